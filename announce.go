@@ -0,0 +1,122 @@
+package main
+
+import (
+    "context"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "golang.org/x/net/ipv4"
+)
+
+// Unsolicited announcements.
+// HELLO|ID=<id>|IP=<ip>|PORT=<port>|V=2|CMDS=..|FW=..|WEB=..|EVENT=boot|ipchange|restart
+// is sent to the announce port (announce_port, default 60001; "off" disables) when the server
+// starts, when the addresses of the host change and before RESTART reboots, so that GUIs
+// listening there update their device list without rescanning. On every interface it goes to
+// the directed broadcast address and the IPv4 discovery group, and over IPv6 to the link-local
+// discovery group; IP is the address of that interface.
+
+const defaultAnnouncePort = "60001"
+
+// addrPollInterval is how often the interface addresses are compared for changes.
+const addrPollInterval = 5 * time.Second
+
+// sendHello announces the device on all interfaces; event tells the reason.
+func sendHello(event string) {
+    port, err := strconv.Atoi(settings.AnnouncePort)
+    if err != nil || port <= 0 {
+        return
+    }
+    conn, err := net.ListenPacket("udp4", ":0")
+    if err != nil {
+        warnf("hello: %v", err)
+        return
+    }
+    defer conn.Close()
+    p := ipv4.NewPacketConn(conn)
+    conn6, err6 := net.ListenPacket("udp6", "[::]:0")
+    if err6 == nil { defer conn6.Close() }
+    group := net.ParseIP(settings.Multicast)
+    group6 := net.ParseIP(settings.Multicast6)
+
+    sent := 0
+    send := func(c net.PacketConn, ip string, to *net.UDPAddr) {
+        if _, err := c.WriteTo([]byte(helloMessage(event, ip)), to); err != nil {
+            debugf("hello to %s: %v", to, err)
+            return
+        }
+        sent++
+    }
+    ifaces, _ := net.Interfaces()
+    for i := range ifaces {
+        ifi := &ifaces[i]
+        if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 { continue }
+        addrs, _ := ifi.Addrs()
+        for _, a := range addrs {
+            ipnet, ok := a.(*net.IPNet)
+            if !ok { continue }
+            if ip4 := ipnet.IP.To4(); ip4 != nil {
+                if ifi.Flags&net.FlagBroadcast != 0 && len(ipnet.Mask) == net.IPv4len {
+                    bcast := make(net.IP, net.IPv4len)
+                    for i := range bcast {
+                        bcast[i] = ip4[i] | ^ipnet.Mask[i]
+                    }
+                    send(conn, ip4.String(), &net.UDPAddr{IP: bcast, Port: port})
+                }
+                if group != nil && group.To4() != nil && ifi.Flags&net.FlagMulticast != 0 && p.SetMulticastInterface(ifi) == nil {
+                    send(conn, ip4.String(), &net.UDPAddr{IP: group, Port: port})
+                }
+            } else if ipnet.IP.IsLinkLocalUnicast() && err6 == nil && group6 != nil && group6.To4() == nil && ifi.Flags&net.FlagMulticast != 0 {
+                send(conn6, ipnet.IP.String(), &net.UDPAddr{IP: group6, Port: port, Zone: ifi.Name})
+            }
+        }
+    }
+    infof("announced HELLO (%s) with %d datagrams to port %d", event, sent, port)
+}
+
+// helloMessage builds the HELLO announcement; ip is the address of the sending interface.
+func helloMessage(event, ip string) string {
+    uid, _ := ensureUniqueID()
+    resp := newResponse("HELLO").set("ID", uid).set("IP", ip).set("PORT", settings.Port).set("V", strconv.Itoa(protoVersion))
+    resp.list("CMDS", commandNames()).set("FW", version)
+    if webPortOpen(settings.WebPort) { resp.set("WEB", settings.WebPort) }
+    return resp.list("OPTS", deviceOpts()).set("FALLBACK", fallbackMode()).set("INST", instanceID).set("HOST", configuredHostname()).set("EVENT", event).encode(nil)
+}
+
+// watchAddresses polls the interface addresses until ctx is done and announces ipchange
+// whenever they differ from the previous poll (DHCP lease, CFG applied, cable moved).
+func watchAddresses(ctx context.Context, interval time.Duration) {
+    last := addrSnapshot()
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+        }
+        cur := addrSnapshot()
+        if cur == last { continue }
+        infof("addresses changed: [%s] -> [%s]", last, cur)
+        last = cur
+        sendHello("ipchange")
+    }
+}
+
+// addrSnapshot lists the non-loopback addresses of all up interfaces in a stable order.
+func addrSnapshot() string {
+    var out []string
+    ifaces, _ := net.Interfaces()
+    for _, ifi := range ifaces {
+        if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 { continue }
+        addrs, _ := ifi.Addrs()
+        for _, a := range addrs {
+            out = append(out, ifi.Name+"="+a.String())
+        }
+    }
+    sort.Strings(out)
+    return strings.Join(out, " ")
+}
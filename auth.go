@@ -0,0 +1,97 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Optional shared-secret authentication for commands registered with Auth (CFG, RESTART).
+// When a key is configured, such requests must carry REQ=<id>, TS=<unix seconds> and
+// SIG=<hex HMAC-SHA256>, where the HMAC is computed over the message text with
+// the SIG field removed, e.g.:
+//   CFG|IP=192.168.1.10|MASK=255.255.255.0|REQ=8f3a|TS=1700000000|SIG=ab12...
+// For v2 JSON requests the HMAC covers request.canonical() and is sent as "sig".
+// Read-only commands (TF, GET_ID, QUERY_NET) never require a signature.
+
+// authMaxSkew bounds the allowed difference between the request TS and local time.
+const authMaxSkew = 5 * time.Minute
+
+// defaultAuthKeyFile is the default auth_key_file; missing file means auth is off.
+const defaultAuthKeyFile = "/etc/udp-server.key"
+
+// loadAuthKey returns the shared secret from AUTH_KEY, or from the file at path
+// (auth_key_file / AUTH_KEY_FILE, default /etc/udp-server.key). An empty result disables auth.
+func loadAuthKey(path string) []byte {
+    if k := strings.TrimSpace(os.Getenv("AUTH_KEY")); k != "" {
+        return []byte(k)
+    }
+    if path == "" {
+        return nil
+    }
+    b, err := os.ReadFile(path)
+    if err != nil {
+        return nil
+    }
+    return []byte(strings.TrimSpace(string(b)))
+}
+
+// checkAuth verifies REQ/TS/SIG of req against key. It returns an empty string when the
+// request is accepted, otherwise a short reason for AUTH_NACK|ERR=<reason>.
+func checkAuth(key []byte, req *request, now time.Time) string {
+    if len(key) == 0 {
+        return ""
+    }
+    if req.Sig == "" {
+        return "NO_SIG"
+    }
+    if req.TS == "" {
+        return "NO_TS"
+    }
+    if req.Req == "" {
+        // without a request ID the replay check cannot tell a repeated request apart
+        return "NO_REQ"
+    }
+    ts, err := strconv.ParseInt(req.TS, 10, 64)
+    if err != nil {
+        return "BAD_TS"
+    }
+    skew := now.Sub(time.Unix(ts, 0))
+    if skew < 0 { skew = -skew }
+    if skew > authMaxSkew {
+        return "STALE_TS"
+    }
+    want := signMessage(key, req.Signed)
+    got, err := hex.DecodeString(strings.ToLower(req.Sig))
+    if err != nil || !hmac.Equal(got, want) {
+        return "BAD_SIG"
+    }
+    return ""
+}
+
+// signMessage computes HMAC-SHA256 of msg with key.
+func signMessage(key []byte, msg string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(msg))
+    return mac.Sum(nil)
+}
+
+// splitSig removes the SIG=... field from a pipe-delimited message and returns
+// the remaining text (the signed content) and the signature value.
+func splitSig(msg string) (signed, sig string) {
+    parts := strings.Split(msg, "|")
+    kept := parts[:0]
+    for _, p := range parts {
+        kv := strings.SplitN(p, "=", 2)
+        if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "SIG") {
+            sig = strings.TrimSpace(kv[1])
+            continue
+        }
+        kept = append(kept, p)
+    }
+    return strings.Join(kept, "|"), sig
+}
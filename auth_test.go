@@ -0,0 +1,90 @@
+package main
+
+import (
+    "encoding/hex"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestCheckAuth(t *testing.T) {
+    key := []byte("s3cret")
+    now := time.Unix(1700000000, 0)
+    ts := strconv.FormatInt(now.Unix(), 10)
+    sign := func(msg string) string { return msg + "|SIG=" + hex.EncodeToString(signMessage(key, msg)) }
+    signJSON := func(canonical, env string) string {
+        return strings.Replace(env, "SIG", hex.EncodeToString(signMessage(key, canonical)), 1)
+    }
+    tests := []struct {
+        name string
+        key  []byte
+        msg  string
+        want string
+    }{
+        {"no key", nil, "CFG|IP=10.0.0.5", ""},
+        {"signed", key, sign("CFG|IP=10.0.0.5|REQ=ab|TS=" + ts), ""},
+        {"sig in the middle", key, "CFG|SIG=" + hex.EncodeToString(signMessage(key, "CFG|IP=10.0.0.5|REQ=ab|TS="+ts)) + "|IP=10.0.0.5|REQ=ab|TS=" + ts, ""},
+        {"upper-case sig", key, "CFG|REQ=ab|TS=" + ts + "|SIG=" + strings.ToUpper(hex.EncodeToString(signMessage(key, "CFG|REQ=ab|TS="+ts))), ""},
+        {"skew within limit", key, sign("CFG|REQ=ab|TS=" + strconv.FormatInt(now.Unix()-299, 10)), ""},
+        {"no sig", key, "CFG|IP=10.0.0.5|REQ=ab|TS=" + ts, "NO_SIG"},
+        {"no ts", key, sign("CFG|IP=10.0.0.5|REQ=ab"), "NO_TS"},
+        {"no req", key, sign("CFG|IP=10.0.0.5|TS=" + ts), "NO_REQ"},
+        {"bad ts", key, sign("CFG|IP=10.0.0.5|REQ=ab|TS=now"), "BAD_TS"},
+        {"old ts", key, sign("CFG|REQ=ab|TS=" + strconv.FormatInt(now.Unix()-301, 10)), "STALE_TS"},
+        {"future ts", key, sign("CFG|REQ=ab|TS=" + strconv.FormatInt(now.Unix()+301, 10)), "STALE_TS"},
+        {"tampered", key, strings.Replace(sign("CFG|IP=10.0.0.5|REQ=ab|TS="+ts), "10.0.0.5", "10.0.0.6", 1), "BAD_SIG"},
+        {"other key", key, "CFG|REQ=ab|TS=" + ts + "|SIG=" + hex.EncodeToString(signMessage([]byte("other"), "CFG|REQ=ab|TS="+ts)), "BAD_SIG"},
+        {"not hex", key, "CFG|REQ=ab|TS=" + ts + "|SIG=xyz", "BAD_SIG"},
+        {"json", key, signJSON("CFG|DNS=8.8.8.8,1.1.1.1|IP=10.0.0.5|REQ=ab|TS="+ts,
+            `{"v":2,"cmd":"cfg","req":"ab","ts":`+ts+`,"args":{"ip":"10.0.0.5","dns":["8.8.8.8","1.1.1.1"]},"sig":"SIG"}`), ""},
+        {"json tampered", key, signJSON("CFG|IP=10.0.0.5|REQ=ab|TS="+ts, `{"v":2,"cmd":"cfg","req":"ab","ts":`+ts+`,"args":{"ip":"10.0.0.6"},"sig":"SIG"}`), "BAD_SIG"},
+        {"json no req", key, signJSON("CFG|IP=10.0.0.5|REQ=|TS="+ts, `{"v":2,"cmd":"cfg","ts":`+ts+`,"args":{"ip":"10.0.0.5"},"sig":"SIG"}`), "NO_REQ"},
+        // fields moved into a value must not keep the signature of the original request
+        {"json fields in a value", key, signJSON("CFG|ID=X|IP=10.0.0.5|REQ=ab|TS="+ts,
+            `{"v":2,"cmd":"cfg","req":"ab","ts":`+ts+`,"args":{"id":"X|IP=10.0.0.5"},"sig":"SIG"}`), "BAD_SIG"},
+        {"json list in a value", key, signJSON("CFG|DNS=8.8.8.8,1.1.1.1|REQ=ab|TS="+ts,
+            `{"v":2,"cmd":"cfg","req":"ab","ts":`+ts+`,"args":{"dns":"8.8.8.8,1.1.1.1"},"sig":"SIG"}`), "BAD_SIG"},
+    }
+    for _, tt := range tests {
+        req, err := parseRequest(tt.msg)
+        if err != nil { t.Fatalf("%s: %v", tt.name, err) }
+        if got := checkAuth(tt.key, req, now); got != tt.want {
+            t.Errorf("%s: checkAuth = %q, want %q", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestSplitSig(t *testing.T) {
+    tests := []struct{ msg, signed, sig string }{
+        {"CFG|IP=1.2.3.4|TS=1|SIG=ab", "CFG|IP=1.2.3.4|TS=1", "ab"},
+        {"CFG| sig = ab |IP=1.2.3.4", "CFG|IP=1.2.3.4", "ab"},
+        {"CFG|IP=1.2.3.4", "CFG|IP=1.2.3.4", ""},
+        {"CFG|SIGNAL=1", "CFG|SIGNAL=1", ""},
+    }
+    for _, tt := range tests {
+        if signed, sig := splitSig(tt.msg); signed != tt.signed || sig != tt.sig {
+            t.Errorf("splitSig(%q) = %q, %q, want %q, %q", tt.msg, signed, sig, tt.signed, tt.sig)
+        }
+    }
+}
+
+// TestDispatchForgedEnvelope moves REQ of a signed v2 request into an argument value and drops
+// "req", which gave the same signed text before the canonical form escaped its separators.
+func TestDispatchForgedEnvelope(t *testing.T) {
+    saved := settings
+    t.Cleanup(func() { settings = saved })
+    settings.AuthKey = []byte("s3cret")
+    ts := strconv.FormatInt(time.Now().Unix(), 10)
+    sig := hex.EncodeToString(signMessage(settings.AuthKey, "CFG|ID=X|IP=10.0.0.5|REQ=ab|TS="+ts))
+    for _, msg := range []string{
+        `{"v":2,"cmd":"cfg","ts":` + ts + `,"args":{"id":"X|IP=10.0.0.5|REQ=ab"},"sig":"` + sig + `"}`,
+        `{"v":2,"cmd":"cfg","req":"cd","ts":` + ts + `,"args":{"id":"X|IP=10.0.0.5|REQ=ab"},"sig":"` + sig + `"}`,
+    } {
+        req, err := parseRequest(msg)
+        if err != nil { t.Fatal(err) }
+        if resp := dispatch(req); resp == nil || resp.Status != "AUTH_NACK" {
+            t.Errorf("dispatch(%s) = %+v, want AUTH_NACK", msg, resp)
+        }
+    }
+}
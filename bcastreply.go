@@ -0,0 +1,46 @@
+package main
+
+import (
+    "log"
+    "net"
+
+    "golang.org/x/net/ipv4"
+)
+
+// Broadcast replies.
+// A device statically set to 10.0.0.5/24 still hears the TF broadcast of a client at 192.168.1.20
+// on the same segment, but its unicast reply goes to a gateway (or nowhere). When the sender of an
+// IPv4 request is on none of the device's subnets, the reply is also sent to 255.255.255.255 at the
+// client's port, out of the interface the request arrived on, with TO=<client ip>:<port> added so
+// that other clients ignore it. The unicast reply is still sent for clients behind a router.
+// broadcast_reply (BROADCAST_REPLY) = false turns this off.
+
+// offSubnet reports whether from is an IPv4 sender outside every local subnet (or 0.0.0.0,
+// which cannot be answered by unicast at all).
+func offSubnet(from net.Addr) bool {
+    u, ok := from.(*net.UDPAddr)
+    if !ok { return false }
+    ip := u.IP.To4()
+    if ip == nil || ip.IsLoopback() { return false }
+    if ip.IsUnspecified() { return true }
+    addrs, err := net.InterfaceAddrs()
+    if err != nil { return false }
+    for _, a := range addrs {
+        if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && n.Contains(ip) { return false }
+    }
+    return true
+}
+
+// sendBroadcastReply broadcasts resp, addressed with TO=, to the port the request came from.
+func sendBroadcastReply(pkt packet, resp *response, req *request) {
+    u := pkt.from.(*net.UDPAddr)
+    out := resp.set("TO", u.String()).encode(req)
+    dst := &net.UDPAddr{IP: net.IPv4bcast, Port: u.Port}
+    var cm *ipv4.ControlMessage
+    if pkt.ifIndex > 0 { cm = &ipv4.ControlMessage{IfIndex: pkt.ifIndex} }
+    if _, err := ipv4.NewPacketConn(pkt.conn).WriteTo([]byte(out), cm, dst); err != nil {
+        log.Printf("broadcast reply to %s: %v", u, err)
+        return
+    }
+    infof("broadcast reply to %s (off-subnet): %q", u, out)
+}
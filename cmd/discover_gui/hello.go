@@ -0,0 +1,110 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "sync"
+
+    "golang.org/x/net/ipv4"
+    "golang.org/x/net/ipv6"
+)
+
+// HELLO announcements (see the server's announce.go).
+// Devices send HELLO|ID=..|IP=..|PORT=..|V=..|CMDS=..|FW=..|WEB=..|EVENT=boot|ipchange|restart
+// to port 60001 by broadcast and to the discovery groups when they start, when their address
+// changes and before they reboot. listenHello receives them in the background so that the
+// device table follows the devices without rescanning.
+
+const helloPort = 60001
+
+// listenHello receives announcements on helloPort over IPv4 (broadcast and discoveryGroup) and
+// IPv6 (discoveryGroup6) and calls onHello for each, one call at a time. It returns an error
+// only when neither socket could be opened.
+func listenHello(onHello func(d Device, event string)) error {
+    var mu sync.Mutex
+    serve := func(c net.PacketConn) {
+        buf := make([]byte, 2048)
+        for {
+            n, from, err := c.ReadFrom(buf)
+            if err != nil {
+                fmt.Printf("HELLO listener stopped: %v\n", err)
+                return
+            }
+            msg := strings.TrimSpace(string(buf[:n]))
+            if !strings.HasPrefix(strings.ToUpper(msg), "HELLO|") { continue }
+            d, event := parseHello(from, msg)
+            if d.ID == "" { continue }
+            mu.Lock()
+            onHello(d, event)
+            mu.Unlock()
+        }
+    }
+
+    var errs []string
+    if c, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", helloPort)); err == nil {
+        p := ipv4.NewPacketConn(c)
+        forMulticastIfaces(func(ifi *net.Interface) { _ = p.JoinGroup(ifi, &net.UDPAddr{IP: net.ParseIP(discoveryGroup)}) })
+        go serve(c)
+    } else {
+        errs = append(errs, err.Error())
+    }
+    if c, err := net.ListenPacket("udp6", fmt.Sprintf("[::]:%d", helloPort)); err == nil {
+        p := ipv6.NewPacketConn(c)
+        forMulticastIfaces(func(ifi *net.Interface) { _ = p.JoinGroup(ifi, &net.UDPAddr{IP: net.ParseIP(discoveryGroup6)}) })
+        go serve(c)
+    } else {
+        errs = append(errs, err.Error())
+    }
+    if len(errs) == 2 { return errors.New(strings.Join(errs, "; ")) }
+    return nil
+}
+
+// forMulticastIfaces calls f for every up, multicast-capable interface
+func forMulticastIfaces(f func(ifi *net.Interface)) {
+    ifaces, _ := net.Interfaces()
+    for i := range ifaces {
+        if ifaces[i].Flags&net.FlagUp == 0 || ifaces[i].Flags&net.FlagMulticast == 0 { continue }
+        f(&ifaces[i])
+    }
+}
+
+// parseHello parses an announcement like a TF reply; the contact address is the sender's
+// (IPv6 link-local senders keep their zone). Via is "hello".
+func parseHello(from net.Addr, msg string) (Device, string) {
+    d := parseDiscovery(from, msg)
+    d.Via = "hello"
+    event := ""
+    for _, p := range strings.Split(msg, "|")[1:] {
+        if kv := strings.SplitN(p, "=", 2); len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "EVENT") {
+            event = strings.ToLower(strings.TrimSpace(kv[1]))
+        }
+    }
+    return d, event
+}
+
+// applyHello merges an announcement into list and returns the new list and the index of the
+// device. A known ID is updated in place, the announced values winning (a new address of the
+// same family replaces the old one, e.g. after CFG); an unknown ID is appended.
+func applyHello(list []Device, d Device) ([]Device, int) {
+    for i, old := range list {
+        if old.ID != d.ID { continue }
+        v6, oldV6 := strings.Contains(d.IP, ":"), strings.Contains(old.IP, ":")
+        switch {
+        case v6 && !oldV6:
+            // keep the IPv4 contact address, remember the IPv6 one
+            d.IP, d.IP6 = old.IP, d.IP
+            list[i] = mergeDevice(d, old)
+        case !v6 && oldV6:
+            d.IP6 = old.IP
+            list[i] = mergeDevice(d, old)
+        default:
+            list[i] = mergeDevice(d, old)
+        }
+        // An announcement reports the current mode; no FALLBACK= means the device left it
+        list[i].Fallback = d.Fallback
+        return list, i
+    }
+    return append(list, d), len(list)
+}
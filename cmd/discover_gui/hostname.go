@@ -0,0 +1,44 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "regexp"
+    "strings"
+    "time"
+)
+
+// Hostname. Devices report their configured hostname as HOST= in TF and HELLO and advertise
+//   SET_HOSTNAME|NAME=cam01|APPLY=1 -> SET_HOSTNAME_ACK|NAME=cam01|APPLY_ACK  (or SET_HOSTNAME_NACK|ERR=BAD_NAME)
+// SET_HOSTNAME is signed like CFG; APPLY=1 also makes the name the running hostname.
+
+// hostLabelRe matches one RFC 1123 label, as the device checks it
+var hostLabelRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// isValidHostname checks an RFC 1123 host name of at most 64 characters (the device's limit)
+func isValidHostname(name string) bool {
+    if name == "" || len(name) > 64 || net.ParseIP(name) != nil { return false }
+    for _, l := range strings.Split(name, ".") {
+        if !hostLabelRe.MatchString(l) { return false }
+    }
+    return true
+}
+
+// sendSetHostname sets the hostname of d and applies it live; SET_HOSTNAME_NACK becomes an error
+func sendSetHostname(d Device, name, key string, timeout time.Duration) (string, error) {
+    msg, err := exchange(d, newDevRequest("SET_HOSTNAME").set("NAME", name).set("APPLY", "1"), key, true, timeout, func(up string) bool { return strings.HasPrefix(up, "SET_HOSTNAME_") })
+    if err != nil { return msg, err }
+    if strings.HasPrefix(strings.ToUpper(msg), "SET_HOSTNAME_NACK") {
+        return msg, fmt.Errorf("SET_HOSTNAME_NACK: %s", replyField(msg, "ERR"))
+    }
+    return msg, nil
+}
+
+func hostnameColumnText(lang string) string      { if lang == "zh" { return "主机名" } ; return "HOSTNAME" }
+func hostnamePlaceholder(lang string) string     { if lang == "zh" { return "主机名 (如 cam01)" } ; return "Hostname (e.g. cam01)" }
+func hostnameButtonText(lang string) string      { if lang == "zh" { return "修改主机名" } ; return "Set hostname" }
+func invalidHostname(lang string) string         { if lang == "zh" { return "主机名无效：仅限字母、数字和连字符，每段 1-63 个字符，总长不超过 64" } ; return "Invalid hostname: letters, digits and hyphens, 1-63 characters per label, at most 64 in total" }
+func statusSettingHostname(lang string) string   { if lang == "zh" { return "正在修改主机名..." } ; return "Setting hostname..." }
+func hostnameSetStatus(lang, name string) string { if lang == "zh" { return "主机名已修改为 " + name } ; return "Hostname set to " + name }
+func hostnameNotLive(lang string) string         { if lang == "zh" { return "（已写入，重启后生效）" } ; return " (saved, effective after reboot)" }
+func hostnameFailed(lang string) string          { if lang == "zh" { return "修改主机名失败: " } ; return "Set hostname failed: " }
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "strings"
+    "time"
+)
+
+// Interface selection. Devices advertising LIST_IF report their interfaces as
+//   IF_LIST|IFS=eth0,eth1|DEFAULT=eth0|BACKEND=..|eth0.MAC=..|eth0.STATE=up|eth0.ADDR=a,b|eth0.FILE=..
+// and accept IF=<name> on QUERY_NET and CFG; older devices only manage their default interface.
+// VLANs and bonds add eth0.100.KIND=vlan|eth0.100.PARENT=eth0|eth0.100.VLAN=100 and
+// bond0.KIND=bond|bond0.SLAVES=eth1,eth2|bond0.MODE=active-backup|bond0.ACTIVE=eth1|eth1.MASTER=bond0.
+
+// ifaceInfo is one interface reported by LIST_IF
+type ifaceInfo struct {
+    Name, MAC, State, File string
+    Addrs                  []string
+    Kind, Parent, VLAN     string   // device type (vlan, bond, wlan, ...) and the parent and id of a VLAN
+    Master                 string   // bond the interface is a slave of
+    Slaves                 []string // slaves of a bond
+    Mode, Active           string   // bond mode and active slave
+}
+
+// listInterfaces asks the device for its interfaces; def is the one it uses without IF=
+func listInterfaces(d Device, timeout time.Duration) (ifs []ifaceInfo, def string, err error) {
+    msg, err := exchange(d, newDevRequest("LIST_IF"), "", false, timeout, func(up string) bool { return strings.HasPrefix(up, "IF_LIST") })
+    if err != nil { return nil, "", err }
+    ifs, def = parseIfList(msg)
+    return ifs, def, nil
+}
+
+// parseIfList parses an IF_LIST reply. Per-interface keys are <name>.<FIELD>; v2 replies arrive
+// upper-cased, so names are matched case-insensitively.
+func parseIfList(msg string) (ifs []ifaceInfo, def string) {
+    fields := map[string]string{}
+    for _, p := range strings.Split(msg, "|")[1:] {
+        kv := strings.SplitN(p, "=", 2)
+        if len(kv) != 2 { continue }
+        fields[strings.ToUpper(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+    }
+    for _, n := range strings.Split(fields["IFS"], ",") {
+        if n = strings.TrimSpace(n); n == "" { continue }
+        key := strings.ToUpper(n) + "."
+        info := ifaceInfo{Name: n, MAC: fields[key+"MAC"], State: fields[key+"STATE"], File: fields[key+"FILE"]}
+        if a := fields[key+"ADDR"]; a != "" { info.Addrs = strings.Split(a, ",") }
+        info.Kind, info.Parent, info.VLAN, info.Master = fields[key+"KIND"], fields[key+"PARENT"], fields[key+"VLAN"], fields[key+"MASTER"]
+        info.Mode, info.Active = fields[key+"MODE"], fields[key+"ACTIVE"]
+        if s := fields[key+"SLAVES"]; s != "" { info.Slaves = strings.Split(s, ",") }
+        ifs = append(ifs, info)
+    }
+    return ifs, fields["DEFAULT"]
+}
+
+// ifaceNames returns the names of ifs
+func ifaceNames(ifs []ifaceInfo) []string {
+    out := make([]string, 0, len(ifs))
+    for _, i := range ifs { out = append(out, i.Name) }
+    return out
+}
+
+// findIface returns the entry called name, if any
+func findIface(ifs []ifaceInfo, name string) (ifaceInfo, bool) {
+    for _, i := range ifs {
+        if i.Name == name { return i, true }
+    }
+    return ifaceInfo{}, false
+}
+
+// withIface adds IF=<name> to a QUERY_NET / CFG request for devices that support interface selection
+func withIface(d Device, req *devRequest, iface string) *devRequest {
+    if iface == "" || !d.advertises("LIST_IF") { return req }
+    return req.set("IF", iface)
+}
+
+// ifaceDetailText summarizes an interface for the interface card: "52:54:00:.. · up · 192.168.1.10/24",
+// with its topology first, e.g. "VLAN 100 @ eth0 · .." or "bond active-backup [eth1*, eth2] · .."
+func ifaceDetailText(i ifaceInfo) string {
+    var parts []string
+    if t := ifaceTopologyText(i); t != "" { parts = append(parts, t) }
+    if i.MAC != "" { parts = append(parts, i.MAC) }
+    if i.State != "" { parts = append(parts, i.State) }
+    for _, a := range i.Addrs {
+        if !strings.HasPrefix(strings.ToLower(a), "fe80:") { parts = append(parts, a); break }
+    }
+    return strings.Join(parts, " · ")
+}
+
+// ifaceTopologyText describes the place of an interface among VLANs and bonds; the active slave
+// of a bond is marked with "*"
+func ifaceTopologyText(i ifaceInfo) string {
+    switch {
+    case i.Kind == "vlan":
+        t := "VLAN " + i.VLAN
+        if i.Parent != "" { t += " @ " + i.Parent }
+        return strings.TrimSpace(t)
+    case i.Kind == "bond":
+        var slaves []string
+        for _, s := range i.Slaves {
+            if s == i.Active { s += "*" }
+            slaves = append(slaves, s)
+        }
+        return strings.TrimSpace("bond " + i.Mode + " [" + strings.Join(slaves, ", ") + "]")
+    case i.Master != "":
+        return "→ " + i.Master
+    }
+    return i.Kind
+}
@@ -2,12 +2,18 @@ package main
 
 import (
     "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
     "fmt"
     "net"
     "net/http"
     "path/filepath"
     "os"
     "os/exec"
+    "sort"
+    "strconv"
     "strings"
     "time"
     "sync"
@@ -19,6 +25,7 @@ import (
     "fyne.io/fyne/v2/storage"
     "fyne.io/fyne/v2/theme"
     "fyne.io/fyne/v2/widget"
+    "golang.org/x/net/ipv4"
     // webview is moved to a dedicated helper binary to avoid UI thread conflicts
 )
 
@@ -147,14 +154,58 @@ func (l fixedSplitLayout) MinSize(objs []fyne.CanvasObject) fyne.Size {
 }
 
 type Device struct {
-    IP    string
+    IP    string // contact address: IPv4 when available, else IPv6 (link-local with zone, e.g. fe80::1%eth0)
+    IP6   string // IPv6 address the device also answered from, if any
     Port  string
     ID    string
+    Proto int // protocol version from TF reply (V=..); 1 if not advertised
+    // Capabilities advertised in the TF reply (empty on older devices)
+    Cmds    []string // supported commands (CMDS=TF,GET_ID,...)
+    FW      string   // firmware/build version (FW=..)
+    WebPort string   // device web page port (WEB=..)
+    Via     string   // how discovery reached the device (VIA=multicast/broadcast/unicast), comma-joined if several
+    Opts    []string // optional protocol features (OPTS=TARGET,BCAST_REPLY)
+    // The device answered by broadcast (TO=..): it is not on the client's subnet
+    OffSubnet bool
+    Fallback  string // FALLBACK=linklocal: the device only has a 169.254 fallback address
+    Inst      string // server instance (INST=..): differs between devices that share an ID
+    Hostname  string // configured hostname (HOST=..)
+}
+
+// hasOpt reports whether the device advertised the optional feature opt (OPTS=..).
+func (d Device) hasOpt(opt string) bool {
+    for _, o := range d.Opts {
+        if strings.EqualFold(o, opt) { return true }
+    }
+    return false
+}
+
+// supports reports whether the device advertised cmd. Devices that advertise nothing
+// (older firmware) are assumed to support everything.
+func (d Device) supports(cmd string) bool {
+    if len(d.Cmds) == 0 { return true }
+    for _, c := range d.Cmds {
+        if strings.EqualFold(c, cmd) { return true }
+    }
+    return false
+}
+
+// advertises reports whether the device explicitly listed cmd (unlike supports, false for older devices)
+func (d Device) advertises(cmd string) bool { return len(d.Cmds) > 0 && d.supports(cmd) }
+
+// webPort returns the advertised web page port; older devices use 8000, and devices that
+// advertise capabilities without WEB have no web page ("").
+func (d Device) webPort() string {
+    if d.WebPort != "" { return d.WebPort }
+    if len(d.Cmds) == 0 { return "8000" }
+    return ""
 }
 
 func main() {
     a := app.New()
     lang := "zh" // default language: Chinese
+    authKey := "" // shared secret for signing CFG/RESTART (configured in Settings)
+    useMDNS := true // also browse mDNS/DNS-SD while scanning (configured in Settings)
     w := a.NewWindow(windowTitle(lang))
     w.Resize(fyne.NewSize(1024, 600))
     // Disable window resizing by user
@@ -173,13 +224,13 @@ func main() {
     devices := []Device{}
     selectedIndex := -1
 
-    // Widgets: Left Table with 3 columns (ID, IP, PORT) - preset 5 rows for grid lines
+    // Widgets: Left Table with 4 columns (ID, IP, PORT, HOSTNAME) - preset 5 rows for grid lines
     minRows := 5
     table := widget.NewTable(
         func() (int, int) { 
             rows := len(devices) + 1 // +1 for header
             if rows < minRows + 1 { rows = minRows + 1 } // ensure minimum rows for grid lines
-            return rows, 3 
+            return rows, 4 
         },
         func() fyne.CanvasObject { return widget.NewLabel("") },
         func(id widget.TableCellID, o fyne.CanvasObject) {
@@ -192,6 +243,8 @@ func main() {
                     lbl.SetText("IP")
                 case 2:
                     lbl.SetText("PORT")
+                case 3:
+                    lbl.SetText(hostnameColumnText(lang))
                 }
                 return
             }
@@ -204,6 +257,8 @@ func main() {
                     lbl.SetText(d.IP)
                 case 2:
                     lbl.SetText(d.Port)
+                case 3:
+                    lbl.SetText(d.Hostname)
                 }
             } else {
                 // Empty rows for grid lines
@@ -212,17 +267,49 @@ func main() {
         },
     )
     // Fix table layout: set reasonable column widths and row height
-    table.SetColumnWidth(0, 220) // ID
+    table.SetColumnWidth(0, 200) // ID
     table.SetColumnWidth(1, 140) // IP
-    table.SetColumnWidth(2, 80)  // PORT
+    table.SetColumnWidth(2, 70)  // PORT
+    table.SetColumnWidth(3, 180) // HOSTNAME
     table.SetRowHeight(0, 28)
     // Right-side selected host & interface indicators (readable labels inside bordered groups)
     selectedIPLabel := widget.NewLabel("")
+    selectedFWLabel := widget.NewLabel("")
     selectedIfaceLabel := widget.NewLabel("")
     hostTitleLabel := widget.NewLabel(selectedHostTitle(lang))
     ifaceTitleLabel := widget.NewLabel(selectedIfaceLabelTitle(lang))
-    hostCard := widget.NewCard("", "", container.NewVBox(hostTitleLabel, selectedIPLabel))
-    ifaceCard := widget.NewCard("", "", container.NewVBox(ifaceTitleLabel, selectedIfaceLabel))
+    hostCard := widget.NewCard("", "", container.NewVBox(hostTitleLabel, selectedIPLabel, selectedFWLabel))
+    // Interface selector: filled from LIST_IF when the device supports it (see iface.go), else
+    // shows the interface QUERY_NET reports
+    var ifaces []ifaceInfo
+    // Values of the last query; DOMAINS/MTU/NTP/ROUTES are only sent when the form differs from them
+    var lastNet netParams
+    domainsEntry := widget.NewEntry()
+    mtuEntry := widget.NewEntry()
+    ntpEntry := widget.NewEntry()
+    routesEd := newRouteEditor(lang)
+    forgetNet := func() {
+        lastNet = netParams{}
+        domainsEntry.SetText("")
+        mtuEntry.SetText("")
+        ntpEntry.SetText("")
+        routesEd.SetRoutes("")
+    }
+    ifaceSelect := widget.NewSelect(nil, func(name string) {
+        if i, ok := findIface(ifaces, name); ok { selectedIfaceLabel.SetText(ifaceDetailText(i)) }
+        if name != lastNet.Iface { forgetNet() }
+    })
+    ifaceSelect.PlaceHolder = ifacePlaceholder(lang)
+    ifaceSelect.Disable()
+    resetIfaces := func() {
+        ifaces = nil
+        ifaceSelect.Options = nil
+        ifaceSelect.ClearSelected()
+        ifaceSelect.Disable()
+        selectedIfaceLabel.SetText("")
+        forgetNet()
+    }
+    ifaceCard := widget.NewCard("", "", container.NewVBox(ifaceTitleLabel, ifaceSelect, selectedIfaceLabel))
     // Predeclare config inputs and action buttons used in selection callback for autofill/state
     var newIPEntry *widget.Entry
     var queryBtn *widget.Button
@@ -232,11 +319,24 @@ func main() {
     var reservedBtn2 *widget.Button
     var reservedBtn3 *widget.Button
     var hintLabel *widget.Label
+    var wifi *wifiPane
+    // Hostname of the selected device, changed with SET_HOSTNAME (see hostname.go)
+    hostnameEntry := widget.NewEntry()
+    hostnameEntry.SetPlaceHolder(hostnamePlaceholder(lang))
+    var hostnameBtn *widget.Button
+    resetHostname := func() {
+        hostnameEntry.SetText("")
+        if hostnameBtn != nil { hostnameBtn.Disable() }
+    }
 
     table.OnSelected = func(id widget.TableCellID) {
         if id.Row == 0 { // header row not selectable
             selectedIndex = -1
             selectedIPLabel.SetText("")
+            selectedFWLabel.SetText("")
+            resetIfaces()
+            wifi.SetDevice(nil)
+            resetHostname()
             if queryBtn != nil { queryBtn.Disable() }
             if applyBtn != nil { applyBtn.Disable() }
             if hintLabel != nil { hintLabel.Show() }
@@ -245,23 +345,43 @@ func main() {
         idx := id.Row - 1
         if idx >= 0 && idx < len(devices) {
             selectedIndex = idx
+            d := devices[idx]
             // Show selected host IP clearly
-            selectedIPLabel.SetText(devices[idx].IP)
+            selectedIPLabel.SetText(hostAddrText(d))
+            selectedFWLabel.SetText(deviceInfoText(lang, d))
             // Auto-fill current known network parameters to config inputs
-            newIPEntry.SetText(devices[idx].IP)
+            newIPEntry.SetText(d.IP)
+            // Offer the device's interfaces, preselecting the one it manages by default
+            resetIfaces()
+            wifi.SetDevice(&d)
+            if d.advertises("LIST_IF") {
+                go func() {
+                    ifs, def, err := listInterfaces(d, 2*time.Second)
+                    if err != nil || selectedIndex != idx { return }
+                    ifaces = ifs
+                    wifi.SetIface(ifs)
+                    ifaceSelect.Options = ifaceNames(ifs)
+                    ifaceSelect.Enable()
+                    if def != "" { ifaceSelect.SetSelected(def) } else { ifaceSelect.Refresh() }
+                }()
+            }
             // If device later supports reporting mask/gw/dns via protocol,
             // we can auto-fill them here.
-            if queryBtn != nil { queryBtn.Enable() }
-            if applyBtn != nil { applyBtn.Enable() }
-            if restartBtn != nil { restartBtn.Enable() }
-            // Pre-check device page availability on port 8000 before enabling View button
+            // Enable actions according to the capabilities the device reported
+            setEnabled(queryBtn, d.supports("QUERY_NET"))
+            setEnabled(applyBtn, d.supports("CFG"))
+            setEnabled(restartBtn, d.supports("RESTART"))
+            hostnameEntry.SetText(d.Hostname)
+            setEnabled(hostnameBtn, d.advertises("SET_HOSTNAME"))
+            // Pre-check device page availability on its web port before enabling View button
             if viewBtn != nil {
                 viewBtn.Disable()
-                ip := devices[idx].IP
-                go func() {
-                    online := isDevicePageOnline(ip, 1500*time.Millisecond)
-                    if online { viewBtn.Enable() } else { viewBtn.Disable() }
-                }()
+                if wp := d.webPort(); wp != "" {
+                    go func() {
+                        online := isDevicePageOnline(d.IP, wp, 1500*time.Millisecond)
+                        if online { viewBtn.Enable() } else { viewBtn.Disable() }
+                    }()
+                }
             }
             // Keep hint area height stable: show empty text instead of hiding
             if hintLabel != nil { hintLabel.SetText(" ") }
@@ -271,6 +391,10 @@ func main() {
         if id.Row == 0 { return }
         selectedIndex = -1
         selectedIPLabel.SetText("")
+        selectedFWLabel.SetText("")
+        resetIfaces()
+        wifi.SetDevice(nil)
+        resetHostname()
         if queryBtn != nil { queryBtn.Disable() }
         if applyBtn != nil { applyBtn.Disable() }
         if viewBtn != nil { viewBtn.Disable() }
@@ -286,13 +410,29 @@ func main() {
     queryLoadingMgr.SetStatusWidget(status)
     configLoadingMgr.SetStatusWidget(status)
     restartLoadingMgr.SetStatusWidget(status)
+    // Wi-Fi tab (see wifi.go); WIFI_SET is signed with the admin key like CFG
+    wifi = newWifiPane(lang, w, status, func() string { return authKey })
+
+    // Live updates: devices announce themselves with HELLO (see hello.go)
+    if err := listenHello(func(d Device, event string) {
+        var idx int
+        devices, idx = applyHello(devices, d)
+        table.Refresh()
+        if idx == selectedIndex {
+            selectedIPLabel.SetText(hostAddrText(devices[idx]))
+            selectedFWLabel.SetText(deviceInfoText(lang, devices[idx]))
+        }
+        status.SetText(helloStatus(lang, d.ID, event))
+    }); err != nil {
+        fmt.Printf("HELLO listener disabled: %v\n", err)
+    }
 
     // Discovery button
     scanBtn := widget.NewButtonWithIcon(scanButtonText(lang), theme.SearchIcon(), func() {
         scanLoadingMgr.StartLoading()
         scanLoadingMgr.UpdateStatus(statusScanning(lang))
         go func() {
-            found, err := discover("60000", 2*time.Second)
+            found, err := discover("60000", 2*time.Second, useMDNS)
             
             scanLoadingMgr.FinishLoading(func() {
                 if err != nil {
@@ -304,11 +444,20 @@ func main() {
                 // reset current selection indicator after a fresh scan
                 selectedIndex = -1
                 selectedIPLabel.SetText("")
+                selectedFWLabel.SetText("")
+                resetIfaces()
+                wifi.SetDevice(nil)
+                resetHostname()
                 if queryBtn != nil { queryBtn.Disable() }
                 if applyBtn != nil { applyBtn.Disable() }
                 if viewBtn != nil { viewBtn.Disable() }
+                if restartBtn != nil { restartBtn.Disable() }
                 if hintLabel != nil { hintLabel.Show() }
                 scanLoadingMgr.UpdateStatus(foundFmt(lang, len(devices)))
+                if c := idCollisions(devices); len(c) > 0 {
+                    scanLoadingMgr.UpdateStatus(foundFmt(lang, len(devices)) + idCollisionStatus(lang, len(c)))
+                    dialog.NewInformation(idCollisionTitle(lang), idCollisionText(lang, c), w).Show()
+                }
             })
         }()
     })
@@ -326,6 +475,13 @@ func main() {
     gatewayEntry.SetPlaceHolder(gatewayPlaceholder(lang))
     dnsEntry := widget.NewEntry()
     dnsEntry.SetPlaceHolder(dnsPlaceholder(lang))
+    ip6Entry := widget.NewEntry()
+    ip6Entry.SetPlaceHolder(ip6Placeholder(lang))
+    gw6Entry := widget.NewEntry()
+    gw6Entry.SetPlaceHolder(gw6Placeholder(lang))
+    domainsEntry.SetPlaceHolder(domainsPlaceholder(lang))
+    mtuEntry.SetPlaceHolder(mtuPlaceholder(lang))
+    ntpEntry.SetPlaceHolder(ntpPlaceholder(lang))
 
     // Network mode select: static or dhcp
     modeSelect := widget.NewSelect([]string{"static", "dhcp"}, func(v string) {
@@ -334,11 +490,23 @@ func main() {
             netmaskEntry.Disable()
             gatewayEntry.Disable()
             dnsEntry.Disable()
+            ip6Entry.Disable()
+            gw6Entry.Disable()
+            domainsEntry.Disable()
+            mtuEntry.Disable()
+            ntpEntry.Disable()
+            routesEd.SetEnabled(false)
         } else {
             newIPEntry.Enable()
             netmaskEntry.Enable()
             gatewayEntry.Enable()
             dnsEntry.Enable()
+            ip6Entry.Enable()
+            gw6Entry.Enable()
+            domainsEntry.Enable()
+            mtuEntry.Enable()
+            ntpEntry.Enable()
+            routesEd.SetEnabled(true)
         }
     })
     modeSelect.PlaceHolder = netModeLabel(lang)
@@ -350,11 +518,10 @@ func main() {
             return
         }
         d := devices[selectedIndex]
-        p := parsePort(d.Port, 60000)
         queryLoadingMgr.StartLoading()
         queryLoadingMgr.UpdateStatus(statusQuerying(lang))
         go func() {
-            ip, mask, gw, dns, iface, err := queryNetParams(d.IP, p, 2*time.Second)
+            np, err := queryNetParams(d, ifaceSelect.Selected, 2*time.Second)
             
             queryLoadingMgr.FinishLoading(func() {
                 if err != nil {
@@ -363,11 +530,23 @@ func main() {
                     return
                 }
                 // Autofill entries with returned values (only non-empty)
-                if ip != "" { newIPEntry.SetText(ip) }
-                if mask != "" { netmaskEntry.SetText(mask) }
-                if gw != "" { gatewayEntry.SetText(gw) }
-                if dns != "" { dnsEntry.SetText(dns) }
-                if iface != "" { selectedIfaceLabel.SetText(iface) }
+                if np.IP != "" { newIPEntry.SetText(np.IP) }
+                if np.Mask != "" { netmaskEntry.SetText(np.Mask) }
+                if np.GW != "" { gatewayEntry.SetText(np.GW) }
+                if dns := joinNonEmpty(np.DNS, np.DNS6); dns != "" { dnsEntry.SetText(dns) }
+                if ip6 := np.globalIP6(); ip6 != "" { ip6Entry.SetText(ip6) }
+                if np.GW6 != "" { gw6Entry.SetText(np.GW6) }
+                domainsEntry.SetText(np.Domains)
+                mtuEntry.SetText(np.MTU)
+                ntpEntry.SetText(np.NTP)
+                routesEd.SetRoutes(np.Routes)
+                lastNet = np
+                if np.Iface != "" && len(ifaces) == 0 {
+                    // device without LIST_IF: show the interface it manages (read-only)
+                    ifaceSelect.Options = []string{np.Iface}
+                    ifaceSelect.SetSelected(np.Iface)
+                    selectedIfaceLabel.SetText(np.ifaceText())
+                }
                 queryLoadingMgr.UpdateStatus(queryFilled(lang))
             })
         }()
@@ -381,19 +560,21 @@ func main() {
             return
         }
         d := devices[selectedIndex]
-        p := parsePort(d.Port, 60000)
-        // targetAddr := &net.UDPAddr{IP: net.ParseIP(d.IP), Port: p}
 
         // Validate inputs (if provided)
         ip := strings.TrimSpace(newIPEntry.Text)
         mask := strings.TrimSpace(netmaskEntry.Text)
         gw := strings.TrimSpace(gatewayEntry.Text)
         dns := strings.TrimSpace(dnsEntry.Text)
+        ip6 := strings.TrimSpace(ip6Entry.Text)
+        gw6 := strings.TrimSpace(gw6Entry.Text)
+        extras := netExtras{Domains: domainsEntry.Text, MTU: strings.TrimSpace(mtuEntry.Text), NTP: ntpEntry.Text, Routes: routesEd.Routes()}
+        extraFields := extras.cfgFields(lastNet)
 
         isDHCP := strings.ToLower(modeSelect.Selected) == "dhcp"
 
         if !isDHCP {
-            if ip == "" && mask == "" && gw == "" && dns == "" {
+            if ip == "" && mask == "" && gw == "" && dns == "" && ip6 == "" && gw6 == "" && len(extraFields) == 0 {
                 status.SetText(noParamsProvided(lang))
                 return
             }
@@ -412,29 +593,82 @@ func main() {
                 dialog.NewInformation(errorTitle(lang), invalidGateway(lang), w).Show()
                 return
             }
-            if dns != "" && !isValidIPv4(dns) {
+            if dns != "" && !isValidIPList(dns) {
                 status.SetText(invalidDNS(lang))
                 dialog.NewInformation(errorTitle(lang), invalidDNS(lang), w).Show()
                 return
             }
+            if ip6 != "" && !isValidIPv6CIDR(ip6) {
+                status.SetText(invalidIP6(lang))
+                dialog.NewInformation(errorTitle(lang), invalidIP6(lang), w).Show()
+                return
+            }
+            if gw6 != "" && !isValidIPv6(gw6) {
+                status.SetText(invalidGateway(lang))
+                dialog.NewInformation(errorTitle(lang), invalidGateway(lang), w).Show()
+                return
+            }
+            if extras.MTU != "" && !isValidMTU(extras.MTU) {
+                status.SetText(invalidMTU(lang))
+                dialog.NewInformation(errorTitle(lang), invalidMTU(lang), w).Show()
+                return
+            }
+            if !isValidNameList(extras.Domains) || !isValidNameList(extras.NTP) {
+                status.SetText(invalidNameList(lang))
+                dialog.NewInformation(errorTitle(lang), invalidNameList(lang), w).Show()
+                return
+            }
+            if !routesEd.Valid() {
+                status.SetText(invalidRoute(lang))
+                dialog.NewInformation(errorTitle(lang), invalidRoute(lang), w).Show()
+                return
+            }
         }
         // Confirm before sending
         dialog.NewConfirm(confirmSendConfigTitle(lang), confirmSendConfigMessage(lang), func(ok bool) {
             if !ok { return }
-            msg := buildNetCfgWithMode(isDHCP, ip, mask, gw, dns)
+            req := withIface(d, buildNetCfgWithMode(isDHCP, ip, mask, gw, dns, ip6, gw6, extraFields), ifaceSelect.Selected)
+            // Devices with CFG_CONFIRM apply the change at once and roll back unless we confirm it
+            if d.advertises("CFG_CONFIRM") { req.set("APPLY", "1") }
             configLoadingMgr.StartLoading()
             configLoadingMgr.UpdateStatus(configSending(lang))
             go func() {
-                ack, err := sendCfgAndWaitAck(d.IP, p, []byte(msg), 3*time.Second)
+                ack, err := sendCfgAndWaitAck(d, req, authKey, 3*time.Second)
+                a := parseCfgAck(ack)
+                var moved Device
+                var cerr error
+                if err == nil && a.Pending {
+                    configLoadingMgr.UpdateStatus(applyPendingStatus(lang, a.Confirm))
+                    newIP := ""
+                    if !isDHCP && !strings.Contains(d.IP, ":") { newIP = ip }
+                    moved, cerr = confirmNetApply(d, newIP, a.Txn, authKey, time.Duration(a.Confirm)*time.Second)
+                }
                 configLoadingMgr.FinishLoading(func() {
                     if err != nil {
-                        configLoadingMgr.UpdateStatus(sendFailed(lang) + err.Error())
-                        dialog.NewInformation(errorTitle(lang), sendFailed(lang)+err.Error(), w).Show()
+                        text := sendFailed(lang) + err.Error()
+                        if ae, ok := err.(*authError); ok { text = authRejected(lang) + ae.reason }
+                        configLoadingMgr.UpdateStatus(text)
+                        dialog.NewInformation(errorTitle(lang), text, w).Show()
+                        return
+                    }
+                    if !a.Pending {
+                        configLoadingMgr.UpdateStatus(a.StatusText(lang))
+                        dialog.NewInformation(infoTitle(lang), a.PopupText(lang), w).Show()
                         return
                     }
-                    a := parseCfgAck(ack)
-                    configLoadingMgr.UpdateStatus(a.StatusText(lang))
-                    dialog.NewInformation(infoTitle(lang), a.PopupText(lang), w).Show()
+                    if cerr != nil {
+                        configLoadingMgr.UpdateStatus(applyRolledBackStatus(lang) + cerr.Error())
+                        dialog.NewInformation(errorTitle(lang), applyRolledBackStatus(lang)+cerr.Error(), w).Show()
+                        return
+                    }
+                    // Follow the device to its new address
+                    for i := range devices {
+                        if devices[i].ID == d.ID && devices[i].IP == d.IP { devices[i].IP = moved.IP }
+                    }
+                    table.Refresh()
+                    if selectedIndex >= 0 && selectedIndex < len(devices) { selectedIPLabel.SetText(hostAddrText(devices[selectedIndex])) }
+                    configLoadingMgr.UpdateStatus(applyConfirmedStatus(lang, moved.IP))
+                    dialog.NewInformation(infoTitle(lang), applyConfirmedStatus(lang, moved.IP), w).Show()
                 })
             }()
         }, w).Show()
@@ -450,7 +684,7 @@ func main() {
             return
         }
         d := devices[selectedIndex]
-        urlStr := fmt.Sprintf("http://%s:8000", d.IP)
+        urlStr := deviceURL(d.IP, d.webPort())
         exePath, _ := os.Executable()
         exeDir := filepath.Dir(exePath)
         viewerPath := filepath.Join(exeDir, "page_viewer")
@@ -479,15 +713,16 @@ func main() {
         dialog.NewConfirm(confirmRestartTitle(lang), confirmRestartMessage(lang), func(ok bool) {
             if !ok { return }
             d := devices[selectedIndex]
-            p := parsePort(d.Port, 60000)
             restartLoadingMgr.StartLoading()
             restartLoadingMgr.UpdateStatus(statusRestarting(lang))
             go func() {
-                ack, err := sendRestartAndWaitAck(d.IP, p, 2*time.Second)
+                ack, err := sendRestartAndWaitAck(d, authKey, 2*time.Second)
                 restartLoadingMgr.FinishLoading(func() {
                     if err != nil {
-                        restartLoadingMgr.UpdateStatus(restartFailedStatus(lang) + err.Error())
-                        dialog.NewInformation(errorTitle(lang), restartFailedStatus(lang)+err.Error(), w).Show()
+                        text := restartFailedStatus(lang) + err.Error()
+                        if ae, ok := err.(*authError); ok { text = authRejected(lang) + ae.reason }
+                        restartLoadingMgr.UpdateStatus(text)
+                        dialog.NewInformation(errorTitle(lang), text, w).Show()
                         return
                     }
                     restartLoadingMgr.UpdateStatus(restartOKStatus(lang))
@@ -499,6 +734,43 @@ func main() {
     restartBtn.Importance = widget.HighImportance
     restartBtn.Disable()
 
+    // Set hostname button: validates the name, sends SET_HOSTNAME|APPLY=1 and updates the list
+    hostnameBtn = widget.NewButton(hostnameButtonText(lang), func() {
+        if selectedIndex == -1 {
+            status.SetText(selectDevicePrompt(lang))
+            return
+        }
+        name := strings.TrimSpace(hostnameEntry.Text)
+        if !isValidHostname(name) {
+            status.SetText(invalidHostname(lang))
+            dialog.NewInformation(errorTitle(lang), invalidHostname(lang), w).Show()
+            return
+        }
+        d := devices[selectedIndex]
+        configLoadingMgr.StartLoading()
+        configLoadingMgr.UpdateStatus(statusSettingHostname(lang))
+        go func() {
+            msg, err := sendSetHostname(d, name, authKey, 2*time.Second)
+            configLoadingMgr.FinishLoading(func() {
+                if err != nil {
+                    text := hostnameFailed(lang) + err.Error()
+                    if ae, ok := err.(*authError); ok { text = authRejected(lang) + ae.reason }
+                    configLoadingMgr.UpdateStatus(text)
+                    dialog.NewInformation(errorTitle(lang), text, w).Show()
+                    return
+                }
+                for i := range devices {
+                    if devices[i].ID == d.ID && devices[i].IP == d.IP { devices[i].Hostname = name }
+                }
+                table.Refresh()
+                text := hostnameSetStatus(lang, name)
+                if !strings.Contains(strings.ToUpper(msg), "APPLY_ACK") { text += hostnameNotLive(lang) }
+                configLoadingMgr.UpdateStatus(text)
+            })
+        }()
+    })
+    hostnameBtn.Disable()
+
     // Reserved buttons (placeholders)
     reservedBtn2 = widget.NewButton(reservedButtonText2(lang), func() {})
     reservedBtn2.Disable()
@@ -517,6 +789,7 @@ func main() {
     form := container.NewVBox(
         cfgTitle,
         infoRow,
+        container.NewBorder(nil, nil, nil, hostnameBtn, hostnameEntry),
         container.NewGridWithColumns(2,
             widget.NewLabel(netModeLabel(lang)),
             modeSelect,
@@ -525,6 +798,16 @@ func main() {
         netmaskEntry,
         gatewayEntry,
         dnsEntry,
+        container.NewGridWithColumns(2, ip6Entry, gw6Entry),
+        domainsEntry,
+        container.NewGridWithColumns(2, mtuEntry, ntpEntry),
+        routesEd.Widget(),
+    )
+
+    // Network settings and Wi-Fi in tabs above the shared action buttons
+    tabs := container.NewAppTabs(
+        container.NewTabItem(networkTabText(lang), container.NewVScroll(form)),
+        container.NewTabItem(wifiTabText(lang), container.NewVScroll(wifi.Widget())),
     )
 
     // Settings button
@@ -556,17 +839,29 @@ func main() {
             }
         })
 
+        // Shared secret used to sign CFG/RESTART (empty = unsigned)
+        authKeyEntry := widget.NewPasswordEntry()
+        authKeyEntry.SetPlaceHolder(authKeyPlaceholder(lang))
+        authKeyEntry.SetText(authKey)
+        mdnsCheck := widget.NewCheck(mdnsBrowseLabel(lang), nil)
+        mdnsCheck.SetChecked(useMDNS)
+
         content := container.NewVBox(
             widget.NewLabel(languageLabel(lang)),
             langSelect,
             loadFontBtn,
             useSystemFontBtn,
+            widget.NewLabel(authKeyLabel(lang)),
+            authKeyEntry,
+            mdnsCheck,
         )
         dialog.NewCustomConfirm(settingsText(lang), okText(lang), cancelText(lang), content, func(ok bool) {
             if !ok { return }
             // Apply language and refresh texts
             sel := langSelect.Selected
             if sel == "中文" { lang = "zh" } else { lang = "en" }
+            authKey = strings.TrimSpace(authKeyEntry.Text)
+            useMDNS = mdnsCheck.Checked
             // Update texts
             w.SetTitle(windowTitle(lang))
             status.SetText(statusReady(lang))
@@ -575,14 +870,30 @@ func main() {
             queryBtn.SetText(queryNetButtonText(lang))
             hostTitleLabel.SetText(selectedHostTitle(lang))
             ifaceTitleLabel.SetText(selectedIfaceLabelTitle(lang))
+            ifaceSelect.PlaceHolder = ifacePlaceholder(lang)
+            ifaceSelect.Refresh()
+            if selectedIndex >= 0 && selectedIndex < len(devices) { selectedFWLabel.SetText(deviceInfoText(lang, devices[selectedIndex])) }
             newIPEntry.SetPlaceHolder(newIPPlaceholder(lang))
             netmaskEntry.SetPlaceHolder(netmaskPlaceholder(lang))
             gatewayEntry.SetPlaceHolder(gatewayPlaceholder(lang))
             dnsEntry.SetPlaceHolder(dnsPlaceholder(lang))
+            ip6Entry.SetPlaceHolder(ip6Placeholder(lang))
+            gw6Entry.SetPlaceHolder(gw6Placeholder(lang))
+            domainsEntry.SetPlaceHolder(domainsPlaceholder(lang))
+            mtuEntry.SetPlaceHolder(mtuPlaceholder(lang))
+            ntpEntry.SetPlaceHolder(ntpPlaceholder(lang))
+            routesEd.SetLang(lang)
+            wifi.SetLang(lang)
+            tabs.Items[0].Text = networkTabText(lang)
+            tabs.Items[1].Text = wifiTabText(lang)
+            tabs.Refresh()
             applyBtn.SetText(applyButtonText(lang))
             settingsBtn.SetText(settingsText(lang))
             viewBtn.SetText(viewButtonText(lang))
             restartBtn.SetText(restartButtonText(lang))
+            hostnameEntry.SetPlaceHolder(hostnamePlaceholder(lang))
+            hostnameBtn.SetText(hostnameButtonText(lang))
+            table.Refresh()
             reservedBtn2.SetText(reservedButtonText2(lang))
             reservedBtn3.SetText(reservedButtonText3(lang))
             if hintLabel != nil { hintLabel.SetText(selectDevicePrompt(lang)) }
@@ -594,7 +905,7 @@ func main() {
     btnRow := container.NewGridWithColumns(3, queryBtn, applyBtn, viewBtn)
     extraRow := container.NewGridWithColumns(3, restartBtn, reservedBtn2, reservedBtn3)
     btnBlock := container.NewVBox(btnRow, extraRow, hintLabel)
-    rightPane := container.NewBorder(nil, btnBlock, nil, nil, form)
+    rightPane := container.NewBorder(nil, btnBlock, nil, nil, tabs)
 
     // Use a custom fixed ratio split layout with a vertical separator for 66%/34%
     sep := widget.NewSeparator()
@@ -620,6 +931,12 @@ func main() {
     w.ShowAndRun()
 }
 
+// setEnabled enables or disables a (possibly not yet created) button
+func setEnabled(b *widget.Button, on bool) {
+    if b == nil { return }
+    if on { b.Enable() } else { b.Disable() }
+}
+
 // ---- i18n helpers ----
 func windowTitle(lang string) string            { if lang == "zh" { return "设备发现与配置" } ; return "Device Discovery & Config" }
 func statusReady(lang string) string            { if lang == "zh" { return "就绪" } ; return "Ready" }
@@ -630,22 +947,53 @@ func statusQuerying(lang string) string         { if lang == "zh" { return "查
 func queryFailed(lang string) string            { if lang == "zh" { return "查询失败: " } ; return "Query failed: " }
 func queryFilled(lang string) string            { if lang == "zh" { return "已填充当前网络参数" } ; return "Filled current network params" }
 func scanError(lang string) string              { if lang == "zh" { return "扫描错误: " } ; return "Scan error: " }
+func helloStatus(lang, id, event string) string {
+    if lang == "zh" {
+        switch event {
+        case "restart": return "设备 " + id + " 正在重启"
+        case "ipchange": return "设备 " + id + " 地址已变更"
+        }
+        return "设备 " + id + " 已上线"
+    }
+    switch event {
+    case "restart": return "Device " + id + " is restarting"
+    case "ipchange": return "Device " + id + " changed its address"
+    }
+    return "Device " + id + " is online"
+}
 func foundFmt(lang string, n int) string        { if lang == "zh" { return fmt.Sprintf("发现 %d 台设备", n) } ; return fmt.Sprintf("Found %d device(s)", n) }
+func idCollisionStatus(lang string, n int) string { if lang == "zh" { return fmt.Sprintf("，%d 个 ID 冲突", n) } ; return fmt.Sprintf(", %d ID collision(s)", n) }
+func idCollisionTitle(lang string) string       { if lang == "zh" { return "设备 ID 冲突" } ; return "Device ID collision" }
+func idCollisionText(lang string, c []string) string { if lang == "zh" { return "以下 ID 被多台设备同时使用：\n\n" + strings.Join(c, "\n") + "\n\n请向其中一台设备发送 ID_REGEN 重新生成 ID。" } ; return "These IDs are used by more than one device:\n\n" + strings.Join(c, "\n") + "\n\nSend ID_REGEN to one of the devices to give it a new ID." }
 func cfgParamsTitle(lang string) string         { if lang == "zh" { return "配置参数 (CFG|ID=..|IP=..|PORT=..):" } ; return "Config params (CFG|ID=..|IP=..|PORT=..):" }
 // New GUI i18n for targeted config
 func selectedHostTitle(lang string) string      { if lang == "zh" { return "选中主机 (只读)" } ; return "Selected Host (read-only)" }
 func selectedHostPlaceholder(lang string) string{ if lang == "zh" { return "左侧选择主机后显示其IP" } ; return "IP of selected host" }
-func selectedIfaceLabelTitle(lang string) string{ if lang == "zh" { return "网卡名称 (只读)" } ; return "Interface Name (read-only)" }
+func selectedIfaceLabelTitle(lang string) string{ if lang == "zh" { return "网卡" } ; return "Interface" }
+func ifacePlaceholder(lang string) string       { if lang == "zh" { return "选择要配置的网卡" } ; return "Select interface to configure" }
 func newIPPlaceholder(lang string) string       { if lang == "zh" { return "新IP，例如 192.168.1.10" } ; return "New IP, e.g. 192.168.1.10" }
 func netmaskPlaceholder(lang string) string     { if lang == "zh" { return "掩码，例如 255.255.255.0" } ; return "Netmask, e.g. 255.255.255.0" }
 func gatewayPlaceholder(lang string) string     { if lang == "zh" { return "网关，例如 192.168.1.1" } ; return "Gateway, e.g. 192.168.1.1" }
-func dnsPlaceholder(lang string) string         { if lang == "zh" { return "DNS，例如 8.8.8.8" } ; return "DNS, e.g. 8.8.8.8" }
+func dnsPlaceholder(lang string) string         { if lang == "zh" { return "DNS，多个用逗号分隔，例如 8.8.8.8,1.1.1.1" } ; return "DNS, comma-separated, e.g. 8.8.8.8,1.1.1.1" }
+func ip6Placeholder(lang string) string         { if lang == "zh" { return "IPv6地址/前缀，例如 2001:db8::10/64" } ; return "IPv6 address/prefix, e.g. 2001:db8::10/64" }
+func gw6Placeholder(lang string) string         { if lang == "zh" { return "IPv6网关，例如 2001:db8::1" } ; return "IPv6 gateway, e.g. 2001:db8::1" }
+func domainsPlaceholder(lang string) string     { if lang == "zh" { return "搜索域，多个用逗号分隔，例如 example.com" } ; return "Search domains, comma-separated, e.g. example.com" }
+func mtuPlaceholder(lang string) string         { if lang == "zh" { return "MTU，例如 1500" } ; return "MTU, e.g. 1500" }
+func ntpPlaceholder(lang string) string         { if lang == "zh" { return "NTP服务器，多个用逗号分隔" } ; return "NTP servers, comma-separated" }
+func routesTitle(lang string) string            { if lang == "zh" { return "静态路由" } ; return "Static routes" }
+func addRouteText(lang string) string           { if lang == "zh" { return "添加路由" } ; return "Add route" }
+func routeDestPlaceholder(lang string) string   { if lang == "zh" { return "目标网段，例如 10.20.0.0/16" } ; return "Destination, e.g. 10.20.0.0/16" }
+func routeViaPlaceholder(lang string) string    { if lang == "zh" { return "经由网关 (可选)" } ; return "Via gateway (optional)" }
 func netModeLabel(lang string) string          { if lang == "zh" { return "网络模式" } ; return "Network Mode" }
 func invalidIP(lang string) string              { if lang == "zh" { return "IP格式不正确" } ; return "Invalid IP format" }
 func invalidNetmask(lang string) string         { if lang == "zh" { return "掩码格式不正确" } ; return "Invalid netmask format" }
+func invalidIP6(lang string) string             { if lang == "zh" { return "IPv6地址格式不正确" } ; return "Invalid IPv6 address format" }
 func invalidGateway(lang string) string         { if lang == "zh" { return "网关格式不正确" } ; return "Invalid gateway format" }
 func invalidDNS(lang string) string             { if lang == "zh" { return "DNS格式不正确" } ; return "Invalid DNS format" }
-func noParamsProvided(lang string) string       { if lang == "zh" { return "请至少填写一个参数 (IP/掩码/网关/DNS)" } ; return "Provide at least one of IP/Netmask/Gateway/DNS" }
+func invalidMTU(lang string) string             { if lang == "zh" { return "MTU应为 68-65535 之间的整数" } ; return "MTU must be an integer between 68 and 65535" }
+func invalidNameList(lang string) string        { if lang == "zh" { return "搜索域或NTP服务器格式不正确" } ; return "Invalid search domain or NTP server" }
+func invalidRoute(lang string) string           { if lang == "zh" { return "路由格式不正确 (目标网段/前缀，网关须与目标同为IPv4或IPv6)" } ; return "Invalid route (destination/prefix; gateway of the same IP family)" }
+func noParamsProvided(lang string) string       { if lang == "zh" { return "请至少填写或修改一个参数 (IP/掩码/网关/DNS/路由等)" } ; return "Provide or change at least one of IP/Netmask/Gateway/DNS/routes/..." }
 func applyButtonText(lang string) string        { if lang == "zh" { return "发送配置" } ; return "Send Config" }
 func queryNetButtonText(lang string) string     { if lang == "zh" { return "参数详情" } ; return "Params Detail" }
 func selectDevicePrompt(lang string) string     { if lang == "zh" { return "请先从左侧列表选择目标主机" } ; return "Select a device from the left list first" }
@@ -668,6 +1016,9 @@ func restartFailedStatus(lang string) string        { if lang == "zh" { return "
 func restartOKPopup(lang string) string             { if lang == "zh" { return "设备已返回RESTART_ACK" } ; return "Device returned RESTART_ACK" }
 func reservedButtonText2(lang string) string        { if lang == "zh" { return "预留2" } ; return "Reserved 2" }
 func reservedButtonText3(lang string) string        { if lang == "zh" { return "预留3" } ; return "Reserved 3" }
+func applyPendingStatus(lang string, secs int) string        { if lang == "zh" { return fmt.Sprintf("配置已写入，设备正在重启网络，%d 秒内在新地址确认...", secs) } ; return fmt.Sprintf("Written, device is restarting its network; confirming at the new address within %ds...", secs) }
+func applyConfirmedStatus(lang, ip string) string             { if lang == "zh" { return "新网络配置已生效并确认，设备地址: " + ip } ; return "New network config is active and confirmed, device address: " + ip }
+func applyRolledBackStatus(lang string) string                { if lang == "zh" { return "未能在新地址确认设备，设备将自动恢复原配置: " } ; return "Could not confirm the device at its new address; it will restore the previous config: " }
 func cfgAckSavedOnlyPopup(lang string) string               { if lang == "zh" { return "仅保存到本地：CFG_ACK|ID=<id>" } ; return "Saved to local only: CFG_ACK|ID=<id>" }
 func sendFailed(lang string) string             { if lang == "zh" { return "发送失败: " } ; return "Send failed: " }
 func configSent(lang string) string             { if lang == "zh" { return "已发送配置: " } ; return "Config sent: " }
@@ -690,6 +1041,16 @@ func confirmSendConfigMessage(lang string) string { if lang == "zh" { return "
 func confirmRestartTitle(lang string) string      { if lang == "zh" { return "确认重启" } ; return "Confirm Restart" }
 func confirmRestartMessage(lang string) string    { if lang == "zh" { return "确定要重启该设备吗？" } ; return "Are you sure to restart the device?" }
 func openingBrowserText(lang string) string     { if lang == "zh" { return "正在使用浏览器访问所选设备网页" } ; return "Opening device web page in browser" }
+func firmwareText(lang, fw string) string       { if fw == "" { return "" } ; if lang == "zh" { return "固件版本: " + fw } ; return "Firmware: " + fw }
+func viaText(lang, via string) string           { if via == "" { return "" } ; if lang == "zh" { return "  发现途径: " + via } ; return "  Found via: " + via }
+func offSubnetText(lang string, off bool) string { if !off { return "" } ; if lang == "zh" { return "\n设备不在本机网段 (广播应答)，可直接为其配置新地址" } ; return "\nNot on this subnet (answered by broadcast); configure a new address for it" }
+func fallbackText(lang, mode string) string    { if mode == "" { return "" } ; if lang == "zh" { return "\n设备处于后备地址模式 (未获取到 DHCP 地址，使用 169.254.x.y)，请为其配置地址" } ; return "\nFallback mode: no DHCP lease, using a 169.254.x.y address; configure an address for it" }
+func deviceInfoText(lang string, d Device) string { return firmwareText(lang, d.FW) + viaText(lang, d.Via) + offSubnetText(lang, d.OffSubnet) + fallbackText(lang, d.Fallback) }
+// Auth i18n
+func authKeyLabel(lang string) string           { if lang == "zh" { return "管理密钥 (签名 CFG/RESTART)" } ; return "Admin key (signs CFG/RESTART)" }
+func mdnsBrowseLabel(lang string) string        { if lang == "zh" { return "扫描时同时使用 mDNS 发现" } ; return "Also browse mDNS when scanning" }
+func authKeyPlaceholder(lang string) string     { if lang == "zh" { return "留空则不签名" } ; return "Leave empty to send unsigned" }
+func authRejected(lang string) string           { if lang == "zh" { return "设备拒绝认证: " } ; return "Device rejected auth: " }
 
 // helper to read all from URIReadCloser (since io.ReadAll requires import)
 func ioReadAll(uc fyne.URIReadCloser) ([]byte, error) {
@@ -717,22 +1078,61 @@ func buildCfg(id, ip, port string) string {
     return strings.Join(parts, "|")
 }
 
-// New builder for IP parameters
-func buildNetCfg(ip, mask, gw, dns string) string {
-    parts := []string{"CFG"}
-    if strings.TrimSpace(ip) != "" { parts = append(parts, "IP="+strings.TrimSpace(ip)) }
-    if strings.TrimSpace(mask) != "" { parts = append(parts, "MASK="+strings.TrimSpace(mask)) }
-    if strings.TrimSpace(gw) != "" { parts = append(parts, "GW="+strings.TrimSpace(gw)) }
-    if strings.TrimSpace(dns) != "" { parts = append(parts, "DNS="+strings.TrimSpace(dns)) }
-    return strings.Join(parts, "|")
+// New builder for IP parameters; extra are further fields (see netExtras.cfgFields)
+func buildNetCfg(ip, mask, gw, dns, ip6, gw6 string, extra map[string][]string) *devRequest {
+    req := newDevRequest("CFG").set("IP", ip).set("MASK", mask).set("GW", gw).set("DNS", splitList(dns)...)
+    req.set("IP6", ip6).set("GW6", gw6)
+    keys := make([]string, 0, len(extra))
+    for k := range extra { keys = append(keys, k) }
+    sort.Strings(keys)
+    for _, k := range keys { req.set(k, extra[k]...) }
+    return req
 }
 
 // Builder that includes DHCP mode when selected
-func buildNetCfgWithMode(dhcp bool, ip, mask, gw, dns string) string {
+func buildNetCfgWithMode(dhcp bool, ip, mask, gw, dns, ip6, gw6 string, extra map[string][]string) *devRequest {
     if dhcp {
-        return "CFG|DHCP=1"
+        return newDevRequest("CFG").set("DHCP", "1")
     }
-    return buildNetCfg(ip, mask, gw, dns)
+    return buildNetCfg(ip, mask, gw, dns, ip6, gw6, extra)
+}
+
+// netExtras are the search domains, MTU, NTP servers and routes of the config form
+type netExtras struct {
+    Domains, MTU, NTP string   // comma-separated lists, MTU in bytes
+    Routes            []string // <dest>/<prefix>[@<gateway>]
+}
+
+// cfgFields returns the CFG fields of the settings that differ from the queried values p; cleared
+// lists are sent as "none" and a cleared MTU as MTU=0 so that the device removes them
+func (x netExtras) cfgFields(p netParams) map[string][]string {
+    out := map[string][]string{}
+    list := func(key string, v []string, old string) {
+        if strings.Join(v, ",") == strings.Join(splitList(old), ",") { return }
+        if len(v) == 0 { v = []string{"none"} }
+        out[key] = v
+    }
+    list("DOMAINS", splitList(x.Domains), p.Domains)
+    if x.MTU != strings.TrimSpace(p.MTU) {
+        if x.MTU == "" { out["MTU"] = []string{"0"} } else { out["MTU"] = []string{x.MTU} }
+    }
+    list("NTP", splitList(x.NTP), p.NTP)
+    list("ROUTES", splitList(strings.Join(x.Routes, ",")), p.Routes)
+    return out
+}
+
+// isValidMTU accepts an MTU between 68 (IPv4 minimum) and 65535
+func isValidMTU(s string) bool {
+    n, err := strconv.Atoi(strings.TrimSpace(s))
+    return err == nil && n >= 68 && n <= 65535
+}
+
+// isValidNameList validates a comma-separated list of host or domain names (or addresses)
+func isValidNameList(s string) bool {
+    for _, p := range splitList(s) {
+        if strings.ContainsAny(p, " \t/@|=") { return false }
+    }
+    return true
 }
 
 // Simple IPv4 validation
@@ -741,35 +1141,75 @@ func isValidIPv4(s string) bool {
     return ip != nil && ip.To4() != nil
 }
 
-// Query NET params from a target IP:PORT within timeout
-// Returns IP, MASK, GW, DNS, and optional interface name (e.g., eth0)
-func queryNetParams(ip string, port int, timeout time.Duration) (rip, mask, gw, dns, iface string, err error) {
-    conn, e := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
-    if e != nil { return "", "", "", "", "", e }
-    defer conn.Close()
-    _ = conn.SetDeadline(time.Now().Add(timeout))
-    raddr := &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
-    if _, e = conn.WriteToUDP([]byte("QUERY_NET"), raddr); e != nil {
-        return "", "", "", "", "", e
+func isValidIPv6(s string) bool {
+    ip := net.ParseIP(strings.TrimSpace(s))
+    return ip != nil && ip.To4() == nil
+}
+
+// isValidIPv6CIDR accepts an IPv6 address with optional /prefix (1-128)
+func isValidIPv6CIDR(s string) bool {
+    s = strings.TrimSpace(s)
+    if !strings.Contains(s, "/") { return isValidIPv6(s) }
+    ip, _, err := net.ParseCIDR(s)
+    return err == nil && ip.To4() == nil
+}
+
+// isValidIPList validates a comma-separated list of IPv4/IPv6 addresses (e.g. DNS servers)
+func isValidIPList(s string) bool {
+    for _, p := range strings.Split(s, ",") {
+        if net.ParseIP(strings.TrimSpace(p)) == nil { return false }
     }
-    buf := make([]byte, 2048)
-    for {
-        n, from, e := conn.ReadFromUDP(buf)
-        if e != nil { return "", "", "", "", "", e }
-        msg := strings.TrimSpace(string(buf[:n]))
-        // Accept reply only from target host
-        if addrIP(from) != ip { continue }
-        // Accept different NET reply prefixes, e.g., NET|..., NET_IF|...
-        upper := strings.ToUpper(msg)
-        if strings.HasPrefix(upper, "NET|") || strings.HasPrefix(upper, "NET_IF|") || strings.HasPrefix(upper, "NET ") || strings.HasPrefix(upper, "NET") {
-            rip, mask, gw, dns, iface = parseNetResponse(msg)
-            return rip, mask, gw, dns, iface, nil
-        }
+    return true
+}
+
+// joinNonEmpty joins the non-empty comma-separated lists with ","
+func joinNonEmpty(lists ...string) string {
+    var out []string
+    for _, l := range lists {
+        if l = strings.TrimSpace(l); l != "" { out = append(out, l) }
+    }
+    return strings.Join(out, ",")
+}
+
+// netParams are the values reported by QUERY_NET
+type netParams struct {
+    IP, Mask, GW, DNS string
+    Iface             string // interface name, e.g. eth0
+    IP6               string // comma-separated IPv6 addresses with prefix
+    GW6, DNS6         string
+    Backend           string // network configuration backend, e.g. networkd or networkmanager
+    Domains, NTP      string // comma-separated search domains and NTP servers
+    MTU               string
+    Routes            string // comma-separated <dest>/<prefix>[@<gateway>]
+}
+
+// ifaceText shows the interface name and, when reported, the backend managing it: "eth0 (networkd)"
+func (p netParams) ifaceText() string {
+    if p.Backend == "" { return p.Iface }
+    return p.Iface + " (" + p.Backend + ")"
+}
+
+// globalIP6 returns the first non-link-local IPv6 address of p, or ""
+func (p netParams) globalIP6() string {
+    for _, a := range strings.Split(p.IP6, ",") {
+        ip, _, err := net.ParseCIDR(strings.TrimSpace(a))
+        if err == nil && !ip.IsLinkLocalUnicast() { return strings.TrimSpace(a) }
     }
+    return ""
+}
+
+// Query NET params of interface iface ("" = the device's default) from a device within timeout
+// Returns IP, MASK, GW, DNS, IPv6 values and optional interface name (e.g., eth0)
+func queryNetParams(d Device, iface string, timeout time.Duration) (netParams, error) {
+    // Accept different NET reply prefixes, e.g., NET|..., NET_IF|...
+    msg, err := exchange(d, withIface(d, newDevRequest("QUERY_NET"), iface), "", false, timeout, func(up string) bool { return strings.HasPrefix(up, "NET") })
+    if err != nil { return netParams{}, err }
+    if strings.HasPrefix(strings.ToUpper(msg), "NET_NACK") { return netParams{}, fmt.Errorf("%s", msg) }
+    return parseNetResponse(msg), nil
 }
 
-// Parse NET|IP=...|MASK=...|GW=...|DNS=...|IF=eth0 (or IFACE=eth0)
-func parseNetResponse(msg string) (ip, mask, gw, dns, iface string) {
+// Parse NET|IP=...|MASK=...|GW=...|DNS=...|IP6=...|GW6=...|DNS6=...|DOMAINS=...|MTU=...|NTP=...|ROUTES=...|IF=eth0 (or IFACE=eth0)
+func parseNetResponse(msg string) (np netParams) {
     parts := strings.Split(msg, "|")
     // tolerate different prefixes like NET_IF
     start := 1
@@ -785,79 +1225,200 @@ func parseNetResponse(msg string) (ip, mask, gw, dns, iface string) {
         v := strings.TrimSpace(kv[1])
         switch k {
         case "IP":
-            ip = v
+            np.IP = v
         case "MASK":
-            mask = v
+            np.Mask = v
         case "GW":
-            gw = v
+            np.GW = v
         case "DNS":
-            dns = v
+            np.DNS = v
+        case "IP6":
+            np.IP6 = v
+        case "GW6":
+            np.GW6 = v
+        case "DNS6":
+            np.DNS6 = v
         case "IF":
-            iface = v
+            np.Iface = v
         case "IFACE":
-            iface = v
+            np.Iface = v
         case "ETH":
-            iface = v
+            np.Iface = v
         case "NIC":
-            iface = v
+            np.Iface = v
         case "DEV":
-            iface = v
+            np.Iface = v
         case "INTERFACE":
-            iface = v
+            np.Iface = v
         case "IFNAME":
-            iface = v
+            np.Iface = v
+        case "BACKEND":
+            np.Backend = v
+        case "DOMAINS":
+            np.Domains = v
+        case "MTU":
+            np.MTU = v
+        case "NTP":
+            np.NTP = v
+        case "ROUTES":
+            np.Routes = v
         }
     }
     return
 }
 
-// sendCfgAndWaitAck sends CFG payload to ip:port and waits for CFG_ACK
-func sendCfgAndWaitAck(ip string, port int, payload []byte, timeout time.Duration) (string, error) {
-    conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+// sendCfgAndWaitAck sends a CFG request (signed when key is set) to the device and waits for CFG_ACK
+func sendCfgAndWaitAck(d Device, req *devRequest, key string, timeout time.Duration) (string, error) {
+    return exchange(d, req, key, true, timeout, func(up string) bool { return strings.HasPrefix(up, "CFG_ACK") })
+}
+
+// sendRestartAndWaitAck sends RESTART (signed when key is set) to the device and waits for RESTART_ACK
+func sendRestartAndWaitAck(d Device, key string, timeout time.Duration) (string, error) {
+    return exchange(d, newDevRequest("RESTART"), key, true, timeout, func(up string) bool { return strings.Contains(up, "RESTART_ACK") })
+}
+
+// exchange sends req to device d and returns the first reply for which want(upper-cased reply) is
+// true. v2 devices get a JSON envelope, others the text form; replies are normalized to text.
+// With stamp (always for v2) the request carries REQ/TS and replies for other requests are ignored.
+// AUTH_NACK / REPLAY_NACK / BUSY_NACK replies end the exchange with an error.
+// When the unicast request times out and the device honors TARGET= (OPTS), it is sent again by
+// broadcast with TARGET=<device ID>, reaching devices with an address the client cannot route to.
+func exchange(d Device, req *devRequest, key string, stamp bool, timeout time.Duration, want func(up string) bool) (string, error) {
+    msg, err := exchangeOnce(d, req, key, stamp, timeout, want, nil)
+    if ne, ok := err.(net.Error); !ok || !ne.Timeout() || !canTarget(d) { return msg, err }
+    fmt.Printf("no unicast reply from %s, broadcasting with TARGET=%s\n", d.IP, d.ID)
+    return exchangeOnce(d, req.with("TARGET", d.ID), key, stamp, timeout, want, broadcastAddrs(parsePort(d.Port, 60000)))
+}
+
+// canTarget reports whether requests to d may be broadcast with TARGET=: the device must have an
+// ID, an IPv4 address and advertise TARGET, since older firmware would apply the request too.
+func canTarget(d Device) bool {
+    return d.ID != "" && !strings.Contains(d.IP, ":") && d.hasOpt("TARGET")
+}
+
+// exchangeOnce runs one exchange: the request goes to d by unicast, or to every address in dests;
+// replies are accepted from d's address only.
+func exchangeOnce(d Device, req *devRequest, key string, stamp bool, timeout time.Duration, want func(up string) bool, dests []*net.UDPAddr) (string, error) {
+    network := "udp4"
+    if strings.Contains(d.IP, ":") { network = "udp6" }
+    if dests == nil {
+        raddr, err := net.ResolveUDPAddr(network, net.JoinHostPort(d.IP, strconv.Itoa(parsePort(d.Port, 60000))))
+        if err != nil { return "", err }
+        dests = []*net.UDPAddr{raddr}
+    }
+    conn, err := net.ListenUDP(network, nil)
     if err != nil { return "", err }
     defer conn.Close()
     _ = conn.SetDeadline(time.Now().Add(timeout))
-    raddr := &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
-    if _, err = conn.WriteToUDP(payload, raddr); err != nil {
+    var wire []byte
+    var reqID string
+    if d.Proto >= protoV2 {
+        wire, reqID = buildV2Request(req, key)
+    } else {
+        wire = []byte(req.text())
+        if stamp { wire, reqID = stampPayload(wire) }
+        wire = signPayload(wire, key)
+    }
+    sent := 0
+    for _, raddr := range dests {
+        if _, err = conn.WriteToUDP(wire, raddr); err == nil { sent++ }
+    }
+    if sent == 0 {
         return "", err
     }
-    buf := make([]byte, 2048)
+    buf := make([]byte, 65535)
     for {
         n, from, err := conn.ReadFromUDP(buf)
         if err != nil { return "", err }
-        if addrIP(from) != ip { continue }
-        msg := strings.TrimSpace(string(buf[:n]))
-        if strings.HasPrefix(strings.ToUpper(msg), "CFG_ACK") {
+        // Accept reply only from target host
+        if addrIP(from) != d.IP { continue }
+        msg := normalizeReply(strings.TrimSpace(string(buf[:n])))
+        // Broadcast replies of devices on another subnet may be meant for another client
+        if !replyForUs(msg, conn.LocalAddr()) { continue }
+        // Ignore stray replies belonging to other requests
+        if reqID != "" && !matchReq(msg, reqID) { continue }
+        if ae := parseAuthNack(msg); ae != nil {
+            return msg, ae
+        }
+        if e := parseReplayNack(msg); e != nil {
+            return msg, e
+        }
+        // Device queue full: fail fast instead of waiting for the timeout
+        if strings.HasPrefix(strings.ToUpper(msg), "BUSY_NACK") {
+            return msg, fmt.Errorf("BUSY_NACK: device busy, retry later")
+        }
+        if want(strings.ToUpper(msg)) {
             return msg, nil
         }
     }
 }
 
-// sendRestartAndWaitAck sends RESTART to ip:port and waits for RESTART_ACK
-func sendRestartAndWaitAck(ip string, port int, timeout time.Duration) (string, error) {
-    conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
-    if err != nil { return "", err }
-    defer conn.Close()
-    _ = conn.SetDeadline(time.Now().Add(timeout))
-    raddr := &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
-    payload := []byte("RESTART")
-    if _, err = conn.WriteToUDP(payload, raddr); err != nil {
-        return "", err
+// replyForUs reports whether a reply is for the socket at local: devices answering a client on
+// another subnet also broadcast the reply with TO=<client ip>:<port>, which must be our port
+// (the address may differ behind NAT). Replies without TO are unicast to us.
+func replyForUs(msg string, local net.Addr) bool {
+    to := replyField(msg, "TO")
+    if to == "" { return true }
+    _, port, err := net.SplitHostPort(to)
+    u, ok := local.(*net.UDPAddr)
+    return err == nil && ok && port == strconv.Itoa(u.Port)
+}
+
+// authError reports an AUTH_NACK reply; reason is the device's ERR= value (e.g. BAD_SIG, STALE_TS)
+type authError struct{ reason string }
+
+func (e *authError) Error() string { return "AUTH_NACK: " + e.reason }
+
+// parseAuthNack returns an *authError if msg is AUTH_NACK|ERR=<reason>, else nil
+func parseAuthNack(msg string) *authError {
+    if !strings.HasPrefix(strings.ToUpper(msg), "AUTH_NACK") { return nil }
+    return &authError{reason: replyField(msg, "ERR")}
+}
+
+// signPayload appends SIG=<hex HMAC-SHA256> to a stamped payload (see stampPayload).
+// The signature covers everything before "|SIG=". An empty key leaves the payload unsigned.
+func signPayload(payload []byte, key string) []byte {
+    if key == "" { return payload }
+    mac := hmac.New(sha256.New, []byte(key))
+    mac.Write(payload)
+    return []byte(string(payload) + "|SIG=" + hex.EncodeToString(mac.Sum(nil)))
+}
+
+// stampPayload appends a fresh REQ=<id> and TS=<unix> to a payload and returns the request ID
+func stampPayload(payload []byte) ([]byte, string) {
+    id := newRequestID()
+    msg := string(payload) + "|REQ=" + id + "|TS=" + strconv.FormatInt(time.Now().Unix(), 10)
+    return []byte(msg), id
+}
+
+// newRequestID returns a random 16-hex-digit request ID
+func newRequestID() string {
+    b := make([]byte, 8)
+    if _, err := rand.Read(b); err != nil {
+        return strconv.FormatInt(time.Now().UnixNano(), 16)
     }
-    buf := make([]byte, 2048)
-    for {
-        n, from, err := conn.ReadFromUDP(buf)
-        if err != nil { return "", err }
-        if addrIP(from) != ip { continue }
-        msg := strings.TrimSpace(string(buf[:n]))
-        up := strings.ToUpper(msg)
-        if strings.Contains(up, "RESTART_ACK") {
-            return msg, nil
-        }
-        if strings.HasPrefix(up, "CFG_ACK") && strings.Contains(up, "RESTART_ACK") {
-            return msg, nil
-        }
+    return hex.EncodeToString(b)
+}
+
+// replyField returns the value of key in a pipe-delimited reply (skipping the status token)
+func replyField(msg, key string) string {
+    for _, p := range strings.Split(msg, "|")[1:] {
+        kv := strings.SplitN(p, "=", 2)
+        if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), key) { return strings.TrimSpace(kv[1]) }
     }
+    return ""
+}
+
+// matchReq reports whether a reply belongs to reqID. Replies without REQ (older devices) are accepted.
+func matchReq(msg, reqID string) bool {
+    r := replyField(msg, "REQ")
+    return r == "" || r == reqID
+}
+
+// parseReplayNack returns an error if msg is REPLAY_NACK|ERR=<reason>, else nil
+func parseReplayNack(msg string) error {
+    if !strings.HasPrefix(strings.ToUpper(msg), "REPLAY_NACK") { return nil }
+    return fmt.Errorf("REPLAY_NACK: %s", replyField(msg, "ERR"))
 }
 
 type cfgAck struct{
@@ -865,16 +1426,58 @@ type cfgAck struct{
     HasNetNack bool
     HasRestartAck bool
     HasRestartNack bool
+    // CFG|APPLY=1: the device restarts its network and waits Confirm seconds for CFG_CONFIRM|TXN=Txn
+    Pending bool
+    Txn string
+    Confirm int
 }
 
 func parseCfgAck(msg string) cfgAck {
     up := strings.ToUpper(msg)
+    confirm, _ := strconv.Atoi(replyField(msg, "CONFIRM"))
     return cfgAck{
         HasNetAck: strings.Contains(up, "NET_ACK"),
         HasNetNack: strings.Contains(up, "NET_NACK"),
         HasRestartAck: strings.Contains(up, "RESTART_ACK"),
         HasRestartNack: strings.Contains(up, "RESTART_NACK"),
+        Pending: strings.Contains(up, "APPLY_PENDING"),
+        Txn: replyField(msg, "TXN"),
+        Confirm: confirm,
+    }
+}
+
+// confirmNetApply is the second phase of CFG|APPLY=1: until the device's confirm window closes it
+// looks for the device at its new address and sends CFG_CONFIRM|TXN=<txn> there. A static newIP
+// is contacted directly; otherwise (DHCP, IPv6 only) the device is re-discovered by ID.
+// It returns the device at its new address, or the last error once the window has passed
+// (the device then restores its previous configuration by itself).
+func confirmNetApply(d Device, newIP, txn, key string, window time.Duration) (Device, error) {
+    deadline := time.Now().Add(window)
+    lastErr := fmt.Errorf("device %s not found", d.ID)
+    for time.Now().Add(2 * time.Second).Before(deadline) {
+        // give the device time to restart its network
+        time.Sleep(2 * time.Second)
+        target := d
+        if newIP != "" {
+            target.IP = newIP
+        } else {
+            found, err := discover(d.Port, 2*time.Second, false)
+            if err != nil { lastErr = err; continue }
+            ok := false
+            for _, f := range found {
+                if f.ID == d.ID { target, ok = f, true; break }
+            }
+            if !ok { continue }
+        }
+        msg, err := exchange(target, newDevRequest("CFG_CONFIRM").set("TXN", txn), key, true, 2*time.Second, func(up string) bool { return strings.HasPrefix(up, "CFG_CONFIRM") })
+        if _, auth := err.(*authError); auth { return d, err }
+        if err != nil { lastErr = err; continue }
+        if strings.HasPrefix(strings.ToUpper(msg), "CFG_CONFIRM_NACK") {
+            return d, fmt.Errorf("CFG_CONFIRM_NACK: %s", replyField(msg, "ERR"))
+        }
+        return target, nil
     }
+    return d, lastErr
 }
 
 func (c cfgAck) StatusText(lang string) string {
@@ -913,7 +1516,39 @@ func sendUDP(network string, laddr, raddr *net.UDPAddr, payload []byte) error {
     return err
 }
 
-func discover(port string, timeout time.Duration) ([]Device, error) {
+// discoveryGroup / discoveryGroup6 are the multicast groups devices join for discovery
+// (server multicast_group / multicast_group6 defaults).
+const (
+    discoveryGroup  = "239.255.60.60"
+    discoveryGroup6 = "ff02::6060"
+)
+
+// broadcastAddrs returns the global broadcast address and the directed broadcast address of every
+// IPv4 subnet of the up, broadcast-capable interfaces, all at port.
+func broadcastAddrs(port int) []*net.UDPAddr {
+    out := []*net.UDPAddr{{IP: net.IPv4bcast, Port: port}} // Global broadcast
+    interfaces, _ := net.Interfaces()
+    for _, iface := range interfaces {
+        if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+            continue
+        }
+        addrs, _ := iface.Addrs()
+        for _, addr := range addrs {
+            if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil && len(ipnet.Mask) == net.IPv4len {
+                // Calculate broadcast address for this network
+                broadcast := make(net.IP, 4)
+                for i := 0; i < 4; i++ {
+                    broadcast[i] = ipnet.IP.To4()[i] | ^ipnet.Mask[i]
+                }
+                out = append(out, &net.UDPAddr{IP: broadcast, Port: port})
+            }
+        }
+    }
+    return out
+}
+
+// discover broadcasts/multicasts TF and, with useMDNS, also browses mDNS; results are merged by ID.
+func discover(port string, timeout time.Duration, useMDNS bool) ([]Device, error) {
     targetPort := parsePort(port, 60000)
     found := map[string]Device{}
     
@@ -923,65 +1558,100 @@ func discover(port string, timeout time.Duration) ([]Device, error) {
         return nil, fmt.Errorf("failed to create UDP socket: %v", err)
     }
     defer conn.Close()
+    // IPv6 socket for the link-local multicast group; works even where IPv4 is unconfigured
+    conn6, err6 := net.ListenPacket("udp6", "[::]:0")
+    if err6 == nil { defer conn6.Close() }
     
     // Set deadline for receiving responses
     _ = conn.SetDeadline(time.Now().Add(timeout))
+    if err6 == nil { _ = conn6.SetDeadline(time.Now().Add(timeout)) }
     
-    // Prepare broadcast addresses
-    broadcastAddresses := []string{
-        "255.255.255.255", // Global broadcast
-    }
-    
-    // Add local network broadcast addresses
+    broadcastAddresses := broadcastAddrs(targetPort)
     interfaces, _ := net.Interfaces()
-    for _, iface := range interfaces {
-        if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
-            continue
+    
+    // Also send to the multicast group on every multicast-capable interface:
+    // many managed switches and Wi-Fi APs drop broadcast but forward multicast
+    if gaddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", discoveryGroup, targetPort)); err == nil {
+        p := ipv4.NewPacketConn(conn)
+        sent := false
+        for i := range interfaces {
+            iface := &interfaces[i]
+            if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+                continue
+            }
+            if err := p.SetMulticastInterface(iface); err != nil { continue }
+            if _, err := conn.WriteTo([]byte("TF"), gaddr); err == nil { sent = true }
         }
-        addrs, _ := iface.Addrs()
-        for _, addr := range addrs {
-            if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
-                // Calculate broadcast address for this network
-                broadcast := make(net.IP, 4)
-                for i := 0; i < 4; i++ {
-                    broadcast[i] = ipnet.IP.To4()[i] | ^ipnet.Mask[i]
-                }
-                broadcastAddresses = append(broadcastAddresses, broadcast.String())
+        if !sent {
+            // Let the OS choose the interface
+            _ = p.SetMulticastInterface(nil)
+            if _, err := conn.WriteTo([]byte("TF"), gaddr); err != nil {
+                fmt.Printf("Failed to send multicast to %s: %v\n", gaddr, err)
             }
         }
     }
-    
+
     // Send broadcast messages to all addresses
-    for _, bcastIP := range broadcastAddresses {
-        bcastAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", bcastIP, targetPort))
-        if err != nil {
-            fmt.Printf("Failed to resolve broadcast address %s: %v\n", bcastIP, err)
-            continue
-        }
-        
-        // Send broadcast message
+    for _, bcastAddr := range broadcastAddresses {
         if _, err := conn.WriteTo([]byte("TF"), bcastAddr); err != nil {
-            fmt.Printf("Failed to send broadcast to %s: %v\n", bcastIP, err)
+            fmt.Printf("Failed to send broadcast to %s: %v\n", bcastAddr.IP, err)
         }
     }
     
-    // Listen for responses
-    buf := make([]byte, 2048)
-    for {
-        n, from, err := conn.ReadFrom(buf)
-        if err != nil {
-            // Deadline or other error ends discovery
-            break
+    // IPv6: send to the link-local group on every multicast-capable interface (zone = interface)
+    if err6 == nil {
+        for _, iface := range interfaces {
+            if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+                continue
+            }
+            gaddr := &net.UDPAddr{IP: net.ParseIP(discoveryGroup6), Port: targetPort, Zone: iface.Name}
+            _, _ = conn6.WriteTo([]byte("TF"), gaddr)
         }
-        msg := strings.TrimSpace(string(buf[:n]))
-        if strings.HasPrefix(strings.ToUpper(msg), "TF|") {
-            if fromUDP, ok := from.(*net.UDPAddr); ok {
-                d := parseDiscovery(fromUDP, msg)
-                key := from.String()
-                found[key] = d
+    }
+
+    // Listen for responses on both sockets
+    var mu sync.Mutex
+    collect := func(c net.PacketConn) {
+        buf := make([]byte, 2048)
+        for {
+            n, from, err := c.ReadFrom(buf)
+            if err != nil {
+                // Deadline or other error ends discovery
+                return
+            }
+            msg := strings.TrimSpace(string(buf[:n]))
+            if strings.HasPrefix(strings.ToUpper(msg), "TF|") && replyForUs(msg, c.LocalAddr()) {
+                if fromUDP, ok := from.(*net.UDPAddr); ok {
+                    d := parseDiscovery(fromUDP, msg)
+                    mu.Lock()
+                    addDiscovered(found, d)
+                    mu.Unlock()
+                }
             }
         }
     }
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() { defer wg.Done(); collect(conn) }()
+    if err6 == nil {
+        wg.Add(1)
+        go func() { defer wg.Done(); collect(conn6) }()
+    }
+    if useMDNS {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            ds, err := browseMDNS(timeout)
+            if err != nil {
+                fmt.Printf("mDNS browse failed: %v\n", err)
+                return
+            }
+            mu.Lock()
+            for _, d := range ds { addDiscovered(found, d) }
+            mu.Unlock()
+        }()
+    }
+    wg.Wait()
     
     // Convert map to slice
     out := make([]Device, 0, len(found))
@@ -993,7 +1663,7 @@ func discover(port string, timeout time.Duration) ([]Device, error) {
 
 func parseDiscovery(from net.Addr, msg string) Device {
     d := Device{IP: addrIP(from), Port: "", ID: ""}
-    // Message format: TF|ID=<id>|PORT=<port>
+    // Message format: TF|ID=<id>|PORT=<port>[|V=<ver>|CMDS=<a,b,..>|FW=<version>|WEB=<port>|OPTS=<a,b>|FALLBACK=<mode>|INST=<instance>|HOST=<hostname>|VIA=<path>|TO=<client>]
     parts := strings.Split(msg, "|")
     for _, p := range parts[1:] { // skip "TF"
         kv := strings.SplitN(p, "=", 2)
@@ -1005,20 +1675,142 @@ func parseDiscovery(from net.Addr, msg string) Device {
             d.ID = v
         case "PORT":
             d.Port = v
+        case "V":
+            d.Proto, _ = strconv.Atoi(v)
+        case "CMDS":
+            for _, c := range strings.Split(v, ",") {
+                if c = strings.TrimSpace(c); c != "" { d.Cmds = append(d.Cmds, strings.ToUpper(c)) }
+            }
+        case "FW":
+            d.FW = v
+        case "WEB":
+            d.WebPort = v
+        case "OPTS":
+            for _, o := range strings.Split(v, ",") {
+                if o = strings.TrimSpace(o); o != "" { d.Opts = append(d.Opts, strings.ToUpper(o)) }
+            }
+        case "FALLBACK":
+            d.Fallback = strings.ToLower(v)
+        case "INST":
+            d.Inst = v
+        case "HOST":
+            d.Hostname = v
+        case "VIA":
+            d.Via = strings.ToLower(v)
+        case "TO":
+            d.OffSubnet = true
         }
     }
     if d.Port == "" { d.Port = "60000" }
+    if d.Proto == 0 { d.Proto = 1 }
     return d
 }
 
+// addDiscovered records a TF reply (or mDNS result) in found, keyed by device ID so that a device
+// answering over IPv4, IPv6 and mDNS is listed once (IPv4 preferred as contact address, the IPv6
+// one kept in IP6). All paths are remembered in Via; fields missing in one reply are filled from the other.
+// Another device with the same ID (other INST) is kept as a separate entry, see idCollisions.
+func addDiscovered(found map[string]Device, d Device) {
+    key := d.ID
+    if key == "" { key = d.IP }
+    if prev, ok := found[key]; ok && prev.Inst != "" && d.Inst != "" && prev.Inst != d.Inst { key += "@" + d.Inst }
+    prev, ok := found[key]
+    if !ok {
+        found[key] = d
+        return
+    }
+    v6, prevV6 := strings.Contains(d.IP, ":"), strings.Contains(prev.IP, ":")
+    switch {
+    case prev.IP == d.IP:
+        found[key] = mergeDevice(prev, d)
+    case v6 && !prevV6:
+        if prev.IP6 == "" { prev.IP6 = d.IP }
+        found[key] = mergeDevice(prev, d)
+    case !v6 && prevV6:
+        d.IP6 = prev.IP
+        found[key] = mergeDevice(d, prev)
+    default:
+        // Same ID at another address of the same family: list both
+        found[key+"@"+d.IP] = d
+    }
+}
+
+// idCollisions returns "<ID>: <address>, <address>" for every ID that more than one discovered
+// device uses. Entries of one device (same INST, e.g. answering from two interfaces) do not count;
+// older firmware sends no INST, so any ID listed twice is reported for it.
+func idCollisions(devs []Device) []string {
+    byID := map[string][]Device{}
+    var ids []string
+    for _, d := range devs {
+        if d.ID == "" { continue }
+        if _, ok := byID[d.ID]; !ok { ids = append(ids, d.ID) }
+        byID[d.ID] = append(byID[d.ID], d)
+    }
+    sort.Strings(ids)
+    var out []string
+    for _, id := range ids {
+        ds := byID[id]
+        if len(ds) < 2 { continue }
+        same := true
+        var addrs []string
+        for _, d := range ds {
+            if d.Inst == "" || d.Inst != ds[0].Inst { same = false }
+            addrs = append(addrs, d.IP)
+        }
+        sort.Strings(addrs)
+        if !same { out = append(out, id+": "+strings.Join(addrs, ", ")) }
+    }
+    return out
+}
+
+// mergeDevice returns a with empty fields filled from b and the discovery paths of both
+func mergeDevice(a, b Device) Device {
+    if a.IP6 == "" && b.IP6 != a.IP { a.IP6 = b.IP6 }
+    if len(a.Cmds) == 0 { a.Cmds = b.Cmds }
+    if a.FW == "" { a.FW = b.FW }
+    if a.WebPort == "" { a.WebPort = b.WebPort }
+    if len(a.Opts) == 0 { a.Opts = b.Opts }
+    if a.Fallback == "" { a.Fallback = b.Fallback }
+    if a.Inst == "" { a.Inst = b.Inst }
+    if a.Hostname == "" { a.Hostname = b.Hostname }
+    if b.Proto > a.Proto { a.Proto = b.Proto }
+    a.Via = mergeVia(a.Via, b.Via)
+    a.OffSubnet = a.OffSubnet || b.OffSubnet
+    return a
+}
+
+// mergeVia adds path b to the comma-separated path list a, skipping duplicates.
+func mergeVia(a, b string) string {
+    if b == "" { return a }
+    if a == "" { return b }
+    for _, v := range strings.Split(a, ",") {
+        if v == b { return a }
+    }
+    return a + "," + b
+}
+
+// hostAddrText shows the contact address plus the IPv6 address when the device has both
+func hostAddrText(d Device) string {
+    if d.IP6 != "" && d.IP6 != d.IP { return d.IP + "\n" + d.IP6 }
+    return d.IP
+}
+
+// addrIP returns the host part of a UDP address; IPv6 link-local hosts keep their zone (fe80::1%eth0)
 func addrIP(a net.Addr) string {
     s := a.String()
-    if i := strings.LastIndex(s, ":"); i > 0 {
-        return s[:i]
+    if host, _, err := net.SplitHostPort(s); err == nil {
+        return host
     }
     return s
 }
 
+// deviceURL returns http://<ip>:<port>, bracketing IPv6 hosts and escaping the zone separator
+func deviceURL(ip, port string) string {
+    host := ip
+    if strings.Contains(ip, ":") { host = strings.Replace(ip, "%", "%25", 1) }
+    return "http://" + net.JoinHostPort(host, port)
+}
+
 func parsePort(s string, def int) int {
     if s == "" { return def }
     var p int
@@ -1027,10 +1819,10 @@ func parsePort(s string, def int) int {
     return p
 }
 
-// isDevicePageOnline checks whether http://<ip>:8000 is reachable and returns 2xx/3xx
-func isDevicePageOnline(ip string, timeout time.Duration) bool {
-    if ip == "" { return false }
-    url := fmt.Sprintf("http://%s:8000/", ip)
+// isDevicePageOnline checks whether http://<ip>:<port> is reachable and returns 2xx/3xx
+func isDevicePageOnline(ip, port string, timeout time.Duration) bool {
+    if ip == "" || port == "" { return false }
+    url := deviceURL(ip, port) + "/"
     ctx, cancel := context.WithTimeout(context.Background(), timeout)
     defer cancel()
     req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
@@ -0,0 +1,100 @@
+package main
+
+import (
+    "net"
+    "strconv"
+    "strings"
+    "time"
+
+    "golang.org/x/net/dns/dnsmessage"
+)
+
+// mDNS / DNS-SD browsing for _trae-cfg._udp.local (see the server's mdns.go).
+// A one-shot query is sent from an ephemeral port, so responders answer by unicast
+// (legacy unicast, RFC 6762 6.7); answers and additional records of all replies
+// received within the timeout are combined into devices.
+
+const (
+    mdnsAddr    = "224.0.0.251:5353"
+    mdnsService = "_trae-cfg._udp.local."
+)
+
+// mdnsInstance collects what is known about one service instance.
+type mdnsInstance struct {
+    port   string
+    target string
+    txt    map[string]string
+    from   string // address of the responder
+}
+
+// browseMDNS queries for the service and returns the devices that answered within timeout.
+func browseMDNS(timeout time.Duration) ([]Device, error) {
+    conn, err := net.ListenPacket("udp4", ":0")
+    if err != nil { return nil, err }
+    defer conn.Close()
+    _ = conn.SetDeadline(time.Now().Add(timeout))
+
+    q := dnsmessage.Message{
+        Header: dnsmessage.Header{ID: uint16(time.Now().UnixNano())},
+        Questions: []dnsmessage.Question{{
+            Name:  dnsmessage.MustNewName(mdnsService),
+            Type:  dnsmessage.TypePTR,
+            Class: dnsmessage.ClassINET | 1<<15, // QU: ask for a unicast reply
+        }},
+    }
+    out, err := q.Pack()
+    if err != nil { return nil, err }
+    raddr, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+    if err != nil { return nil, err }
+    if _, err := conn.WriteTo(out, raddr); err != nil { return nil, err }
+
+    instances := map[string]*mdnsInstance{}
+    hosts := map[string]string{} // host name -> IPv4 address
+    get := func(name string) *mdnsInstance {
+        name = strings.ToLower(name)
+        if instances[name] == nil { instances[name] = &mdnsInstance{txt: map[string]string{}} }
+        return instances[name]
+    }
+    buf := make([]byte, 9000)
+    for {
+        n, from, err := conn.ReadFrom(buf)
+        if err != nil { break } // deadline ends browsing
+        var m dnsmessage.Message
+        if m.Unpack(buf[:n]) != nil || !m.Header.Response { continue }
+        for _, r := range append(m.Answers, m.Additionals...) {
+            name := r.Header.Name.String()
+            switch b := r.Body.(type) {
+            case *dnsmessage.PTRResource:
+                if strings.EqualFold(name, mdnsService) { get(b.PTR.String()).from = addrIP(from) }
+            case *dnsmessage.SRVResource:
+                inst := get(name)
+                inst.port, inst.target = strconv.Itoa(int(b.Port)), strings.ToLower(b.Target.String())
+                if inst.from == "" { inst.from = addrIP(from) }
+            case *dnsmessage.TXTResource:
+                inst := get(name)
+                for _, kv := range b.TXT {
+                    if k, v, ok := strings.Cut(kv, "="); ok { inst.txt[strings.ToLower(k)] = v }
+                }
+            case *dnsmessage.AResource:
+                hosts[strings.ToLower(name)] = net.IP(b.A[:]).String()
+            }
+        }
+    }
+
+    var devices []Device
+    for name, inst := range instances {
+        if !strings.HasSuffix(name, strings.ToLower(mdnsService)) || (inst.port == "" && len(inst.txt) == 0) { continue }
+        d := Device{ID: inst.txt["id"], Port: inst.txt["port"], WebPort: inst.txt["web"], FW: inst.txt["fw"], Via: "mdns"}
+        if d.ID == "" { d.ID = strings.TrimSuffix(name, "."+strings.ToLower(mdnsService)) }
+        if d.Port == "" { d.Port = inst.port }
+        if d.Port == "" { d.Port = "60000" }
+        d.Proto, _ = strconv.Atoi(inst.txt["v"])
+        if d.Proto == 0 { d.Proto = 1 }
+        // Prefer the responder's address (reachable from here), else the SRV target's A record
+        d.IP = inst.from
+        if d.IP == "" { d.IP = hosts[inst.target] }
+        if d.IP == "" { continue }
+        devices = append(devices, d)
+    }
+    return devices, nil
+}
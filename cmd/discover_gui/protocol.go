@@ -0,0 +1,154 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// v2 JSON protocol support. Devices advertising V=2 in their TF reply are sent
+//   {"v":2,"cmd":"cfg","req":"<id>","ts":<unix>,"args":{"ip":"...","dns":["a","b"]},"sig":"<hex>"}
+// and answer with {"v":2,"cmd":"cfg_ack","ok":true,"data":{...},"flags":[...]}.
+// Requests are built as a devRequest (command and argument values) and sent as text
+// (CMD|K=v1,v2...) or as the envelope above; replies are normalized back to text so the
+// existing reply parsers work for both versions.
+
+const protoV2 = 2
+
+// devRequest is a command for a device. Args maps upper-case keys to their values; the v2
+// envelope carries the values as they are (so they may contain '|' and ','), the text form
+// joins them with ','.
+type devRequest struct {
+    Cmd  string
+    Args map[string][]string
+    keys []string // keys in the order they were set, for the text form
+}
+
+func newDevRequest(cmd string) *devRequest {
+    return &devRequest{Cmd: cmd, Args: map[string][]string{}}
+}
+
+// set adds values to key; empty values are skipped, and so is a key without values
+func (r *devRequest) set(key string, values ...string) *devRequest {
+    key = strings.ToUpper(key)
+    for _, v := range values {
+        if v = strings.TrimSpace(v); v == "" { continue }
+        if _, ok := r.Args[key]; !ok { r.keys = append(r.keys, key) }
+        r.Args[key] = append(r.Args[key], v)
+    }
+    return r
+}
+
+// with returns a copy of r with values added to key
+func (r *devRequest) with(key string, values ...string) *devRequest {
+    c := newDevRequest(r.Cmd)
+    for _, k := range r.keys { c.set(k, r.Args[k]...) }
+    return c.set(key, values...)
+}
+
+// text is the v1 form CMD|KEY=v1,v2|...
+func (r *devRequest) text() string {
+    parts := []string{r.Cmd}
+    for _, k := range r.keys { parts = append(parts, k+"="+strings.Join(r.Args[k], ",")) }
+    return strings.Join(parts, "|")
+}
+
+type v2Request struct {
+    V    int                    `json:"v"`
+    Cmd  string                 `json:"cmd"`
+    Req  string                 `json:"req"`
+    TS   int64                  `json:"ts"`
+    Args map[string]interface{} `json:"args,omitempty"`
+    Sig  string                 `json:"sig,omitempty"`
+}
+
+type v2Reply struct {
+    V     int                    `json:"v"`
+    Cmd   string                 `json:"cmd"`
+    Req   string                 `json:"req"`
+    TS    json.Number            `json:"ts"`
+    OK    bool                   `json:"ok"`
+    Data  map[string]interface{} `json:"data"`
+    Flags []string               `json:"flags"`
+}
+
+// buildV2Request turns req into a stamped (REQ/TS) v2 envelope, signed when key is set. A key
+// with one value is sent as a string, else as an array. The signature covers the canonical form
+// CMD|K=v1,v2 (keys sorted)|REQ=..|TS=.. used by the device, with '\', '|', ',' and '=' escaped
+// by '\' inside the command, keys and values.
+func buildV2Request(req *devRequest, key string) ([]byte, string) {
+    env := v2Request{V: protoV2, Cmd: strings.ToLower(req.Cmd), Req: newRequestID(), TS: time.Now().Unix()}
+    keys := make([]string, 0, len(req.Args))
+    for k := range req.Args { keys = append(keys, k) }
+    sort.Strings(keys)
+    canon := []string{canonicalEscape(strings.ToUpper(env.Cmd))}
+    if len(keys) > 0 { env.Args = map[string]interface{}{} }
+    for _, k := range keys {
+        vs := req.Args[k]
+        esc := make([]string, len(vs))
+        for i, v := range vs { esc[i] = canonicalEscape(v) }
+        canon = append(canon, canonicalEscape(k)+"="+strings.Join(esc, ","))
+        if len(vs) == 1 { env.Args[strings.ToLower(k)] = vs[0] } else { env.Args[strings.ToLower(k)] = vs }
+    }
+    canon = append(canon, "REQ="+env.Req, "TS="+strconv.FormatInt(env.TS, 10))
+    if key != "" {
+        mac := hmac.New(sha256.New, []byte(key))
+        mac.Write([]byte(strings.Join(canon, "|")))
+        env.Sig = hex.EncodeToString(mac.Sum(nil))
+    }
+    b, _ := json.Marshal(env)
+    return b, env.Req
+}
+
+var canonicalEscaper = strings.NewReplacer(`\`, `\\`, "|", `\|`, ",", `\,`, "=", `\=`)
+
+// canonicalEscape escapes the separators of the canonical form in s
+func canonicalEscape(s string) string { return canonicalEscaper.Replace(s) }
+
+// normalizeReply turns a v2 JSON reply into the text form STATUS|K=V...|FLAG|REQ=..|TS=..
+// Text replies are returned unchanged.
+func normalizeReply(msg string) string {
+    if !strings.HasPrefix(msg, "{") { return msg }
+    var r v2Reply
+    if err := json.Unmarshal([]byte(msg), &r); err != nil { return msg }
+    parts := []string{strings.ToUpper(r.Cmd)}
+    keys := make([]string, 0, len(r.Data))
+    for k := range r.Data { keys = append(keys, k) }
+    sort.Strings(keys)
+    for _, k := range keys {
+        var v string
+        switch x := r.Data[k].(type) {
+        case []interface{}:
+            vs := make([]string, 0, len(x))
+            for _, e := range x { vs = append(vs, jsonText(e)) }
+            v = strings.Join(vs, ",")
+        default:
+            v = jsonText(x)
+        }
+        parts = append(parts, strings.ToUpper(k)+"="+v)
+    }
+    for _, f := range r.Flags { parts = append(parts, strings.ToUpper(f)) }
+    if r.Req != "" { parts = append(parts, "REQ="+r.Req) }
+    if r.TS != "" { parts = append(parts, "TS="+r.TS.String()) }
+    return strings.Join(parts, "|")
+}
+
+func jsonText(v interface{}) string {
+    switch x := v.(type) {
+    case string:
+        return x
+    case float64:
+        return strconv.FormatFloat(x, 'f', -1, 64)
+    case bool:
+        return strconv.FormatBool(x)
+    case nil:
+        return ""
+    }
+    b, _ := json.Marshal(v)
+    return string(b)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+    "net"
+    "strings"
+
+    "fyne.io/fyne/v2"
+    "fyne.io/fyne/v2/container"
+    "fyne.io/fyne/v2/theme"
+    "fyne.io/fyne/v2/widget"
+)
+
+// Static routes. QUERY_NET reports and CFG accepts
+//   ROUTES=10.20.0.0/16@192.168.1.254,10.30.0.5/32
+// (<dest>/<prefix>[@<gateway>]); ROUTES=none removes all static routes of the interface.
+
+// routeEditor is the list of route rows (destination, gateway, remove button) of the config form
+type routeEditor struct {
+    lang     string
+    rows     []*routeRow
+    box      *fyne.Container
+    addBtn   *widget.Button
+    title    *widget.Label
+    disabled bool
+}
+
+type routeRow struct {
+    dest, via *widget.Entry
+    remove    *widget.Button
+}
+
+func newRouteEditor(lang string) *routeEditor {
+    e := &routeEditor{lang: lang, box: container.NewVBox()}
+    e.title = widget.NewLabel(routesTitle(lang))
+    e.addBtn = widget.NewButtonWithIcon(addRouteText(lang), theme.ContentAddIcon(), func() { e.add("", "") })
+    return e
+}
+
+// Widget returns the editor: a title, one row per route and the add button
+func (e *routeEditor) Widget() fyne.CanvasObject {
+    return container.NewVBox(container.NewBorder(nil, nil, nil, e.addBtn, e.title), e.box)
+}
+
+func (e *routeEditor) add(dest, via string) {
+    r := &routeRow{dest: widget.NewEntry(), via: widget.NewEntry()}
+    r.dest.SetPlaceHolder(routeDestPlaceholder(e.lang))
+    r.via.SetPlaceHolder(routeViaPlaceholder(e.lang))
+    r.dest.SetText(dest)
+    r.via.SetText(via)
+    r.remove = widget.NewButtonWithIcon("", theme.DeleteIcon(), func() { e.removeRow(r) })
+    if e.disabled {
+        r.dest.Disable()
+        r.via.Disable()
+        r.remove.Disable()
+    }
+    e.rows = append(e.rows, r)
+    e.box.Add(container.NewBorder(nil, nil, nil, r.remove, container.NewGridWithColumns(2, r.dest, r.via)))
+}
+
+func (e *routeEditor) removeRow(r *routeRow) {
+    for i, x := range e.rows {
+        if x != r { continue }
+        e.rows = append(e.rows[:i], e.rows[i+1:]...)
+        e.box.Remove(e.box.Objects[i])
+        return
+    }
+}
+
+// SetRoutes replaces the rows with a ROUTES list as reported by QUERY_NET
+func (e *routeEditor) SetRoutes(list string) {
+    e.rows = nil
+    e.box.RemoveAll()
+    for _, r := range splitList(list) {
+        dest, via, _ := strings.Cut(r, "@")
+        e.add(dest, via)
+    }
+}
+
+// Routes returns the routes of the non-empty rows in wire form
+func (e *routeEditor) Routes() []string {
+    var out []string
+    for _, r := range e.rows {
+        dest, via := strings.TrimSpace(r.dest.Text), strings.TrimSpace(r.via.Text)
+        if dest == "" && via == "" { continue }
+        if via != "" { dest += "@" + via }
+        out = append(out, dest)
+    }
+    return out
+}
+
+// Valid reports whether every route has a destination network and a gateway of its family
+func (e *routeEditor) Valid() bool {
+    for _, r := range e.Routes() {
+        if !isValidRoute(r) { return false }
+    }
+    return true
+}
+
+func (e *routeEditor) SetEnabled(on bool) {
+    e.disabled = !on
+    setEnabled(e.addBtn, on)
+    for _, r := range e.rows {
+        if on { r.dest.Enable(); r.via.Enable() } else { r.dest.Disable(); r.via.Disable() }
+        setEnabled(r.remove, on)
+    }
+}
+
+func (e *routeEditor) SetLang(lang string) {
+    e.lang = lang
+    e.title.SetText(routesTitle(lang))
+    e.addBtn.SetText(addRouteText(lang))
+    for _, r := range e.rows {
+        r.dest.SetPlaceHolder(routeDestPlaceholder(lang))
+        r.via.SetPlaceHolder(routeViaPlaceholder(lang))
+    }
+}
+
+// isValidRoute validates <dest>[/<prefix>][@<gateway>]
+func isValidRoute(s string) bool {
+    dest, via, _ := strings.Cut(s, "@")
+    ip := net.ParseIP(dest)
+    if strings.Contains(dest, "/") {
+        var err error
+        if ip, _, err = net.ParseCIDR(dest); err != nil { return false }
+    }
+    if ip == nil { return false }
+    if via == "" { return true }
+    gw := net.ParseIP(via)
+    return gw != nil && (gw.To4() == nil) == (ip.To4() == nil)
+}
+
+// splitList splits a comma-separated list, dropping empty items
+func splitList(s string) []string {
+    var out []string
+    for _, p := range strings.Split(s, ",") {
+        if p = strings.TrimSpace(p); p != "" { out = append(out, p) }
+    }
+    return out
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+    "encoding/hex"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "fyne.io/fyne/v2"
+    "fyne.io/fyne/v2/container"
+    "fyne.io/fyne/v2/dialog"
+    "fyne.io/fyne/v2/theme"
+    "fyne.io/fyne/v2/widget"
+)
+
+// Wi-Fi tab. Devices with a wireless interface advertise
+//   WIFI_SCAN    -> WIFI_SCAN|IF=wlan0|SCAN=STARTED|COUNT=2|AP1.SSID=home|AP1.SSID_HEX=..|AP1.SIGNAL=-48|AP1.FREQ=2437|AP1.SEC=PSK|..
+// WIFI_SCAN answers at once with the results the device has; SCAN=STARTED means it started a new
+// scan, so the GUI asks again after wifiScanWait for the fresh results.
+//   WIFI_STATUS  -> WIFI_STATUS|IF=wlan0|STATE=COMPLETED|SSID=home|RSSI=-48|LINKSPEED=65|IP=..|NETWORKS=home,corp
+//   WIFI_SET     -> WIFI_ACK|IF=wlan0|SSID=home|FILE=..|APPLY_ACK  (or WIFI_NACK|ERR=..)
+// SSIDs with characters the text form cannot carry also arrive as SSID_HEX / NETWORKS_HEX.
+// WIFI_SET is signed like CFG; the SSID and the secrets are sent hex encoded (SSID_HEX, PSK_HEX,
+// IDENTITY_HEX, PASSWORD_HEX) so that any character survives the text and v2 encodings.
+
+const (
+    wifiSecPSK  = "WPA-PSK"
+    wifiSecEAP  = "WPA-EAP"
+    wifiSecOpen = "Open"
+)
+
+// wifiAP is one access point of a WIFI_SCAN reply
+type wifiAP struct {
+    SSID, BSSID, Freq, Sec string
+    Signal                 int
+}
+
+// wifiStatus is a WIFI_STATUS reply
+type wifiStatus struct {
+    Iface, State, SSID, RSSI, LinkSpeed, IP string
+    Networks                                []string
+}
+
+// replyMap returns the fields of a pipe-delimited reply with upper-cased keys
+func replyMap(msg string) map[string]string {
+    m := map[string]string{}
+    for _, p := range strings.Split(msg, "|")[1:] {
+        if k, v, ok := strings.Cut(p, "="); ok { m[strings.ToUpper(strings.TrimSpace(k))] = strings.TrimSpace(v) }
+    }
+    return m
+}
+
+// wifiNack returns the error of a WIFI_NACK reply, else nil
+func wifiNack(msg string) error {
+    if !strings.HasPrefix(strings.ToUpper(msg), "WIFI_NACK") { return nil }
+    return fmt.Errorf("WIFI_NACK: %s", replyField(msg, "ERR"))
+}
+
+func isWifiReply(prefix string) func(up string) bool {
+    return func(up string) bool { return strings.HasPrefix(up, prefix) || strings.HasPrefix(up, "WIFI_NACK") }
+}
+
+// wifiScanWait is how long a scan the device started takes
+const wifiScanWait = 3 * time.Second
+
+// scanWifi asks the device to scan and, when it started a new scan, asks again once it is done.
+// Older devices wait for the scan before replying, so timeout should be generous
+func scanWifi(d Device, iface string, timeout time.Duration) ([]wifiAP, error) {
+    msg, err := exchange(d, withIface(d, newDevRequest("WIFI_SCAN"), iface), "", false, timeout, isWifiReply("WIFI_SCAN"))
+    if err != nil { return nil, err }
+    if err := wifiNack(msg); err != nil { return nil, err }
+    if strings.EqualFold(replyField(msg, "SCAN"), "STARTED") {
+        time.Sleep(wifiScanWait)
+        if again, err := exchange(d, withIface(d, newDevRequest("WIFI_SCAN"), iface), "", false, timeout, isWifiReply("WIFI_SCAN")); err == nil && wifiNack(again) == nil {
+            msg = again
+        }
+    }
+    return parseWifiScan(msg), nil
+}
+
+func parseWifiScan(msg string) []wifiAP {
+    f := replyMap(msg)
+    n, _ := strconv.Atoi(f["COUNT"])
+    var aps []wifiAP
+    for i := 1; i <= n; i++ {
+        p := fmt.Sprintf("AP%d.", i)
+        ap := wifiAP{SSID: f[p+"SSID"], BSSID: f[p+"BSSID"], Freq: f[p+"FREQ"], Sec: f[p+"SEC"]}
+        ap.SSID = hexOr(f[p+"SSID_HEX"], ap.SSID)
+        ap.Signal, _ = strconv.Atoi(f[p+"SIGNAL"])
+        if ap.SSID != "" { aps = append(aps, ap) }
+    }
+    return aps
+}
+
+// hexOr returns the hex-decoded h, or def when h is empty or invalid
+func hexOr(h, def string) string {
+    if b, err := hex.DecodeString(h); err == nil && len(b) > 0 { return string(b) }
+    return def
+}
+
+func queryWifiStatus(d Device, iface string, timeout time.Duration) (wifiStatus, error) {
+    msg, err := exchange(d, withIface(d, newDevRequest("WIFI_STATUS"), iface), "", false, timeout, isWifiReply("WIFI_STATUS"))
+    if err != nil { return wifiStatus{}, err }
+    if err := wifiNack(msg); err != nil { return wifiStatus{}, err }
+    f := replyMap(msg)
+    st := wifiStatus{Iface: f["IF"], State: f["STATE"], SSID: hexOr(f["SSID_HEX"], f["SSID"]), RSSI: f["RSSI"], LinkSpeed: f["LINKSPEED"], IP: f["IP"]}
+    if hx := splitList(f["NETWORKS_HEX"]); len(hx) > 0 {
+        for _, h := range hx { st.Networks = append(st.Networks, hexOr(h, "")) }
+    } else {
+        st.Networks = splitList(f["NETWORKS"])
+    }
+    return st, nil
+}
+
+// buildWifiSet builds a WIFI_SET|APPLY=1 request for the security mode sec
+func buildWifiSet(ssid, sec, psk, identity, password string, hidden bool) *devRequest {
+    hx := func(s string) string { return hex.EncodeToString([]byte(s)) }
+    req := newDevRequest("WIFI_SET").set("SSID_HEX", hx(ssid))
+    switch sec {
+    case wifiSecPSK:
+        req.set("PSK_HEX", hx(psk))
+    case wifiSecEAP:
+        req.set("IDENTITY_HEX", hx(identity)).set("PASSWORD_HEX", hx(password))
+    }
+    if hidden { req.set("HIDDEN", "1") }
+    return req.set("APPLY", "1")
+}
+
+// sendWifiSet sends a WIFI_SET request (signed when key is set) and returns the WIFI_ACK reply
+func sendWifiSet(d Device, req *devRequest, key string, timeout time.Duration) (string, error) {
+    msg, err := exchange(d, req, key, true, timeout, isWifiReply("WIFI_ACK"))
+    if err != nil { return "", err }
+    return msg, wifiNack(msg)
+}
+
+// isValidWifiInput checks SSID length and the secret of sec as the device does
+func isValidWifiInput(ssid, sec, psk, identity string) bool {
+    if len(ssid) == 0 || len(ssid) > 32 { return false }
+    switch sec {
+    case wifiSecPSK:
+        if len(psk) == 64 {
+            _, err := hex.DecodeString(psk)
+            return err == nil
+        }
+        return len(psk) >= 8 && len(psk) <= 63
+    case wifiSecEAP:
+        return identity != ""
+    }
+    return true
+}
+
+// wifiPane is the content of the Wi-Fi tab
+type wifiPane struct {
+    lang   string
+    w      fyne.Window
+    status *widget.Label // window status line
+    key    func() string // admin key used to sign WIFI_SET
+
+    dev   *Device
+    iface string // wireless interface from LIST_IF, "" lets the device choose
+    aps   []wifiAP
+
+    stateLabel, ssidLabel, secLabel *widget.Label
+    refreshBtn, scanBtn, connectBtn *widget.Button
+    apList                          *widget.List
+    ssidEntry, pskEntry             *widget.Entry
+    identityEntry, passwordEntry    *widget.Entry
+    secSelect                       *widget.Select
+    hiddenCheck                     *widget.Check
+}
+
+func newWifiPane(lang string, w fyne.Window, status *widget.Label, key func() string) *wifiPane {
+    p := &wifiPane{lang: lang, w: w, status: status, key: key}
+    p.stateLabel = widget.NewLabel(selectDevicePrompt(lang))
+    p.stateLabel.Wrapping = fyne.TextWrapWord
+    p.refreshBtn = widget.NewButtonWithIcon(wifiRefreshText(lang), theme.ViewRefreshIcon(), p.refresh)
+    p.scanBtn = widget.NewButtonWithIcon(wifiScanText(lang), theme.SearchIcon(), p.scan)
+    p.apList = widget.NewList(
+        func() int { return len(p.aps) },
+        func() fyne.CanvasObject { return widget.NewLabel("") },
+        func(i widget.ListItemID, o fyne.CanvasObject) { o.(*widget.Label).SetText(wifiAPText(p.aps[i])) },
+    )
+    p.apList.OnSelected = func(i widget.ListItemID) {
+        if i < 0 || i >= len(p.aps) { return }
+        ap := p.aps[i]
+        p.ssidEntry.SetText(ap.SSID)
+        switch ap.Sec {
+        case "EAP":
+            p.secSelect.SetSelected(wifiSecEAP)
+        case "OPEN":
+            p.secSelect.SetSelected(wifiSecOpen)
+        default:
+            p.secSelect.SetSelected(wifiSecPSK)
+        }
+    }
+    p.ssidLabel = widget.NewLabel(wifiSSIDLabel(lang))
+    p.ssidEntry = widget.NewEntry()
+    p.ssidEntry.SetPlaceHolder("SSID")
+    p.pskEntry = widget.NewPasswordEntry()
+    p.identityEntry = widget.NewEntry()
+    p.passwordEntry = widget.NewPasswordEntry()
+    p.secLabel = widget.NewLabel(wifiSecLabel(lang))
+    p.secSelect = widget.NewSelect([]string{wifiSecPSK, wifiSecEAP, wifiSecOpen}, func(string) { p.updateSecFields() })
+    p.secSelect.Selected = wifiSecPSK
+    p.updateSecFields()
+    p.hiddenCheck = widget.NewCheck(wifiHiddenLabel(lang), nil)
+    p.connectBtn = widget.NewButtonWithIcon(wifiConnectText(lang), theme.ConfirmIcon(), p.connect)
+    p.connectBtn.Importance = widget.HighImportance
+    p.SetLang(lang)
+    p.SetDevice(nil)
+    return p
+}
+
+// Widget returns the tab content
+func (p *wifiPane) Widget() fyne.CanvasObject {
+    list := container.NewGridWrap(fyne.NewSize(360, 150), p.apList)
+    return container.NewVBox(
+        container.NewBorder(nil, nil, nil, p.refreshBtn, p.stateLabel),
+        container.NewBorder(nil, nil, nil, p.scanBtn, widget.NewSeparator()),
+        list,
+        container.NewGridWithColumns(2, p.ssidLabel, p.ssidEntry),
+        container.NewGridWithColumns(2, p.secLabel, p.secSelect),
+        p.pskEntry,
+        container.NewGridWithColumns(2, p.identityEntry, p.passwordEntry),
+        p.hiddenCheck,
+        p.connectBtn,
+    )
+}
+
+// SetDevice switches the tab to device d (nil when none is selected) and reads its Wi-Fi status
+func (p *wifiPane) SetDevice(d *Device) {
+    p.dev, p.iface, p.aps = d, "", nil
+    p.apList.UnselectAll()
+    p.apList.Refresh()
+    on := d != nil && d.advertises("WIFI_STATUS")
+    setEnabled(p.refreshBtn, on)
+    setEnabled(p.scanBtn, on && d.advertises("WIFI_SCAN"))
+    setEnabled(p.connectBtn, on && d.advertises("WIFI_SET"))
+    switch {
+    case d == nil:
+        p.stateLabel.SetText(selectDevicePrompt(p.lang))
+    case !on:
+        p.stateLabel.SetText(wifiUnsupported(p.lang))
+    default:
+        p.refresh()
+    }
+}
+
+// SetIface selects the wireless interface the commands are sent for (from LIST_IF)
+func (p *wifiPane) SetIface(ifs []ifaceInfo) {
+    for _, i := range ifs {
+        if i.Kind == "wlan" {
+            p.iface = i.Name
+            return
+        }
+    }
+}
+
+func (p *wifiPane) SetLang(lang string) {
+    p.lang = lang
+    p.refreshBtn.SetText(wifiRefreshText(lang))
+    p.scanBtn.SetText(wifiScanText(lang))
+    p.ssidLabel.SetText(wifiSSIDLabel(lang))
+    p.secLabel.SetText(wifiSecLabel(lang))
+    p.pskEntry.SetPlaceHolder(wifiPSKPlaceholder(lang))
+    p.identityEntry.SetPlaceHolder(wifiIdentityPlaceholder(lang))
+    p.passwordEntry.SetPlaceHolder(wifiPasswordPlaceholder(lang))
+    p.hiddenCheck.Text = wifiHiddenLabel(lang)
+    p.hiddenCheck.Refresh()
+    p.connectBtn.SetText(wifiConnectText(lang))
+    if p.dev == nil { p.stateLabel.SetText(selectDevicePrompt(lang)) }
+}
+
+// updateSecFields enables the secret entries of the selected security mode
+func (p *wifiPane) updateSecFields() {
+    psk, eap := p.secSelect.Selected == wifiSecPSK, p.secSelect.Selected == wifiSecEAP
+    if psk { p.pskEntry.Enable() } else { p.pskEntry.Disable() }
+    if eap { p.identityEntry.Enable(); p.passwordEntry.Enable() } else { p.identityEntry.Disable(); p.passwordEntry.Disable() }
+}
+
+func (p *wifiPane) refresh() {
+    d := p.dev
+    if d == nil { return }
+    p.stateLabel.SetText(wifiQuerying(p.lang))
+    go func() {
+        st, err := queryWifiStatus(*d, p.iface, 2*time.Second)
+        if p.dev != d { return }
+        if err != nil {
+            p.stateLabel.SetText(queryFailed(p.lang) + err.Error())
+            return
+        }
+        p.stateLabel.SetText(wifiStatusText(p.lang, st))
+    }()
+}
+
+func (p *wifiPane) scan() {
+    d := p.dev
+    if d == nil { return }
+    p.scanBtn.Disable()
+    p.status.SetText(wifiScanning(p.lang))
+    go func() {
+        aps, err := scanWifi(*d, p.iface, 8*time.Second)
+        p.scanBtn.Enable()
+        if p.dev != d { return }
+        if err != nil {
+            p.status.SetText(scanError(p.lang) + err.Error())
+            return
+        }
+        p.aps = aps
+        p.apList.UnselectAll()
+        p.apList.Refresh()
+        p.status.SetText(wifiFoundFmt(p.lang, len(aps)))
+    }()
+}
+
+func (p *wifiPane) connect() {
+    d := p.dev
+    if d == nil {
+        p.status.SetText(selectDevicePrompt(p.lang))
+        return
+    }
+    ssid, sec := p.ssidEntry.Text, p.secSelect.Selected
+    if !isValidWifiInput(ssid, sec, p.pskEntry.Text, strings.TrimSpace(p.identityEntry.Text)) {
+        p.status.SetText(wifiInvalidInput(p.lang))
+        dialog.NewInformation(errorTitle(p.lang), wifiInvalidInput(p.lang), p.w).Show()
+        return
+    }
+    req := withIface(*d, buildWifiSet(ssid, sec, p.pskEntry.Text, strings.TrimSpace(p.identityEntry.Text), p.passwordEntry.Text, p.hiddenCheck.Checked), p.iface)
+    dialog.NewConfirm(wifiConfirmTitle(p.lang), wifiConfirmMessage(p.lang, ssid), func(ok bool) {
+        if !ok { return }
+        p.connectBtn.Disable()
+        p.status.SetText(configSending(p.lang))
+        go func() {
+            ack, err := sendWifiSet(*d, req, p.key(), 3*time.Second)
+            p.connectBtn.Enable()
+            if err != nil {
+                text := sendFailed(p.lang) + err.Error()
+                if ae, ok := err.(*authError); ok { text = authRejected(p.lang) + ae.reason }
+                p.status.SetText(text)
+                dialog.NewInformation(errorTitle(p.lang), text, p.w).Show()
+                return
+            }
+            text := wifiSavedText(p.lang, strings.Contains(strings.ToUpper(ack), "APPLY_ACK"))
+            p.status.SetText(text)
+            dialog.NewInformation(infoTitle(p.lang), text, p.w).Show()
+            // give wpa_supplicant time to associate before reading the status again
+            time.AfterFunc(5*time.Second, func() { if p.dev == d { p.refresh() } })
+        }()
+    }, p.w).Show()
+}
+
+// wifiAPText is a scan result line: "home  -48 dBm  2.4 GHz  PSK"
+func wifiAPText(ap wifiAP) string {
+    parts := []string{ap.SSID, strconv.Itoa(ap.Signal) + " dBm"}
+    if f, err := strconv.Atoi(ap.Freq); err == nil {
+        band := "2.4 GHz"
+        if f >= 5000 { band = "5 GHz" }
+        if f >= 5925 { band = "6 GHz" }
+        parts = append(parts, band)
+    }
+    if ap.Sec != "" { parts = append(parts, ap.Sec) }
+    return strings.Join(parts, "  ")
+}
+
+// wifiStatusText describes a WIFI_STATUS reply, e.g. "wlan0: connected to home (-48 dBm, 65 Mb/s) 192.168.1.20"
+func wifiStatusText(lang string, st wifiStatus) string {
+    t := st.Iface + ": "
+    if st.State != "COMPLETED" {
+        t += wifiNotConnected(lang) + " (" + st.State + ")"
+    } else {
+        t += wifiConnectedTo(lang) + " " + st.SSID
+        var sig []string
+        if st.RSSI != "" { sig = append(sig, st.RSSI+" dBm") }
+        if st.LinkSpeed != "" { sig = append(sig, st.LinkSpeed+" Mb/s") }
+        if len(sig) > 0 { t += " (" + strings.Join(sig, ", ") + ")" }
+        if st.IP != "" { t += " " + st.IP }
+    }
+    if len(st.Networks) > 0 { t += "\n" + wifiSavedNetworks(lang) + strings.Join(st.Networks, ", ") }
+    return t
+}
+
+func wifiTabText(lang string) string              { if lang == "zh" { return "Wi-Fi" } ; return "Wi-Fi" }
+func networkTabText(lang string) string           { if lang == "zh" { return "网络" } ; return "Network" }
+func wifiUnsupported(lang string) string          { if lang == "zh" { return "该设备不支持Wi-Fi配置" } ; return "The device does not support Wi-Fi configuration" }
+func wifiRefreshText(lang string) string          { if lang == "zh" { return "刷新状态" } ; return "Refresh" }
+func wifiScanText(lang string) string             { if lang == "zh" { return "扫描Wi-Fi" } ; return "Scan Wi-Fi" }
+func wifiScanning(lang string) string             { if lang == "zh" { return "设备正在扫描Wi-Fi网络..." } ; return "Device is scanning for Wi-Fi networks..." }
+func wifiFoundFmt(lang string, n int) string      { if lang == "zh" { return fmt.Sprintf("发现 %d 个Wi-Fi网络", n) } ; return fmt.Sprintf("Found %d Wi-Fi network(s)", n) }
+func wifiQuerying(lang string) string             { if lang == "zh" { return "查询Wi-Fi状态中..." } ; return "Querying Wi-Fi status..." }
+func wifiSSIDLabel(lang string) string            { if lang == "zh" { return "网络名称 (SSID)" } ; return "Network name (SSID)" }
+func wifiSecLabel(lang string) string             { if lang == "zh" { return "安全类型" } ; return "Security" }
+func wifiPSKPlaceholder(lang string) string       { if lang == "zh" { return "Wi-Fi密码 (8-63个字符)" } ; return "Wi-Fi password (8-63 characters)" }
+func wifiIdentityPlaceholder(lang string) string  { if lang == "zh" { return "企业认证用户名" } ; return "Enterprise identity" }
+func wifiPasswordPlaceholder(lang string) string  { if lang == "zh" { return "企业认证密码" } ; return "Enterprise password" }
+func wifiHiddenLabel(lang string) string          { if lang == "zh" { return "隐藏网络" } ; return "Hidden network" }
+func wifiConnectText(lang string) string          { if lang == "zh" { return "保存并连接" } ; return "Save & Connect" }
+func wifiInvalidInput(lang string) string         { if lang == "zh" { return "SSID须为1-32字节；WPA-PSK密码须为8-63个字符或64位十六进制；WPA-EAP须填写用户名" } ; return "SSID must be 1-32 bytes; a WPA-PSK password 8-63 characters or 64 hex digits; WPA-EAP needs an identity" }
+func wifiConfirmTitle(lang string) string         { if lang == "zh" { return "确认Wi-Fi配置" } ; return "Confirm Wi-Fi Config" }
+func wifiConfirmMessage(lang, ssid string) string { if lang == "zh" { return "设备将连接到 " + ssid + "。若设备仅通过该Wi-Fi接入，密码错误会导致设备失联，确定继续吗？" } ; return "The device will connect to " + ssid + ". If it is reachable only over Wi-Fi, a wrong password makes it unreachable. Continue?" }
+func wifiSavedText(lang string, applied bool) string {
+    if applied { if lang == "zh" { return "Wi-Fi配置已写入并生效" } ; return "Wi-Fi config written and applied" }
+    if lang == "zh" { return "Wi-Fi配置已写入，但重新加载wpa_supplicant失败" } ; return "Wi-Fi config written, but reloading wpa_supplicant failed"
+}
+func wifiNotConnected(lang string) string         { if lang == "zh" { return "未连接" } ; return "not connected" }
+func wifiConnectedTo(lang string) string          { if lang == "zh" { return "已连接" } ; return "connected to" }
+func wifiSavedNetworks(lang string) string        { if lang == "zh" { return "已保存的网络: " } ; return "Saved networks: " }
@@ -0,0 +1,83 @@
+package main
+
+import (
+    "log"
+    "strconv"
+    "strings"
+)
+
+// Discovery and identity commands: TF, GET_ID, ID_REGEN.
+
+func init() {
+    registerCommand(&command{
+        Name:   "TF",
+        Help:   "Discovery: reply with ID, port and capabilities",
+        Handle: handleTF,
+    })
+    registerCommand(&command{
+        Name:   "GET_ID",
+        Help:   "Return the unique device ID",
+        Handle: handleGetID,
+    })
+    registerCommand(&command{
+        Name:   "ID_REGEN",
+        Auth:   true,
+        Help:   "Replace the unique ID with a new one by id_strategy or STRATEGY=timestamp|machine-id|mac|cpu-serial",
+        Handle: handleIDRegen,
+    })
+}
+
+// handleTF responds with discovery info: ID (from /etc/unique_ID, create if missing), PORT and
+// capabilities: protocol version, supported commands, firmware version and web page port.
+// VIA tells whether the request arrived by multicast, broadcast or unicast, OPTS lists the
+// optional protocol features (see deviceOpts) and FALLBACK=linklocal marks a device that only has a
+// link-local address (see linklocal.go). INST tells replies of one device apart from those of
+// another device with the same ID (see instanceID); HOST is the configured hostname.
+func handleTF(req *request) *response {
+    uid, err := ensureUniqueID()
+    if err != nil {
+        log.Printf("ensureUniqueID error: %v", err)
+    }
+    resp := newResponse("TF").set("ID", uid).set("PORT", settings.Port).set("V", strconv.Itoa(protoVersion))
+    resp.list("CMDS", commandNames()).set("FW", version)
+    if webPortOpen(settings.WebPort) { resp.set("WEB", settings.WebPort) }
+    resp.list("OPTS", deviceOpts()).set("FALLBACK", fallbackMode()).set("INST", instanceID).set("HOST", configuredHostname()).set("VIA", req.Via)
+    return resp
+}
+
+// deviceOpts lists optional protocol features clients may rely on: TARGET (requests with another
+// device's TARGET= are ignored, see forOtherDevice) and BCAST_REPLY (off-subnet clients get
+// broadcast replies, see bcastreply.go). Older firmware sends no OPTS.
+func deviceOpts() []string {
+    opts := []string{"TARGET"}
+    if settings.BcastReply { opts = append(opts, "BCAST_REPLY") }
+    return opts
+}
+
+// handleGetID queries the unique ID from /etc/unique_ID; create if missing per rule.
+// Reply is the bare field ID=<id> (no status token).
+func handleGetID(req *request) *response {
+    id, err := ensureUniqueID()
+    if err != nil {
+        log.Printf("ensureUniqueID error: %v", err)
+    }
+    return newResponse("").set("ID", id)
+}
+
+// handleIDRegen replaces the unique ID (and, as on first creation, the hostname Kan-<ID>), e.g.
+// after two devices turned out to share one: ID_REGEN_ACK|ID=<new>|OLD=<old>|STRATEGY=<s>.
+// ID_REGEN_NACK|ERR=BAD_STRATEGY, NO_SOURCE (the strategy's source is missing) or WRITE_FAILED.
+func handleIDRegen(req *request) *response {
+    strategy := settings.IDStrategy
+    if v := req.arg("STRATEGY"); v != "" { strategy = strings.ToLower(v) }
+    old, id, err := regenerateUniqueID(strategy)
+    if err == errBadStrategy || err == errNoIDSource {
+        return newResponse("ID_REGEN_NACK").set("ERR", err.Error())
+    }
+    if err != nil {
+        log.Printf("ID_REGEN: write %s: %v", settings.IDFile, err)
+        return newResponse("ID_REGEN_NACK").set("ERR", "WRITE_FAILED")
+    }
+    infof("unique ID changed from %s to %s (%s)", old, id, strategy)
+    return newResponse("ID_REGEN_ACK").set("ID", id).set("OLD", old).set("STRATEGY", strategy)
+}
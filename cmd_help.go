@@ -0,0 +1,33 @@
+package main
+
+// HELP / CMDS: list registered commands, or describe one with HELP|CMD=<name>.
+//   HELP                -> HELP|CMDS=CFG,GET_ID,...|AUTH=CFG,RESTART
+//   HELP|CMD=QUERY_NET  -> HELP|NAME=QUERY_NET|ALIASES=QUERY,QRY,...|AUTH=0|DESC=...
+
+func init() {
+    registerCommand(&command{
+        Name:    "HELP",
+        Aliases: []string{"CMDS"},
+        Help:    "List commands, or describe one with CMD=<name>",
+        Handle:  handleHelp,
+    })
+}
+
+func handleHelp(req *request) *response {
+    if name := req.arg("CMD"); name != "" {
+        c := lookupCommand(name)
+        if c == nil {
+            return newResponse("HELP_NACK").set("ERR", "UNKNOWN_CMD").list("CMDS", commandNames())
+        }
+        auth := "0"
+        if c.Auth { auth = "1" }
+        return newResponse("HELP").set("NAME", c.Name).list("ALIASES", c.Aliases).set("AUTH", auth).set("DESC", c.Help)
+    }
+    var authCmds []string
+    for _, n := range commandNames() {
+        if lookupCommand(n).Auth {
+            authCmds = append(authCmds, n)
+        }
+    }
+    return newResponse("HELP").list("CMDS", commandNames()).list("AUTH", authCmds)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "errors"
+    "io/fs"
+    "log"
+    "net"
+    "os"
+    "os/exec"
+    "regexp"
+    "strings"
+    "sync"
+)
+
+// Hostname commands: GET_HOSTNAME and SET_HOSTNAME.
+// The configured name is the content of hostname_file (default /etc/hostname); SET_HOSTNAME also
+// renames it in the matching line of hosts_file (default /etc/hosts) and with APPLY=1 makes it the
+// running hostname through hostnamectl. A new unique ID sets the name Kan-<ID> the same way.
+
+func init() {
+    registerCommand(&command{
+        Name:   "GET_HOSTNAME",
+        Help:   "Report the configured (NAME) and running (LIVE) hostname",
+        Handle: handleGetHostname,
+    })
+    registerCommand(&command{
+        Name:   "SET_HOSTNAME",
+        Auth:   true,
+        Help:   "Write NAME=<hostname> to the hostname file and hosts file; APPLY=1 also sets it live via hostnamectl",
+        Handle: handleSetHostname,
+    })
+}
+
+// hostLabel matches one RFC 1123 label: letters, digits and inner hyphens, at most 63 characters.
+var hostLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// maxHostname is the kernel's limit (HOST_NAME_MAX), below the 253 characters RFC 1123 allows.
+const maxHostname = 64
+
+// hostMu serializes writes of the hostname and hosts files (SET_HOSTNAME, new unique ID).
+var hostMu sync.Mutex
+
+// validHostname reports whether name is an RFC 1123 host name (dot-separated labels) that the
+// kernel accepts and that does not look like an IP address.
+func validHostname(name string) bool {
+    if name == "" || len(name) > maxHostname || net.ParseIP(name) != nil { return false }
+    for _, l := range strings.Split(name, ".") {
+        if !hostLabel.MatchString(l) { return false }
+    }
+    return true
+}
+
+// handleGetHostname replies HOSTNAME|NAME=<configured>|LIVE=<running>; they differ after a
+// SET_HOSTNAME without APPLY=1 until the next boot.
+func handleGetHostname(req *request) *response {
+    live, _ := os.Hostname()
+    return newResponse("HOSTNAME").set("NAME", configuredHostname()).set("LIVE", live)
+}
+
+// handleSetHostname replies SET_HOSTNAME_ACK|NAME=<name>[|APPLY_ACK|APPLY_NACK] or
+// SET_HOSTNAME_NACK|ERR=BAD_NAME or WRITE_FAILED.
+func handleSetHostname(req *request) *response {
+    name := req.arg("NAME")
+    if !validHostname(name) {
+        return newResponse("SET_HOSTNAME_NACK").set("ERR", "BAD_NAME")
+    }
+    if err := writeHostname(name); err != nil {
+        log.Printf("SET_HOSTNAME: %v", err)
+        return newResponse("SET_HOSTNAME_NACK").set("ERR", "WRITE_FAILED")
+    }
+    resp := newResponse("SET_HOSTNAME_ACK").set("NAME", name)
+    if !req.flag("APPLY") { return resp }
+    if out, err := exec.Command("hostnamectl", "set-hostname", name).CombinedOutput(); err != nil {
+        log.Printf("hostnamectl set-hostname %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+        return resp.flag("APPLY_NACK")
+    }
+    return resp.flag("APPLY_ACK")
+}
+
+// configuredHostname returns the name in hostname_file, else the running hostname.
+func configuredHostname() string {
+    if b, err := os.ReadFile(settings.HostnameFile); err == nil {
+        if n := strings.TrimSpace(string(b)); n != "" { return n }
+    }
+    n, _ := os.Hostname()
+    return n
+}
+
+// writeHostname writes name to hostname_file and renames the configured name in hosts_file
+// (see renameInHosts). Each file is replaced in one step (temporary file and rename); when the
+// hostname file cannot be replaced the old hosts file is put back, so both keep matching.
+func writeHostname(name string) error {
+    hostMu.Lock()
+    defer hostMu.Unlock()
+    old := configuredHostname()
+    hosts, err := os.ReadFile(settings.HostsFile)
+    if err != nil && !errors.Is(err, fs.ErrNotExist) { return err }
+    if err := replaceFile(settings.HostsFile, []byte(renameInHosts(string(hosts), old, name))); err != nil { return err }
+    if err := replaceFile(settings.HostnameFile, []byte(name+"\n")); err != nil {
+        if hosts != nil {
+            if rerr := replaceFile(settings.HostsFile, hosts); rerr != nil { log.Printf("restore %s: %v", settings.HostsFile, rerr) }
+        }
+        return err
+    }
+    return nil
+}
+
+// replaceFile writes data to path through a temporary file in the same directory.
+func replaceFile(path string, data []byte) error {
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0o644); err != nil { return err }
+    if err := os.Rename(tmp, path); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return nil
+}
+
+// renameInHosts returns the hosts file content with the names old (and its first label, for a
+// dotted name) replaced by name (and its first label) on every line listing them. Without such a
+// line the 127.0.1.1 line (the Debian convention for the own name) is set to name, or added.
+// Loopback lines (127.0.0.1, ::1) and the localhost names are never changed.
+func renameInHosts(content, old, name string) string {
+    short := func(n string) string { s, _, _ := strings.Cut(n, "."); return s }
+    names := func(n string) []string {
+        if short(n) != n { return []string{n, short(n)} }
+        return []string{n}
+    }
+    lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+    if content == "" { lines = nil }
+    renamed, self := false, -1
+    for i, l := range lines {
+        body, comment, hasComment := strings.Cut(l, "#")
+        f := strings.Fields(body)
+        if len(f) < 2 { continue }
+        if f[0] == "127.0.1.1" && self < 0 { self = i }
+        if isLoopbackEntry(f[0]) { continue }
+        changed := false
+        for j := 1; j < len(f); j++ {
+            switch {
+            case isLocalhostName(f[j]):
+            case old != "" && strings.EqualFold(f[j], old):
+                f[j], changed = name, true
+            case old != "" && short(old) != old && strings.EqualFold(f[j], short(old)):
+                f[j], changed = short(name), true
+            }
+        }
+        if !changed { continue }
+        renamed = true
+        l = f[0] + "\t" + strings.Join(dedupe(f[1:]), " ")
+        if hasComment { l += " #" + comment }
+        lines[i] = l
+    }
+    if !renamed {
+        l := "127.0.1.1\t" + strings.Join(names(name), " ")
+        if self >= 0 { lines[self] = l } else { lines = append(lines, l) }
+    }
+    return strings.Join(lines, "\n") + "\n"
+}
+
+// isLoopbackEntry reports whether addr is a loopback address other than 127.0.1.1, i.e. the
+// address of a localhost line.
+func isLoopbackEntry(addr string) bool {
+    ip := net.ParseIP(addr)
+    return ip != nil && ip.IsLoopback() && addr != "127.0.1.1"
+}
+
+// isLocalhostName reports whether n is localhost or one of its variants (localhost.localdomain,
+// ip6-localhost, ...).
+func isLocalhostName(n string) bool {
+    n = strings.ToLower(n)
+    return n == "localhost" || strings.HasPrefix(n, "localhost.") || strings.HasPrefix(n, "ip6-") || strings.HasSuffix(n, "-localhost")
+}
+
+// dedupe drops repeated names, keeping the first occurrence.
+func dedupe(names []string) []string {
+    var out []string
+    for _, n := range names {
+        dup := false
+        for _, o := range out {
+            if strings.EqualFold(o, n) { dup = true; break }
+        }
+        if !dup { out = append(out, n) }
+    }
+    return out
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestRenameInHosts(t *testing.T) {
+    debian := "127.0.0.1\tlocalhost\n127.0.1.1\tKan-0190\n\n# IPv6\n::1\tlocalhost ip6-localhost ip6-loopback\nff02::1\tip6-allnodes\n"
+    tests := []struct {
+        name, content, old, new, want string
+    }{
+        {"debian", debian, "Kan-0190", "cam01",
+            "127.0.0.1\tlocalhost\n127.0.1.1\tcam01\n\n# IPv6\n::1\tlocalhost ip6-localhost ip6-loopback\nff02::1\tip6-allnodes\n"},
+        {"case and comment", "192.168.1.10\tKAN-0190 kan-0190 # static\n", "Kan-0190", "cam01",
+            "192.168.1.10\tcam01 # static\n"},
+        {"dotted name", "127.0.1.1\tcam01.lab.example.com cam01\n", "cam01.lab.example.com", "cam02.lab.example.com",
+            "127.0.1.1\tcam02.lab.example.com cam02\n"},
+        {"own name on a loopback line", "127.0.0.1\tlocalhost Kan-0190\n::1\tlocalhost Kan-0190\n", "Kan-0190", "cam01",
+            "127.0.0.1\tlocalhost Kan-0190\n::1\tlocalhost Kan-0190\n127.0.1.1\tcam01\n"},
+        {"old name is localhost", debian, "localhost", "cam01",
+            "127.0.0.1\tlocalhost\n127.0.1.1\tcam01\n\n# IPv6\n::1\tlocalhost ip6-localhost ip6-loopback\nff02::1\tip6-allnodes\n"},
+        {"localhost variant", "127.0.0.1\tlocalhost.localdomain localhost\n192.168.1.10\tlocalhost.localdomain\n", "localhost.localdomain", "cam01",
+            "127.0.0.1\tlocalhost.localdomain localhost\n192.168.1.10\tlocalhost.localdomain\n127.0.1.1\tcam01\n"},
+        {"no own line", "127.0.0.1\tlocalhost\n", "raspberrypi", "cam01.lab",
+            "127.0.0.1\tlocalhost\n127.0.1.1\tcam01.lab cam01\n"},
+        {"empty file", "", "", "cam01", "127.0.1.1\tcam01\n"},
+        {"other hosts untouched", "192.168.1.20\tcam010 nas\n127.0.1.1\tcam01\n", "cam01", "cam02",
+            "192.168.1.20\tcam010 nas\n127.0.1.1\tcam02\n"},
+    }
+    for _, tt := range tests {
+        if got := renameInHosts(tt.content, tt.old, tt.new); got != tt.want {
+            t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestValidHostname(t *testing.T) {
+    tests := map[string]bool{
+        "cam01": true, "Kan-0190-A3F2-1C4B": true, "cam01.lab.example.com": true, "a": true,
+        "": false, "-cam": false, "cam-": false, "cam_01": false, "cam 01": false, "cam..lab": false,
+        "192.168.1.10": false, "::1": false, "cam01.": false, "cam\n01": false,
+        strings.Repeat("a.", 32) + "a": false, strings.Repeat("a.", 31) + "ab": true,
+    }
+    for name, want := range tests {
+        if got := validHostname(name); got != want { t.Errorf("validHostname(%q) = %v, want %v", name, got, want) }
+    }
+}
+
+func TestWriteHostname(t *testing.T) {
+    dir := t.TempDir()
+    saved := settings
+    t.Cleanup(func() { settings = saved })
+    settings.HostnameFile = filepath.Join(dir, "hostname")
+    settings.HostsFile = filepath.Join(dir, "hosts")
+    writeTestFile(t, settings.HostnameFile, "Kan-0190\n")
+    writeTestFile(t, settings.HostsFile, "127.0.0.1\tlocalhost\n127.0.1.1\tKan-0190\n")
+
+    if err := writeHostname("cam01"); err != nil { t.Fatal(err) }
+    if got := readTestFile(t, settings.HostnameFile); got != "cam01\n" { t.Errorf("hostname file = %q", got) }
+    if got := readTestFile(t, settings.HostsFile); got != "127.0.0.1\tlocalhost\n127.0.1.1\tcam01\n" { t.Errorf("hosts file = %q", got) }
+    if got := configuredHostname(); got != "cam01" { t.Errorf("configuredHostname = %q", got) }
+
+    // the hosts file is put back when the hostname file cannot be replaced
+    settings.HostnameFile = filepath.Join(dir, "missing", "hostname")
+    if err := writeHostname("cam02"); err == nil { t.Fatal("no error for an unwritable hostname file") }
+    if got := readTestFile(t, settings.HostsFile); got != "127.0.0.1\tlocalhost\n127.0.1.1\tcam01\n" { t.Errorf("hosts file not restored: %q", got) }
+    if _, err := os.Stat(settings.HostsFile + ".tmp"); !os.IsNotExist(err) { t.Errorf("temporary file left behind: %v", err) }
+}
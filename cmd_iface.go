@@ -0,0 +1,123 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// Interface listing: LIST_IF reports every network interface (except loopback) as
+//   IF_LIST|IFS=eth0,eth1|DEFAULT=eth0|BACKEND=networkd|eth0.MAC=..|eth0.STATE=up|
+//   eth0.ADDR=192.168.1.10/24,fe80::1/64|eth0.FILE=/etc/systemd/network/eth0.network|eth1.MAC=..
+// STATE is the kernel operstate (up, down, dormant, ...); FILE is the backend file configuring the
+// interface, omitted if there is none yet. DEFAULT is the interface CFG and QUERY_NET use without IF=.
+// The topology follows as <if>.KIND (the kernel's device type: vlan, bond, wlan, ...; omitted for
+// plain ethernet), <if>.PARENT and <if>.VLAN of a VLAN, <if>.SLAVES, <if>.MODE and <if>.ACTIVE of
+// a bond and <if>.MASTER of a bond slave; QUERY_NET reports the same fields without the prefix.
+
+var errNoIface = errors.New("NO_IF")
+
+func init() {
+    registerCommand(&command{
+        Name:    "LIST_IF",
+        Aliases: []string{"IFS", "LIST_IFACES"},
+        Help:    "List interfaces with MAC, link state, addresses and backend file",
+        Handle:  handleListIf,
+    })
+}
+
+func handleListIf(req *request) *response {
+    ifaces, err := net.Interfaces()
+    if err != nil {
+        return newResponse("IF_LIST_NACK").set("ERR", "NO_IFACES")
+    }
+    resp := newResponse("IF_LIST")
+    var names []string
+    for _, ifi := range ifaces {
+        if ifi.Flags&net.FlagLoopback == 0 { names = append(names, ifi.Name) }
+    }
+    resp.list("IFS", names).set("DEFAULT", defaultIface()).set("BACKEND", netBackend.Name())
+    for _, ifi := range ifaces {
+        if ifi.Flags&net.FlagLoopback != 0 { continue }
+        var addrs []string
+        if as, err := ifi.Addrs(); err == nil {
+            for _, a := range as {
+                addrs = append(addrs, a.String())
+            }
+        }
+        resp.set(ifi.Name+".MAC", ifi.HardwareAddr.String()).
+            set(ifi.Name+".STATE", linkState(ifi)).
+            list(ifi.Name+".ADDR", addrs).
+            set(ifi.Name+".FILE", netBackend.File(ifi.Name))
+        readLinkInfo(ifi.Name).report(resp, ifi.Name+".")
+    }
+    return resp
+}
+
+// linkInfo is the place of an interface in the VLAN / bond topology.
+type linkInfo struct {
+    Kind, Parent, VLAN, Master, Mode, Active string
+    Slaves                                   []string
+}
+
+// readLinkInfo reads the topology of name from sysfs (and /proc/net/vlan for the VLAN id).
+func readLinkInfo(name string) (l linkInfo) {
+    dir := filepath.Join("/sys/class/net", name)
+    l.Kind = linkKind(name)
+    if t, err := os.Readlink(filepath.Join(dir, "master")); err == nil { l.Master = filepath.Base(t) }
+    switch l.Kind {
+    case "vlan":
+        if m, _ := filepath.Glob(filepath.Join(dir, "lower_*")); len(m) > 0 { l.Parent = strings.TrimPrefix(filepath.Base(m[0]), "lower_") }
+        if b, err := os.ReadFile(filepath.Join("/proc/net/vlan", name)); err == nil {
+            if f := strings.Fields(string(b)); len(f) > 2 && f[1] == "VID:" { l.VLAN = f[2] }
+        }
+    case "bond":
+        l.Slaves = strings.Fields(readSysfs(filepath.Join(dir, "bonding/slaves")))
+        if f := strings.Fields(readSysfs(filepath.Join(dir, "bonding/mode"))); len(f) > 0 { l.Mode = f[0] }
+        l.Active = readSysfs(filepath.Join(dir, "bonding/active_slave"))
+    }
+    return l
+}
+
+// report adds the topology fields, named prefix+KIND etc., to resp.
+func (l linkInfo) report(resp *response, prefix string) *response {
+    return resp.set(prefix+"KIND", l.Kind).set(prefix+"PARENT", l.Parent).set(prefix+"VLAN", l.VLAN).
+        list(prefix+"SLAVES", l.Slaves).set(prefix+"MODE", l.Mode).set(prefix+"ACTIVE", l.Active).
+        set(prefix+"MASTER", l.Master)
+}
+
+// linkKind returns the DEVTYPE of the interface (vlan, bond, wlan, bridge, ...), "" for plain devices.
+func linkKind(name string) string {
+    for _, l := range strings.Split(readSysfs(filepath.Join("/sys/class/net", name, "uevent")), "\n") {
+        if v, ok := strings.CutPrefix(l, "DEVTYPE="); ok { return v }
+    }
+    return ""
+}
+
+// readSysfs returns the trimmed content of a sysfs file, "" if it cannot be read.
+func readSysfs(path string) string {
+    b, err := os.ReadFile(path)
+    if err != nil { return "" }
+    return strings.TrimSpace(string(b))
+}
+
+// linkState returns the operstate of the interface from sysfs, else up/down from its flags.
+func linkState(ifi net.Interface) string {
+    if b, err := os.ReadFile(filepath.Join("/sys/class/net", ifi.Name, "operstate")); err == nil {
+        if s := strings.TrimSpace(string(b)); s != "" { return s }
+    }
+    if ifi.Flags&net.FlagUp != 0 { return "up" }
+    return "down"
+}
+
+// targetIface returns the interface a request is for: IF=<name> (which must exist), else defaultIface.
+func targetIface(req *request) (string, error) {
+    name := req.arg("IF")
+    if name == "" { return defaultIface(), nil }
+    if _, err := net.InterfaceByName(name); err != nil {
+        return "", errNoIface
+    }
+    return name, nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "regexp"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+)
+
+// Network commands: QUERY_NET (read current parameters), CFG (write configuration) and
+// CFG_CONFIRM (commit a CFG|APPLY=1 transaction, see netapply.go). QUERY_NET and CFG work on
+// IF=<name> when given (see LIST_IF in cmd_iface.go), else on the default interface.
+// Besides the addresses they carry DOMAINS=<search domains>, MTU=<bytes>, NTP=<servers> and
+// ROUTES=<dest>/<prefix>[@<gateway>],...; on CFG a list of "none" (MTU=0) clears the setting.
+// CFG also creates and removes VLAN and bond interfaces (see linkChange and netdev.go).
+
+func init() {
+    registerCommand(&command{
+        Name:    "QUERY_NET",
+        Aliases: []string{"QUERY", "QRY", "QRY_NET", "NET", "GET_NET"},
+        Help:    "Report current IP/MASK/GW/DNS, IPv6 IP6/GW6/DNS6, DOMAINS/MTU/NTP/ROUTES, interface name and network backend [IF=<name>]",
+        Handle:  handleQueryNet,
+    })
+    registerCommand(&command{
+        Name:   "CFG",
+        Auth:   true,
+        Help:   "Save ID/IP/PORT and write static (IP/MASK/GW/DNS, IP6/PREFIX6/GW6, DOMAINS/MTU/NTP/ROUTES) or DHCP=1 network config [IF=<name>], creating VLAN=<id> or BOND=<name>|SLAVES=.. (REMOVE=1 deletes); APPLY=1 [CONFIRM=<s>] applies it with rollback",
+        Handle: handleCfg,
+    })
+    registerCommand(&command{
+        Name:   "CFG_CONFIRM",
+        Auth:   true,
+        Help:   "Confirm a pending CFG|APPLY=1 (TXN=<id>), sent to the new address",
+        Handle: handleCfgConfirm,
+    })
+}
+
+// handleQueryNet queries current network parameters (IP/MASK/GW/DNS, IPv6 IP6/GW6/DNS6,
+// DOMAINS/MTU/NTP/ROUTES) and reports the network backend in use; NET_NACK|ERR=NO_IF for an unknown IF=.
+func handleQueryNet(req *request) *response {
+    ifn, err := targetIface(req)
+    if err != nil {
+        return newResponse("NET_NACK").set("ERR", err.Error())
+    }
+    c := getNetworkParams(ifn)
+    var dns []string
+    for _, d := range c.DNS {
+        if isIPv4(d) { dns = append(dns, d) }
+    }
+    resp := newResponse("NET").set("IP", c.IP).set("MASK", c.Mask).set("GW", c.GW).list("DNS", dns)
+    ip6, gw6, dns6 := getIPv6Params(ifn)
+    resp.list("IP6", ip6).set("GW6", gw6).list("DNS6", dns6)
+    resp.list("DOMAINS", c.Domains).set("MTU", c.MTU).list("NTP", c.NTP).list("ROUTES", routeStrings(c.Routes))
+    readLinkInfo(ifn).report(resp, "")
+    // Include both IF and IFACE for maximum client compatibility
+    return resp.set("IF", ifn).set("IFACE", ifn).set("BACKEND", netBackend.Name())
+}
+
+// handleCfg saves ID/IP/PORT and writes the network configuration; CFG_NACK|ERR=BAD_VALUE for a
+// value the backends must not see (see checkCfgValues), NO_IF for an unknown IF=.
+func handleCfg(req *request) *response {
+    if err := checkCfgValues(req); err != nil {
+        log.Printf("CFG: %v", err)
+        return newResponse("CFG_NACK").set("ERR", errBadValue.Error())
+    }
+    iface, err := targetIface(req)
+    if err != nil {
+        return newResponse("CFG_NACK").set("ERR", err.Error())
+    }
+    cfg := DeviceConfig{ID: req.arg("ID"), IP: req.arg("IP"), Port: req.arg("PORT")}
+    if cfg.ID == "" {
+        // If no ID supplied, assume this device
+        cfg.ID = settings.DeviceID
+    }
+    // Persist config to local JSON file (safe alternative to changing OS network settings)
+    if err := saveConfig(cfg); err != nil {
+        log.Printf("config save error: %v", err)
+        return newResponse("CFG_NACK").set("ERR", "SAVE_FAILED")
+    }
+    resp := newResponse("CFG_ACK").set("ID", cfg.ID)
+    // Additionally, apply network changes through the network backend (see netbackend.go):
+    // - VLAN=/BOND= first create (or with REMOVE=1 delete) that interface, see netdev.go
+    // - If DHCP flag present, write DHCP config
+    // - Else if IP/MASK/GW/DNS present, write static config
+    // Note: the backend only applies the change (restarts networkd, ...) with APPLY=1, which rolls back unless confirmed.
+    link, linkWrite, err := linkChange(req, iface)
+    if err != nil {
+        return resp.set("ERR", err.Error()).flag("NET_NACK")
+    }
+    if link != "" { iface = link }
+    var write func() error
+    var addrs []string // new addresses CFG_CONFIRM must arrive at; unknown with DHCP
+    if req.flag("DHCP") || (link != "" && !hasStaticParams(req)) {
+        write = func() error { return netBackend.WriteDHCP(iface) }
+    } else {
+        nc := netConfig{IP: req.arg("IP"), Mask: req.arg("MASK"), GW: req.arg("GW"), DNS: req.args("DNS"), GW6: req.arg("GW6")}
+        if !hasStaticParams(req) {
+            return resp
+        }
+        if v := req.arg("IP6"); v != "" {
+            ip6, err := normalizeIPv6CIDR(v, req.arg("PREFIX6"))
+            if err != nil {
+                log.Printf("CFG: %v", err)
+                return resp.flag("NET_NACK")
+            }
+            nc.IP6 = ip6
+        }
+        if nc.GW6 != "" && !isIPv6(nc.GW6) {
+            log.Printf("CFG: invalid IPv6 gateway %q", nc.GW6)
+            return resp.flag("NET_NACK")
+        }
+        if err := parseNetExtras(req, &nc); err != nil {
+            log.Printf("CFG: %v", err)
+            return resp.flag("NET_NACK")
+        }
+        write = func() error { return netBackend.WriteStatic(iface, nc) }
+        if nc.IP != "" { addrs = append(addrs, nc.IP) }
+        if nc.IP6 != "" { addrs = append(addrs, strings.SplitN(nc.IP6, "/", 2)[0]) }
+    }
+    if linkWrite != nil {
+        if req.flag("REMOVE") {
+            write, addrs = linkWrite, nil
+        } else {
+            configure := write
+            write = func() error {
+                if err := linkWrite(); err != nil { return err }
+                return configure()
+            }
+        }
+    }
+    if !req.flag("APPLY") {
+        if err := write(); err != nil {
+            log.Printf("apply network config error: %v", err)
+            return resp.flag("NET_NACK")
+        }
+        return resp.flag("NET_ACK")
+    }
+
+    timeout := settings.ConfirmTime
+    if v, err := strconv.Atoi(req.arg("CONFIRM")); err == nil && v > 0 { timeout = v }
+    t, err := beginNetApply(iface, write, addrs, time.Duration(timeout)*time.Second)
+    if err != nil {
+        log.Printf("apply network config error: %v", err)
+        if err == errTxnPending { resp.set("ERR", err.Error()) }
+        return resp.flag("NET_NACK")
+    }
+    return resp.flag("NET_ACK").flag("APPLY_PENDING").set("TXN", t.ID).set("CONFIRM", strconv.Itoa(timeout))
+}
+
+var (
+    errLinkUnsupported = errors.New("UNSUPPORTED")
+    errBadLink         = errors.New("BAD_LINK")
+    errBadValue        = errors.New("BAD_VALUE")
+)
+
+// checkCfgValues rejects a CFG whose values could change the meaning of the configuration files
+// the backends write: control characters (a newline would start a new line, e.g. an ifupdown
+// "up" hook run as root) in any value, IP/GW that are not IPv4 addresses, DNS servers that are not
+// IP addresses and a MASK that is not a contiguous IPv4 netmask.
+func checkCfgValues(req *request) error {
+    for k, vs := range req.Args {
+        for _, v := range vs {
+            if hasControl(k) || hasControl(v) { return fmt.Errorf("control character in %s", k) }
+        }
+    }
+    for _, k := range []string{"IP", "GW"} {
+        if v := req.arg(k); v != "" && !isIPv4(v) { return fmt.Errorf("invalid %s %q", k, v) }
+    }
+    for _, d := range req.args("DNS") {
+        if net.ParseIP(d) == nil { return fmt.Errorf("invalid DNS server %q", d) }
+    }
+    if v := req.arg("MASK"); v != "" && !validMask(v) { return fmt.Errorf("invalid netmask %q", v) }
+    return nil
+}
+
+// hasControl reports whether s contains an ASCII or Unicode control character.
+func hasControl(s string) bool {
+    return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+// validMask reports whether mask is a dotted IPv4 netmask that maskToPrefix accepts and whose
+// bits are contiguous.
+func validMask(mask string) bool {
+    ip := net.ParseIP(strings.TrimSpace(mask)).To4()
+    if ip == nil || maskToPrefix(mask) == 0 { return false }
+    ones, bits := net.IPMask(ip).Size()
+    return bits == 32 && ones == maskToPrefix(mask)
+}
+
+// linkName matches names allowed for bonds (at most 15 bytes, as the kernel requires).
+var linkName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+
+// linkChange handles VLAN=<id> (on iface) and BOND=<name>|SLAVES=<a>,<b>[|PRIMARY=<a>] of a CFG:
+// it returns the interface the rest of the CFG configures and the step creating it, or with
+// REMOVE=1 the step deleting it. Without VLAN= and BOND= it returns "" and nil. The errors are
+// the ERR codes of the reply.
+func linkChange(req *request, iface string) (string, func() error, error) {
+    vlan, bond := req.arg("VLAN"), req.arg("BOND")
+    if vlan == "" && bond == "" { return "", nil, nil }
+    lb, ok := netBackend.(linkBackend)
+    if !ok { return "", nil, errLinkUnsupported }
+    if vlan != "" {
+        id, err := strconv.Atoi(vlan)
+        name := iface + "." + vlan
+        if err != nil || id < 1 || id > 4094 || len(name) > 15 { return "", nil, errBadLink }
+        if req.flag("REMOVE") {
+            if !lb.HasLink(name) { return "", nil, errNoLink }
+            return name, func() error { return lb.RemoveVLAN(name) }, nil
+        }
+        return name, func() error { _, err := lb.AddVLAN(iface, id); return err }, nil
+    }
+    if !linkName.MatchString(bond) { return "", nil, errBadLink }
+    if req.flag("REMOVE") {
+        if !lb.HasLink(bond) { return "", nil, errNoLink }
+        return bond, func() error { return lb.RemoveBond(bond) }, nil
+    }
+    slaves, primary := req.args("SLAVES"), req.arg("PRIMARY")
+    if len(slaves) == 0 { return "", nil, errBadLink }
+    for _, s := range slaves {
+        if _, err := net.InterfaceByName(s); err != nil { return "", nil, errNoIface }
+    }
+    if primary != "" && !slices.Contains(slaves, primary) { return "", nil, errBadLink }
+    return bond, func() error { return lb.AddBond(bond, slaves, primary) }, nil
+}
+
+// hasStaticParams reports whether a CFG carries static network settings.
+func hasStaticParams(req *request) bool {
+    for _, k := range []string{"IP", "MASK", "GW", "DNS", "IP6", "GW6"} {
+        if req.arg(k) != "" { return true }
+    }
+    return hasNetExtras(req)
+}
+
+// netExtraKeys are the CFG settings besides the addresses, gateways and DNS servers.
+var netExtraKeys = []string{"DOMAINS", "MTU", "NTP", "ROUTES"}
+
+func hasNetExtras(req *request) bool {
+    for _, k := range netExtraKeys {
+        if len(req.Args[k]) > 0 { return true }
+    }
+    return false
+}
+
+// listArg returns the values of a list setting: nil if absent, empty (but non-nil) for "none".
+func listArg(req *request, key string) []string {
+    vs := req.args(key)
+    if len(req.Args[key]) == 0 { return nil }
+    if len(vs) == 0 || (len(vs) == 1 && strings.EqualFold(vs[0], "none")) { return []string{} }
+    return vs
+}
+
+// parseNetExtras validates DOMAINS, MTU, NTP and ROUTES of a CFG into c.
+func parseNetExtras(req *request, c *netConfig) error {
+    c.Domains = listArg(req, "DOMAINS")
+    for _, d := range c.Domains {
+        if !validDomainName(d) { return fmt.Errorf("invalid search domain %q", d) }
+    }
+    if v := req.arg("MTU"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || (n != 0 && (n < 68 || n > 65535)) { return fmt.Errorf("invalid MTU %q", v) }
+        c.MTU = strconv.Itoa(n)
+    }
+    c.NTP = listArg(req, "NTP")
+    for _, s := range c.NTP {
+        if net.ParseIP(s) == nil && !validDomainName(s) { return fmt.Errorf("invalid NTP server %q", s) }
+    }
+    if rs := listArg(req, "ROUTES"); rs != nil {
+        c.Routes = []netRoute{}
+        for _, s := range rs {
+            r, err := parseRoute(s)
+            if err != nil { return err }
+            c.Routes = append(c.Routes, r)
+        }
+    }
+    return nil
+}
+
+// validDomainName reports whether s is a DNS name of RFC 1123 labels (see hostLabel), at most
+// 253 characters with an optional trailing dot. Anything else, e.g. a newline, could add lines to
+// the configuration files.
+func validDomainName(s string) bool {
+    s = strings.TrimSuffix(s, ".")
+    if s == "" || len(s) > 253 { return false }
+    for _, l := range strings.Split(s, ".") {
+        if !hostLabel.MatchString(l) { return false }
+    }
+    return true
+}
+
+// handleCfgConfirm commits the pending network change; replies CFG_CONFIRM_NACK|ERR=NO_TXN,
+// TXN_MISMATCH or WRONG_ADDR (not sent to the new address) otherwise.
+func handleCfgConfirm(req *request) *response {
+    if err := confirmNetTxn(req.arg("TXN"), req.Dst); err != nil {
+        return newResponse("CFG_CONFIRM_NACK").set("ERR", err.Error())
+    }
+    return newResponse("CFG_CONFIRM_ACK").set("TXN", req.arg("TXN"))
+}
@@ -0,0 +1,25 @@
+package main
+
+import "log"
+
+// RESTART: reboot the host (mutating, requires auth when a key is set).
+
+func init() {
+    registerCommand(&command{
+        Name:   "RESTART",
+        Auth:   true,
+        Help:   "Reboot the device",
+        Handle: handleRestart,
+    })
+}
+
+// handleRestart attempts to restart the host; requires appropriate permissions on device side.
+// Listening GUIs are told beforehand with HELLO|EVENT=restart.
+func handleRestart(req *request) *response {
+    sendHello("restart")
+    if err := restartHost(); err != nil {
+        log.Printf("restart host error: %v", err)
+        return newResponse("RESTART_NACK").set("ERR", err.Error())
+    }
+    return newResponse("RESTART_ACK")
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Wi-Fi client configuration through wpa_supplicant (wpa_cli):
+//   WIFI_SCAN [IF=<wlan>]   WIFI_SCAN|IF=wlan0|SCAN=STARTED|COUNT=2|AP1.SSID=home|AP1.BSSID=..|
+//                           AP1.SIGNAL=-48|AP1.FREQ=2437|AP1.SEC=PSK|AP2.SSID=..  (strongest first,
+//                           one entry per SSID, as many as fit in maxScanReply). The reply carries
+//                           the results wpa_supplicant has at hand; SCAN=STARTED says a new scan
+//                           was started, whose results a WIFI_SCAN a few seconds later returns. At
+//                           most one scan is started per wifiScanInterval, so repeated requests do
+//                           not keep the radio busy.
+//   WIFI_SET|SSID=home|PSK=secret [APPLY=1]   or  SSID=corp|IDENTITY=alice|PASSWORD=..|EAP=PEAP
+//                           writes the network to <wpa_dir>/wpa_supplicant-<wlan>.conf (the file of
+//                           the wpa_supplicant@<wlan> unit), replacing a network with the same SSID;
+//                           APPLY=1 reloads wpa_supplicant. SSID, PSK, IDENTITY and PASSWORD may be
+//                           sent hex encoded as <KEY>_HEX= (values with '|', ',' or blanks).
+//   WIFI_STATUS [IF=<wlan>] WIFI_STATUS|IF=wlan0|STATE=COMPLETED|SSID=home|BSSID=..|FREQ=2437|
+//                           RSSI=-48|LINKSPEED=65|IP=192.168.1.20|NETWORKS=home,corp
+// SSIDs that are not plain printable ASCII (or contain '|' or ',') are also sent hex encoded as
+// SSID_HEX=, AP<n>.SSID_HEX= and NETWORKS_HEX= (all networks).
+// Without IF= the commands use wifi_iface, else the first wireless interface. The addresses of the
+// interface are configured with CFG|IF=<wlan> like those of any other interface. The secrets travel
+// in the clear: set a key (see auth.go) so that at least nobody else can change them.
+
+var (
+    errNoWifi  = errors.New("NO_WIFI")
+    errNotWifi = errors.New("NOT_WIFI")
+    errNoWpa   = errors.New("NO_WPA")
+)
+
+const (
+    defaultWpaDir = "/etc/wpa_supplicant"
+    // maxScanReply bounds the encoded WIFI_SCAN reply in bytes, so that it fits an unfragmented
+    // datagram on a 1500-byte MTU; the weakest access points are left out.
+    maxScanReply = 1400
+)
+
+// wifiScanInterval is the least time between two scans started by WIFI_SCAN.
+var wifiScanInterval = 10 * time.Second
+
+// wifiScans holds when WIFI_SCAN last started a scan, per interface.
+var (
+    wifiScanMu sync.Mutex
+    wifiScans  = map[string]time.Time{}
+)
+
+func init() {
+    registerCommand(&command{
+        Name:   "WIFI_SCAN",
+        Help:   "Scan for Wi-Fi networks: SSID, BSSID, SIGNAL (dBm), FREQ (MHz) and SEC of each [IF=<wlan>]",
+        Handle: handleWifiScan,
+    })
+    registerCommand(&command{
+        Name:   "WIFI_SET",
+        Auth:   true,
+        Help:   "Write a Wi-Fi network: SSID with PSK, IDENTITY/PASSWORD [EAP=PEAP|TTLS] or none (open) [HIDDEN=1] [COUNTRY=<cc>] [IF=<wlan>]; APPLY=1 reloads wpa_supplicant",
+        Handle: handleWifiSet,
+    })
+    registerCommand(&command{
+        Name:   "WIFI_STATUS",
+        Help:   "Report Wi-Fi association state, SSID, BSSID, FREQ, RSSI, LINKSPEED, IP and configured NETWORKS [IF=<wlan>]",
+        Handle: handleWifiStatus,
+    })
+}
+
+func handleWifiScan(req *request) *response {
+    iface, err := wifiIface(req)
+    if err != nil {
+        return newResponse("WIFI_NACK").set("ERR", err.Error())
+    }
+    out, err := wpaCli(iface, "scan_results")
+    if err != nil {
+        log.Printf("wifi scan: %v", err)
+        return newResponse("WIFI_NACK").set("ERR", errNoWpa.Error()).set("IF", iface)
+    }
+    return scanReply(req, iface, startWifiScan(iface), parseScanResults(out))
+}
+
+// scanReply builds the WIFI_SCAN reply with as many of aps as fit in maxScanReply bytes,
+// measured in the wire format of req (SSID_HEX copies and the echoed REQ/TS included).
+func scanReply(req *request, iface string, started bool, aps []accessPoint) *response {
+    build := func(n int) *response {
+        resp := newResponse("WIFI_SCAN").set("IF", iface)
+        if started { resp.set("SCAN", "STARTED") }
+        resp.set("COUNT", strconv.Itoa(n))
+        for i, ap := range aps[:n] {
+            p := fmt.Sprintf("AP%d.", i+1)
+            resp.set(p+"SSID", ap.SSID)
+            if !plainText(ap.SSID) { resp.set(p+"SSID_HEX", hex.EncodeToString([]byte(ap.SSID))) }
+            resp.set(p+"BSSID", ap.BSSID).set(p+"SIGNAL", strconv.Itoa(ap.Signal)).set(p+"FREQ", ap.Freq).set(p+"SEC", ap.Sec)
+        }
+        return resp
+    }
+    n := 0
+    for n < len(aps) && len(build(n+1).encode(req)) <= maxScanReply { n++ }
+    return build(n)
+}
+
+func handleWifiSet(req *request) *response {
+    iface, err := wifiIface(req)
+    if err != nil {
+        return newResponse("WIFI_NACK").set("ERR", err.Error())
+    }
+    n, err := wifiNetworkFromRequest(req)
+    if err != nil {
+        return newResponse("WIFI_NACK").set("ERR", err.Error()).set("IF", iface)
+    }
+    country := strings.ToUpper(req.arg("COUNTRY"))
+    if country != "" && (len(country) != 2 || country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z') {
+        return newResponse("WIFI_NACK").set("ERR", "BAD_COUNTRY").set("IF", iface)
+    }
+    path := wpaConfFile(iface)
+    if err := writeWpaNetwork(path, n, country); err != nil {
+        log.Printf("wifi config write error: %v", err)
+        return newResponse("WIFI_NACK").set("ERR", "SAVE_FAILED").set("IF", iface)
+    }
+    resp := newResponse("WIFI_ACK").set("IF", iface).set("SSID", n.SSID).set("FILE", path)
+    if !req.flag("APPLY") {
+        return resp
+    }
+    if err := applyWpa(iface); err != nil {
+        log.Printf("wifi apply error: %v", err)
+        return resp.flag("APPLY_NACK")
+    }
+    return resp.flag("APPLY_ACK")
+}
+
+func handleWifiStatus(req *request) *response {
+    iface, err := wifiIface(req)
+    if err != nil {
+        return newResponse("WIFI_NACK").set("ERR", err.Error())
+    }
+    resp := newResponse("WIFI_STATUS").set("IF", iface)
+    if b, err := os.ReadFile(wpaConfFile(iface)); err == nil {
+        var ssids, hexed []string
+        plain := true
+        for _, n := range parseWpaConf(string(b)).networks {
+            ssids = append(ssids, n.SSID)
+            hexed = append(hexed, hex.EncodeToString([]byte(n.SSID)))
+            plain = plain && plainText(n.SSID)
+        }
+        resp.list("NETWORKS", ssids)
+        if !plain { resp.list("NETWORKS_HEX", hexed) }
+    }
+    out, err := wpaCli(iface, "status")
+    if err != nil {
+        return resp.set("STATE", "NOT_RUNNING")
+    }
+    st := keyValues(out)
+    ssid := decodeSSID(st["ssid"])
+    resp.set("STATE", st["wpa_state"]).set("SSID", ssid)
+    if !plainText(ssid) { resp.set("SSID_HEX", hex.EncodeToString([]byte(ssid))) }
+    resp.set("BSSID", st["bssid"]).set("FREQ", st["freq"]).set("KEY_MGMT", st["key_mgmt"]).set("IP", st["ip_address"])
+    if out, err := wpaCli(iface, "signal_poll"); err == nil {
+        sig := keyValues(out)
+        resp.set("RSSI", sig["RSSI"]).set("LINKSPEED", sig["LINKSPEED"])
+    }
+    return resp
+}
+
+// startWifiScan asks wpa_supplicant to scan iface unless a scan was started less than
+// wifiScanInterval ago; it does not wait for the scan, which takes a few seconds.
+func startWifiScan(iface string) bool {
+    wifiScanMu.Lock()
+    defer wifiScanMu.Unlock()
+    if time.Since(wifiScans[iface]) < wifiScanInterval { return false }
+    // FAIL-BUSY: a scan is already running, its results come just as well
+    if out, err := wpaCli(iface, "scan"); err != nil && out != "FAIL-BUSY" {
+        log.Printf("wifi scan: %v", err)
+        return false
+    }
+    wifiScans[iface] = time.Now()
+    return true
+}
+
+// wifiIface returns the wireless interface of a request: IF=<name> (which must exist and be
+// wireless), else wifi_iface, else the first wireless interface.
+func wifiIface(req *request) (string, error) {
+    if name := req.arg("IF"); name != "" {
+        if _, err := net.InterfaceByName(name); err != nil { return "", errNoIface }
+        if !isWireless(name) { return "", errNotWifi }
+        return name, nil
+    }
+    if w := wirelessIfaces(); len(w) > 0 { return w[0], nil }
+    return "", errNoWifi
+}
+
+// isWireless reports whether name is a wireless interface (or the configured wifi_iface).
+func isWireless(name string) bool {
+    if name == settings.WifiIface { return true }
+    return linkKind(name) == "wlan" || fileExists(filepath.Join("/sys/class/net", name, "wireless"))
+}
+
+// wirelessIfaces lists the wireless interfaces, wifi_iface first.
+func wirelessIfaces() []string {
+    var out []string
+    if settings.WifiIface != "" { out = append(out, settings.WifiIface) }
+    ifaces, _ := net.Interfaces()
+    for _, ifi := range ifaces {
+        if ifi.Name != settings.WifiIface && isWireless(ifi.Name) { out = append(out, ifi.Name) }
+    }
+    return out
+}
+
+// wpaCli runs wpa_cli on iface; a FAIL reply is an error.
+func wpaCli(iface string, args ...string) (string, error) {
+    out, err := exec.Command("wpa_cli", append([]string{"-i", iface}, args...)...).Output()
+    s := strings.TrimSpace(string(out))
+    if err != nil { return s, fmt.Errorf("wpa_cli %s: %v", strings.Join(args, " "), err) }
+    if strings.HasPrefix(s, "FAIL") { return s, fmt.Errorf("wpa_cli %s: %s", strings.Join(args, " "), s) }
+    return s, nil
+}
+
+// applyWpa makes wpa_supplicant re-read the configuration, starting its unit if it does not run.
+func applyWpa(iface string) error {
+    if _, err := wpaCli(iface, "reconfigure"); err == nil { return nil }
+    return runLogged("systemctl", "enable", "--now", "wpa_supplicant@"+iface)
+}
+
+func wpaConfFile(iface string) string {
+    return filepath.Join(settings.WpaDir, "wpa_supplicant-"+iface+".conf")
+}
+
+// keyValues parses key=value lines (wpa_cli status, signal_poll).
+func keyValues(s string) map[string]string {
+    m := map[string]string{}
+    for _, l := range strings.Split(s, "\n") {
+        if k, v, ok := strings.Cut(strings.TrimSpace(l), "="); ok { m[k] = v }
+    }
+    return m
+}
+
+// accessPoint is one WIFI_SCAN result.
+type accessPoint struct {
+    SSID, BSSID, Freq, Sec string
+    Signal                 int
+}
+
+// parseScanResults parses wpa_cli scan_results (bssid, frequency, signal level, flags, ssid),
+// keeping the strongest access point of each SSID and dropping hidden ones, strongest first.
+func parseScanResults(s string) []accessPoint {
+    best := map[string]accessPoint{}
+    for _, l := range strings.Split(s, "\n") {
+        f := strings.SplitN(strings.TrimRight(l, "\r"), "\t", 5)
+        if len(f) < 5 || strings.Count(f[0], ":") != 5 { continue }
+        sig, err := strconv.Atoi(f[2])
+        if err != nil { continue }
+        ap := accessPoint{SSID: decodeSSID(f[4]), BSSID: f[0], Freq: f[1], Sec: scanSecurity(f[3]), Signal: sig}
+        if ap.SSID == "" { continue }
+        if old, ok := best[ap.SSID]; !ok || ap.Signal > old.Signal { best[ap.SSID] = ap }
+    }
+    var out []accessPoint
+    for _, ap := range best {
+        out = append(out, ap)
+    }
+    sort.Slice(out, func(i, j int) bool {
+        if out[i].Signal != out[j].Signal { return out[i].Signal > out[j].Signal }
+        return out[i].SSID < out[j].SSID
+    })
+    return out
+}
+
+// scanSecurity maps scan flags like [WPA2-PSK-CCMP][ESS] to EAP, PSK, SAE, WEP or OPEN.
+func scanSecurity(flags string) string {
+    for _, s := range []string{"EAP", "PSK", "SAE", "WEP"} {
+        if strings.Contains(flags, s) { return s }
+    }
+    return "OPEN"
+}
+
+// decodeSSID undoes the escaping wpa_cli applies to SSIDs (\xNN, \\, \", \n, \r, \t, \e).
+func decodeSSID(s string) string {
+    if !strings.Contains(s, `\`) { return s }
+    var b []byte
+    for i := 0; i < len(s); i++ {
+        if s[i] != '\\' || i+1 == len(s) {
+            b = append(b, s[i])
+            continue
+        }
+        i++
+        switch s[i] {
+        case 'n':
+            b = append(b, '\n')
+        case 'r':
+            b = append(b, '\r')
+        case 't':
+            b = append(b, '\t')
+        case 'e':
+            b = append(b, 0x1b)
+        case 'x':
+            if i+2 < len(s) {
+                if v, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+                    b = append(b, byte(v))
+                    i += 2
+                    continue
+                }
+            }
+            b = append(b, '\\', 'x')
+        default:
+            b = append(b, s[i])
+        }
+    }
+    return string(b)
+}
+
+// plainText reports whether s is printable ASCII that survives the text protocol and a quoted
+// wpa_supplicant string.
+func plainText(s string) bool {
+    for i := 0; i < len(s); i++ {
+        if s[i] < 0x20 || s[i] > 0x7e || s[i] == '"' || s[i] == '|' || s[i] == ',' { return false }
+    }
+    return true
+}
+
+// wpaString encodes a wpa_supplicant string value: quoted when plain, else hex.
+func wpaString(s string) string {
+    if plainText(s) { return `"` + s + `"` }
+    return hex.EncodeToString([]byte(s))
+}
+
+// parseWpaString decodes a quoted or hex wpa_supplicant string value.
+func parseWpaString(v string) string {
+    if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' { return v[1 : len(v)-1] }
+    if b, err := hex.DecodeString(v); err == nil { return string(b) }
+    return v
+}
+
+// textArg returns KEY of a request, or the hex-decoded KEY_HEX when given.
+func textArg(req *request, key string) (string, error) {
+    if v := req.arg(key + "_HEX"); v != "" {
+        b, err := hex.DecodeString(v)
+        if err != nil { return "", errors.New("BAD_HEX") }
+        return string(b), nil
+    }
+    return req.arg(key), nil
+}
+
+// wifiNetwork is one network={} block of a wpa_supplicant configuration.
+type wifiNetwork struct {
+    SSID  string
+    Lines []string // the settings, e.g. `ssid="home"`, `psk="secret"`
+}
+
+// wifiNetworkFromRequest builds the network of a WIFI_SET; the errors are the ERR codes of the reply.
+func wifiNetworkFromRequest(req *request) (wifiNetwork, error) {
+    var v [4]string
+    for i, k := range []string{"SSID", "PSK", "IDENTITY", "PASSWORD"} {
+        s, err := textArg(req, k)
+        if err != nil { return wifiNetwork{}, err }
+        v[i] = s
+    }
+    ssid, psk, identity, password := v[0], v[1], v[2], v[3]
+    if len(ssid) == 0 || len(ssid) > 32 { return wifiNetwork{}, errors.New("BAD_SSID") }
+    n := wifiNetwork{SSID: ssid, Lines: []string{"ssid=" + wpaString(ssid)}}
+    if req.flag("HIDDEN") { n.Lines = append(n.Lines, "scan_ssid=1") }
+    switch {
+    case identity != "":
+        eap := strings.ToUpper(req.arg("EAP"))
+        if eap == "" { eap = "PEAP" }
+        if eap != "PEAP" && eap != "TTLS" { return wifiNetwork{}, errors.New("BAD_EAP") }
+        n.Lines = append(n.Lines, "key_mgmt=WPA-EAP", "eap="+eap, "identity="+wpaString(identity),
+            "password="+wpaString(password), `phase2="auth=MSCHAPV2"`)
+    case psk != "":
+        switch {
+        case len(psk) == 64 && isHex(psk):
+            n.Lines = append(n.Lines, "key_mgmt=WPA-PSK", "psk="+strings.ToLower(psk))
+        case len(psk) >= 8 && len(psk) <= 63 && printableASCII(psk):
+            n.Lines = append(n.Lines, "key_mgmt=WPA-PSK", `psk="`+psk+`"`)
+        default:
+            return wifiNetwork{}, errors.New("BAD_PSK")
+        }
+    default:
+        n.Lines = append(n.Lines, "key_mgmt=NONE")
+    }
+    return n, nil
+}
+
+func isHex(s string) bool {
+    _, err := hex.DecodeString(s)
+    return err == nil
+}
+
+// printableASCII reports whether s is printable ASCII, as a WPA passphrase must be.
+func printableASCII(s string) bool {
+    for i := 0; i < len(s); i++ {
+        if s[i] < 0x20 || s[i] > 0x7e { return false }
+    }
+    return true
+}
+
+// wpaConf is a wpa_supplicant configuration: the global settings and the network blocks.
+type wpaConf struct {
+    header   []string
+    networks []wifiNetwork
+}
+
+func parseWpaConf(s string) wpaConf {
+    var c wpaConf
+    var cur *wifiNetwork
+    for _, l := range strings.Split(s, "\n") {
+        t := strings.TrimSpace(l)
+        switch {
+        case cur == nil && strings.HasPrefix(t, "network=") && strings.HasSuffix(t, "{"):
+            cur = &wifiNetwork{}
+        case cur == nil:
+            c.header = append(c.header, l)
+        case t == "}":
+            c.networks = append(c.networks, *cur)
+            cur = nil
+        case t != "":
+            if v, ok := strings.CutPrefix(t, "ssid="); ok { cur.SSID = parseWpaString(v) }
+            cur.Lines = append(cur.Lines, t)
+        }
+    }
+    for len(c.header) > 0 && strings.TrimSpace(c.header[len(c.header)-1]) == "" {
+        c.header = c.header[:len(c.header)-1]
+    }
+    return c
+}
+
+func (c wpaConf) String() string {
+    var b strings.Builder
+    for _, l := range c.header {
+        b.WriteString(l + "\n")
+    }
+    for _, n := range c.networks {
+        b.WriteString("\nnetwork={\n")
+        for _, l := range n.Lines {
+            b.WriteString("\t" + l + "\n")
+        }
+        b.WriteString("}\n")
+    }
+    return b.String()
+}
+
+// writeWpaNetwork adds n to the configuration at path (replacing a network with the same SSID)
+// and sets country= when given. A new file gets the control interface wpa_cli talks to.
+func writeWpaNetwork(path string, n wifiNetwork, country string) error {
+    c := wpaConf{header: []string{"ctrl_interface=DIR=/run/wpa_supplicant GROUP=netdev", "update_config=1"}}
+    if b, err := os.ReadFile(path); err == nil {
+        c = parseWpaConf(string(b))
+    } else if !os.IsNotExist(err) {
+        return err
+    }
+    if country != "" {
+        c.header = upsertKey(c.header, "country=", "country="+country)
+    }
+    replaced := false
+    for i := range c.networks {
+        if c.networks[i].SSID == n.SSID {
+            c.networks[i], replaced = n, true
+        }
+    }
+    if !replaced { c.networks = append(c.networks, n) }
+    // the file holds the secrets: write it 0600 and replace the old one in one step
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil { return err }
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, []byte(c.String()), 0o600); err != nil { return err }
+    return os.Rename(tmp, path)
+}
+
+// upsertKey replaces the line starting with prefix, or appends line.
+func upsertKey(lines []string, prefix, line string) []string {
+    for i, l := range lines {
+        if strings.HasPrefix(strings.TrimSpace(l), prefix) {
+            lines[i] = line
+            return lines
+        }
+    }
+    return append(lines, line)
+}
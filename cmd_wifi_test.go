@@ -0,0 +1,292 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestParseScanResults(t *testing.T) {
+    out := "bssid / frequency / signal level / flags / ssid\n" +
+        "aa:bb:cc:dd:ee:01\t2437\t-60\t[WPA2-PSK-CCMP][ESS]\thome\n" +
+        "aa:bb:cc:dd:ee:02\t5180\t-45\t[WPA2-PSK-CCMP][ESS]\thome\n" +
+        "aa:bb:cc:dd:ee:03\t2412\t-70\t[WPA2-EAP-CCMP][ESS]\tcorp\\x7cnet\r\n" +
+        "aa:bb:cc:dd:ee:04\t2412\t-80\t[ESS]\t\n" +
+        "aa:bb:cc:dd:ee:05\t2462\t-70\t[WEP][ESS]\tcafe\n" +
+        "aa:bb:cc:dd:ee:06\t2462\t-50\t[SAE-CCMP][ESS]\ttab\tin name\n" +
+        "aa:bb:cc:dd:ee:07\t2462\tweak\t[ESS]\tbroken\n" +
+        "not a bssid\t2462\t-10\t[ESS]\tbroken\n"
+    want := []accessPoint{
+        {SSID: "home", BSSID: "aa:bb:cc:dd:ee:02", Freq: "5180", Sec: "PSK", Signal: -45},
+        {SSID: "tab\tin name", BSSID: "aa:bb:cc:dd:ee:06", Freq: "2462", Sec: "SAE", Signal: -50},
+        {SSID: "cafe", BSSID: "aa:bb:cc:dd:ee:05", Freq: "2462", Sec: "WEP", Signal: -70},
+        {SSID: "corp|net", BSSID: "aa:bb:cc:dd:ee:03", Freq: "2412", Sec: "EAP", Signal: -70},
+    }
+    if got := parseScanResults(out); !reflect.DeepEqual(got, want) {
+        t.Errorf("parseScanResults:\n got %+v\nwant %+v", got, want)
+    }
+    if got := parseScanResults(""); len(got) != 0 {
+        t.Errorf("parseScanResults(\"\") = %+v, want none", got)
+    }
+}
+
+func TestDecodeSSID(t *testing.T) {
+    tests := []struct{ in, want string }{
+        {"home", "home"},
+        {`caf\xc3\xa9`, "café"},
+        {`a\\b`, `a\b`},
+        {`say \"hi\"`, `say "hi"`},
+        {`a\nb\rc\td\e`, "a\nb\rc\td\x1b"},
+        {`bad\xZZ`, `bad\xZZ`},
+        {`short\x4`, `short\x4`},
+        {`trailing\`, `trailing\`},
+    }
+    for _, tt := range tests {
+        if got := decodeSSID(tt.in); got != tt.want {
+            t.Errorf("decodeSSID(%q) = %q, want %q", tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestParseWpaConf(t *testing.T) {
+    conf := "ctrl_interface=DIR=/run/wpa_supplicant GROUP=netdev\n" +
+        "country=DE\n" +
+        "\n" +
+        "network={\n" +
+        "\tssid=\"home\"\n" +
+        "\tpsk=\"secret12\"\n" +
+        "}\n" +
+        "network={\n" +
+        "    ssid=636166c3a9\n" +
+        "    key_mgmt=NONE\n" +
+        "}\n"
+    c := parseWpaConf(conf)
+    if want := []string{"ctrl_interface=DIR=/run/wpa_supplicant GROUP=netdev", "country=DE"}; !reflect.DeepEqual(c.header, want) {
+        t.Errorf("header = %q, want %q", c.header, want)
+    }
+    want := []wifiNetwork{
+        {SSID: "home", Lines: []string{`ssid="home"`, `psk="secret12"`}},
+        {SSID: "café", Lines: []string{"ssid=636166c3a9", "key_mgmt=NONE"}},
+    }
+    if !reflect.DeepEqual(c.networks, want) {
+        t.Errorf("networks = %+v, want %+v", c.networks, want)
+    }
+    if again := parseWpaConf(c.String()); !reflect.DeepEqual(again, c) {
+        t.Errorf("String does not round-trip:\n%s", c.String())
+    }
+}
+
+func TestWriteWpaNetwork(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "wpa", "wpa_supplicant-wlan0.conf")
+    home := wifiNetwork{SSID: "home", Lines: []string{`ssid="home"`, `psk="secret12"`}}
+    corp := wifiNetwork{SSID: "corp", Lines: []string{`ssid="corp"`, "key_mgmt=NONE"}}
+    newHome := wifiNetwork{SSID: "home", Lines: []string{`ssid="home"`, `psk="changed1"`}}
+    for _, n := range []wifiNetwork{home, corp} {
+        if err := writeWpaNetwork(path, n, ""); err != nil { t.Fatal(err) }
+    }
+    if err := writeWpaNetwork(path, newHome, "DE"); err != nil { t.Fatal(err) }
+
+    b, err := os.ReadFile(path)
+    if err != nil { t.Fatal(err) }
+    c := parseWpaConf(string(b))
+    if want := []wifiNetwork{newHome, corp}; !reflect.DeepEqual(c.networks, want) {
+        t.Errorf("networks = %+v, want %+v", c.networks, want)
+    }
+    want := []string{"ctrl_interface=DIR=/run/wpa_supplicant GROUP=netdev", "update_config=1", "country=DE"}
+    if !reflect.DeepEqual(c.header, want) {
+        t.Errorf("header = %q, want %q", c.header, want)
+    }
+    if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+        t.Errorf("mode = %v (%v), want 0600", fi.Mode().Perm(), err)
+    }
+    if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+        t.Errorf("temporary file left behind: %v", err)
+    }
+}
+
+func TestWifiNetworkFromRequest(t *testing.T) {
+    psk64 := strings.Repeat("aB", 32)
+    tests := []struct {
+        msg   string
+        lines []string
+        err   string
+    }{
+        {"WIFI_SET|SSID=home|PSK=secret12", []string{`ssid="home"`, "key_mgmt=WPA-PSK", `psk="secret12"`}, ""},
+        {"WIFI_SET|SSID=home|PSK=" + psk64, []string{`ssid="home"`, "key_mgmt=WPA-PSK", "psk=" + strings.ToLower(psk64)}, ""},
+        {"WIFI_SET|SSID=open|HIDDEN=1", []string{`ssid="open"`, "scan_ssid=1", "key_mgmt=NONE"}, ""},
+        {"WIFI_SET|SSID=corp|IDENTITY=alice|PASSWORD=pw|EAP=ttls", []string{`ssid="corp"`, "key_mgmt=WPA-EAP", "eap=TTLS",
+            `identity="alice"`, `password="pw"`, `phase2="auth=MSCHAPV2"`}, ""},
+        {"WIFI_SET|SSID=corp|IDENTITY=alice|PASSWORD=pw", []string{`ssid="corp"`, "key_mgmt=WPA-EAP", "eap=PEAP",
+            `identity="alice"`, `password="pw"`, `phase2="auth=MSCHAPV2"`}, ""},
+        // "a|b" and "p,w d" hex encoded
+        {"WIFI_SET|SSID_HEX=617c62|PSK_HEX=702c772064313233", []string{"ssid=617c62", "key_mgmt=WPA-PSK", `psk="p,w d123"`}, ""},
+        {"WIFI_SET|PSK=secret12", nil, "BAD_SSID"},
+        {"WIFI_SET|SSID=" + strings.Repeat("x", 33), nil, "BAD_SSID"},
+        {"WIFI_SET|SSID=home|PSK=short", nil, "BAD_PSK"},
+        {"WIFI_SET|SSID=home|PSK_HEX=73656372657431320a", nil, "BAD_PSK"},
+        {"WIFI_SET|SSID=corp|IDENTITY=alice|EAP=TLS", nil, "BAD_EAP"},
+        {"WIFI_SET|SSID_HEX=zz", nil, "BAD_HEX"},
+    }
+    for _, tt := range tests {
+        req, err := parseRequest(tt.msg)
+        if err != nil { t.Fatalf("parseRequest(%q): %v", tt.msg, err) }
+        n, err := wifiNetworkFromRequest(req)
+        if tt.err != "" {
+            if err == nil || err.Error() != tt.err { t.Errorf("%s: err = %v, want %s", tt.msg, err, tt.err) }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s: %v", tt.msg, err)
+            continue
+        }
+        if !reflect.DeepEqual(n.Lines, tt.lines) { t.Errorf("%s: lines = %q, want %q", tt.msg, n.Lines, tt.lines) }
+    }
+}
+
+func TestScanReplyBudget(t *testing.T) {
+    var aps []accessPoint
+    for i := 0; i < 40; i++ {
+        // 32-byte SSIDs that need an SSID_HEX copy: the largest entries a scan can give
+        ssid := fmt.Sprintf("café|%02d", i) + strings.Repeat("x", 24)
+        aps = append(aps, accessPoint{SSID: ssid, BSSID: fmt.Sprintf("aa:bb:cc:dd:ee:%02x", i), Freq: "5180", Sec: "PSK", Signal: -40 - i})
+    }
+    for _, msg := range []string{"WIFI_SCAN|REQ=8f3a0c2d9e4b4f6a|TS=1700000000", `{"v":2,"cmd":"wifi_scan","req":"8f3a0c2d9e4b4f6a","ts":1700000000}`} {
+        req, _ := parseRequest(msg)
+        resp := scanReply(req, "wlan0", true, aps)
+        out := resp.encode(req)
+        if len(out) > maxScanReply { t.Errorf("%s: reply is %d bytes", msg, len(out)) }
+        n, _ := strconv.Atoi(fieldValue(resp, "COUNT"))
+        if n == 0 || n == len(aps) { t.Errorf("%s: COUNT=%d", msg, n) }
+        if fieldValue(resp, fmt.Sprintf("AP%d.SSID_HEX", n)) == "" || fieldValue(resp, fmt.Sprintf("AP%d.SSID", n+1)) != "" {
+            t.Errorf("%s: COUNT=%d does not match the entries:\n%s", msg, n, out)
+        }
+        // one more entry would not have fit
+        if more := scanReply(req, "wlan0", true, aps[:n+1]); fieldValue(more, "COUNT") != strconv.Itoa(n) {
+            t.Errorf("%s: %d entries fit, want %d", msg, n+1, n)
+        }
+    }
+    if resp := scanReply(&request{V: 1}, "wlan0", false, aps[:2]); fieldValue(resp, "COUNT") != "2" {
+        t.Errorf("short list cut: %s", resp.encode(nil))
+    }
+}
+
+// fieldValue returns the first value of key in resp, or "".
+func fieldValue(resp *response, key string) string {
+    for _, f := range resp.Fields {
+        if f.Key == key && len(f.Values) > 0 { return f.Values[0] }
+    }
+    return ""
+}
+
+// fakeWpaCli puts a wpa_cli (and a failing systemctl) first on PATH, makes wlan9 the Wi-Fi
+// interface and returns the file the stubs log their arguments to. WPA_FAIL=1 makes wpa_cli
+// fail; WPA_RECONFIGURE is what it prints for reconfigure.
+func fakeWpaCli(t *testing.T) string {
+    t.Helper()
+    dir := t.TempDir()
+    calls := filepath.Join(dir, "calls")
+    script := `#!/bin/sh
+echo "$(basename "$0") $*" >> "` + calls + `"
+[ "$(basename "$0")" = systemctl ] && exit 1
+[ "$WPA_FAIL" = 1 ] && { echo "Failed to connect to non-global ctrl_ifname: $2"; exit 255; }
+case "$3" in
+scan) echo OK ;;
+scan_results) printf 'bssid / frequency / signal level / flags / ssid\naa:bb:cc:dd:ee:01\t2437\t-48\t[WPA2-PSK-CCMP][ESS]\thome\n' ;;
+status) printf 'bssid=aa:bb:cc:dd:ee:01\nfreq=2437\nssid=caf\\xc3\\xa9\nkey_mgmt=WPA2-PSK\nwpa_state=COMPLETED\nip_address=192.168.1.20\n' ;;
+signal_poll) printf 'RSSI=-48\nLINKSPEED=65\nNOISE=9999\n' ;;
+reconfigure) echo "$WPA_RECONFIGURE" ;;
+esac
+`
+    for _, name := range []string{"wpa_cli", "systemctl"} {
+        if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil { t.Fatal(err) }
+    }
+    t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+    t.Setenv("WPA_FAIL", "")
+    t.Setenv("WPA_RECONFIGURE", "OK")
+    saved, savedScans, savedInterval := settings, wifiScans, wifiScanInterval
+    t.Cleanup(func() { settings, wifiScans, wifiScanInterval = saved, savedScans, savedInterval })
+    settings.WifiIface = "wlan9"
+    settings.WpaDir = filepath.Join(dir, "wpa")
+    wifiScans = map[string]time.Time{}
+    return calls
+}
+
+// dispatchText parses and dispatches a text request.
+func dispatchText(t *testing.T, msg string) *response {
+    t.Helper()
+    req, err := parseRequest(msg)
+    if err != nil { t.Fatal(err) }
+    resp := dispatch(req)
+    if resp == nil { t.Fatalf("%s: no reply", msg) }
+    return resp
+}
+
+func hasFlag(resp *response, name string) bool {
+    for _, f := range resp.Fields {
+        if f.Key == name && len(f.Values) == 0 { return true }
+    }
+    return false
+}
+
+func TestDispatchWifiScan(t *testing.T) {
+    calls := fakeWpaCli(t)
+    wifiScanInterval = time.Hour
+    for i, wantStarted := range []bool{true, false, false} {
+        resp := dispatchText(t, "WIFI_SCAN")
+        if resp.Status != "WIFI_SCAN" || fieldValue(resp, "IF") != "wlan9" || fieldValue(resp, "COUNT") != "1" || fieldValue(resp, "AP1.SSID") != "home" {
+            t.Fatalf("%d: %s", i, resp.encode(nil))
+        }
+        if started := fieldValue(resp, "SCAN") == "STARTED"; started != wantStarted { t.Errorf("%d: SCAN=STARTED is %v, want %v", i, started, wantStarted) }
+    }
+    if n := strings.Count(readTestFile(t, calls), "wpa_cli -i wlan9 scan\n"); n != 1 { t.Errorf("%d scans started, want 1", n) }
+
+    // once the interval has passed the next request starts a scan again
+    wifiScanInterval = 0
+    if resp := dispatchText(t, "WIFI_SCAN"); fieldValue(resp, "SCAN") != "STARTED" { t.Errorf("no scan after the interval: %s", resp.encode(nil)) }
+
+    t.Setenv("WPA_FAIL", "1")
+    resp := dispatchText(t, "WIFI_SCAN")
+    if resp.Status != "WIFI_NACK" || fieldValue(resp, "ERR") != "NO_WPA" { t.Errorf("without wpa_supplicant: %s", resp.encode(nil)) }
+}
+
+func TestDispatchWifiStatus(t *testing.T) {
+    fakeWpaCli(t)
+    if err := writeWpaNetwork(wpaConfFile("wlan9"), wifiNetwork{SSID: "café", Lines: []string{"ssid=636166c3a9", "key_mgmt=NONE"}}, ""); err != nil { t.Fatal(err) }
+    resp := dispatchText(t, "WIFI_STATUS")
+    want := "WIFI_STATUS|IF=wlan9|NETWORKS=café|NETWORKS_HEX=636166c3a9|STATE=COMPLETED|SSID=café|SSID_HEX=636166c3a9|" +
+        "BSSID=aa:bb:cc:dd:ee:01|FREQ=2437|KEY_MGMT=WPA2-PSK|IP=192.168.1.20|RSSI=-48|LINKSPEED=65"
+    if got := resp.encode(nil); got != want { t.Errorf("WIFI_STATUS:\n got %s\nwant %s", got, want) }
+
+    t.Setenv("WPA_FAIL", "1")
+    if resp := dispatchText(t, "WIFI_STATUS"); fieldValue(resp, "STATE") != "NOT_RUNNING" { t.Errorf("without wpa_supplicant: %s", resp.encode(nil)) }
+}
+
+func TestDispatchWifiSetApply(t *testing.T) {
+    calls := fakeWpaCli(t)
+    resp := dispatchText(t, "WIFI_SET|SSID=home|PSK=secret12|APPLY=1")
+    if resp.Status != "WIFI_ACK" || !hasFlag(resp, "APPLY_ACK") { t.Errorf("reconfigure OK: %s", resp.encode(nil)) }
+    if got := readTestFile(t, calls); got != "wpa_cli -i wlan9 reconfigure\n" { t.Errorf("calls:\n%s", got) }
+    if c := parseWpaConf(readTestFile(t, wpaConfFile("wlan9"))); len(c.networks) != 1 || c.networks[0].SSID != "home" {
+        t.Errorf("networks = %+v", c.networks)
+    }
+
+    // reconfigure fails and so does starting the unit
+    t.Setenv("WPA_RECONFIGURE", "FAIL")
+    resp = dispatchText(t, "WIFI_SET|SSID=home|PSK=secret12|APPLY=1")
+    if resp.Status != "WIFI_ACK" || !hasFlag(resp, "APPLY_NACK") { t.Errorf("reconfigure FAIL: %s", resp.encode(nil)) }
+    if got := readTestFile(t, calls); !strings.HasSuffix(got, "wpa_cli -i wlan9 reconfigure\nsystemctl enable --now wpa_supplicant@wlan9\n") {
+        t.Errorf("calls:\n%s", got)
+    }
+
+    // without APPLY nothing is reloaded
+    before := readTestFile(t, calls)
+    if resp := dispatchText(t, "WIFI_SET|SSID=corp"); resp.Status != "WIFI_ACK" || hasFlag(resp, "APPLY_ACK") || hasFlag(resp, "APPLY_NACK") {
+        t.Errorf("without APPLY: %s", resp.encode(nil))
+    }
+    if readTestFile(t, calls) != before { t.Error("wpa_cli called without APPLY") }
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Command registry.
+// Each command lives in its own cmd_*.go file and registers itself from init():
+//
+//   func init() {
+//       registerCommand(&command{Name: "FOO", Aliases: []string{"F"}, Help: "...", Handle: handleFoo})
+//   }
+//
+// dispatch looks the command up by name or alias, enforces auth and replay checks for
+// commands with Auth set, and calls the handler (Auth handlers one at a time).
+// Unknown commands are answered with UNKNOWN_CMD|CMDS=<valid commands>.
+// Any request may carry TARGET=<unique id>: only the device with that ID handles it, all others
+// ignore it without a reply. This lets a client broadcast CFG or RESTART to the one device it
+// cannot reach by unicast (see forOtherDevice).
+
+// command describes one protocol command.
+type command struct {
+    Name    string                        // canonical upper-case name, e.g. "QUERY_NET"
+    Aliases []string                      // alternative names, e.g. "QUERY", "NET"
+    Auth    bool                          // mutating: requires signature (when a key is set), replay checks, runs serialized
+    Help    string                        // one-line description for HELP
+    Handle  func(req *request) *response
+}
+
+var (
+    commands     []*command
+    commandIndex = map[string]*command{}
+)
+
+// registerCommand adds c under its name and aliases. Duplicate names are a programming error.
+func registerCommand(c *command) {
+    for _, n := range append([]string{c.Name}, c.Aliases...) {
+        n = strings.ToUpper(n)
+        if _, dup := commandIndex[n]; dup {
+            panic("duplicate command name: " + n)
+        }
+        commandIndex[n] = c
+    }
+    commands = append(commands, c)
+}
+
+// enabled restricts the command set to the configured names (nil enables all).
+var enabled map[*command]bool
+
+// enableCommands limits dispatch to the named commands (names or aliases); an empty list enables all.
+func enableCommands(names []string) error {
+    if len(names) == 0 {
+        enabled = nil
+        return nil
+    }
+    m := map[*command]bool{}
+    for _, n := range names {
+        c := commandIndex[strings.ToUpper(strings.TrimSpace(n))]
+        if c == nil {
+            return fmt.Errorf("unknown command %q (valid: %s)", n, strings.Join(commandNames(), ","))
+        }
+        m[c] = true
+    }
+    enabled = m
+    return nil
+}
+
+// lookupCommand returns the enabled command registered under name or alias, or nil.
+func lookupCommand(name string) *command {
+    c := commandIndex[strings.ToUpper(name)]
+    if c == nil || (enabled != nil && !enabled[c]) {
+        return nil
+    }
+    return c
+}
+
+// commandNames returns the canonical names of all enabled commands, sorted.
+func commandNames() []string {
+    names := make([]string, 0, len(commands))
+    for _, c := range commands {
+        if enabled != nil && !enabled[c] { continue }
+        names = append(names, c.Name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// replays remembers recent request IDs of Auth commands (see replay.go).
+var replays = newReplayCache(replayWindow)
+
+// mutateMu serializes handlers of Auth commands, which change device state.
+var mutateMu sync.Mutex
+
+// dispatch runs the handler for req and returns its response, nil for a request targeting another device.
+func dispatch(req *request) *response {
+    if forOtherDevice(req) {
+        return nil
+    }
+    c := lookupCommand(req.Cmd)
+    if c == nil {
+        return newResponse("UNKNOWN_CMD").list("CMDS", commandNames())
+    }
+    if c.Auth {
+        if reason := checkAuth(settings.AuthKey, req, time.Now()); reason != "" {
+            return newResponse("AUTH_NACK").set("ERR", reason)
+        }
+        if reason := replays.checkReplay(req, time.Now()); reason != "" {
+            return newResponse("REPLAY_NACK").set("ERR", reason)
+        }
+        mutateMu.Lock()
+        defer mutateMu.Unlock()
+    }
+    return c.Handle(req)
+}
+
+// forOtherDevice reports whether req carries TARGET= with the unique ID of another device.
+func forOtherDevice(req *request) bool {
+    t := req.arg("TARGET")
+    if t == "" { return false }
+    id, _ := ensureUniqueID()
+    return !strings.EqualFold(t, id)
+}
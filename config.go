@@ -0,0 +1,284 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "io/fs"
+    "log"
+    "os"
+    "slices"
+    "strconv"
+    "strings"
+)
+
+// Server configuration.
+// Settings are merged in this order, later sources winning:
+//   1. built-in defaults (defaultSettings)
+//   2. JSON config file (-config, default /etc/udp-server.json; a missing default file is ignored)
+//   3. environment variables (UDP_PORT, DEVICE_ID, WEB_PORT, IFACE_NAME, ...; see envOverrides)
+//   4. command-line flags that were given explicitly
+// "udp-server -print-config" prints the merged result as JSON and exits.
+
+// defaultConfigFile is read when -config is not given.
+const defaultConfigFile = "/etc/udp-server.json"
+
+// serverSettings holds runtime settings shared by command handlers.
+type serverSettings struct {
+    Listen       string   `json:"listen"`           // IPv4 listen address; empty listens on all, "off" disables IPv4
+    Listen6      string   `json:"listen6"`          // IPv6 listen address; empty listens on all, "off" disables IPv6
+    Port         string   `json:"port"`             // UDP listen port
+    Multicast    string   `json:"multicast_group"`  // IPv4 discovery group; empty or "off" disables
+    Multicast6   string   `json:"multicast_group6"` // IPv6 discovery group; empty or "off" disables
+    MDNS         bool     `json:"mdns"`             // advertise via mDNS / DNS-SD (see mdns.go)
+    AnnouncePort string   `json:"announce_port"`    // UDP port HELLO announcements are sent to; "off" disables
+    BcastReply   bool     `json:"broadcast_reply"`  // also broadcast replies to clients on another subnet (see bcastreply.go)
+    DeviceID     string   `json:"device_id"`        // default ID saved by CFG when none is given
+    WebPort      string   `json:"web_port"`         // device web page port advertised in discovery
+    Iface        string   `json:"iface"`            // interface name reported by QUERY_NET; empty detects it
+    StateDir     string   `json:"state_dir"`        // directory of device_config.json
+    NetBackend   string   `json:"net_backend"`      // auto, networkd, networkmanager, ifupdown or netplan (see netbackend.go)
+    NetDir       string   `json:"net_dir"`          // systemd-networkd directory for *.network files
+    NMDir        string   `json:"nm_dir"`           // NetworkManager keyfile directory
+    Interfaces   string   `json:"interfaces_file"`  // ifupdown configuration file
+    NetplanDir   string   `json:"netplan_dir"`      // netplan *.yaml directory
+    NetplanGen   bool     `json:"netplan_generate"` // validate netplan writes with "netplan generate"
+    WifiIface    string   `json:"wifi_iface"`       // wireless interface of the WIFI_* commands; empty detects it
+    WpaDir       string   `json:"wpa_dir"`          // directory of wpa_supplicant-<iface>.conf (see cmd_wifi.go)
+    IDFile       string   `json:"id_file"`          // persistent unique ID
+    IDStrategy   string   `json:"id_strategy"`      // how a new ID is derived: timestamp, machine-id, mac or cpu-serial (see uniqueid.go)
+    HostnameFile string   `json:"hostname_file"`    // written as "Kan-<ID>" when a new ID is generated, and by SET_HOSTNAME
+    HostsFile    string   `json:"hosts_file"`       // its name is kept in the matching line (see cmd_hostname.go)
+    AuthKeyFile  string   `json:"auth_key_file"`    // shared secret file (see auth.go)
+    Commands     []string `json:"commands"`         // enabled commands; empty enables all
+    LogLevel     string   `json:"log_level"`        // debug, info, warn or error
+    Workers      int      `json:"workers"`          // worker goroutines (see worker.go)
+    QueueSize    int      `json:"queue_size"`       // pending request queue length
+    ConfirmTime  int      `json:"confirm_timeout"`  // seconds to wait for CFG_CONFIRM after CFG|APPLY=1 (see netapply.go)
+    LinkLocal    int      `json:"linklocal_fallback"` // seconds after startup to assign a 169.254 address if unconfigured; 0 disables (see linklocal.go)
+    AuthKey      []byte   `json:"-"`                // shared secret for Auth commands; empty disables auth
+}
+
+var settings = defaultSettings()
+
+// defaultSettings returns the built-in configuration.
+func defaultSettings() serverSettings {
+    hn, _ := os.Hostname()
+    if hn == "" {
+        hn = "unknown"
+    }
+    return serverSettings{
+        Port:         "60000",
+        Multicast:    defaultMulticastGroup,
+        Multicast6:   defaultMulticastGroup6,
+        MDNS:         true,
+        AnnouncePort: defaultAnnouncePort,
+        BcastReply:   true,
+        DeviceID:     "HOST-" + hn,
+        WebPort:      "8000",
+        StateDir:     ".",
+        NetBackend:   "auto",
+        NetDir:       "/etc/systemd/network",
+        NMDir:        defaultNMDir,
+        Interfaces:   defaultInterfacesFile,
+        NetplanDir:   defaultNetplanDir,
+        NetplanGen:   true,
+        WpaDir:       defaultWpaDir,
+        IDFile:       "/etc/unique_ID",
+        IDStrategy:   idTimestamp,
+        HostnameFile: "/etc/hostname",
+        HostsFile:    "/etc/hosts",
+        AuthKeyFile:  defaultAuthKeyFile,
+        LogLevel:     "info",
+        Workers:      defaultWorkers,
+        QueueSize:    defaultQueueSize,
+        ConfirmTime:  defaultConfirmTimeout,
+    }
+}
+
+// loadSettings builds the merged configuration from args (without the program name).
+// printOnly reports whether -print-config was given.
+func loadSettings(args []string) (s serverSettings, printOnly bool, err error) {
+    s = defaultSettings()
+    fl := flag.NewFlagSet("udp-server", flag.ContinueOnError)
+    configPath := fl.String("config", "", "JSON config file (default "+defaultConfigFile+" if present)")
+    listen := fl.String("listen", s.Listen, "IPv4 listen address (empty: all, \"off\" disables)")
+    listen6 := fl.String("listen6", s.Listen6, "IPv6 listen address (empty: all, \"off\" disables)")
+    port := fl.String("port", s.Port, "UDP port")
+    group := fl.String("multicast", s.Multicast, "IPv4 multicast discovery group (\"off\" disables)")
+    group6 := fl.String("multicast6", s.Multicast6, "IPv6 multicast discovery group (\"off\" disables)")
+    mdns := fl.Bool("mdns", s.MDNS, "advertise _trae-cfg._udp via mDNS")
+    announcePort := fl.String("announce-port", s.AnnouncePort, "UDP port for HELLO announcements (\"off\" disables)")
+    stateDir := fl.String("state-dir", s.StateDir, "directory for device_config.json")
+    netBackend := fl.String("net-backend", s.NetBackend, "network backend: auto, networkd, networkmanager, ifupdown, netplan")
+    netDir := fl.String("net-dir", s.NetDir, "systemd-networkd configuration directory")
+    idFile := fl.String("id-file", s.IDFile, "unique ID file")
+    idStrategy := fl.String("id-strategy", s.IDStrategy, "new ID from: timestamp, machine-id, mac, cpu-serial")
+    cmds := fl.String("commands", "", "comma-separated enabled commands (empty: all)")
+    logLevel := fl.String("log-level", s.LogLevel, "log level: debug, info, warn, error")
+    printConfig := fl.Bool("print-config", false, "print merged configuration and exit")
+    if err := fl.Parse(args); err != nil {
+        return s, false, err
+    }
+
+    // Config file
+    path, explicit := *configPath, *configPath != ""
+    if !explicit {
+        path = defaultConfigFile
+    }
+    if b, err := os.ReadFile(path); err == nil {
+        if err := json.Unmarshal(b, &s); err != nil {
+            return s, false, fmt.Errorf("config %s: %v", path, err)
+        }
+    } else if explicit || !errors.Is(err, fs.ErrNotExist) {
+        return s, false, fmt.Errorf("config %s: %v", path, err)
+    }
+
+    envOverrides(&s)
+
+    // Explicit flags
+    fl.Visit(func(f *flag.Flag) {
+        switch f.Name {
+        case "listen":
+            s.Listen = *listen
+        case "listen6":
+            s.Listen6 = *listen6
+        case "port":
+            s.Port = *port
+        case "multicast":
+            s.Multicast = *group
+        case "multicast6":
+            s.Multicast6 = *group6
+        case "mdns":
+            s.MDNS = *mdns
+        case "announce-port":
+            s.AnnouncePort = *announcePort
+        case "state-dir":
+            s.StateDir = *stateDir
+        case "net-backend":
+            s.NetBackend = *netBackend
+        case "net-dir":
+            s.NetDir = *netDir
+        case "id-file":
+            s.IDFile = *idFile
+        case "id-strategy":
+            s.IDStrategy = *idStrategy
+        case "commands":
+            s.Commands = splitList(*cmds)
+        case "log-level":
+            s.LogLevel = *logLevel
+        }
+    })
+
+    if _, err := strconv.Atoi(s.Port); err != nil {
+        return s, false, fmt.Errorf("invalid port %q", s.Port)
+    }
+    if _, err := strconv.Atoi(s.AnnouncePort); err != nil && s.AnnouncePort != "off" {
+        return s, false, fmt.Errorf("invalid announce port %q", s.AnnouncePort)
+    }
+    s.IDStrategy = strings.ToLower(strings.TrimSpace(s.IDStrategy))
+    if !slices.Contains(idStrategies, s.IDStrategy) {
+        return s, false, fmt.Errorf("invalid id strategy %q", s.IDStrategy)
+    }
+    if _, ok := logLevels[strings.ToLower(s.LogLevel)]; !ok {
+        return s, false, fmt.Errorf("invalid log level %q", s.LogLevel)
+    }
+    if s.Workers < 1 { s.Workers = defaultWorkers }
+    if s.QueueSize < 1 { s.QueueSize = defaultQueueSize }
+    if s.ConfirmTime < 1 { s.ConfirmTime = defaultConfirmTimeout }
+    return s, *printConfig, nil
+}
+
+// envOverrides applies environment variables on top of the config file.
+func envOverrides(s *serverSettings) {
+    str := func(name string, dst *string) {
+        if v := strings.TrimSpace(os.Getenv(name)); v != "" { *dst = v }
+    }
+    num := func(name string, dst *int) {
+        if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 { *dst = v }
+    }
+    boolean := func(name string, dst *bool) {
+        switch strings.ToLower(strings.TrimSpace(os.Getenv(name))) {
+        case "1", "yes", "true", "on":
+            *dst = true
+        case "0", "no", "false", "off":
+            *dst = false
+        }
+    }
+    str("UDP_LISTEN", &s.Listen)
+    str("UDP_LISTEN6", &s.Listen6)
+    str("UDP_PORT", &s.Port)
+    str("MULTICAST_GROUP", &s.Multicast)
+    str("MULTICAST_GROUP6", &s.Multicast6)
+    boolean("MDNS", &s.MDNS)
+    str("ANNOUNCE_PORT", &s.AnnouncePort)
+    boolean("BROADCAST_REPLY", &s.BcastReply)
+    str("DEVICE_ID", &s.DeviceID)
+    str("WEB_PORT", &s.WebPort)
+    str("IFACE_NAME", &s.Iface)
+    str("STATE_DIR", &s.StateDir)
+    str("NET_BACKEND", &s.NetBackend)
+    str("NET_DIR", &s.NetDir)
+    str("NM_DIR", &s.NMDir)
+    str("INTERFACES_FILE", &s.Interfaces)
+    str("NETPLAN_DIR", &s.NetplanDir)
+    boolean("NETPLAN_GENERATE", &s.NetplanGen)
+    str("WIFI_IFACE", &s.WifiIface)
+    str("WPA_DIR", &s.WpaDir)
+    str("ID_FILE", &s.IDFile)
+    str("ID_STRATEGY", &s.IDStrategy)
+    str("HOSTNAME_FILE", &s.HostnameFile)
+    str("HOSTS_FILE", &s.HostsFile)
+    str("AUTH_KEY_FILE", &s.AuthKeyFile)
+    str("LOG_LEVEL", &s.LogLevel)
+    if v := os.Getenv("COMMANDS"); strings.TrimSpace(v) != "" { s.Commands = splitList(v) }
+    num("WORKERS", &s.Workers)
+    num("QUEUE_SIZE", &s.QueueSize)
+    num("CONFIRM_TIMEOUT", &s.ConfirmTime)
+    if v, err := strconv.Atoi(os.Getenv("LINKLOCAL_FALLBACK")); err == nil && v >= 0 { s.LinkLocal = v }
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(v string) []string {
+    var out []string
+    for _, p := range strings.Split(v, ",") {
+        if p = strings.TrimSpace(p); p != "" { out = append(out, p) }
+    }
+    return out
+}
+
+// printSettings writes s as indented JSON to w (stdout for -print-config).
+func printSettings(w io.Writer, s serverSettings) {
+    b, err := json.MarshalIndent(s, "", "  ")
+    if err != nil {
+        log.Fatalf("print config: %v", err)
+    }
+    fmt.Fprintln(w, string(b))
+}
+
+// Log levels: request traffic is logged at info, errors are always logged.
+const (
+    levelDebug = iota
+    levelInfo
+    levelWarn
+    levelError
+)
+
+var logLevels = map[string]int{"debug": levelDebug, "info": levelInfo, "warn": levelWarn, "error": levelError}
+
+// logLevel is the active level; set from settings.LogLevel at startup.
+var logLevel = levelInfo
+
+func debugf(format string, args ...interface{}) {
+    if logLevel <= levelDebug { log.Printf(format, args...) }
+}
+
+func infof(format string, args ...interface{}) {
+    if logLevel <= levelInfo { log.Printf(format, args...) }
+}
+
+func warnf(format string, args ...interface{}) {
+    if logLevel <= levelWarn { log.Printf(format, args...) }
+}
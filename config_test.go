@@ -0,0 +1,104 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// envNames are the variables envOverrides reads.
+var envNames = []string{"UDP_LISTEN", "UDP_LISTEN6", "UDP_PORT", "MULTICAST_GROUP", "MULTICAST_GROUP6", "MDNS",
+    "ANNOUNCE_PORT", "BROADCAST_REPLY", "DEVICE_ID", "WEB_PORT", "IFACE_NAME", "STATE_DIR", "NET_BACKEND", "NET_DIR",
+    "NM_DIR", "INTERFACES_FILE", "NETPLAN_DIR", "NETPLAN_GENERATE", "WIFI_IFACE", "WPA_DIR", "ID_FILE", "ID_STRATEGY",
+    "HOSTNAME_FILE", "HOSTS_FILE", "AUTH_KEY_FILE", "LOG_LEVEL", "COMMANDS", "WORKERS", "QUEUE_SIZE", "CONFIRM_TIMEOUT",
+    "LINKLOCAL_FALLBACK"}
+
+func TestLoadSettingsOrder(t *testing.T) {
+    tests := []struct {
+        name  string
+        file  string            // config file content
+        env   map[string]string // environment
+        args  []string          // flags besides -config
+        check func(s serverSettings) bool
+    }{
+        {"defaults", `{}`, nil, nil,
+            func(s serverSettings) bool { return s.Port == "60000" && s.MDNS && s.LogLevel == "info" && s.Workers == defaultWorkers }},
+        {"file", `{"port":"61000","mdns":false,"log_level":"warn","workers":2}`, nil, nil,
+            func(s serverSettings) bool { return s.Port == "61000" && !s.MDNS && s.LogLevel == "warn" && s.Workers == 2 }},
+        {"env over file", `{"port":"61000","mdns":false,"log_level":"warn","workers":2}`,
+            map[string]string{"UDP_PORT": "62000", "MDNS": "yes", "LOG_LEVEL": "debug", "WORKERS": "3"}, nil,
+            func(s serverSettings) bool { return s.Port == "62000" && s.MDNS && s.LogLevel == "debug" && s.Workers == 3 }},
+        {"flags over env", `{"port":"61000","mdns":false,"log_level":"warn","workers":2}`,
+            map[string]string{"UDP_PORT": "62000", "MDNS": "yes", "LOG_LEVEL": "debug", "WORKERS": "3"},
+            []string{"-port", "63000", "-mdns=false", "-log-level", "error"},
+            // WORKERS has no flag, so the environment still wins there
+            func(s serverSettings) bool { return s.Port == "63000" && !s.MDNS && s.LogLevel == "error" && s.Workers == 3 }},
+        {"flags over file", `{"port":"61000","commands":["TF","CFG"]}`, nil, []string{"-port", "63000", "-commands", "TF, GET_ID"},
+            func(s serverSettings) bool { return s.Port == "63000" && reflect.DeepEqual(s.Commands, []string{"TF", "GET_ID"}) }},
+        {"flag equal to the default", `{"port":"61000"}`, map[string]string{"UDP_PORT": "62000"}, []string{"-port", "60000"},
+            func(s serverSettings) bool { return s.Port == "60000" }},
+        {"empty env ignored", `{"port":"61000","mdns":false}`, map[string]string{"UDP_PORT": " ", "MDNS": ""}, nil,
+            func(s serverSettings) bool { return s.Port == "61000" && !s.MDNS }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for _, n := range envNames { t.Setenv(n, "") }
+            for k, v := range tt.env { t.Setenv(k, v) }
+            path := filepath.Join(t.TempDir(), "udp-server.json")
+            writeTestFile(t, path, tt.file)
+            s, printOnly, err := loadSettings(append([]string{"-config", path}, tt.args...))
+            if err != nil || printOnly { t.Fatalf("loadSettings = %v, %v", printOnly, err) }
+            if !tt.check(s) { t.Errorf("got %+v", s) }
+        })
+    }
+}
+
+func TestLoadSettingsErrors(t *testing.T) {
+    for _, n := range envNames { t.Setenv(n, "") }
+    dir := t.TempDir()
+    path := filepath.Join(dir, "udp-server.json")
+    tests := []struct {
+        file string
+        args []string
+        err  string
+    }{
+        {`{"port":`, nil, "config " + path},
+        {`{"port":"sixty"}`, nil, `invalid port "sixty"`},
+        {`{}`, []string{"-id-strategy", "random"}, `invalid id strategy "random"`},
+        {`{}`, []string{"-log-level", "loud"}, `invalid log level "loud"`},
+        {`{}`, []string{"-announce-port", "x"}, `invalid announce port "x"`},
+        {`{}`, []string{"-config", filepath.Join(dir, "missing.json")}, "config " + filepath.Join(dir, "missing.json")},
+    }
+    for _, tt := range tests {
+        writeTestFile(t, path, tt.file)
+        _, _, err := loadSettings(append([]string{"-config", path}, tt.args...))
+        if err == nil || !strings.HasPrefix(err.Error(), tt.err) { t.Errorf("%s %q: err = %v, want %s", tt.file, tt.args, err, tt.err) }
+    }
+}
+
+func TestPrintConfig(t *testing.T) {
+    for _, n := range envNames { t.Setenv(n, "") }
+    t.Setenv("UDP_PORT", "62000")
+    path := filepath.Join(t.TempDir(), "udp-server.json")
+    writeTestFile(t, path, `{"port":"61000","net_backend":"netplan","commands":["TF"]}`)
+    s, printOnly, err := loadSettings([]string{"-config", path, "-print-config", "-log-level", "debug"})
+    if err != nil || !printOnly { t.Fatalf("loadSettings = %v, %v", printOnly, err) }
+    s.AuthKey = []byte("s3cret")
+
+    var buf bytes.Buffer
+    printSettings(&buf, s)
+    out := buf.String()
+    for _, want := range []string{`"port": "62000"`, `"net_backend": "netplan"`, `"log_level": "debug"`, `"commands": [` + "\n" + `    "TF"` + "\n  ]"} {
+        if !strings.Contains(out, want) { t.Errorf("%s missing from:\n%s", want, out) }
+    }
+    if strings.Contains(out, "s3cret") || strings.Contains(out, "AuthKey") { t.Errorf("the key is printed:\n%s", out) }
+
+    // the printed configuration reads back as the same settings
+    again := defaultSettings()
+    if err := json.Unmarshal(buf.Bytes(), &again); err != nil { t.Fatal(err) }
+    s.AuthKey = nil
+    if !reflect.DeepEqual(again, s) { t.Errorf("printed config reads back as\n%+v\nwant\n%+v", again, s) }
+}
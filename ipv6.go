@@ -0,0 +1,114 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// IPv6 network parameters.
+// QUERY_NET reports IP6=<addr/prefix,...>, GW6=<gateway> and DNS6=<servers>; CFG accepts
+// IP6=<addr>[/prefix] (or PREFIX6=<len>, default 64) and GW6=<gateway>, written as extra
+// Address=/Gateway= lines next to the IPv4 ones.
+
+// getIPv6Params obtains IPv6 addresses (with prefix), default gateway and DNS servers of iface.
+// Configured values of the network backend win; otherwise live values of iface are used.
+func getIPv6Params(iface string) (addrs []string, gw string, dns []string) {
+    c := netBackend.Read(iface)
+    if c.IP6 != "" { addrs = []string{c.IP6} }
+    gw = c.GW6
+    if len(addrs) == 0 { addrs = ipv6FromInterface(iface) }
+    if gw == "" { gw = gateway6FromProcRoute(iface) }
+    for _, d := range c.DNS {
+        if isIPv6(d) { dns = append(dns, d) }
+    }
+    if len(dns) == 0 { dns = dns6FromResolvConf() }
+    return addrs, gw, dns
+}
+
+// ipv6FromInterface lists the IPv6 addresses (addr/prefix) of the named interface, global ones first.
+func ipv6FromInterface(name string) []string {
+    ifi, err := net.InterfaceByName(name)
+    if err != nil { return nil }
+    ifAddrs, _ := ifi.Addrs()
+    var global, local []string
+    for _, a := range ifAddrs {
+        ipnet, ok := a.(*net.IPNet)
+        if !ok || ipnet.IP.To4() != nil || ipnet.IP.To16() == nil { continue }
+        if ipnet.IP.IsLinkLocalUnicast() {
+            local = append(local, ipnet.String())
+        } else {
+            global = append(global, ipnet.String())
+        }
+    }
+    return append(global, local...)
+}
+
+// gateway6FromProcRoute parses /proc/net/ipv6_route to find the default IPv6 gateway (Linux); with
+// iface set, only a default route through that interface counts
+func gateway6FromProcRoute(iface string) string {
+    b, err := os.ReadFile("/proc/net/ipv6_route")
+    if err != nil { return "" }
+    for _, line := range strings.Split(string(b), "\n") {
+        // dest dest_plen src src_plen next_hop metric refcnt use flags iface
+        f := strings.Fields(line)
+        if len(f) < 10 { continue }
+        if f[0] != strings.Repeat("0", 32) || f[1] != "00" { continue }
+        if iface != "" && f[9] != iface { continue }
+        if ip := hexToIPv6(f[4]); ip != nil && !ip.IsUnspecified() {
+            return ip.String()
+        }
+    }
+    return ""
+}
+
+func hexToIPv6(s string) net.IP {
+    if len(s) != 32 { return nil }
+    ip := make(net.IP, net.IPv6len)
+    for i := 0; i < net.IPv6len; i++ {
+        v, err := strconv.ParseUint(s[2*i:2*i+2], 16, 8)
+        if err != nil { return nil }
+        ip[i] = byte(v)
+    }
+    return ip
+}
+
+// dns6FromResolvConf reads IPv6 nameservers from /etc/resolv.conf
+func dns6FromResolvConf() []string {
+    b, err := os.ReadFile("/etc/resolv.conf")
+    if err != nil { return nil }
+    var out []string
+    for _, l := range strings.Split(string(b), "\n") {
+        s := strings.TrimSpace(l)
+        if strings.HasPrefix(s, "nameserver ") {
+            ip := strings.TrimSpace(strings.TrimPrefix(s, "nameserver "))
+            if isIPv6(ip) { out = append(out, ip) }
+        }
+    }
+    return out
+}
+
+// normalizeIPv6CIDR validates an IPv6 address given as "addr/prefix" or "addr" plus prefix
+// (default 64) and returns "addr/prefix".
+func normalizeIPv6CIDR(addr, prefix string) (string, error) {
+    addr = strings.TrimSpace(addr)
+    if i := strings.Index(addr, "/"); i >= 0 {
+        addr, prefix = addr[:i], addr[i+1:]
+    }
+    if !isIPv6(addr) {
+        return "", fmt.Errorf("invalid IPv6 address %q", addr)
+    }
+    if prefix == "" { prefix = "64" }
+    pfx, err := strconv.Atoi(prefix)
+    if err != nil || pfx < 1 || pfx > 128 {
+        return "", fmt.Errorf("invalid IPv6 prefix %q", prefix)
+    }
+    return net.ParseIP(addr).String() + "/" + strconv.Itoa(pfx), nil
+}
+
+func isIPv6(s string) bool {
+    ip := net.ParseIP(strings.TrimSpace(s))
+    return ip != nil && ip.To4() == nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "errors"
+    "net"
+    "os/exec"
+    "strconv"
+    "time"
+)
+
+// Link-local fallback address.
+// A freshly flashed device on a network without DHCP has no IPv4 address and can only be reached
+// by broadcast. With linklocal_fallback (LINKLOCAL_FALLBACK) = <seconds> the server looks at the
+// default interface (see fallbackIface) that long after startup: when it has no IPv4 address
+// (other than 169.254/16) and the backend configures no static one, it picks 169.254.x.y/16
+// derived from the unique ID, checks with "arping -D" that no other host uses it (trying the next
+// candidate on conflict), writes it into the configuration of the interface through the network
+// backend (SetLinkLocal, which keeps DHCP on) and applies it. Once the interface gets another
+// IPv4 address (a DHCP lease or a CFG) the fallback address is removed from the configuration and
+// applied again; an address left in the configuration by an earlier run is kept or removed the
+// same way. Without a working conflict check no address is assigned. TF and HELLO carry
+// FALLBACK=linklocal while that interface has only link-local IPv4 addresses (also when another
+// tool such as avahi-autoipd set them).
+
+const (
+    // linkLocalTries is the number of candidate addresses probed before giving up.
+    linkLocalTries = 10
+    // fallbackLinkLocal is the FALLBACK= value of discovery replies.
+    fallbackLinkLocal = "linklocal"
+)
+
+var linkLocalNet = &net.IPNet{IP: net.IPv4(169, 254, 0, 0).To4(), Mask: net.CIDRMask(16, 32)}
+
+// runLinkLocalFallback waits delay and then configures a link-local address if the interface is
+// still unconfigured (see above), and removes it when a routable address shows up. It returns
+// when ctx is done.
+func runLinkLocalFallback(ctx context.Context, delay time.Duration) {
+    select {
+    case <-ctx.Done():
+        return
+    case <-time.After(delay):
+    }
+    iface := fallbackIface()
+    if iface == "" {
+        warnf("link-local fallback: no interface to configure")
+        return
+    }
+    c := netBackend.Read(iface)
+    if ip := interfaceIPv4(iface, false); ip != "" {
+        debugf("link-local fallback: %s has %s, not needed", iface, ip)
+        if isLinkLocalCIDR(c.IP) { removeLinkLocal(iface, ip) }
+        return
+    }
+    if c.IP != "" && !isLinkLocalCIDR(c.IP) {
+        debugf("link-local fallback: %s is configured with %s, not needed", iface, c.IP)
+        return
+    }
+    if c.IP != "" {
+        // written by an earlier run that stopped before a lease arrived
+        infof("link-local fallback: %s keeps %s from its configuration", iface, c.IP)
+    } else if !addLinkLocal(iface, delay) {
+        return
+    }
+
+    // DHCP (or a CFG) may still configure the interface: then the fallback address goes away
+    t := time.NewTicker(addrPollInterval)
+    defer t.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+        }
+        if ip := interfaceIPv4(iface, false); ip != "" {
+            removeLinkLocal(iface, ip)
+            return
+        }
+    }
+}
+
+// addLinkLocal picks a free link-local address for iface and writes and applies it through the
+// network backend. It reports whether the address was configured.
+func addLinkLocal(iface string, delay time.Duration) bool {
+    id, _ := ensureUniqueID()
+    addr := ""
+    for n := 0; n < linkLocalTries && addr == ""; n++ {
+        ip := linkLocalAddr(id, n).String()
+        inUse, err := arpInUse(iface, ip)
+        if err != nil {
+            warnf("link-local fallback: cannot check %s for conflicts, not assigning it: %v", ip, err)
+            return false
+        }
+        if inUse {
+            infof("link-local fallback: %s is in use, trying another address", ip)
+            continue
+        }
+        addr = ip + "/16"
+    }
+    if addr == "" {
+        warnf("link-local fallback: no free address after %d tries", linkLocalTries)
+        return false
+    }
+    if err := netBackend.SetLinkLocal(iface, addr); err != nil {
+        warnf("link-local fallback: write %s for %s via %s: %v", addr, iface, netBackend.Name(), err)
+        return false
+    }
+    if err := netBackend.Apply(iface); err != nil {
+        warnf("link-local fallback: apply %s on %s via %s: %v", addr, iface, netBackend.Name(), err)
+        if err := netBackend.SetLinkLocal(iface, ""); err != nil { warnf("link-local fallback: remove %s: %v", addr, err) }
+        return false
+    }
+    infof("link-local fallback: no address after %v, configured %s on %s via %s", delay, addr, iface, netBackend.Name())
+    return true
+}
+
+// removeLinkLocal takes the fallback address out of the configuration of iface, which got ip,
+// and applies the change.
+func removeLinkLocal(iface, ip string) {
+    if err := netBackend.SetLinkLocal(iface, ""); err != nil {
+        warnf("link-local fallback: remove the address of %s via %s: %v", iface, netBackend.Name(), err)
+        return
+    }
+    if err := netBackend.Apply(iface); err != nil {
+        warnf("link-local fallback: apply on %s via %s: %v", iface, netBackend.Name(), err)
+        return
+    }
+    infof("link-local fallback: %s got %s, removed the fallback address", iface, ip)
+}
+
+// isLinkLocalCIDR reports whether v (an address, optionally with /prefix) is in 169.254/16.
+func isLinkLocalCIDR(v string) bool {
+    ip, _ := splitCIDR(v)
+    p := net.ParseIP(ip)
+    return p != nil && p.To4() != nil && linkLocalNet.Contains(p)
+}
+
+// linkLocalAddr returns candidate n for the device id: an address in 169.254.1.0 - 169.254.254.255
+// (RFC 3927) taken from a hash, so a device gets the same address every time.
+func linkLocalAddr(id string, n int) net.IP {
+    h := sha256.Sum256([]byte(id + "#" + strconv.Itoa(n)))
+    return net.IPv4(169, 254, 1+h[0]%254, h[1]).To4()
+}
+
+// arpInUse probes ip with duplicate address detection ("arping -D", which exits with 0 when no
+// host answers and 1 when another host does); any other outcome, e.g. arping missing, is an error.
+func arpInUse(iface, ip string) (bool, error) {
+    err := exec.Command("arping", "-D", "-q", "-c", "2", "-w", "3", "-I", iface, ip).Run()
+    var ee *exec.ExitError
+    if errors.As(err, &ee) && ee.ExitCode() == 1 { return true, nil }
+    return false, err
+}
+
+// fallbackIface returns the interface the fallback configures: defaultIface when it exists,
+// else the first up interface that can broadcast (an unconfigured device has no default route).
+func fallbackIface() string {
+    if n := defaultIface(); interfaceExists(n) { return n }
+    ifaces, _ := net.Interfaces()
+    for _, ifi := range ifaces {
+        if ifi.Flags&net.FlagLoopback == 0 && ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagBroadcast != 0 {
+            return ifi.Name
+        }
+    }
+    return ""
+}
+
+func interfaceExists(name string) bool {
+    _, err := net.InterfaceByName(name)
+    return err == nil
+}
+
+// interfaceIPv4 returns the first IPv4 address of iface, skipping 169.254/16 unless linkLocal.
+func interfaceIPv4(iface string, linkLocal bool) string {
+    ifi, err := net.InterfaceByName(iface)
+    if err != nil { return "" }
+    addrs, _ := ifi.Addrs()
+    for _, a := range addrs {
+        n, ok := a.(*net.IPNet)
+        if !ok || n.IP.To4() == nil { continue }
+        if linkLocal || !linkLocalNet.Contains(n.IP) { return n.IP.String() }
+    }
+    return ""
+}
+
+// fallbackMode returns FALLBACK= of discovery replies: "linklocal" when the interface the
+// fallback configures has only link-local IPv4 addresses, else "".
+func fallbackMode() string {
+    iface := fallbackIface()
+    if interfaceIPv4(iface, true) != "" && interfaceIPv4(iface, false) == "" { return fallbackLinkLocal }
+    return ""
+}
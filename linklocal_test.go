@@ -0,0 +1,74 @@
+package main
+
+import (
+    "context"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestIsLinkLocalCIDR(t *testing.T) {
+    tests := map[string]bool{
+        "169.254.1.2": true, "169.254.1.2/16": true, "169.254.255.255/16,169.254.0.1": true,
+        "169.253.1.2/16": false, "192.168.1.10/24": false, "fe80::1/64": false, "": false, "x": false,
+    }
+    for v, want := range tests {
+        if got := isLinkLocalCIDR(v); got != want { t.Errorf("isLinkLocalCIDR(%q) = %v, want %v", v, got, want) }
+    }
+}
+
+// fakeArping puts an arping that reports every address as free first on PATH.
+func fakeArping(t *testing.T) {
+    t.Helper()
+    dir := t.TempDir()
+    if err := os.WriteFile(filepath.Join(dir, "arping"), []byte("#!/bin/sh\nexit 0\n"), 0o755); err != nil { t.Fatal(err) }
+    t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestLinkLocalFallbackAdd(t *testing.T) {
+    // an interface without an IPv4 address stands in for the unconfigured one
+    iface := ""
+    ifaces, _ := net.Interfaces()
+    for _, ifi := range ifaces {
+        if ifi.Flags&net.FlagLoopback == 0 && interfaceIPv4(ifi.Name, true) == "" { iface = ifi.Name }
+    }
+    if iface == "" { t.Skip("no interface without an IPv4 address") }
+    b := fakeNetApply(t)
+    fakeArping(t)
+    settings.Iface = iface
+    settings.IDFile = filepath.Join(t.TempDir(), "unique_ID")
+    settings.HostnameFile = filepath.Join(t.TempDir(), "hostname")
+    settings.HostsFile = filepath.Join(t.TempDir(), "hosts")
+    writeTestFile(t, settings.IDFile, "0190-A3F2-1C4B")
+
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan struct{})
+    go func() {
+        runLinkLocalFallback(ctx, time.Millisecond)
+        close(done)
+    }()
+    calls := waitCalls(t, b, 2)
+    cancel()
+    <-done
+    addr := linkLocalAddr("0190-A3F2-1C4B", 0).String() + "/16"
+    if want := []string{"write " + iface + " DHCP=yes Address=" + addr, "apply " + iface}; strings.Join(calls, ",") != strings.Join(want, ",") {
+        t.Errorf("calls = %q, want %q", calls, want)
+    }
+}
+
+func TestLinkLocalFallbackRemove(t *testing.T) {
+    b := fakeNetApply(t)
+    settings.Iface = "lo" // has 127.0.0.1, like an interface that got a lease
+    writeTestFile(t, b.File("lo"), "DHCP=yes\nAddress=169.254.10.20/16\n")
+    runLinkLocalFallback(context.Background(), 0)
+    if calls := b.log(); strings.Join(calls, ",") != "write lo DHCP=yes,apply lo" { t.Errorf("calls = %q", calls) }
+
+    // a static address is left alone
+    b.calls = nil
+    writeTestFile(t, b.File("lo"), "Address=127.0.0.1/8\n")
+    runLinkLocalFallback(context.Background(), 0)
+    if calls := b.log(); len(calls) != 0 { t.Errorf("calls = %q", calls) }
+}
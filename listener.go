@@ -0,0 +1,88 @@
+package main
+
+import (
+    "context"
+    "log"
+    "net"
+    "strings"
+    "time"
+
+    "golang.org/x/net/ipv4"
+    "golang.org/x/net/ipv6"
+)
+
+// UDP listeners.
+// The server keeps one socket per address family: udp4 on listen:port (receives broadcast
+// and the IPv4 multicast group) and udp6 on [listen6]:port (IPv6-only, receives the
+// ff02:: link-local group). Both feed the same worker pool; replies leave through the
+// socket the request arrived on. Setting listen or listen6 to "off" disables that family.
+
+// listener is one UDP socket feeding the worker pool.
+type listener struct {
+    pc   net.PacketConn
+    read func(buf []byte) (n int, from net.Addr, dst net.IP, ifIndex int, err error)
+}
+
+// listen4 opens the IPv4 socket and joins the IPv4 discovery group (unless group is empty or "off").
+func listen4(addr, group string) (*listener, error) {
+    pc, err := net.ListenPacket("udp4", addr)
+    if err != nil {
+        return nil, err
+    }
+    // Destination address of each datagram (IP_PKTINFO) tells how a request arrived, the
+    // interface where broadcast replies go out (see bcastreply.go)
+    p := ipv4.NewPacketConn(pc)
+    if err := p.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
+        log.Printf("control messages unavailable, VIA not reported: %v", err)
+    }
+    if group != "" && group != "off" {
+        if joined := joinMulticast(group, false, p.JoinGroup); len(joined) > 0 {
+            log.Printf("joined multicast group %s on %s", group, strings.Join(joined, ","))
+        }
+    }
+    return &listener{pc: pc, read: func(buf []byte) (int, net.Addr, net.IP, int, error) {
+        n, cm, from, err := p.ReadFrom(buf)
+        if cm != nil { return n, from, cm.Dst, cm.IfIndex, err }
+        return n, from, nil, 0, err
+    }}, nil
+}
+
+// listen6 opens the IPv6 socket and joins the IPv6 discovery group (unless group is empty or "off").
+func listen6(addr, group string) (*listener, error) {
+    pc, err := net.ListenPacket("udp6", addr)
+    if err != nil {
+        return nil, err
+    }
+    p := ipv6.NewPacketConn(pc)
+    if err := p.SetControlMessage(ipv6.FlagDst, true); err != nil {
+        log.Printf("IPv6 control messages unavailable, VIA not reported: %v", err)
+    }
+    if group != "" && group != "off" {
+        if joined := joinMulticast(group, true, p.JoinGroup); len(joined) > 0 {
+            log.Printf("joined multicast group %s on %s", group, strings.Join(joined, ","))
+        }
+    }
+    return &listener{pc: pc, read: func(buf []byte) (int, net.Addr, net.IP, int, error) {
+        n, cm, from, err := p.ReadFrom(buf)
+        if cm != nil { return n, from, cm.Dst, cm.IfIndex, err }
+        return n, from, nil, 0, err
+    }}, nil
+}
+
+// serve reads datagrams and submits them to pool until ctx is done. Shutdown unblocks the
+// read with a deadline; the socket stays open so workers can still send their replies.
+func (l *listener) serve(ctx context.Context, pool *workerPool) {
+    buf := make([]byte, 2048)
+    for {
+        n, remoteAddr, dst, ifIndex, err := l.read(buf)
+        if err != nil {
+            if ctx.Err() != nil {
+                return
+            }
+            // Continue on read errors to keep the server alive.
+            log.Printf("read error on %s: %v", l.pc.LocalAddr(), err)
+            continue
+        }
+        pool.submit(packet{data: append([]byte(nil), buf[:n]...), conn: l.pc, from: remoteAddr, dst: dst, ifIndex: ifIndex, received: time.Now()})
+    }
+}
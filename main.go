@@ -1,229 +1,244 @@
 package main
 
 import (
+    "context"
     "encoding/json"
+    "fmt"
     "log"
     "net"
     "os"
     "os/exec"
+    "os/signal"
     "path/filepath"
     "strings"
     "strconv"
+    "sync"
+    "syscall"
     "time"
 )
 
 // Simple UDP responder:
 // - Listens on UDP port 60000 (default)
-// - When receiving broadcast or direct UDP with content "TF" (case-insensitive), replies with "TF_ACK"
-// - Otherwise replies with "UNKNOWN_CMD"
+// - When receiving broadcast or direct UDP with content "TF" (case-insensitive), replies with discovery info
+// - Commands are registered in cmd_*.go (see commands.go); unknown ones get "UNKNOWN_CMD|CMDS=..."
+// - CFG and RESTART require an HMAC signature when a shared secret is configured (see auth.go)
+// - Optional REQ=<id>|TS=<unix> fields are echoed in every response; duplicate REQs are rejected (see replay.go)
+// - Messages starting with '{' use the v2 JSON envelope and are answered in JSON (see protocol.go)
+// - Requests are processed by a bounded worker pool; CFG/RESTART run one at a time (see worker.go)
+// - SIGTERM/SIGINT stop reading, finish in-flight replies and exit; systemd notify/watchdog and
+//   "install" subcommand in systemd.go
+// - Listens on IPv4 and IPv6 (see listener.go); joins multicast groups for discovery and
+//   TF reports VIA=multicast|broadcast|unicast (see multicast.go)
+// - Advertises itself as _trae-cfg._udp.local via mDNS / DNS-SD (see mdns.go)
+// - Sends HELLO on startup, on address changes and before RESTART (see announce.go)
+// - Settings come from a JSON config file, environment variables and flags (see config.go)
+
+// version is the firmware/build version reported in discovery; set at build time with
+// -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
 type DeviceConfig struct {
     ID    string `json:"id"`
     IP    string `json:"ip"`
     Port  string `json:"port"`
 }
 
-func main() {
-    port := "60000"
-    if p := os.Getenv("UDP_PORT"); p != "" {
-        port = p
-    }
+// shutdownTimeout bounds how long in-flight requests may take after SIGTERM.
+const shutdownTimeout = 5 * time.Second
 
-    // Device ID from env or hostname fallback
-    deviceID := os.Getenv("DEVICE_ID")
-    if deviceID == "" {
-        hn, _ := os.Hostname()
-        if hn == "" {
-            hn = "unknown"
+func main() {
+    // Subcommand: write a systemd unit for this binary
+    if len(os.Args) > 1 && os.Args[1] == "install" {
+        if err := installUnit(os.Args[2:]); err != nil {
+            log.Fatalf("install: %v", err)
         }
-        deviceID = "HOST-" + hn
+        return
     }
 
-    addr := ":" + port
-    // Use IPv4 UDP; broadcast messages are received transparently by a normal listener.
-    pc, err := net.ListenPacket("udp4", addr)
+    s, printOnly, err := loadSettings(os.Args[1:])
     if err != nil {
-        log.Fatalf("failed to listen on UDP %s: %v", addr, err)
+        log.Fatalf("config: %v", err)
+    }
+    if printOnly {
+        printSettings(os.Stdout, s)
+        return
+    }
+    settings = s
+    logLevel = logLevels[strings.ToLower(settings.LogLevel)]
+    if err := enableCommands(settings.Commands); err != nil {
+        log.Fatalf("config: %v", err)
     }
-    defer pc.Close()
 
-    log.Printf("UDP responder listening on %s", addr)
+    // Network configuration backend (see netbackend.go)
+    if netBackend, err = selectNetBackend(settings.NetBackend); err != nil {
+        log.Fatalf("config: %v", err)
+    }
+    log.Printf("network backend: %s", netBackend.Name())
+    // Undo a network change that was never confirmed (see netapply.go)
+    recoverNetTxn()
 
-    buf := make([]byte, 2048)
-    for {
-        n, remoteAddr, err := pc.ReadFrom(buf)
-        if err != nil {
-            // Continue on read errors to keep the server alive.
-            log.Printf("read error: %v", err)
-            continue
+    // Optional shared secret for mutating commands
+    settings.AuthKey = loadAuthKey(settings.AuthKeyFile)
+    if len(settings.AuthKey) > 0 {
+        log.Printf("auth enabled: CFG/RESTART require TS+SIG")
+    }
+
+    // One socket per address family (see listener.go)
+    var listeners []*listener
+    var addrs []string
+    if settings.Listen != "off" {
+        addr := net.JoinHostPort(settings.Listen, settings.Port)
+        // Broadcast messages are received transparently by a normal IPv4 listener.
+        if l, err := listen4(addr, settings.Multicast); err != nil {
+            log.Printf("failed to listen on UDP %s: %v", addr, err)
+        } else {
+            listeners = append(listeners, l)
+            addrs = append(addrs, "udp4 "+addr)
+        }
+    }
+    if settings.Listen6 != "off" {
+        addr := net.JoinHostPort(settings.Listen6, settings.Port)
+        if l, err := listen6(addr, settings.Multicast6); err != nil {
+            log.Printf("failed to listen on UDP6 %s: %v", addr, err)
+        } else {
+            listeners = append(listeners, l)
+            addrs = append(addrs, "udp6 "+addr)
         }
+    }
+    if len(listeners) == 0 {
+        log.Fatalf("no UDP listener could be opened on port %s", settings.Port)
+    }
+    for _, l := range listeners {
+        defer l.pc.Close()
+    }
+    log.Printf("UDP responder listening on %s", strings.Join(addrs, ", "))
 
-        msg := strings.TrimSpace(string(buf[:n]))
-        log.Printf("received from %s: %q", remoteAddr.String(), msg)
+    // Bounded worker pool; size via workers / queue_size (WORKERS / QUEUE_SIZE)
+    pool := newWorkerPool(settings.Workers, settings.QueueSize)
+    log.Printf("processing with %d workers, queue size %d", settings.Workers, settings.QueueSize)
 
-        var resp string
-        switch {
-        case strings.EqualFold(msg, "TF"):
-            // Respond with discovery info: ID (from /etc/unique_ID, create if missing) and PORT
-            uid, err := ensureUniqueID()
-            if err != nil {
-                log.Printf("ensureUniqueID error: %v")
-            }
-            resp = "TF|ID=" + uid + "|PORT=" + port
-        case strings.EqualFold(msg, "GET_ID"):
-            // Query unique ID from /etc/unique_ID; create if missing per rule.
-            id, err := ensureUniqueID()
-            if err != nil {
-                log.Printf("ensureUniqueID error: %v")
-            }
-            resp = "ID=" + id
-        case strings.EqualFold(msg, "QUERY") || strings.EqualFold(msg, "QRY") || strings.EqualFold(msg, "QUERY_NET") || strings.EqualFold(msg, "QRY_NET") || strings.EqualFold(msg, "NET") || strings.EqualFold(msg, "GET_NET"):
-            // Query current network parameters (IP/MASK/GW/DNS)
-            ip, mask, gw, dns := getNetworkParams()
-            parts := []string{"NET"}
-            if ip != "" { parts = append(parts, "IP="+ip) }
-            if mask != "" { parts = append(parts, "MASK="+mask) }
-            if gw != "" { parts = append(parts, "GW="+gw) }
-            if dns != "" { parts = append(parts, "DNS="+dns) }
-            // Append interface name (always include IF=..., with robust fallback)
-            ifn := ifaceName()
-            if ifn == "" { ifn = "eth0" }
-            // Include both IF and IFACE for maximum client compatibility
-            parts = append(parts, "IF="+ifn)
-            parts = append(parts, "IFACE="+ifn)
-            resp = strings.Join(parts, "|")
-        case strings.HasPrefix(strings.ToUpper(msg), "CFG|"):
-            // Parse simple key=value pairs separated by '|'
-            cfg := parseConfig(msg)
-            if cfg.ID == "" {
-                // If no ID supplied, assume this device
-                cfg.ID = deviceID
-            }
-            // Persist config to local JSON file (safe alternative to changing OS network settings)
-            if err := saveConfig(cfg); err != nil {
-                log.Printf("config save error: %v")
-                resp = "CFG_NACK|ERR=SAVE_FAILED"
-            } else {
-                // Additionally, apply network changes:
-                // - If DHCP flag present, write DHCP config to /etc/systemd/network/eth*.network
-                // - Else if IP/MASK/GW/DNS present, write static config
-                // Note: do NOT restart systemd-networkd to avoid potential connectivity loss.
-                if hasDHCPFlag(msg) {
-                    if err := applySystemdNetworkDHCP(); err != nil {
-                        log.Printf("apply DHCP network config error: %v")
-                        resp = "CFG_ACK|ID=" + cfg.ID + "|NET_NACK"
-                    } else {
-                        resp = "CFG_ACK|ID=" + cfg.ID + "|NET_ACK"
-                    }
-                } else {
-                    ip, mask, gw, dns := parseNetKV(msg)
-                    if ip != "" || mask != "" || gw != "" || dns != "" {
-                        if err := applySystemdNetworkConfig(ip, mask, gw, dns); err != nil {
-                            log.Printf("apply systemd network config error: %v")
-                            resp = "CFG_ACK|ID=" + cfg.ID + "|NET_NACK"
-                        } else {
-                            // Do not restart systemd-networkd per current safety requirement
-                            resp = "CFG_ACK|ID=" + cfg.ID + "|NET_ACK"
-                        }
-                    } else {
-                        resp = "CFG_ACK|ID=" + cfg.ID
-                    }
-                }
-            }
-        case strings.EqualFold(msg, "RESTART"):
-            // Attempt to restart the host; requires appropriate permissions on device side
-            if err := restartHost(); err != nil {
-                log.Printf("restart host error: %v", err)
-                resp = "RESTART_NACK|ERR=" + strings.ReplaceAll(err.Error(), "|", ":")
-            } else {
-                resp = "RESTART_ACK"
-            }
-        default:
-            resp = "UNKNOWN_CMD"
+    // Stop on SIGTERM/SIGINT: unblock reads with a deadline (the sockets stay open so
+    // workers can still send their replies), then drain the pool.
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+    defer stop()
+    go func() {
+        <-ctx.Done()
+        log.Printf("shutdown requested")
+        notify("STOPPING=1")
+        for _, l := range listeners {
+            _ = l.pc.SetReadDeadline(time.Now())
         }
+    }()
+    if wd := watchdogInterval(); wd > 0 {
+        log.Printf("systemd watchdog enabled (%v)", wd)
+        go runWatchdog(ctx, wd)
+    }
+    notify("READY=1\nSTATUS=listening on " + strings.Join(addrs, ", "))
 
-        if _, err := pc.WriteTo([]byte(resp), remoteAddr); err != nil {
-            log.Printf("write error to %s: %v", remoteAddr.String(), err)
-        } else {
-            log.Printf("responded to %s: %q", remoteAddr.String(), resp)
-        }
+    // Announce ourselves and again whenever the addresses change (see announce.go)
+    if settings.AnnouncePort != "off" {
+        sendHello("boot")
+        go watchAddresses(ctx, addrPollInterval)
     }
-}
 
-// parseConfig parses a message like: CFG|ID=abc|IP=192.168.1.10|PORT=60000
-func parseConfig(s string) DeviceConfig {
-    // Normalize and strip leading CFG|
-    up := s
-    if strings.HasPrefix(strings.ToUpper(up), "CFG|") {
-        up = s[len("CFG|"):]
+    // Link-local address for devices that got none (see linklocal.go)
+    if settings.LinkLocal > 0 {
+        go runLinkLocalFallback(ctx, time.Duration(settings.LinkLocal)*time.Second)
     }
-    parts := strings.Split(up, "|")
-    cfg := DeviceConfig{}
-    for _, p := range parts {
-        kv := strings.SplitN(p, "=", 2)
-        if len(kv) != 2 {
-            continue
-        }
-        k := strings.ToUpper(strings.TrimSpace(kv[0]))
-        v := strings.TrimSpace(kv[1])
-        switch k {
-        case "ID":
-            cfg.ID = v
-        case "IP":
-            cfg.IP = v
-        case "PORT":
-            cfg.Port = v
+
+    var wg sync.WaitGroup
+    // mDNS / DNS-SD advertisement (see mdns.go); sends a goodbye before exiting
+    if settings.MDNS {
+        if m, err := startMDNS(); err != nil {
+            log.Printf("mdns disabled: %v", err)
+        } else {
+            log.Printf("advertising %s via mDNS", mdnsService)
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                m.serve(ctx)
+            }()
         }
     }
-    return cfg
-}
-
-// parseNetKV extracts IP/MASK/GW/DNS from a payload like: CFG|IP=...|MASK=...|GW=...|DNS=...
-func parseNetKV(s string) (ip, mask, gw, dns string) {
-    // strip leading token up to first '|'
-    idx := strings.Index(s, "|")
-    rest := s
-    if idx >= 0 {
-        rest = s[idx+1:]
-    }
-    parts := strings.Split(rest, "|")
-    for _, p := range parts {
-        kv := strings.SplitN(p, "=", 2)
-        if len(kv) != 2 { continue }
-        k := strings.ToUpper(strings.TrimSpace(kv[0]))
-        v := strings.TrimSpace(kv[1])
-        switch k {
-        case "IP": ip = v
-        case "MASK": mask = v
-        case "GW": gw = v
-        case "DNS": dns = v
-        }
+    for _, l := range listeners {
+        wg.Add(1)
+        go func(l *listener) {
+            defer wg.Done()
+            l.serve(ctx, pool)
+        }(l)
+    }
+    wg.Wait()
+
+    if pool.stop(shutdownTimeout) {
+        log.Printf("all requests finished, exiting")
+    } else {
+        log.Printf("shutdown timeout (%v), exiting with requests in flight", shutdownTimeout)
     }
-    return
 }
 
-// hasDHCPFlag detects DHCP intent in the CFG payload (e.g., CFG|DHCP=1 or DHCP=yes)
-func hasDHCPFlag(s string) bool {
-    up := strings.ToUpper(s)
-    return strings.Contains(up, "DHCP=1") || strings.Contains(up, "DHCP=YES") || strings.Contains(up, "DHCP=TRUE")
+// netConfig is a static network configuration received with CFG; empty fields are left unchanged.
+// The lists Domains, NTP and Routes replace the configured ones when non-nil (an empty, non-nil
+// list clears them); MTU "0" removes the configured MTU.
+type netConfig struct {
+    IP      string     // IPv4 address
+    Mask    string     // dotted IPv4 netmask
+    GW      string     // IPv4 gateway
+    DNS     []string   // DNS servers (IPv4 or IPv6)
+    IP6     string     // IPv6 address with prefix, e.g. 2001:db8::10/64
+    GW6     string     // IPv6 gateway
+    Domains []string   // DNS search domains
+    MTU     string     // link MTU in bytes
+    NTP     []string   // NTP servers
+    Routes  []netRoute // static routes (besides the default gateways)
 }
 
-// applySystemdNetworkConfig writes IP/mask/gateway/DNS to /etc/systemd/network/eth*.network
-// It updates existing keys in [Network] section or creates a new file if none exists.
-func applySystemdNetworkConfig(ip, mask, gw, dns string) error {
-    dir := "/etc/systemd/network"
-    // choose target file: prefer existing eth*.network else fallback to eth0.network
-    matches, _ := filepath.Glob(filepath.Join(dir, "eth*.network"))
-    var path string
-    if len(matches) > 0 {
-        path = matches[0]
-    } else {
-        // Try to infer iface name from default route
-        iface := defaultIfaceFromProcRoute()
-        if iface == "" || !strings.HasPrefix(iface, "eth") {
-            iface = "eth0"
-        }
-        path = filepath.Join(dir, iface+".network")
+// empty reports whether c carries no settings at all.
+func (c netConfig) empty() bool {
+    return c.IP == "" && c.Mask == "" && c.GW == "" && len(c.DNS) == 0 && c.IP6 == "" && c.GW6 == "" &&
+        c.Domains == nil && c.MTU == "" && c.NTP == nil && c.Routes == nil
+}
+
+// netRoute is a static route; Via is empty for a route to an on-link network.
+// On the wire it is written <dest>/<prefix>@<gateway>, e.g. ROUTES=10.20.0.0/16@192.168.1.254.
+type netRoute struct {
+    To  string // destination network, e.g. 10.20.0.0/16
+    Via string // gateway
+}
+
+func (r netRoute) String() string {
+    if r.Via == "" { return r.To }
+    return r.To + "@" + r.Via
+}
+
+// parseRoute parses <dest>[/<prefix>][@<gateway>]; the gateway must be of the destination's family.
+func parseRoute(s string) (netRoute, error) {
+    to, via, _ := strings.Cut(strings.TrimSpace(s), "@")
+    if !strings.Contains(to, "/") {
+        if isIPv6(to) { to += "/128" } else { to += "/32" }
+    }
+    _, n, err := net.ParseCIDR(to)
+    if err != nil { return netRoute{}, fmt.Errorf("invalid route destination %q", to) }
+    r := netRoute{To: n.String(), Via: strings.TrimSpace(via)}
+    if r.Via != "" && (net.ParseIP(r.Via) == nil || isIPv6(r.Via) != (n.IP.To4() == nil)) {
+        return netRoute{}, fmt.Errorf("invalid route gateway %q", r.Via)
     }
+    return r, nil
+}
+
+// routeStrings returns the wire form of routes.
+func routeStrings(routes []netRoute) []string {
+    var out []string
+    for _, r := range routes { out = append(out, r.String()) }
+    return out
+}
+
+// applySystemdNetworkConfig writes IP/mask/gateway/DNS and IPv6 address/gateway of iface to its
+// .network file in net_dir (default /etc/systemd/network, see networkdFile).
+// It updates existing keys in [Network] section or creates <iface>.network if none exists.
+// Search domains and NTP servers go to Domains=/NTP= of [Network], the MTU to MTUBytes= of [Link]
+// and each static route to a [Route] section with Destination= and Gateway=.
+func applySystemdNetworkConfig(iface string, c netConfig) error {
+    path := networkdFile(iface)
 
     // Read existing content if present
     var lines []string
@@ -231,8 +246,6 @@ func applySystemdNetworkConfig(ip, mask, gw, dns string) error {
         lines = strings.Split(string(b), "\n")
     } else {
         // Create a minimal template
-        iface := "eth0"
-        if d := defaultIfaceFromProcRoute(); d != "" && strings.HasPrefix(d, "eth") { iface = d }
         lines = []string{
             "[Match]",
             "Name=" + iface,
@@ -241,6 +254,8 @@ func applySystemdNetworkConfig(ip, mask, gw, dns string) error {
         }
     }
 
+    for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" { lines = lines[:len(lines)-1] }
+
     // Ensure [Network] section exists
     hasNetwork := false
     for _, l := range lines {
@@ -252,52 +267,111 @@ func applySystemdNetworkConfig(ip, mask, gw, dns string) error {
 
     // Build desired keys
     var addrLine string
-    if ip != "" {
-        if mask != "" {
-            pfx := maskToPrefix(mask)
-            if pfx > 0 { addrLine = "Address=" + ip + "/" + strconv.Itoa(pfx) } else { addrLine = "Address=" + ip }
+    if c.IP != "" {
+        if c.Mask != "" {
+            pfx := maskToPrefix(c.Mask)
+            if pfx > 0 { addrLine = "Address=" + c.IP + "/" + strconv.Itoa(pfx) } else { addrLine = "Address=" + c.IP }
         } else {
-            addrLine = "Address=" + ip
+            addrLine = "Address=" + c.IP
         }
     }
     gwLine := ""
-    if gw != "" { gwLine = "Gateway=" + gw }
+    if c.GW != "" { gwLine = "Gateway=" + c.GW }
     dnsLine := ""
-    if dns != "" { dnsLine = "DNS=" + dns }
-
-    // Update or append within [Network]
-    lines = upsertInSection(lines, "[Network]", "Address=", addrLine)
-    lines = upsertInSection(lines, "[Network]", "Gateway=", gwLine)
+    if len(c.DNS) > 0 { dnsLine = "DNS=" + strings.Join(c.DNS, " ") }
+    addr6Line, gw6Line := "", ""
+    if c.IP6 != "" { addr6Line = "Address=" + c.IP6 }
+    if c.GW6 != "" { gw6Line = "Gateway=" + c.GW6 }
+
+    // Update or append within [Network]; Address=/Gateway= exist once per address family
+    v4 := func(v string) bool { return !strings.Contains(v, ":") }
+    v6 := func(v string) bool { return strings.Contains(v, ":") }
+    lines = upsertInSectionFunc(lines, "[Network]", "Address=", addrLine, v4)
+    lines = upsertInSectionFunc(lines, "[Network]", "Gateway=", gwLine, v4)
+    lines = upsertInSectionFunc(lines, "[Network]", "Address=", addr6Line, v6)
+    lines = upsertInSectionFunc(lines, "[Network]", "Gateway=", gw6Line, v6)
     lines = upsertInSection(lines, "[Network]", "DNS=", dnsLine)
+    lines = setListInSection(lines, "[Network]", "Domains=", c.Domains)
+    lines = setListInSection(lines, "[Network]", "NTP=", c.NTP)
+    if c.MTU == "0" {
+        lines = removeEmptySection(removeInSection(lines, "[Link]", "MTUBytes="), "[Link]")
+    } else if c.MTU != "" {
+        lines = upsertInSection(lines, "[Link]", "MTUBytes=", "MTUBytes="+c.MTU)
+    }
+    if c.Routes != nil {
+        lines = removeRouteSections(lines)
+        for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" { lines = lines[:len(lines)-1] }
+        for _, r := range c.Routes {
+            lines = append(lines, "", "[Route]", "Destination="+r.To)
+            if r.Via != "" { lines = append(lines, "Gateway="+r.Via) }
+        }
+    }
     // Ensure DHCP disabled for static configuration
     lines = upsertInSection(lines, "[Network]", "DHCP=", "DHCP=no")
 
     // Write back
-    content := strings.Join(lines, "\n")
+    content := strings.Join(lines, "\n") + "\n"
     return os.WriteFile(path, []byte(content), 0o644)
 }
 
-// applySystemdNetworkDHCP writes a minimal DHCP config to /etc/systemd/network/eth*.network
-// It chooses an existing eth*.network or falls back to <iface>.network based on default route.
-func applySystemdNetworkDHCP() error {
-    dir := "/etc/systemd/network"
-    matches, _ := filepath.Glob(filepath.Join(dir, "eth*.network"))
-    var path string
-    var iface string
-    if len(matches) > 0 {
-        path = matches[0]
-        // try infer iface from file name
-        base := filepath.Base(path)
-        if strings.HasPrefix(base, "eth") { iface = strings.TrimSuffix(base, ".network") }
-    }
-    if path == "" {
-        // Pick default iface from route if available
-        iface = defaultIfaceFromProcRoute()
-        if iface == "" || !strings.HasPrefix(iface, "eth") {
-            iface = "eth0"
+// removeEmptySection drops section (and the blank lines before it) when it has no keys left.
+func removeEmptySection(lines []string, section string) []string {
+    for i, l := range lines {
+        if strings.TrimSpace(l) != section { continue }
+        end := i + 1
+        for end < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[end]), "[") {
+            if t := strings.TrimSpace(lines[end]); t != "" && !strings.HasPrefix(t, "#") { return lines }
+            end++
+        }
+        start := i
+        for start > 0 && strings.TrimSpace(lines[start-1]) == "" { start-- }
+        if end < len(lines) && start > 0 { start++ } // keep one blank line between the neighbours
+        return append(lines[:start:start], lines[end:]...)
+    }
+    return lines
+}
+
+// setListInSection sets key (e.g. "Domains=") to the space-separated values; nil leaves it, an
+// empty list removes it.
+func setListInSection(lines []string, section, key string, values []string) []string {
+    if values == nil { return lines }
+    if len(values) == 0 { return removeInSection(lines, section, key) }
+    return upsertInSection(lines, section, key, key+strings.Join(values, " "))
+}
+
+// removeRouteSections drops the [Route] sections that have a Destination (static routes written
+// by CFG); [Route] sections with just a Gateway are default routes and stay.
+func removeRouteSections(lines []string) []string {
+    var out, sec []string
+    flush := func() {
+        if iniValue(sec, "[Route]", "Destination") == "" {
+            out = append(out, sec...)
+        } else {
+            // drop the section together with the blank lines before it, keeping those after it
+            for len(out) > 0 && strings.TrimSpace(out[len(out)-1]) == "" { out = out[:len(out)-1] }
+            for i := len(sec); i > 0 && strings.TrimSpace(sec[i-1]) == "" && len(out) > 0; i-- { out = append(out, "") }
+        }
+        sec = nil
+    }
+    for _, l := range lines {
+        t := strings.TrimSpace(l)
+        if strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") {
+            if sec != nil { flush() }
+            if t == "[Route]" {
+                sec = []string{l}
+                continue
+            }
         }
-        path = filepath.Join(dir, iface+".network")
+        if sec != nil { sec = append(sec, l) } else { out = append(out, l) }
     }
+    if sec != nil { flush() }
+    return out
+}
+
+// applySystemdNetworkDHCP writes a minimal DHCP config for iface to its .network file in net_dir
+// (see networkdFile), replacing the static settings.
+func applySystemdNetworkDHCP(iface string) error {
+    path := networkdFile(iface)
 
     // Minimal DHCP file content
     lines := []string{
@@ -307,13 +381,43 @@ func applySystemdNetworkDHCP() error {
         "[Network]",
         "DHCP=yes",
     }
-    content := strings.Join(lines, "\n")
+    content := strings.Join(lines, "\n") + "\n"
     return os.WriteFile(path, []byte(content), 0o644)
 }
 
+// setNetworkdLinkLocal adds addr as an extra Address= of iface (creating a DHCP file if there is
+// none), or removes the link-local Address= lines when addr is "".
+func setNetworkdLinkLocal(iface, addr string) error {
+    path := networkdFile(iface)
+    b, err := os.ReadFile(path)
+    if os.IsNotExist(err) && addr != "" {
+        if err := applySystemdNetworkDHCP(iface); err != nil { return err }
+        b, err = os.ReadFile(path)
+    }
+    if err != nil {
+        if os.IsNotExist(err) { return nil }
+        return err
+    }
+    old := strings.TrimRight(string(b), "\n")
+    lines := strings.Split(old, "\n")
+    if addr != "" {
+        lines = upsertInSectionFunc(lines, "[Network]", "Address=", "Address="+addr, isLinkLocalCIDR)
+    } else {
+        lines = removeInSectionFunc(lines, "[Network]", "Address=", isLinkLocalCIDR)
+    }
+    if strings.Join(lines, "\n") == old { return nil }
+    return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+}
+
 // upsertInSection finds a section header, and replaces the first line starting with keyPrefix with newLine.
 // If newLine is empty, it leaves existing content unchanged. If key not found and newLine is non-empty, it appends it within the section.
 func upsertInSection(lines []string, section string, keyPrefix string, newLine string) []string {
+    return upsertInSectionFunc(lines, section, keyPrefix, newLine, nil)
+}
+
+// upsertInSectionFunc is upsertInSection that only replaces lines whose value (after keyPrefix)
+// satisfies match; a nil match accepts any value.
+func upsertInSectionFunc(lines []string, section string, keyPrefix string, newLine string, match func(value string) bool) []string {
     if newLine == "" { return lines }
     // Find section range
     start := -1
@@ -335,13 +439,14 @@ func upsertInSection(lines []string, section string, keyPrefix string, newLine s
     }
     // search key within section
     for i := start + 1; i < end; i++ {
-        if strings.HasPrefix(strings.TrimSpace(lines[i]), keyPrefix) {
+        t := strings.TrimSpace(lines[i])
+        if strings.HasPrefix(t, keyPrefix) && (match == nil || match(strings.TrimPrefix(t, keyPrefix))) {
             lines[i] = newLine
             return lines
         }
     }
-    // not found -> append before end
-    // ensure there's at least one empty line separation
+    // not found -> append before end, keeping trailing blank lines after the new key
+    for end > start+1 && strings.TrimSpace(lines[end-1]) == "" { end-- }
     if end == len(lines) {
         lines = append(lines, newLine)
     } else {
@@ -419,10 +524,15 @@ func restartHost() error {
     return nil
 }
 
-// ensureUniqueID reads /etc/unique_ID if present; if missing, creates it per rules
-// Rule: current timestamp -> hex uppercase; prefix with '0'; insert '-' every 4 chars.
+// idMu guards creation of the ID file (TF/GET_ID may run concurrently)
+var idMu sync.Mutex
+
+// ensureUniqueID reads the ID file (id_file, default /etc/unique_ID) if present; if missing, creates it
+// by the id_strategy rule (see uniqueid.go).
 func ensureUniqueID() (string, error) {
-    const path = "/etc/unique_ID"
+    path := settings.IDFile
+    idMu.Lock()
+    defer idMu.Unlock()
     // If exists, read and return
     if b, err := os.ReadFile(path); err == nil {
         id := strings.TrimSpace(string(b))
@@ -432,43 +542,53 @@ func ensureUniqueID() (string, error) {
         // If file exists but empty, fall through to regenerate
     }
     // Generate new ID and write
-    id := generateUniqueID()
-    if err := os.WriteFile(path, []byte(id), 0o644); err != nil {
-        // Return ID even if write fails (permission or other), but report error
-        return id, err
+    id, strategy := generateUniqueID()
+    log.Printf("created unique ID %s (%s)", id, strategy)
+    // Return ID even if write fails (permission or other), but report error
+    return id, writeUniqueID(id, true)
+}
+
+// regenerateUniqueID replaces the ID file with an ID by strategy and returns the old and new ID.
+// Unlike ensureUniqueID it does not fall back to the timestamp rule.
+func regenerateUniqueID(strategy string) (string, string, error) {
+    idMu.Lock()
+    defer idMu.Unlock()
+    b, _ := os.ReadFile(settings.IDFile)
+    id, err := idFromStrategy(strategy)
+    if err != nil { return "", "", err }
+    old := strings.TrimSpace(string(b))
+    // A hostname set by SET_HOSTNAME (or by hand) is kept; only the default one follows the ID
+    host := configuredHostname()
+    return old, id, writeUniqueID(id, host == "" || strings.EqualFold(host, "Kan-"+old))
+}
+
+// writeUniqueID writes the ID file and, with rename, the hostname "Kan-<ID>" (see writeHostname).
+// Caller holds idMu.
+func writeUniqueID(id string, rename bool) error {
+    if err := os.WriteFile(settings.IDFile, []byte(id), 0o644); err != nil {
+        return err
     }
+    if !rename { return nil }
     // Also write hostname as "Kan-<ID>" after generating a new ID
-    if err := os.WriteFile("/etc/hostname", []byte("Kan-"+id), 0o644); err != nil {
+    if err := writeHostname("Kan-" + id); err != nil {
         // Do not fail the operation, just log for visibility
-        log.Printf("write /etc/hostname error: %v", err)
-    }
-    return id, nil
-}
-
-func generateUniqueID() string {
-    // Use current Unix timestamp in milliseconds
-    ts := time.Now().UnixMilli()
-    hex := strings.ToUpper(strconv.FormatInt(ts, 16))
-    // Prefix first digit with 0
-    padded := "0" + hex
-    // Insert '-' every 4 characters
-    var sb strings.Builder
-    for i := 0; i < len(padded); i += 4 {
-        end := i + 4
-        if end > len(padded) {
-            end = len(padded)
-        }
-        sb.WriteString(padded[i:end])
-        if end < len(padded) {
-            sb.WriteByte('-')
-        }
+        log.Printf("write %s error: %v", settings.HostnameFile, err)
     }
-    return sb.String()
+    return nil
+}
+
+// generateUniqueID derives a new ID by id_strategy and returns it with the strategy used: the
+// timestamp rule when the strategy's source is missing.
+func generateUniqueID() (string, string) {
+    id, err := idFromStrategy(settings.IDStrategy)
+    if err == nil { return id, settings.IDStrategy }
+    log.Printf("id strategy %s: source unavailable, using %s", settings.IDStrategy, idTimestamp)
+    return timestampID(), idTimestamp
 }
 
 func saveConfig(cfg DeviceConfig) error {
-    // Store under current working dir
-    path := filepath.Join(".", "device_config.json")
+    // Store under state_dir (default: current working dir)
+    path := filepath.Join(settings.StateDir, "device_config.json")
     // Merge with existing config if present
     var existing DeviceConfig
     if b, err := os.ReadFile(path); err == nil {
@@ -490,75 +610,91 @@ func saveConfig(cfg DeviceConfig) error {
     return os.WriteFile(path, data, 0o644)
 }
 
-// getNetworkParams obtains IP, netmask, gateway and DNS.
+// getNetworkParams obtains the IPv4 address, netmask, gateway, DNS servers, search domains, MTU,
+// NTP servers and static routes of iface.
 // Priority:
-// 1) Parse from /etc/system/network/eth*.network (user-specified path)
-// 2) Fallback to /etc/systemd/network/eth*.network
-// 3) Fallback to live system info: interfaces, /proc/net/route, /etc/resolv.conf
-func getNetworkParams() (ip, mask, gw, dns string) {
-    // Try systemd network files first (correct path)
-    ip, mask, gw, dns = parseNetworkFiles("/etc/systemd/network/eth*.network")
-    if ip == "" && mask == "" && gw == "" && dns == "" {
-        // Fallback to any .network files in systemd directory
-        ip, mask, gw, dns = parseNetworkFiles("/etc/systemd/network/*.network")
-    }
+// 1) Configuration of the network backend (e.g. the .network file of iface)
+// 2) Fallback to live system info: interfaces, /proc/net/route, /etc/resolv.conf
+func getNetworkParams(iface string) netConfig {
+    c := netBackend.Read(iface)
     // Fallbacks if any missing
-    if ip == "" || mask == "" {
-        ip2, mask2 := ipMaskFromInterfaces()
-        if ip == "" { ip = ip2 }
-        if mask == "" { mask = mask2 }
-    }
-    if gw == "" { gw = gatewayFromProcRoute() }
-    if dns == "" { dns = dnsFromResolvConf() }
-    return ip, mask, gw, dns
-}
-
-func parseNetworkFiles(glob string) (ip, mask, gw, dns string) {
-    matches, _ := filepath.Glob(glob)
-    for _, f := range matches {
-        b, err := os.ReadFile(f)
-        if err != nil { continue }
-        lines := strings.Split(string(b), "\n")
-        var addrCIDR string
-        for _, line := range lines {
-            s := strings.TrimSpace(line)
-            if s == "" || strings.HasPrefix(s, "#") { continue }
-            // Only consider within [Network] section loosely (simple heuristic)
-            // We just look for keys regardless of section for simplicity.
-            if strings.HasPrefix(s, "Address=") {
-                addrCIDR = strings.TrimSpace(strings.TrimPrefix(s, "Address="))
-            } else if strings.HasPrefix(s, "Gateway=") {
-                gw = strings.TrimSpace(strings.TrimPrefix(s, "Gateway="))
-            } else if strings.HasPrefix(s, "DNS=") {
-                dnsVal := strings.TrimSpace(strings.TrimPrefix(s, "DNS="))
-                // systemd allows multiple space-separated; pick first IPv4
-                fields := strings.Fields(dnsVal)
-                for _, d := range fields {
-                    if isIPv4(d) { dns = d; break }
-                }
-            }
+    if c.IP == "" || c.Mask == "" {
+        ip2, mask2 := ipv4FromInterface(iface)
+        if ip2 == "" { ip2, mask2 = ipMaskFromInterfaces() }
+        if c.IP == "" { c.IP = ip2 }
+        if c.Mask == "" { c.Mask = mask2 }
+    }
+    if c.GW == "" { c.GW = gatewayFromProcRoute(iface) }
+    hasDNS4 := false
+    for _, d := range c.DNS {
+        if isIPv4(d) { hasDNS4 = true }
+    }
+    if !hasDNS4 { c.DNS = append(c.DNS, dnsFromResolvConf()...) }
+    if len(c.Domains) == 0 { c.Domains = searchFromResolvConf() }
+    if c.MTU == "" {
+        if ifi, err := net.InterfaceByName(iface); err == nil && ifi.MTU > 0 { c.MTU = strconv.Itoa(ifi.MTU) }
+    }
+    return c
+}
+
+// parseNetworkFile reads a systemd-networkd .network file: Address=/Gateway=/DNS=/Domains=/NTP=
+// of [Network] (one address and gateway per family), MTUBytes= of [Link] and the [Route]
+// sections (one without Destination is a default route).
+func parseNetworkFile(path string) (c netConfig) {
+    b, err := os.ReadFile(path)
+    if err != nil { return c }
+    section := ""
+    var route *netRoute
+    endRoute := func() {
+        if route == nil { return }
+        switch {
+        case route.To == "" || route.To == "0.0.0.0/0" || route.To == "::/0":
+            if isIPv4(route.Via) && c.GW == "" { c.GW = route.Via }
+            if isIPv6(route.Via) && c.GW6 == "" { c.GW6 = route.Via }
+        default:
+            c.Routes = append(c.Routes, *route)
         }
-        if addrCIDR != "" {
-            // Expect something like 192.168.1.10/24
-            if ipNet := strings.Split(addrCIDR, "/"); len(ipNet) == 2 {
-                ipCandidate := strings.TrimSpace(ipNet[0])
-                if isIPv4(ipCandidate) {
-                    ip = ipCandidate
-                    if pfx, err := strconv.Atoi(ipNet[1]); err == nil && pfx >= 0 && pfx <= 32 {
-                        mask = prefixToMask(pfx)
-                    }
-                }
-            } else {
-                // If no CIDR, try to parse as plain IP
-                if isIPv4(addrCIDR) { ip = addrCIDR }
-            }
+        route = nil
+    }
+    for _, line := range strings.Split(string(b), "\n") {
+        s := strings.TrimSpace(line)
+        if s == "" || strings.HasPrefix(s, "#") || strings.HasPrefix(s, ";") { continue }
+        if strings.HasPrefix(s, "[") {
+            endRoute()
+            section = s
+            if section == "[Route]" { route = &netRoute{} }
+            continue
         }
-        // If we found anything meaningful, return (prefer first match)
-        if ip != "" || mask != "" || gw != "" || dns != "" {
-            return ip, mask, gw, dns
+        k, v, ok := strings.Cut(s, "=")
+        if !ok { continue }
+        k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+        switch section + k {
+        case "[Network]Address":
+            ip, pfx := splitCIDR(v)
+            if isIPv4(ip) && c.IP == "" {
+                c.IP = ip
+                if n, err := strconv.Atoi(pfx); err == nil && n >= 0 && n <= 32 { c.Mask = prefixToMask(n) }
+            } else if isIPv6(ip) && c.IP6 == "" {
+                c.IP6 = v
+            }
+        case "[Network]Gateway":
+            if isIPv4(v) { c.GW = v } else if isIPv6(v) { c.GW6 = v }
+        case "[Network]DNS":
+            c.DNS = append(c.DNS, strings.Fields(v)...)
+        case "[Network]Domains":
+            c.Domains = append(c.Domains, strings.Fields(v)...)
+        case "[Network]NTP":
+            c.NTP = append(c.NTP, strings.Fields(v)...)
+        case "[Link]MTUBytes":
+            c.MTU = v
+        case "[Route]Destination":
+            route.To = v
+        case "[Route]Gateway":
+            route.Via = v
         }
     }
-    return "", "", "", ""
+    endRoute()
+    return c
 }
 
 // ipMaskFromInterfaces finds first non-loopback IPv4 addr and netmask
@@ -587,14 +723,35 @@ func ipMaskFromInterfaces() (ip, mask string) {
     return firstIP, firstMask
 }
 
+// ipv4FromInterface returns the first IPv4 address and netmask of the named interface
+func ipv4FromInterface(name string) (ip, mask string) {
+    ifi, err := net.InterfaceByName(name)
+    if err != nil { return "", "" }
+    addrs, _ := ifi.Addrs()
+    for _, a := range addrs {
+        if ipnet, ok := a.(*net.IPNet); ok {
+            if ip4 := ipnet.IP.To4(); ip4 != nil { return ip4.String(), netmaskFromIPNet(ipnet) }
+        }
+    }
+    return "", ""
+}
+
+// liveMask returns the netmask iface has now, else that of the first interface (see ipMaskFromInterfaces)
+func liveMask(iface string) string {
+    if _, m := ipv4FromInterface(iface); m != "" { return m }
+    _, m := ipMaskFromInterfaces()
+    return m
+}
+
 func netmaskFromIPNet(n *net.IPNet) string {
     // Convert mask bytes to dotted form
     m := n.Mask
     return net.IP(m).String()
 }
 
-// gatewayFromProcRoute parses /proc/net/route to find default gateway (Linux)
-func gatewayFromProcRoute() string {
+// gatewayFromProcRoute parses /proc/net/route to find default gateway (Linux); with iface set, only
+// a default route through that interface counts
+func gatewayFromProcRoute(iface string) string {
     const path = "/proc/net/route"
     b, err := os.ReadFile(path)
     if err != nil { return "" }
@@ -604,6 +761,7 @@ func gatewayFromProcRoute() string {
         if len(f) < 3 { continue }
         dest := f[1]
         gwHex := f[2]
+        if iface != "" && f[0] != iface { continue }
         if dest == "00000000" { // default route
             if ip := hexLEToIPv4(gwHex); ip != "" { return ip }
         }
@@ -621,20 +779,39 @@ func hexLEToIPv4(s string) string {
     return net.IPv4(byte(b0), byte(b1), byte(b2), byte(b3)).String()
 }
 
-// dnsFromResolvConf reads first nameserver from /etc/resolv.conf
-func dnsFromResolvConf() string {
+// dnsFromResolvConf reads the IPv4 nameservers from /etc/resolv.conf
+func dnsFromResolvConf() []string {
     const path = "/etc/resolv.conf"
     b, err := os.ReadFile(path)
-    if err != nil { return "" }
+    if err != nil { return nil }
+    var out []string
     lines := strings.Split(string(b), "\n")
     for _, l := range lines {
         s := strings.TrimSpace(l)
         if strings.HasPrefix(s, "nameserver ") {
             ip := strings.TrimSpace(strings.TrimPrefix(s, "nameserver "))
-            if isIPv4(ip) { return ip }
+            if isIPv4(ip) { out = append(out, ip) }
         }
     }
-    return ""
+    return out
+}
+
+// searchFromResolvConf reads the search domains from /etc/resolv.conf
+func searchFromResolvConf() []string {
+    b, err := os.ReadFile("/etc/resolv.conf")
+    if err != nil { return nil }
+    var out []string
+    for _, l := range strings.Split(string(b), "\n") {
+        if f := strings.Fields(l); len(f) > 1 && (f[0] == "search" || f[0] == "domain") { out = f[1:] }
+    }
+    return out
+}
+
+// defaultIface is the interface CFG and QUERY_NET manage when the request has no IF=: ifaceName,
+// else eth0.
+func defaultIface() string {
+    if n := ifaceName(); n != "" { return n }
+    return "eth0"
 }
 
 // ifaceName determines a reasonable interface name to report (e.g., eth0).
@@ -642,9 +819,10 @@ func dnsFromResolvConf() string {
 // 1) Interface from default route in /proc/net/route
 // 2) First interface with IPv4 and typical ethernet prefixes (eth*, enp*, ens*, eno*)
 // 3) Any non-loopback interface that has IPv4
+// 4) A wireless interface (wlan*, not yet associated)
 func ifaceName() string {
-    // 0) Allow manual override via environment variable
-    if env := os.Getenv("IFACE_NAME"); strings.TrimSpace(env) != "" { return strings.TrimSpace(env) }
+    // 0) Allow manual override via config (iface) or environment variable IFACE_NAME
+    if settings.Iface != "" { return settings.Iface }
     // 1) Default route on Linux
     if d := defaultIfaceFromProcRoute(); d != "" { return d }
     // 2) Enumerate local interfaces and pick a reasonable one
@@ -666,9 +844,20 @@ func ifaceName() string {
             }
         }
     }
+    // 4) Nothing has an address yet: a wireless interface still to be configured (see cmd_wifi.go)
+    if w := wirelessIfaces(); fallback == "" && len(w) > 0 { return w[0] }
     return fallback
 }
 
+// webPortOpen reports whether a TCP service (the device web page) accepts connections on the local port
+func webPortOpen(port string) bool {
+    if port == "" || port == "0" { return false }
+    c, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), 200*time.Millisecond)
+    if err != nil { return false }
+    c.Close()
+    return true
+}
+
 func prefixToMask(pfx int) string {
     var m uint32
     if pfx == 0 { return "0.0.0.0" }
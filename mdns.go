@@ -0,0 +1,218 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "golang.org/x/net/dns/dnsmessage"
+    "golang.org/x/net/ipv4"
+)
+
+// mDNS / DNS-SD advertisement.
+// Each device announces itself as <ID>._trae-cfg._udp.local with
+//   SRV  -> <host>.local:<control port>
+//   TXT  -> id=<ID> port=<control port> web=<web port> v=<protocol version> fw=<firmware>
+//   A/AAAA for <host>.local
+// so that standard tools (avahi-browse, dns-sd) can find devices without speaking TF.
+// Queries to 224.0.0.251:5353 are answered by multicast, or unicast when the query asks
+// for it (QU bit) or comes from a port other than 5353 (legacy unicast, RFC 6762 6.7).
+// Enabled by the mdns setting (MDNS=0 disables); IPv4 only.
+
+const (
+    mdnsGroup    = "224.0.0.251"
+    mdnsPort     = 5353
+    mdnsService  = "_trae-cfg._udp.local."
+    mdnsServices = "_services._dns-sd._udp.local."
+    mdnsTTL      = 120
+    // mdnsUnicast is the top bit of the question class (QU) and, in answers, the cache-flush bit
+    mdnsUnicast = 1 << 15
+)
+
+type mdnsResponder struct {
+    pc    net.PacketConn
+    group *net.UDPAddr
+}
+
+// startMDNS opens UDP 5353 (shared with other responders where possible) and joins the mDNS group.
+func startMDNS() (*mdnsResponder, error) {
+    lc := net.ListenConfig{Control: reuseAddrPort}
+    pc, err := lc.ListenPacket(context.Background(), "udp4", ":"+strconv.Itoa(mdnsPort))
+    if err != nil {
+        return nil, err
+    }
+    p := ipv4.NewPacketConn(pc)
+    if joined := joinMulticast(mdnsGroup, false, p.JoinGroup); len(joined) == 0 {
+        pc.Close()
+        return nil, errors.New("cannot join " + mdnsGroup)
+    }
+    _ = p.SetMulticastTTL(255)
+    return &mdnsResponder{pc: pc, group: &net.UDPAddr{IP: net.ParseIP(mdnsGroup), Port: mdnsPort}}, nil
+}
+
+// serve answers queries until ctx is done, announcing on start and saying goodbye (TTL 0) on exit.
+func (m *mdnsResponder) serve(ctx context.Context) {
+    go func() {
+        <-ctx.Done()
+        m.announce(0)
+        m.pc.Close()
+    }()
+    // RFC 6762 8.3: announce at least twice, one second apart
+    m.announce(mdnsTTL)
+    time.AfterFunc(time.Second, func() {
+        if ctx.Err() == nil { m.announce(mdnsTTL) }
+    })
+
+    buf := make([]byte, 9000)
+    for {
+        n, from, err := m.pc.ReadFrom(buf)
+        if err != nil {
+            if ctx.Err() != nil {
+                return
+            }
+            debugf("mdns read error: %v", err)
+            continue
+        }
+        var q dnsmessage.Message
+        if err := q.Unpack(buf[:n]); err != nil || q.Header.Response || len(q.Questions) == 0 {
+            continue
+        }
+        m.reply(&q, from)
+    }
+}
+
+// reply answers the questions of q this device is authoritative for.
+func (m *mdnsResponder) reply(q *dnsmessage.Message, from net.Addr) {
+    src, _ := from.(*net.UDPAddr)
+    legacy := src != nil && src.Port != mdnsPort
+    unicast := legacy
+    ttl := uint32(mdnsTTL)
+    if legacy { ttl = 10 }
+    recs := mdnsRecords(ttl)
+    var answers, extra []dnsmessage.Resource
+    for _, question := range q.Questions {
+        if question.Class&mdnsUnicast != 0 { unicast = true }
+        a, x := recs.answer(question)
+        answers = append(answers, a...)
+        extra = append(extra, x...)
+    }
+    if len(answers) == 0 {
+        return
+    }
+    resp := dnsmessage.Message{
+        Header:      dnsmessage.Header{Response: true, Authoritative: true},
+        Answers:     answers,
+        Additionals: extra,
+    }
+    if legacy {
+        // Legacy unicast responses echo the query ID and questions
+        resp.Header.ID = q.Header.ID
+        resp.Questions = q.Questions
+    }
+    to := net.Addr(m.group)
+    if unicast && src != nil { to = src }
+    m.send(resp, to)
+}
+
+// announce multicasts all records with ttl (0 = goodbye).
+func (m *mdnsResponder) announce(ttl uint32) {
+    r := mdnsRecords(ttl)
+    answers := append([]dnsmessage.Resource{r.ptr, r.srv, r.txt}, r.addrs...)
+    m.send(dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}, Answers: answers}, m.group)
+}
+
+func (m *mdnsResponder) send(msg dnsmessage.Message, to net.Addr) {
+    out, err := msg.Pack()
+    if err != nil {
+        log.Printf("mdns pack error: %v", err)
+        return
+    }
+    if _, err := m.pc.WriteTo(out, to); err != nil {
+        debugf("mdns write to %s: %v", to, err)
+    }
+}
+
+// mdnsRecordSet holds the records of this device.
+type mdnsRecordSet struct {
+    instance, host string // <ID>._trae-cfg._udp.local. and <hostname>.local.
+    ptr, enum      dnsmessage.Resource // service -> instance, service enumeration -> service
+    srv, txt       dnsmessage.Resource
+    addrs          []dnsmessage.Resource // A/AAAA of host
+}
+
+// mdnsRecords builds the current records (ID, ports and addresses may change at runtime).
+func mdnsRecords(ttl uint32) mdnsRecordSet {
+    id, _ := ensureUniqueID()
+    hn, _ := os.Hostname()
+    r := mdnsRecordSet{instance: dnsLabel(id) + "." + mdnsService, host: dnsLabel(hn) + ".local."}
+    port, _ := strconv.Atoi(settings.Port)
+    hdr := func(name string, t dnsmessage.Type, unique bool) dnsmessage.ResourceHeader {
+        class := dnsmessage.ClassINET
+        if unique { class |= mdnsUnicast }
+        return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: t, Class: class, TTL: ttl}
+    }
+    r.ptr = dnsmessage.Resource{Header: hdr(mdnsService, dnsmessage.TypePTR, false), Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(r.instance)}}
+    r.enum = dnsmessage.Resource{Header: hdr(mdnsServices, dnsmessage.TypePTR, false), Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(mdnsService)}}
+    r.srv = dnsmessage.Resource{Header: hdr(r.instance, dnsmessage.TypeSRV, true), Body: &dnsmessage.SRVResource{Port: uint16(port), Target: dnsmessage.MustNewName(r.host)}}
+    txt := []string{"id=" + id, "port=" + settings.Port, "web=" + settings.WebPort, "v=" + strconv.Itoa(protoVersion), "fw=" + version}
+    r.txt = dnsmessage.Resource{Header: hdr(r.instance, dnsmessage.TypeTXT, true), Body: &dnsmessage.TXTResource{TXT: txt}}
+    addrs, _ := net.InterfaceAddrs()
+    for _, a := range addrs {
+        ipnet, ok := a.(*net.IPNet)
+        if !ok || ipnet.IP.IsLoopback() { continue }
+        if ip4 := ipnet.IP.To4(); ip4 != nil {
+            var b [4]byte
+            copy(b[:], ip4)
+            r.addrs = append(r.addrs, dnsmessage.Resource{Header: hdr(r.host, dnsmessage.TypeA, true), Body: &dnsmessage.AResource{A: b}})
+        } else if ip6 := ipnet.IP.To16(); ip6 != nil {
+            var b [16]byte
+            copy(b[:], ip6)
+            r.addrs = append(r.addrs, dnsmessage.Resource{Header: hdr(r.host, dnsmessage.TypeAAAA, true), Body: &dnsmessage.AAAAResource{AAAA: b}})
+        }
+    }
+    return r
+}
+
+// answer returns answers and additional records for one question.
+func (r mdnsRecordSet) answer(q dnsmessage.Question) (answers, extra []dnsmessage.Resource) {
+    name := q.Name.String()
+    pick := func(rs ...dnsmessage.Resource) []dnsmessage.Resource {
+        var out []dnsmessage.Resource
+        for _, x := range rs {
+            if q.Type == dnsmessage.TypeALL || q.Type == x.Header.Type { out = append(out, x) }
+        }
+        return out
+    }
+    switch {
+    case strings.EqualFold(name, mdnsService):
+        if answers = pick(r.ptr); len(answers) > 0 { extra = append([]dnsmessage.Resource{r.srv, r.txt}, r.addrs...) }
+    case strings.EqualFold(name, mdnsServices):
+        answers = pick(r.enum)
+    case strings.EqualFold(name, r.instance):
+        if answers = pick(r.srv, r.txt); len(answers) > 0 { extra = r.addrs }
+    case strings.EqualFold(name, r.host):
+        answers = pick(r.addrs...)
+    }
+    return answers, extra
+}
+
+// dnsLabel makes s usable as a single DNS label (letters, digits, '-').
+func dnsLabel(s string) string {
+    var b strings.Builder
+    for _, c := range s {
+        switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-':
+            b.WriteRune(c)
+        default:
+            b.WriteByte('-')
+        }
+    }
+    if b.Len() == 0 { return "device" }
+    if b.Len() > 63 { return b.String()[:63] }
+    return b.String()
+}
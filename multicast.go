@@ -0,0 +1,80 @@
+package main
+
+import (
+    "log"
+    "net"
+)
+
+// Multicast discovery.
+// Broadcast is filtered by many managed switches and Wi-Fi APs, so the server also joins an
+// IPv4 multicast group (multicast_group, default 239.255.60.60) and, on the IPv6 socket, the
+// link-local group ff02::6060 (multicast_group6) on every multicast-capable interface and
+// answers TF sent to group:port. The destination address of each datagram is read from the
+// IP_PKTINFO / IPV6_PKTINFO control message and reported in TF as VIA=multicast|broadcast|unicast.
+
+// defaultMulticastGroup is the discovery group; the GUI sends TF to the same address.
+const defaultMulticastGroup = "239.255.60.60"
+
+// defaultMulticastGroup6 is the IPv6 link-local discovery group (see listener.go).
+const defaultMulticastGroup6 = "ff02::6060"
+
+// joinMulticast joins group on all up, multicast-capable interfaces using join
+// (ipv4.PacketConn.JoinGroup or ipv6.PacketConn.JoinGroup). v6 selects the address
+// family group must belong to. It returns the interfaces joined.
+func joinMulticast(group string, v6 bool, join func(*net.Interface, net.Addr) error) []string {
+    ip := net.ParseIP(group)
+    if ip == nil || !ip.IsMulticast() || (ip.To4() == nil) != v6 {
+        log.Printf("multicast: invalid group %q", group)
+        return nil
+    }
+    gaddr := &net.UDPAddr{IP: ip}
+    var joined []string
+    ifaces, _ := net.Interfaces()
+    for i := range ifaces {
+        ifi := &ifaces[i]
+        if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 { continue }
+        if err := join(ifi, gaddr); err != nil {
+            debugf("multicast: join %s on %s: %v", group, ifi.Name, err)
+            continue
+        }
+        joined = append(joined, ifi.Name)
+    }
+    if len(joined) == 0 {
+        // Let the kernel pick the interface (default route)
+        if err := join(nil, gaddr); err != nil {
+            log.Printf("multicast: join %s failed: %v", group, err)
+            return nil
+        }
+        joined = append(joined, "default")
+    }
+    return joined
+}
+
+// arrivalPath classifies the destination address of a received datagram:
+// "multicast", "broadcast" (limited or directed) or "unicast"; "" when unknown.
+func arrivalPath(dst net.IP) string {
+    if dst == nil {
+        return ""
+    }
+    if dst.IsMulticast() {
+        return "multicast"
+    }
+    if dst.Equal(net.IPv4bcast) {
+        return "broadcast"
+    }
+    addrs, _ := net.InterfaceAddrs()
+    for _, a := range addrs {
+        ipnet, ok := a.(*net.IPNet)
+        if !ok { continue }
+        ip4 := ipnet.IP.To4()
+        if ip4 == nil || len(ipnet.Mask) != net.IPv4len { continue }
+        bcast := make(net.IP, net.IPv4len)
+        for i := range bcast {
+            bcast[i] = ip4[i] | ^ipnet.Mask[i]
+        }
+        if dst.Equal(bcast) && !dst.Equal(ip4) {
+            return "broadcast"
+        }
+    }
+    return "unicast"
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Transactional network apply.
+// CFG with APPLY=1 backs up the files of the network backend (e.g. <net_dir>/*.network) in the
+// transaction record, writes the new configuration, answers
+// CFG_ACK|..|NET_ACK|APPLY_PENDING|TXN=<id>|CONFIRM=<seconds> and then applies it (restarts
+// systemd-networkd, activates the NetworkManager connection, ...). Unless CFG_CONFIRM|TXN=<id>
+// arrives at the new address within CONFIRM seconds (CFG argument, default confirm_timeout),
+// the backup is restored and applied again, so a wrong address cannot lock the device out. The pending transaction is
+// kept in <state_dir>/net_txn.json and rolled back at startup if the server was restarted
+// before it was confirmed. Without APPLY=1, CFG only writes the files as before.
+
+// defaultConfirmTimeout is the default confirm_timeout in seconds.
+const defaultConfirmTimeout = 60
+
+// applyDelay gives the CFG reply time to leave before the backend drops the old address.
+var applyDelay = time.Second
+
+var (
+    errTxnPending  = errors.New("TXN_PENDING")
+    errNoTxn       = errors.New("NO_TXN")
+    errTxnMismatch = errors.New("TXN_MISMATCH")
+    errWrongAddr   = errors.New("WRONG_ADDR")
+)
+
+// netBackup is the previous content of one network file.
+type netBackup struct {
+    Path    string      `json:"path"`
+    Existed bool        `json:"existed"` // false: created by the transaction, removed on rollback
+    Mode    os.FileMode `json:"mode,omitempty"`
+    Data    []byte      `json:"data,omitempty"`
+}
+
+// netTxn is a network change waiting for CFG_CONFIRM.
+type netTxn struct {
+    ID    string      `json:"id"`
+    Iface string      `json:"iface,omitempty"` // interface the change is for
+    Addrs []string    `json:"addrs,omitempty"` // addresses CFG_CONFIRM must be sent to; empty accepts any (DHCP)
+    Files []netBackup `json:"files"`
+    timer *time.Timer
+}
+
+var (
+    txnMu      sync.Mutex
+    pendingTxn *netTxn
+)
+
+// backendFiles lists the existing files of the network backend.
+func backendFiles() []string {
+    var out []string
+    for _, g := range netBackend.Files() {
+        m, _ := filepath.Glob(g)
+        out = append(out, m...)
+    }
+    return out
+}
+
+func txnFile() string { return filepath.Join(settings.StateDir, "net_txn.json") }
+
+// beginNetApply runs write (a change of iface) as a transaction: the backend's files are backed
+// up first, restored if write fails, and otherwise applied after applyDelay and the change rolled
+// back unless confirmNetTxn is called within timeout. addrs are the new addresses (without prefix).
+func beginNetApply(iface string, write func() error, addrs []string, timeout time.Duration) (*netTxn, error) {
+    txnMu.Lock()
+    defer txnMu.Unlock()
+    if pendingTxn != nil {
+        return nil, errTxnPending
+    }
+    t := &netTxn{ID: newTxnID(), Iface: iface, Addrs: addrs}
+    for _, p := range backendFiles() {
+        fi, err := os.Stat(p)
+        if err != nil {
+            return nil, fmt.Errorf("backup %s: %v", p, err)
+        }
+        b, err := os.ReadFile(p)
+        if err != nil {
+            return nil, fmt.Errorf("backup %s: %v", p, err)
+        }
+        // keep the permissions: keyfiles may hold secrets and NetworkManager ignores world-readable ones
+        t.Files = append(t.Files, netBackup{Path: p, Existed: true, Mode: fi.Mode().Perm(), Data: b})
+    }
+    // Record the transaction before touching the files, so a crash mid-write is rolled back too
+    if err := t.save(); err != nil {
+        return nil, err
+    }
+    werr := write()
+    for _, p := range backendFiles() {
+        if !t.has(p) { t.Files = append(t.Files, netBackup{Path: p}) }
+    }
+    if werr != nil {
+        t.restore()
+        return nil, werr
+    }
+    if err := t.save(); err != nil {
+        t.restore()
+        return nil, err
+    }
+    pendingTxn = t
+    infof("network apply %s: %s written, applying via %s in %v, confirm within %v", t.ID, iface, netBackend.Name(), applyDelay, timeout)
+
+    go func() {
+        time.Sleep(applyDelay)
+        if err := netBackend.Apply(iface); err != nil {
+            log.Printf("network apply %s: apply via %s: %v", t.ID, netBackend.Name(), err)
+            rollbackNetTxn(t, "apply failed")
+            return
+        }
+        txnMu.Lock()
+        defer txnMu.Unlock()
+        if pendingTxn == t {
+            t.timer = time.AfterFunc(timeout, func() { rollbackNetTxn(t, "not confirmed in time") })
+        }
+    }()
+    return t, nil
+}
+
+// confirmNetTxn commits the pending transaction id. dst is the address the confirmation was
+// sent to; it must be one of the new addresses when those are known.
+func confirmNetTxn(id, dst string) error {
+    txnMu.Lock()
+    defer txnMu.Unlock()
+    t := pendingTxn
+    if t == nil {
+        return errNoTxn
+    }
+    if id != t.ID {
+        return errTxnMismatch
+    }
+    if len(t.Addrs) > 0 && dst != "" && !containsIP(t.Addrs, dst) {
+        return errWrongAddr
+    }
+    if t.timer != nil { t.timer.Stop() }
+    pendingTxn = nil
+    if err := os.Remove(txnFile()); err != nil && !os.IsNotExist(err) {
+        warnf("network apply %s: %v", t.ID, err)
+    }
+    log.Printf("network apply %s: confirmed via %s", t.ID, dst)
+    return nil
+}
+
+// rollbackNetTxn restores the backup of t (if still pending) and applies it again.
+func rollbackNetTxn(t *netTxn, reason string) {
+    txnMu.Lock()
+    if pendingTxn != t {
+        txnMu.Unlock()
+        return
+    }
+    pendingTxn = nil
+    t.restore()
+    txnMu.Unlock()
+    log.Printf("network apply %s: rolled back (%s)", t.ID, reason)
+    if err := netBackend.Apply(t.Iface); err != nil {
+        log.Printf("network apply %s: apply after rollback: %v", t.ID, err)
+    }
+}
+
+// recoverNetTxn rolls back a transaction left pending by a previous run.
+func recoverNetTxn() {
+    b, err := os.ReadFile(txnFile())
+    if err != nil {
+        return
+    }
+    var t netTxn
+    if err := json.Unmarshal(b, &t); err != nil {
+        log.Printf("network apply: ignoring %s: %v", txnFile(), err)
+        _ = os.Remove(txnFile())
+        return
+    }
+    t.restore()
+    log.Printf("network apply %s: rolled back unconfirmed change from previous run", t.ID)
+    if t.Iface == "" { t.Iface = defaultIface() }
+    if err := netBackend.Apply(t.Iface); err != nil {
+        log.Printf("network apply %s: apply after rollback: %v", t.ID, err)
+    }
+}
+
+// restore puts back the backed up files, removes files the transaction created and drops the record.
+func (t *netTxn) restore() {
+    for _, f := range t.Files {
+        var err error
+        if f.Existed {
+            mode := f.Mode
+            if mode == 0 { mode = 0o644 }
+            if err = os.WriteFile(f.Path, f.Data, mode); err == nil { err = os.Chmod(f.Path, mode) }
+        } else if err = os.Remove(f.Path); os.IsNotExist(err) {
+            err = nil
+        }
+        if err != nil { log.Printf("network apply %s: restore %s: %v", t.ID, f.Path, err) }
+    }
+    if err := os.Remove(txnFile()); err != nil && !os.IsNotExist(err) {
+        warnf("network apply %s: %v", t.ID, err)
+    }
+}
+
+func (t *netTxn) save() error {
+    b, err := json.Marshal(t)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(settings.StateDir, 0o755); err != nil {
+        return err
+    }
+    return os.WriteFile(txnFile(), b, 0o600)
+}
+
+func (t *netTxn) has(path string) bool {
+    for _, f := range t.Files {
+        if f.Path == path { return true }
+    }
+    return false
+}
+
+// newTxnID returns a short hex ID for a transaction.
+func newTxnID() string {
+    return strings.ToUpper(fmt.Sprintf("%x", time.Now().UnixNano()&0xffffffff))
+}
+
+// containsIP reports whether ip equals one of addrs (IPv6 zones and textual forms normalized).
+func containsIP(addrs []string, ip string) bool {
+    want := net.ParseIP(strings.SplitN(ip, "%", 2)[0])
+    for _, a := range addrs {
+        if got := net.ParseIP(a); got != nil && got.Equal(want) { return true }
+    }
+    return false
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// fakeBackend keeps its configuration in <dir>/<iface>.network and records the calls made to it.
+type fakeBackend struct {
+    dir   string
+    mu    sync.Mutex
+    calls []string
+}
+
+func (b *fakeBackend) record(call string) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.calls = append(b.calls, call)
+}
+
+func (b *fakeBackend) log() []string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return append([]string(nil), b.calls...)
+}
+
+func (b *fakeBackend) Name() string { return "fake" }
+func (b *fakeBackend) File(iface string) string { return filepath.Join(b.dir, iface+".network") }
+func (b *fakeBackend) Files() []string { return []string{filepath.Join(b.dir, "*.network")} }
+func (b *fakeBackend) WriteDHCP(iface string) error { return b.write(iface, "DHCP=yes\n") }
+func (b *fakeBackend) Apply(iface string) error { b.record("apply " + iface); return nil }
+func (b *fakeBackend) WriteStatic(iface string, c netConfig) error {
+    return b.write(iface, "Address="+c.IP+"\n")
+}
+
+func (b *fakeBackend) SetLinkLocal(iface, addr string) error {
+    if addr == "" { return b.write(iface, "DHCP=yes\n") }
+    return b.write(iface, "DHCP=yes\nAddress="+addr+"\n")
+}
+
+// Read returns the address of the file, if any.
+func (b *fakeBackend) Read(iface string) netConfig {
+    var c netConfig
+    data, _ := os.ReadFile(b.File(iface))
+    for _, l := range strings.Split(string(data), "\n") {
+        if v, ok := strings.CutPrefix(l, "Address="); ok { c.IP, _ = splitCIDR(v) }
+    }
+    return c
+}
+
+func (b *fakeBackend) write(iface, content string) error {
+    b.record("write " + iface + " " + strings.ReplaceAll(strings.TrimSpace(content), "\n", " "))
+    return os.WriteFile(b.File(iface), []byte(content), 0o644)
+}
+
+// fakeNetApply installs a fakeBackend, a temporary state_dir and a millisecond applyDelay.
+func fakeNetApply(t *testing.T) *fakeBackend {
+    t.Helper()
+    dir := t.TempDir()
+    b := &fakeBackend{dir: filepath.Join(dir, "net")}
+    if err := os.MkdirAll(b.dir, 0o755); err != nil { t.Fatal(err) }
+    saved, savedBackend, savedDelay := settings, netBackend, applyDelay
+    t.Cleanup(func() {
+        settings, netBackend, applyDelay = saved, savedBackend, savedDelay
+        txnMu.Lock()
+        pendingTxn = nil
+        txnMu.Unlock()
+    })
+    settings.StateDir = filepath.Join(dir, "state")
+    netBackend, applyDelay = b, time.Millisecond
+    return b
+}
+
+// waitCalls waits up to a second for the backend to have received n calls.
+func waitCalls(t *testing.T, b *fakeBackend, n int) []string {
+    t.Helper()
+    deadline := time.Now().Add(time.Second)
+    for len(b.log()) < n && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    calls := b.log()
+    if len(calls) < n { t.Fatalf("calls = %q, want %d", calls, n) }
+    return calls
+}
+
+func TestNetApplyRollback(t *testing.T) {
+    b := fakeNetApply(t)
+    eth0, eth1 := b.File("eth0"), b.File("eth1")
+    if err := os.WriteFile(eth0, []byte("DHCP=yes\nLLMNR=no\n"), 0o600); err != nil { t.Fatal(err) }
+    if err := os.Chmod(eth0, 0o600); err != nil { t.Fatal(err) }
+
+    write := func() error {
+        if err := b.WriteStatic("eth0", netConfig{IP: "10.0.0.5"}); err != nil { return err }
+        return b.WriteStatic("eth1", netConfig{IP: "10.0.1.5"})
+    }
+    txn, err := beginNetApply("eth0", write, []string{"10.0.0.5"}, 10*time.Millisecond)
+    if err != nil { t.Fatal(err) }
+    if !fileExists(txnFile()) { t.Error("no transaction record while pending") }
+    if _, err := beginNetApply("eth0", write, nil, time.Second); err != errTxnPending { t.Errorf("second transaction: err = %v, want %v", err, errTxnPending) }
+
+    // applied, not confirmed, rolled back and applied again
+    calls := waitCalls(t, b, 4)
+    if want := "write eth0 Address=10.0.0.5,write eth1 Address=10.0.1.5,apply eth0,apply eth0"; strings.Join(calls, ",") != want { t.Errorf("calls = %q, want %s", calls, want) }
+    if got := readTestFile(t, eth0); got != "DHCP=yes\nLLMNR=no\n" { t.Errorf("eth0 not restored: %q", got) }
+    if fi, err := os.Stat(eth0); err != nil || fi.Mode().Perm() != 0o600 { t.Errorf("eth0 mode = %v (%v), want 0600", fi.Mode().Perm(), err) }
+    if fileExists(eth1) { t.Error("eth1, created by the transaction, was not removed") }
+    if fileExists(txnFile()) { t.Error("transaction record left behind") }
+    if err := confirmNetTxn(txn.ID, "10.0.0.5"); err != errNoTxn { t.Errorf("confirm after rollback: err = %v, want %v", err, errNoTxn) }
+}
+
+func TestNetApplyConfirm(t *testing.T) {
+    b := fakeNetApply(t)
+    if err := confirmNetTxn("1234", ""); err != errNoTxn { t.Errorf("confirm without a transaction: err = %v, want %v", err, errNoTxn) }
+    write := func() error { return b.WriteStatic("eth0", netConfig{IP: "10.0.0.5"}) }
+    txn, err := beginNetApply("eth0", write, []string{"10.0.0.5", "2001:db8::5"}, 50*time.Millisecond)
+    if err != nil { t.Fatal(err) }
+    waitCalls(t, b, 2)
+
+    tests := []struct {
+        id, dst string
+        want    error
+    }{
+        {txn.ID + "0", "10.0.0.5", errTxnMismatch},
+        {txn.ID, "192.168.1.10", errWrongAddr},
+        {txn.ID, "2001:db8::5%eth0", nil},
+    }
+    for _, tt := range tests {
+        if err := confirmNetTxn(tt.id, tt.dst); err != tt.want { t.Errorf("confirmNetTxn(%s, %s) = %v, want %v", tt.id, tt.dst, err, tt.want) }
+    }
+    if fileExists(txnFile()) { t.Error("transaction record left behind") }
+
+    // the timer was stopped: nothing is rolled back after the timeout
+    time.Sleep(100 * time.Millisecond)
+    if calls := b.log(); len(calls) != 2 { t.Errorf("calls = %q after confirm", calls) }
+    if got := readTestFile(t, b.File("eth0")); got != "Address=10.0.0.5\n" { t.Errorf("eth0 = %q, want the confirmed change", got) }
+}
+
+func TestRecoverNetTxn(t *testing.T) {
+    b := fakeNetApply(t)
+    eth0, eth1 := b.File("eth0"), b.File("eth1")
+    writeTestFile(t, eth0, "DHCP=yes\n")
+    // a transaction recorded by a previous run that stopped before the confirmation
+    txn := &netTxn{ID: "AB12", Iface: "eth0", Files: []netBackup{{Path: eth0, Existed: true, Mode: 0o644, Data: []byte("DHCP=yes\n")}, {Path: eth1}}}
+    if err := txn.save(); err != nil { t.Fatal(err) }
+    writeTestFile(t, eth0, "Address=10.0.0.5\n")
+    writeTestFile(t, eth1, "Address=10.0.1.5\n")
+
+    recoverNetTxn()
+    if got := readTestFile(t, eth0); got != "DHCP=yes\n" { t.Errorf("eth0 not restored: %q", got) }
+    if fileExists(eth1) { t.Error("eth1 was not removed") }
+    if fileExists(txnFile()) { t.Error("transaction record left behind") }
+    if calls := b.log(); strings.Join(calls, ",") != "apply eth0" { t.Errorf("calls = %q, want apply eth0", calls) }
+
+    // nothing to recover
+    recoverNetTxn()
+    if calls := b.log(); len(calls) != 1 { t.Errorf("calls = %q", calls) }
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+)
+
+// Network configuration backends.
+// CFG writes and QUERY_NET reads the persistent network configuration through a networkBackend:
+//   networkd        <net_dir>/*.network files of systemd-networkd (see main.go)
+//   networkmanager  keyfiles <nm_dir>/*.nmconnection of NetworkManager (see netbackend_nm.go)
+//   ifupdown        iface stanzas in /etc/network/interfaces and sourced files (see netbackend_ifupdown.go)
+//   netplan         ethernets entries in <netplan_dir>/*.yaml (see netbackend_netplan.go)
+// net_backend (NET_BACKEND, -net-backend) selects one; "auto" (default) detects the running
+// service at startup. QUERY_NET reports the backend in use as BACKEND=<name>.
+// Every method works on one interface: IF=<name> of the request, else defaultIface.
+
+// networkBackend reads and writes the persistent configuration of an interface.
+type networkBackend interface {
+    // Name is reported in QUERY_NET.
+    Name() string
+    // Read returns the configured static values; fields are empty when not configured (e.g. DHCP).
+    Read(iface string) netConfig
+    // WriteStatic merges c into the configuration; empty fields are left unchanged.
+    WriteStatic(iface string, c netConfig) error
+    // WriteDHCP switches the interface to DHCP.
+    WriteDHCP(iface string) error
+    // Apply makes the written configuration active (restarts or reloads the service).
+    Apply(iface string) error
+    // File is the file holding the configuration of iface, "" if there is none yet (LIST_IF).
+    File(iface string) string
+    // Files are glob patterns of the files the Write methods may change; CFG|APPLY=1 backs them up.
+    Files() []string
+    // SetLinkLocal adds the link-local fallback address addr (169.254.x.y/16) to the configuration
+    // of iface, keeping DHCP on, or removes it again when addr is "" (see linklocal.go).
+    SetLinkLocal(iface, addr string) error
+}
+
+// linkBackend is implemented by backends that can create VLAN and bond interfaces (see netdev.go).
+type linkBackend interface {
+    // AddVLAN creates the VLAN id on parent and returns its name (<parent>.<id>).
+    AddVLAN(parent string, id int) (string, error)
+    // RemoveVLAN deletes a VLAN interface created by AddVLAN.
+    RemoveVLAN(name string) error
+    // AddBond creates an active-backup bond of slaves; primary ("" for none) is preferred.
+    AddBond(name string, slaves []string, primary string) error
+    // RemoveBond deletes the bond and puts its slaves back to DHCP.
+    RemoveBond(name string) error
+    // HasLink reports whether the backend configures the VLAN or bond name.
+    HasLink(name string) bool
+}
+
+// netBackend is the backend in use, chosen in main by selectNetBackend.
+var netBackend networkBackend = networkdBackend{}
+
+// selectNetBackend returns the backend called name, or the detected one for "" and "auto".
+func selectNetBackend(name string) (networkBackend, error) {
+    switch strings.ToLower(strings.TrimSpace(name)) {
+    case "", "auto":
+        return detectNetBackend(), nil
+    case "networkd", "systemd-networkd":
+        return networkdBackend{}, nil
+    case "networkmanager", "nm":
+        return nmBackend{}, nil
+    case "ifupdown", "interfaces":
+        return ifupdownBackend{}, nil
+    case "netplan":
+        return netplanBackend{}, nil
+    }
+    return nil, fmt.Errorf("unknown network backend %q", name)
+}
+
+// detectNetBackend picks the service that manages the network on this host: netplan when it has
+// a configuration (it renders for networkd or NetworkManager and would overwrite their files),
+// else a running NetworkManager, else ifupdown when the interfaces file configures a real
+// interface (unless systemd-networkd is running); systemd-networkd is the fallback.
+func detectNetBackend() networkBackend {
+    if netplanManages() {
+        return netplanBackend{}
+    }
+    if serviceActive("NetworkManager", "/run/NetworkManager") {
+        return nmBackend{}
+    }
+    if ifupdownManages() && !serviceActive("systemd-networkd", "/run/systemd/netif") {
+        return ifupdownBackend{}
+    }
+    return networkdBackend{}
+}
+
+// serviceActive reports whether the systemd unit is active; without systemctl it checks
+// for the runtime directory the service creates.
+func serviceActive(unit, runDir string) bool {
+    if _, err := exec.LookPath("systemctl"); err == nil {
+        return exec.Command("systemctl", "is-active", "--quiet", unit).Run() == nil
+    }
+    fi, err := os.Stat(runDir)
+    return err == nil && fi.IsDir()
+}
+
+// networkdBackend writes systemd-networkd .network (and .netdev, see netdev.go) files in net_dir.
+type networkdBackend struct{}
+
+func (networkdBackend) Name() string { return "networkd" }
+
+func (networkdBackend) Read(iface string) netConfig { return parseNetworkFile(networkdFile(iface)) }
+
+func (networkdBackend) WriteStatic(iface string, c netConfig) error { return applySystemdNetworkConfig(iface, c) }
+func (networkdBackend) WriteDHCP(iface string) error                { return applySystemdNetworkDHCP(iface) }
+func (networkdBackend) Apply(iface string) error                    { return applyNetworkd(iface) }
+func (networkdBackend) SetLinkLocal(iface, addr string) error       { return setNetworkdLinkLocal(iface, addr) }
+func (networkdBackend) File(iface string) string {
+    if p := networkdFile(iface); fileExists(p) { return p }
+    return ""
+}
+func (networkdBackend) Files() []string {
+    return []string{filepath.Join(settings.NetDir, "*.network"), filepath.Join(settings.NetDir, "*.netdev")}
+}
+
+// networkdFile returns the .network file in net_dir that matches iface: the first one (in name
+// order, as networkd applies them) whose [Match] Name= list matches it, else <iface>.network.
+func networkdFile(iface string) string {
+    matches, _ := filepath.Glob(filepath.Join(settings.NetDir, "*.network"))
+    for _, f := range matches {
+        b, err := os.ReadFile(f)
+        if err != nil { continue }
+        for _, pat := range strings.Fields(iniValue(strings.Split(string(b), "\n"), "[Match]", "Name")) {
+            if ok, _ := filepath.Match(pat, iface); ok { return f }
+        }
+    }
+    return filepath.Join(settings.NetDir, iface+".network")
+}
+
+func fileExists(path string) bool {
+    _, err := os.Stat(path)
+    return err == nil
+}
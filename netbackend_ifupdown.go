@@ -0,0 +1,395 @@
+package main
+
+import (
+    "log"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// ifupdown backend (Debian /etc/network/interfaces).
+// The "iface <name> inet ..." stanza of an interface is looked up in
+// interfaces_file (default /etc/network/interfaces) and the files it pulls in with "source"
+// and "source-directory" (usually /etc/network/interfaces.d). Static settings become
+//   iface eth0 inet static        iface eth0 inet6 static
+//       address 192.168.1.10          address 2001:db8::10
+//       netmask 255.255.255.0         netmask 64
+//       gateway 192.168.1.1           gateway 2001:db8::1
+//       dns-nameservers 8.8.8.8
+//       dns-search example.com
+//       mtu 1400
+//       up ip route add 10.20.0.0/16 via 192.168.1.254
+// (routes of both families go to the inet stanza) and DHCP "inet dhcp" (and "inet6 auto" if
+// there is an inet6 stanza). Other options of the stanza (other up/down hooks, ...) and all
+// unrelated stanzas are kept as they are; NTP servers are ignored. When the
+// interface has no stanza yet, "auto <name>" and a new stanza are appended to interfaces_file.
+// Apply takes the interface down, flushes its addresses and brings it up again.
+
+const defaultInterfacesFile = "/etc/network/interfaces"
+
+type ifupdownBackend struct{}
+
+func (ifupdownBackend) Name() string { return "ifupdown" }
+
+func (ifupdownBackend) Files() []string { return ifupdownFiles() }
+
+func (ifupdownBackend) File(iface string) string {
+    if f, _ := findStanza(loadIfupdown(), iface, "inet"); f != nil { return f.path }
+    return ""
+}
+
+func (ifupdownBackend) Read(iface string) netConfig {
+    var c netConfig
+    files := loadIfupdown()
+    if _, st := findStanza(files, iface, "inet"); st != nil && st.method == "static" {
+        ip, pfx := splitCIDR(st.get("address"))
+        if isIPv4(ip) { c.IP = ip }
+        if m := st.get("netmask"); isIPv4(m) {
+            c.Mask = m
+        } else if n, err := strconv.Atoi(firstNonEmpty(m, pfx)); err == nil && n > 0 && n <= 32 {
+            c.Mask = prefixToMask(n)
+        }
+        c.GW = st.get("gateway")
+        c.DNS = strings.Fields(st.get("dns-nameservers"))
+    }
+    if _, st := findStanza(files, iface, "inet"); st != nil {
+        if st.method != "static" {
+            // the fallback address added by SetLinkLocal
+            for _, o := range st.opts {
+                if w := strings.Fields(o); ifLinkLocalHook(o) && w[0] == "up" { c.IP, _ = splitCIDR(w[4]); c.Mask = "255.255.0.0" }
+            }
+        }
+        c.Domains = strings.Fields(st.get("dns-search"))
+        c.MTU = st.get("mtu")
+        c.Routes = st.routes()
+    }
+    if _, st := findStanza(files, iface, "inet6"); st != nil && st.method == "static" {
+        ip, pfx := splitCIDR(st.get("address"))
+        if isIPv6(ip) {
+            c.IP6 = ip + "/" + firstNonEmpty(pfx, st.get("netmask"), "64")
+        }
+        c.GW6 = st.get("gateway")
+    }
+    if _, st := findStanza(files, iface, "inet6"); st != nil { c.Routes = append(c.Routes, st.routes()...) }
+    return c
+}
+
+func (ifupdownBackend) WriteStatic(iface string, c netConfig) error {
+    files := loadIfupdown()
+    if f6, st6 := findStanza(files, iface, "inet6"); c.Routes != nil && f6 != nil && len(st6.routes()) > 0 {
+        // all routes are rewritten into the inet stanza
+        st6.setRoutes(nil)
+        f6.replace(st6, iface)
+    }
+    f, st := findStanza(files, iface, "inet")
+    if f == nil {
+        f, st = files[0], &ifStanza{start: len(files[0].lines), end: len(files[0].lines), family: "inet", method: "dhcp", fresh: true}
+    }
+    if c.IP != "" {
+        ip, _ := splitCIDR(st.get("address"))
+        mask := c.Mask
+        if mask == "" && ip != "" { mask = st.get("netmask") }
+        if mask == "" { mask = liveMask(iface) }
+        if mask == "" { mask = "255.255.255.0" }
+        st.method = "static"
+        st.set("address", c.IP)
+        st.set("netmask", mask)
+    } else if c.Mask != "" && st.method == "static" {
+        st.set("netmask", c.Mask)
+    }
+    if c.GW != "" { st.set("gateway", c.GW) }
+    if len(c.DNS) > 0 { st.set("dns-nameservers", strings.Join(c.DNS, " ")) }
+    if c.Domains != nil {
+        st.del("dns-search")
+        if len(c.Domains) > 0 { st.set("dns-search", strings.Join(c.Domains, " ")) }
+    }
+    if c.MTU == "0" {
+        st.del("mtu")
+    } else if c.MTU != "" {
+        st.set("mtu", c.MTU)
+    }
+    if c.Routes != nil { st.setRoutes(c.Routes) }
+    if c.NTP != nil { log.Printf("ifupdown: NTP servers are not supported, ignored") }
+    f.replace(st, iface)
+
+    if c.IP6 != "" || c.GW6 != "" {
+        f6, st6 := findStanza(files, iface, "inet6")
+        if f6 == nil {
+            // place the new inet6 stanza right after the inet one
+            _, st4 := findStanza(files, iface, "inet")
+            f6, st6 = f, &ifStanza{start: st4.end, end: st4.end, family: "inet6", method: "static", fresh: true}
+        }
+        if c.IP6 != "" {
+            ip, pfx := splitCIDR(c.IP6)
+            st6.method = "static"
+            st6.set("address", ip)
+            st6.set("netmask", firstNonEmpty(pfx, "64"))
+        }
+        if c.GW6 != "" { st6.set("gateway", c.GW6) }
+        f6.replace(st6, iface)
+    }
+    return saveIfupdown(files)
+}
+
+func (ifupdownBackend) WriteDHCP(iface string) error {
+    files := loadIfupdown()
+    f, st := findStanza(files, iface, "inet")
+    if f == nil {
+        f, st = files[0], &ifStanza{start: len(files[0].lines), end: len(files[0].lines), family: "inet", fresh: true}
+    }
+    st.method = "dhcp"
+    st.del("address", "netmask", "gateway", "dns-nameservers", "broadcast", "network")
+    f.replace(st, iface)
+    if f6, st6 := findStanza(files, iface, "inet6"); f6 != nil {
+        st6.method = "auto"
+        st6.del("address", "netmask", "gateway")
+        f6.replace(st6, iface)
+    }
+    return saveIfupdown(files)
+}
+
+func (ifupdownBackend) Apply(iface string) error {
+    // ifdown uses the new stanza, so remove the old addresses explicitly
+    _ = runLogged("ifdown", "--force", iface)
+    _ = runLogged("ip", "-4", "addr", "flush", "dev", iface)
+    _ = runLogged("ip", "-6", "addr", "flush", "dev", iface, "scope", "global")
+    return runLogged("ifup", iface)
+}
+
+// SetLinkLocal adds "up ip addr add <addr> dev <iface> scope link" (and the matching down hook)
+// to the inet stanza, which keeps its method (dhcp), or removes those hooks when addr is "".
+func (ifupdownBackend) SetLinkLocal(iface, addr string) error {
+    files := loadIfupdown()
+    f, st := findStanza(files, iface, "inet")
+    if f == nil {
+        if addr == "" { return nil }
+        f, st = files[0], &ifStanza{start: len(files[0].lines), end: len(files[0].lines), family: "inet", method: "dhcp", fresh: true}
+    }
+    old := strings.Join(st.opts, "\n")
+    var opts []string
+    indent := "    "
+    for _, o := range st.opts {
+        if t := strings.TrimLeft(o, " \t"); t != "" { indent = o[:len(o)-len(t)] }
+        if !ifLinkLocalHook(o) { opts = append(opts, o) }
+    }
+    if addr != "" {
+        opts = append(opts, indent+"up ip addr add "+addr+" dev "+iface+" scope link", indent+"down ip addr del "+addr+" dev "+iface)
+    }
+    st.opts = opts
+    if !st.fresh && strings.Join(st.opts, "\n") == old { return nil }
+    f.replace(st, iface)
+    return saveIfupdown(files)
+}
+
+// ifLinkLocalHook reports whether line is an "up|down ip addr add|del <addr>" option for a
+// link-local address, as written by SetLinkLocal.
+func ifLinkLocalHook(line string) bool {
+    w := strings.Fields(line)
+    return len(w) >= 5 && (w[0] == "up" || w[0] == "down") && w[1] == "ip" && w[2] == "addr" &&
+        (w[3] == "add" || w[3] == "del") && isLinkLocalCIDR(w[4])
+}
+
+// ifupdownFile is one interfaces file, read into lines.
+type ifupdownFile struct {
+    path    string
+    lines   []string
+    changed bool
+}
+
+// ifStanza is an "iface <name> <family> <method>" stanza of a file: lines [start, end).
+type ifStanza struct {
+    start, end int
+    family     string   // inet or inet6
+    method     string   // static, dhcp, manual, auto, ...
+    opts       []string // option lines, with their indentation
+    fresh      bool     // not in the file yet
+}
+
+// stanzaKeywords start a new stanza (and end the options of the previous iface).
+var stanzaKeywords = map[string]bool{"iface": true, "mapping": true, "auto": true, "source": true, "source-directory": true, "rename": true}
+
+// get returns the value of option key ("" if absent).
+func (s *ifStanza) get(key string) string {
+    for _, o := range s.opts {
+        f := strings.Fields(o)
+        if len(f) > 0 && f[0] == key { return strings.Join(f[1:], " ") }
+    }
+    return ""
+}
+
+// set replaces option key or appends it.
+func (s *ifStanza) set(key, value string) {
+    indent := "    "
+    for i, o := range s.opts {
+        f := strings.Fields(o)
+        if len(f) == 0 { continue }
+        indent = o[:len(o)-len(strings.TrimLeft(o, " \t"))]
+        if f[0] == key {
+            s.opts[i] = indent + key + " " + value
+            return
+        }
+    }
+    s.opts = append(s.opts, indent+key+" "+value)
+}
+
+// del removes options.
+func (s *ifStanza) del(keys ...string) {
+    var out []string
+    for _, o := range s.opts {
+        f := strings.Fields(o)
+        drop := false
+        for _, k := range keys {
+            if len(f) > 0 && f[0] == k { drop = true }
+        }
+        if !drop { out = append(out, o) }
+    }
+    s.opts = out
+}
+
+// routes returns the routes added by "up ip route add <dest> [via <gw>]" options.
+func (s *ifStanza) routes() []netRoute {
+    var out []netRoute
+    for _, o := range s.opts {
+        if r, ok := ifRoute(o); ok { out = append(out, r) }
+    }
+    return out
+}
+
+// setRoutes replaces the route options with "up ip route add" lines for routes.
+func (s *ifStanza) setRoutes(routes []netRoute) {
+    var out []string
+    indent := "    "
+    for _, o := range s.opts {
+        if t := strings.TrimLeft(o, " \t"); t != "" { indent = o[:len(o)-len(t)] }
+        if _, ok := ifRoute(o); !ok { out = append(out, o) }
+    }
+    for _, r := range routes {
+        l := indent + "up ip route add " + r.To
+        if r.Via != "" { l += " via " + r.Via }
+        out = append(out, l)
+    }
+    s.opts = out
+}
+
+// ifRoute parses an "up|post-up ip [-4|-6] route add <dest> [via <gw>]" option line.
+func ifRoute(line string) (netRoute, bool) {
+    w := strings.Fields(line)
+    if len(w) > 0 && (w[0] == "up" || w[0] == "post-up") { w = w[1:] } else { return netRoute{}, false }
+    if len(w) > 1 && w[0] == "ip" && (w[1] == "-4" || w[1] == "-6") { w = append(w[:1], w[2:]...) }
+    if len(w) < 4 || w[0] != "ip" || w[1] != "route" || w[2] != "add" { return netRoute{}, false }
+    if w[3] == "default" { return netRoute{}, false }
+    r := netRoute{To: w[3]}
+    if len(w) >= 6 && w[4] == "via" { r.Via = w[5] }
+    return r, true
+}
+
+// replace writes stanza s of interface iface back into f.
+func (f *ifupdownFile) replace(s *ifStanza, iface string) {
+    var block []string
+    if s.fresh {
+        if s.start > 0 { block = append(block, "") }
+        if s.family == "inet" { block = append(block, "auto "+iface) }
+    }
+    block = append(block, "iface "+iface+" "+s.family+" "+s.method)
+    block = append(block, s.opts...)
+    lines := append([]string{}, f.lines[:s.start]...)
+    lines = append(lines, block...)
+    f.lines = append(lines, f.lines[s.end:]...)
+    f.changed = true
+}
+
+// findStanza returns the file and stanza of "iface <iface> <family>", or nil.
+func findStanza(files []*ifupdownFile, iface, family string) (*ifupdownFile, *ifStanza) {
+    for _, f := range files {
+        for i, l := range f.lines {
+            w := strings.Fields(l)
+            if len(w) < 4 || w[0] != "iface" || w[1] != iface || w[2] != family { continue }
+            s := &ifStanza{start: i, end: i + 1, family: family, method: w[3]}
+            for j := i + 1; j < len(f.lines); j++ {
+                t := strings.Fields(f.lines[j])
+                if len(t) > 0 && (stanzaKeywords[t[0]] || strings.HasPrefix(t[0], "allow-")) { break }
+                if len(t) > 0 && !strings.HasPrefix(t[0], "#") {
+                    // options end at the last option line; trailing blanks/comments stay outside
+                    s.opts = append(s.opts, f.lines[s.end:j+1]...)
+                    s.end = j + 1
+                }
+            }
+            return f, s
+        }
+    }
+    return nil, nil
+}
+
+// loadIfupdown reads interfaces_file and the files it sources; the main file is always first
+// (empty if it does not exist).
+func loadIfupdown() []*ifupdownFile {
+    var files []*ifupdownFile
+    for _, p := range ifupdownFiles() {
+        f := &ifupdownFile{path: p}
+        if b, err := os.ReadFile(p); err == nil && len(b) > 0 {
+            f.lines = strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+        }
+        files = append(files, f)
+    }
+    return files
+}
+
+func saveIfupdown(files []*ifupdownFile) error {
+    for _, f := range files {
+        if !f.changed { continue }
+        if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil { return err }
+        if err := os.WriteFile(f.path, []byte(strings.Join(f.lines, "\n")+"\n"), 0o644); err != nil { return err }
+    }
+    return nil
+}
+
+// runPartsName matches the file names source-directory includes (run-parts rules).
+var runPartsName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ifupdownFiles lists interfaces_file followed by the files it sources (one level deep).
+func ifupdownFiles() []string {
+    path := settings.Interfaces
+    out := []string{path}
+    b, err := os.ReadFile(path)
+    if err != nil { return out }
+    rel := func(p string) string {
+        if filepath.IsAbs(p) { return p }
+        return filepath.Join(filepath.Dir(path), p)
+    }
+    for _, l := range strings.Split(string(b), "\n") {
+        w := strings.Fields(l)
+        if len(w) < 2 { continue }
+        switch w[0] {
+        case "source":
+            m, _ := filepath.Glob(rel(w[1]))
+            out = append(out, m...)
+        case "source-directory":
+            entries, _ := os.ReadDir(rel(w[1]))
+            for _, e := range entries {
+                if !e.IsDir() && runPartsName.MatchString(e.Name()) { out = append(out, filepath.Join(rel(w[1]), e.Name())) }
+            }
+        }
+    }
+    return out
+}
+
+// ifupdownManages reports whether interfaces_file (or a sourced file) configures an interface other than lo.
+func ifupdownManages() bool {
+    for _, f := range loadIfupdown() {
+        for _, l := range f.lines {
+            w := strings.Fields(l)
+            if len(w) >= 4 && w[0] == "iface" && w[1] != "lo" { return true }
+        }
+    }
+    return false
+}
+
+// firstNonEmpty returns the first non-empty argument.
+func firstNonEmpty(vs ...string) string {
+    for _, v := range vs {
+        if v != "" { return v }
+    }
+    return ""
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "log"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+
+    "gopkg.in/yaml.v3"
+)
+
+// netplan backend (Ubuntu).
+// The network.ethernets.<iface> entry of an interface is looked up in
+// netplan_dir/*.yaml (default /etc/netplan); netplan merges the files in name order, so the last
+// file that defines the entry is edited, else 90-trae-<iface>.yaml is created. Static settings become
+//   eth0:
+//     dhcp4: false
+//     addresses: [192.168.1.10/24, '2001:db8::10/64']
+//     routes:
+//       - to: default
+//         via: 192.168.1.1
+//       - to: 10.20.0.0/16
+//         via: 192.168.1.254
+//     nameservers:
+//       addresses: [8.8.8.8]
+//       search: [example.com]
+//     mtu: 1400
+// (an existing gateway4/gateway6 key is updated instead of adding a route; NTP servers are
+// ignored), and DHCP sets dhcp4
+// (and dhcp6 if there was a static IPv6 address) and drops the static addresses, gateways and
+// name servers. Comments and all other keys are kept. When netplan_generate is on and netplan is
+// installed, "netplan generate" validates each write; on failure the file is put back and CFG
+// answers NET_NACK. Apply runs "netplan apply".
+
+const defaultNetplanDir = "/etc/netplan"
+
+type netplanBackend struct{}
+
+func (netplanBackend) Name() string { return "netplan" }
+
+func (netplanBackend) Files() []string { return []string{filepath.Join(settings.NetplanDir, "*.yaml")} }
+
+func (netplanBackend) File(iface string) string {
+    _, path, _ := netplanEntry(iface, false)
+    return path
+}
+
+func (netplanBackend) Read(iface string) netConfig {
+    var c netConfig
+    _, _, eth := netplanEntry(iface, false)
+    if eth == nil { return c }
+    for _, a := range netplanAddrs(yamlGet(eth, "addresses")) {
+        ip, pfx := splitCIDR(a)
+        if isIPv4(ip) && c.IP == "" {
+            c.IP = ip
+            if n, err := strconv.Atoi(pfx); err == nil && n > 0 && n <= 32 { c.Mask = prefixToMask(n) }
+        } else if isIPv6(ip) && c.IP6 == "" {
+            c.IP6 = a
+        }
+    }
+    c.GW = yamlScalar(yamlGet(eth, "gateway4"))
+    c.GW6 = yamlScalar(yamlGet(eth, "gateway6"))
+    if r := yamlGet(eth, "routes"); r != nil {
+        for _, route := range r.Content {
+            to, via := yamlScalar(yamlGet(route, "to")), yamlScalar(yamlGet(route, "via"))
+            if !isDefaultRoute(to) {
+                if to != "" { c.Routes = append(c.Routes, netRoute{To: to, Via: via}) }
+                continue
+            }
+            if isIPv4(via) && c.GW == "" { c.GW = via }
+            if isIPv6(via) && c.GW6 == "" { c.GW6 = via }
+        }
+    }
+    c.DNS = netplanAddrs(yamlGet(yamlGet(eth, "nameservers"), "addresses"))
+    c.Domains = netplanAddrs(yamlGet(yamlGet(eth, "nameservers"), "search"))
+    c.MTU = yamlScalar(yamlGet(eth, "mtu"))
+    return c
+}
+
+func (netplanBackend) WriteStatic(iface string, c netConfig) error {
+    doc, path, eth := netplanEntry(iface, true)
+    if c.IP != "" {
+        // keep the configured prefix when no mask is given, else use the live one
+        pfx := maskToPrefix(c.Mask)
+        if pfx <= 0 {
+            for _, a := range netplanAddrs(yamlGet(eth, "addresses")) {
+                if ip, old := splitCIDR(a); isIPv4(ip) {
+                    if n, err := strconv.Atoi(old); err == nil { pfx = n }
+                    break
+                }
+            }
+        }
+        if pfx <= 0 {
+            if m := liveMask(iface); m != "" { pfx = maskToPrefix(m) }
+        }
+        if pfx <= 0 { pfx = 24 }
+        yamlSet(eth, "dhcp4", yamlScalarNode("false"))
+        setNetplanAddr(eth, c.IP+"/"+strconv.Itoa(pfx), isIPv4)
+    }
+    if c.IP6 != "" {
+        yamlSet(eth, "dhcp6", yamlScalarNode("false"))
+        setNetplanAddr(eth, c.IP6, isIPv6)
+    }
+    if c.GW != "" { setNetplanGateway(eth, "gateway4", c.GW, isIPv4) }
+    if c.GW6 != "" { setNetplanGateway(eth, "gateway6", c.GW6, isIPv6) }
+    if len(c.DNS) > 0 { yamlSet(yamlMapping(eth, "nameservers"), "addresses", yamlSeqNode(c.DNS)) }
+    if len(c.Domains) > 0 {
+        yamlSet(yamlMapping(eth, "nameservers"), "search", yamlSeqNode(c.Domains))
+    } else if ns := yamlGet(eth, "nameservers"); c.Domains != nil && ns != nil {
+        yamlDel(ns, "search")
+        if len(ns.Content) == 0 { yamlDel(eth, "nameservers") }
+    }
+    if c.MTU == "0" {
+        yamlDel(eth, "mtu")
+    } else if c.MTU != "" {
+        yamlSet(eth, "mtu", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: c.MTU})
+    }
+    if c.Routes != nil { setNetplanRoutes(eth, c.Routes) }
+    if c.NTP != nil { log.Printf("netplan: NTP servers are not supported, ignored") }
+    return writeNetplan(path, doc)
+}
+
+func (netplanBackend) WriteDHCP(iface string) error {
+    doc, path, eth := netplanEntry(iface, true)
+    had6 := yamlGet(eth, "gateway6") != nil
+    if a := yamlGet(eth, "addresses"); a != nil {
+        for _, v := range netplanAddrs(a) {
+            if ip, _ := splitCIDR(v); isIPv6(ip) { had6 = true }
+        }
+    }
+    yamlSet(eth, "dhcp4", yamlScalarNode("true"))
+    if had6 { yamlSet(eth, "dhcp6", yamlScalarNode("true")) }
+    yamlDel(eth, "addresses", "gateway4", "gateway6")
+    if r := yamlGet(eth, "routes"); r != nil && r.Kind == yaml.SequenceNode {
+        var keep []*yaml.Node
+        for _, route := range r.Content {
+            if !isDefaultRoute(yamlScalar(yamlGet(route, "to"))) { keep = append(keep, route) }
+        }
+        r.Content = keep
+        if len(keep) == 0 { yamlDel(eth, "routes") }
+    }
+    if ns := yamlGet(eth, "nameservers"); ns != nil {
+        yamlDel(ns, "addresses")
+        if len(ns.Content) == 0 { yamlDel(eth, "nameservers") }
+    }
+    return writeNetplan(path, doc)
+}
+
+func (netplanBackend) Apply(string) error { return runLogged("netplan", "apply") }
+
+// SetLinkLocal adds addr to the addresses of iface, next to dhcp4, or removes the link-local
+// addresses when addr is "". A new entry gets dhcp4: true.
+func (netplanBackend) SetLinkLocal(iface, addr string) error {
+    doc, path, eth := netplanEntry(iface, addr != "")
+    if eth == nil { return nil }
+    changed := false
+    if seq := yamlGet(eth, "addresses"); seq != nil && seq.Kind == yaml.SequenceNode {
+        var keep []*yaml.Node
+        for _, n := range seq.Content {
+            if isLinkLocalCIDR(netplanAddr(n)) { changed = true } else { keep = append(keep, n) }
+        }
+        seq.Content = keep
+        if len(keep) == 0 && addr == "" { yamlDel(eth, "addresses") }
+    }
+    if addr != "" {
+        if !fileExists(path) { yamlSet(eth, "dhcp4", yamlScalarNode("true")) }
+        if seq := yamlGet(eth, "addresses"); seq != nil && seq.Kind == yaml.SequenceNode {
+            seq.Content = append(seq.Content, yamlScalarNode(addr))
+        } else {
+            yamlSet(eth, "addresses", yamlSeqNode([]string{addr}))
+        }
+        changed = true
+    }
+    if !changed { return nil }
+    return writeNetplan(path, doc)
+}
+
+// netplanEntry returns the document, path and ethernets entry of iface. With create it returns a
+// new 90-trae-<iface>.yaml document when no file defines the interface; otherwise eth is nil then.
+func netplanEntry(iface string, create bool) (doc *yaml.Node, path string, eth *yaml.Node) {
+    files, _ := filepath.Glob(filepath.Join(settings.NetplanDir, "*.yaml"))
+    for i := len(files) - 1; i >= 0; i-- {
+        d, err := readNetplan(files[i])
+        if err != nil {
+            log.Printf("netplan: %v", err)
+            continue
+        }
+        e := yamlGet(yamlGet(yamlGet(yamlRoot(d), "network"), "ethernets"), iface)
+        if e == nil { continue }
+        if e.Kind != yaml.MappingNode {
+            // "eth0:" with no settings
+            *e = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+        }
+        return d, files[i], e
+    }
+    if !create { return nil, "", nil }
+    root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+    network := yamlMapping(root, "network")
+    yamlSet(network, "version", yamlScalarNode("2"))
+    eth = yamlMapping(yamlMapping(network, "ethernets"), iface)
+    doc = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}
+    return doc, filepath.Join(settings.NetplanDir, "90-trae-"+iface+".yaml"), eth
+}
+
+func readNetplan(path string) (*yaml.Node, error) {
+    b, err := os.ReadFile(path)
+    if err != nil { return nil, err }
+    var doc yaml.Node
+    if err := yaml.Unmarshal(b, &doc); err != nil { return nil, fmt.Errorf("%s: %v", path, err) }
+    if doc.Kind == 0 {
+        // empty file
+        doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+    }
+    return &doc, nil
+}
+
+// writeNetplan writes doc to path (0600, netplan warns about readable files) and validates it
+// with "netplan generate"; when that fails the previous content is restored.
+func writeNetplan(path string, doc *yaml.Node) error {
+    var buf bytes.Buffer
+    enc := yaml.NewEncoder(&buf)
+    enc.SetIndent(2)
+    if err := enc.Encode(doc); err != nil { return err }
+    if err := enc.Close(); err != nil { return err }
+    old, oldErr := os.ReadFile(path)
+    if err := writeKeyfile(path, []string{buf.String()}); err != nil { return err }
+    if err := netplanGenerate(); err != nil {
+        if oldErr == nil {
+            _ = writeKeyfile(path, []string{string(old)})
+        } else {
+            _ = os.Remove(path)
+        }
+        return err
+    }
+    return nil
+}
+
+// netplanGenerate runs "netplan generate" if enabled and netplan is installed.
+func netplanGenerate() error {
+    if !settings.NetplanGen { return nil }
+    if _, err := exec.LookPath("netplan"); err != nil { return nil }
+    if err := runLogged("netplan", "generate"); err != nil {
+        return fmt.Errorf("netplan generate: %v", err)
+    }
+    return nil
+}
+
+// netplanManages reports whether a netplan file configures a network.
+func netplanManages() bool {
+    files, _ := filepath.Glob(filepath.Join(settings.NetplanDir, "*.yaml"))
+    for _, f := range files {
+        if d, err := readNetplan(f); err == nil && yamlGet(yamlRoot(d), "network") != nil { return true }
+    }
+    return false
+}
+
+// setNetplanAddr replaces the addresses of one family (keeping their position) with addr.
+func setNetplanAddr(eth *yaml.Node, addr string, family func(string) bool) {
+    seq := yamlGet(eth, "addresses")
+    if seq == nil || seq.Kind != yaml.SequenceNode {
+        yamlSet(eth, "addresses", yamlSeqNode([]string{addr}))
+        return
+    }
+    var out []*yaml.Node
+    placed := false
+    for _, n := range seq.Content {
+        if ip, _ := splitCIDR(netplanAddr(n)); family(ip) {
+            if !placed { out = append(out, yamlScalarNode(addr)) }
+            placed = true
+            continue
+        }
+        out = append(out, n)
+    }
+    if !placed { out = append(out, yamlScalarNode(addr)) }
+    seq.Content = out
+}
+
+// setNetplanGateway updates the deprecated key (gateway4/gateway6) if present, else the default
+// route of the family, adding one if needed.
+func setNetplanGateway(eth *yaml.Node, key, gw string, family func(string) bool) {
+    if yamlGet(eth, key) != nil {
+        yamlSet(eth, key, yamlScalarNode(gw))
+        return
+    }
+    routes := yamlGet(eth, "routes")
+    if routes == nil || routes.Kind != yaml.SequenceNode {
+        routes = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+        yamlSet(eth, "routes", routes)
+    }
+    for _, r := range routes.Content {
+        if isDefaultRoute(yamlScalar(yamlGet(r, "to"))) && family(yamlScalar(yamlGet(r, "via"))) {
+            yamlSet(r, "via", yamlScalarNode(gw))
+            return
+        }
+    }
+    r := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+    yamlSet(r, "to", yamlScalarNode("default"))
+    yamlSet(r, "via", yamlScalarNode(gw))
+    routes.Content = append(routes.Content, r)
+}
+
+// setNetplanRoutes replaces the non-default routes with routes, keeping the default ones.
+func setNetplanRoutes(eth *yaml.Node, routes []netRoute) {
+    seq := yamlGet(eth, "routes")
+    if seq == nil || seq.Kind != yaml.SequenceNode {
+        if len(routes) == 0 { return }
+        seq = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+        yamlSet(eth, "routes", seq)
+    }
+    var out []*yaml.Node
+    for _, r := range seq.Content {
+        if isDefaultRoute(yamlScalar(yamlGet(r, "to"))) { out = append(out, r) }
+    }
+    for _, r := range routes {
+        n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+        yamlSet(n, "to", yamlScalarNode(r.To))
+        if r.Via != "" { yamlSet(n, "via", yamlScalarNode(r.Via)) }
+        out = append(out, n)
+    }
+    seq.Content = out
+    if len(out) == 0 { yamlDel(eth, "routes") }
+}
+
+func isDefaultRoute(to string) bool { return to == "default" || to == "0.0.0.0/0" || to == "::/0" }
+
+// netplanAddrs returns the items of an address list.
+func netplanAddrs(seq *yaml.Node) []string {
+    var out []string
+    if seq == nil { return out }
+    for _, n := range seq.Content {
+        if a := netplanAddr(n); a != "" { out = append(out, a) }
+    }
+    return out
+}
+
+// netplanAddr returns an address item, either "ip/prefix" or "ip/prefix: {options}".
+func netplanAddr(n *yaml.Node) string {
+    if n.Kind == yaml.MappingNode && len(n.Content) > 0 { return n.Content[0].Value }
+    return yamlScalar(n)
+}
+
+// Minimal helpers for editing yaml.Node trees in place (so comments survive).
+
+func yamlRoot(doc *yaml.Node) *yaml.Node {
+    if doc != nil && doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 { return doc.Content[0] }
+    return nil
+}
+
+// yamlGet returns the value of key in mapping m, or nil.
+func yamlGet(m *yaml.Node, key string) *yaml.Node {
+    if m == nil || m.Kind != yaml.MappingNode { return nil }
+    for i := 0; i+1 < len(m.Content); i += 2 {
+        if m.Content[i].Value == key { return m.Content[i+1] }
+    }
+    return nil
+}
+
+// yamlSet replaces the value of key in mapping m (keeping its comments) or appends it.
+func yamlSet(m *yaml.Node, key string, v *yaml.Node) {
+    for i := 0; i+1 < len(m.Content); i += 2 {
+        if m.Content[i].Value == key {
+            old := m.Content[i+1]
+            v.LineComment, v.HeadComment, v.FootComment = old.LineComment, old.HeadComment, old.FootComment
+            if v.Kind == yaml.SequenceNode && old.Kind == yaml.SequenceNode { v.Style = old.Style }
+            m.Content[i+1] = v
+            return
+        }
+    }
+    m.Content = append(m.Content, yamlScalarNode(key), v)
+}
+
+// yamlDel removes keys from mapping m.
+func yamlDel(m *yaml.Node, keys ...string) {
+    var out []*yaml.Node
+    for i := 0; i+1 < len(m.Content); i += 2 {
+        drop := false
+        for _, k := range keys {
+            if m.Content[i].Value == k { drop = true }
+        }
+        if !drop { out = append(out, m.Content[i], m.Content[i+1]) }
+    }
+    m.Content = out
+}
+
+// yamlMapping returns the mapping under key in m, creating it if needed.
+func yamlMapping(m *yaml.Node, key string) *yaml.Node {
+    if v := yamlGet(m, key); v != nil && v.Kind == yaml.MappingNode { return v }
+    v := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+    yamlSet(m, key, v)
+    return v
+}
+
+func yamlScalar(n *yaml.Node) string {
+    if n == nil || n.Kind != yaml.ScalarNode { return "" }
+    return n.Value
+}
+
+func yamlScalarNode(v string) *yaml.Node { return &yaml.Node{Kind: yaml.ScalarNode, Value: v} }
+
+func yamlSeqNode(vs []string) *yaml.Node {
+    n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Style: yaml.FlowStyle}
+    for _, v := range vs {
+        n.Content = append(n.Content, yamlScalarNode(v))
+    }
+    return n
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+    "crypto/rand"
+    "fmt"
+    "log"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// NetworkManager backend.
+// The connection of an interface is the keyfile in nm_dir (default
+// /etc/NetworkManager/system-connections) whose [connection] interface-name matches; if there
+// is none, trae-<iface>.nmconnection is created. Static settings go to
+//   [ipv4] method=manual, address1=<ip>/<prefix>, gateway=<gw>, dns=<a>;<b>;
+//   [ipv6] method=manual, address1=<ip6>/<prefix>, gateway=<gw6>, dns=<a>;
+// with dns-search=<domains>; and route1=<dest>/<prefix>,<gw> in the section of the route's family
+// and mtu=<bytes> in [ethernet]; DHCP sets method=auto in both sections. NTP servers are not
+// part of a connection and are ignored. Apply reloads the keyfiles with nmcli and
+// activates the connection.
+
+const defaultNMDir = "/etc/NetworkManager/system-connections"
+
+type nmBackend struct{}
+
+func (nmBackend) Name() string { return "networkmanager" }
+
+func (nmBackend) Files() []string { return []string{filepath.Join(settings.NMDir, "*.nmconnection")} }
+
+func (nmBackend) File(iface string) string {
+    _, path := nmConnection(iface)
+    return path
+}
+
+func (nmBackend) Read(iface string) netConfig {
+    lines, _ := nmConnection(iface)
+    var c netConfig
+    if lines == nil { return c }
+    if ip, pfx := splitCIDR(iniValue(lines, "[ipv4]", "address1")); isIPv4(ip) {
+        c.IP = ip
+        if n, err := strconv.Atoi(pfx); err == nil && n > 0 && n <= 32 { c.Mask = prefixToMask(n) }
+    }
+    c.GW = nmGateway(lines, "[ipv4]")
+    c.DNS = splitList(strings.ReplaceAll(iniValue(lines, "[ipv4]", "dns"), ";", ","))
+    if a := strings.SplitN(iniValue(lines, "[ipv6]", "address1"), ",", 2)[0]; a != "" { c.IP6 = a }
+    c.GW6 = nmGateway(lines, "[ipv6]")
+    c.DNS = append(c.DNS, splitList(strings.ReplaceAll(iniValue(lines, "[ipv6]", "dns"), ";", ","))...)
+    for _, sec := range []string{"[ipv4]", "[ipv6]"} {
+        c.Domains = append(c.Domains, splitList(strings.ReplaceAll(iniValue(lines, sec, "dns-search"), ";", ","))...)
+        c.Routes = append(c.Routes, nmRoutes(lines, sec)...)
+    }
+    c.MTU = iniValue(lines, "[ethernet]", "mtu")
+    return c
+}
+
+func (nmBackend) WriteStatic(iface string, c netConfig) error {
+    lines, path, err := nmConnectionOrNew(iface)
+    if err != nil { return err }
+    if c.IP != "" {
+        // keep the configured prefix when no mask is given, else use the live one
+        pfx := maskToPrefix(c.Mask)
+        if pfx <= 0 {
+            _, old := splitCIDR(iniValue(lines, "[ipv4]", "address1"))
+            if n, err := strconv.Atoi(old); err == nil { pfx = n }
+        }
+        if pfx <= 0 {
+            if m := liveMask(iface); m != "" { pfx = maskToPrefix(m) }
+        }
+        if pfx <= 0 { pfx = 24 }
+        lines = upsertInSection(lines, "[ipv4]", "method=", "method=manual")
+        lines = upsertInSection(lines, "[ipv4]", "address1=", "address1="+c.IP+"/"+strconv.Itoa(pfx))
+    }
+    if c.GW != "" { lines = upsertInSection(lines, "[ipv4]", "gateway=", "gateway="+c.GW) }
+    var dns4, dns6 []string
+    for _, d := range c.DNS {
+        if isIPv6(d) { dns6 = append(dns6, d) } else { dns4 = append(dns4, d) }
+    }
+    if len(dns4) > 0 { lines = upsertInSection(lines, "[ipv4]", "dns=", "dns="+strings.Join(dns4, ";")+";") }
+    if c.IP6 != "" {
+        lines = upsertInSection(lines, "[ipv6]", "method=", "method=manual")
+        lines = upsertInSection(lines, "[ipv6]", "address1=", "address1="+c.IP6)
+    }
+    if c.GW6 != "" { lines = upsertInSection(lines, "[ipv6]", "gateway=", "gateway="+c.GW6) }
+    if len(dns6) > 0 { lines = upsertInSection(lines, "[ipv6]", "dns=", "dns="+strings.Join(dns6, ";")+";") }
+    if c.Domains != nil {
+        lines = removeInSection(lines, "[ipv6]", "dns-search=")
+        lines = removeInSection(lines, "[ipv4]", "dns-search=")
+        if len(c.Domains) > 0 { lines = upsertInSection(lines, "[ipv4]", "dns-search=", "dns-search="+strings.Join(c.Domains, ";")+";") }
+    }
+    if c.MTU == "0" {
+        lines = removeInSection(lines, "[ethernet]", "mtu=")
+    } else if c.MTU != "" {
+        lines = upsertInSection(lines, "[ethernet]", "mtu=", "mtu="+c.MTU)
+    }
+    if c.Routes != nil {
+        lines = setNMRoutes(lines, c.Routes)
+    }
+    if c.NTP != nil { log.Printf("networkmanager: NTP servers are not supported, ignored") }
+    return writeKeyfile(path, lines)
+}
+
+func (nmBackend) WriteDHCP(iface string) error {
+    lines, path, err := nmConnectionOrNew(iface)
+    if err != nil { return err }
+    for _, sec := range []string{"[ipv4]", "[ipv6]"} {
+        lines = removeInSection(lines, sec, "address", "gateway=", "dns=")
+        lines = upsertInSection(lines, sec, "method=", "method=auto")
+    }
+    return writeKeyfile(path, lines)
+}
+
+func (nmBackend) Apply(iface string) error {
+    lines, path := nmConnection(iface)
+    if lines == nil { return fmt.Errorf("no NetworkManager connection for %s", iface) }
+    if err := runLogged("nmcli", "connection", "reload"); err != nil { return err }
+    if uuid := iniValue(lines, "[connection]", "uuid"); uuid != "" {
+        return runLogged("nmcli", "connection", "up", "uuid", uuid)
+    }
+    return runLogged("nmcli", "connection", "up", "filename", path)
+}
+
+// SetLinkLocal adds addr as an extra addressN= of [ipv4], which NetworkManager assigns next to
+// the DHCP lease (method=auto), or removes the link-local addresses when addr is "".
+func (nmBackend) SetLinkLocal(iface, addr string) error {
+    lines, path, err := nmConnectionOrNew(iface)
+    if err != nil { return err }
+    old := strings.Join(lines, "\n")
+    lines = removeInSectionFunc(lines, "[ipv4]", "address", func(v string) bool {
+        n, a, ok := strings.Cut(v, "=")
+        _, err := strconv.Atoi(strings.TrimSpace(n))
+        return ok && err == nil && isLinkLocalCIDR(a)
+    })
+    if addr != "" {
+        n := 1
+        for iniValue(lines, "[ipv4]", "address"+strconv.Itoa(n)) != "" { n++ }
+        key := "address" + strconv.Itoa(n) + "="
+        lines = upsertInSection(lines, "[ipv4]", key, key+addr)
+    }
+    if strings.Join(lines, "\n") == old { return nil }
+    return writeKeyfile(path, lines)
+}
+
+// nmConnection returns the lines and path of the keyfile of iface (nil if none).
+func nmConnection(iface string) (lines []string, path string) {
+    matches, _ := filepath.Glob(filepath.Join(settings.NMDir, "*.nmconnection"))
+    for _, f := range matches {
+        b, err := os.ReadFile(f)
+        if err != nil { continue }
+        l := strings.Split(string(b), "\n")
+        if iniValue(l, "[connection]", "interface-name") == iface {
+            return l, f
+        }
+    }
+    return nil, ""
+}
+
+// nmConnectionOrNew is nmConnection, creating a minimal ethernet connection when none exists.
+func nmConnectionOrNew(iface string) ([]string, string, error) {
+    if lines, path := nmConnection(iface); lines != nil { return lines, path, nil }
+    uuid, err := newUUID()
+    if err != nil { return nil, "", err }
+    lines := []string{
+        "[connection]",
+        "id=trae-" + iface,
+        "uuid=" + uuid,
+        "type=ethernet",
+        "interface-name=" + iface,
+        "autoconnect=true",
+        "",
+        "[ipv4]",
+        "method=auto",
+        "",
+        "[ipv6]",
+        "method=auto",
+    }
+    return lines, filepath.Join(settings.NMDir, "trae-"+iface+".nmconnection"), nil
+}
+
+// nmRouteKey matches the routeN= and routeN_options= keys of a connection.
+var nmRouteKey = regexp.MustCompile(`^route[0-9]+(_options)?\s*=`)
+
+// nmRoutes returns the routeN=<dest>/<prefix>[,<gw>[,<metric>]] of section.
+func nmRoutes(lines []string, section string) []netRoute {
+    var out []netRoute
+    in := false
+    for _, l := range lines {
+        t := strings.TrimSpace(l)
+        if strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") {
+            in = t == section
+            continue
+        }
+        if !in || !nmRouteKey.MatchString(t) || strings.Contains(strings.SplitN(t, "=", 2)[0], "_options") { continue }
+        parts := strings.Split(strings.SplitN(t, "=", 2)[1], ",")
+        r := netRoute{To: strings.TrimSpace(parts[0])}
+        if len(parts) > 1 { r.Via = strings.TrimSpace(parts[1]) }
+        out = append(out, r)
+    }
+    return out
+}
+
+// setNMRoutes replaces the routes of both sections with routes, numbered per section.
+func setNMRoutes(lines []string, routes []netRoute) []string {
+    var out []string
+    for _, l := range lines {
+        if !nmRouteKey.MatchString(strings.TrimSpace(l)) { out = append(out, l) }
+    }
+    n4, n6 := 0, 0
+    for _, r := range routes {
+        sec, n := "[ipv4]", &n4
+        if strings.Contains(r.To, ":") { sec, n = "[ipv6]", &n6 }
+        *n++
+        key := "route" + strconv.Itoa(*n) + "="
+        v := r.To
+        if r.Via != "" { v += "," + r.Via }
+        out = upsertInSection(out, sec, key, key+v)
+    }
+    return out
+}
+
+// writeKeyfile writes a keyfile; NetworkManager ignores keyfiles readable by others.
+func writeKeyfile(path string, lines []string) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil { return err }
+    if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600); err != nil { return err }
+    return os.Chmod(path, 0o600)
+}
+
+// nmGateway returns gateway= of section, or the legacy gateway in address1=<addr>,<gw>.
+func nmGateway(lines []string, section string) string {
+    if gw := iniValue(lines, section, "gateway"); gw != "" { return gw }
+    if parts := strings.SplitN(iniValue(lines, section, "address1"), ",", 2); len(parts) == 2 {
+        return strings.TrimSpace(parts[1])
+    }
+    return ""
+}
+
+// splitCIDR splits "ip/prefix[,gw]" into ip and prefix.
+func splitCIDR(v string) (ip, prefix string) {
+    v = strings.SplitN(v, ",", 2)[0]
+    if i := strings.Index(v, "/"); i >= 0 { return strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:]) }
+    return strings.TrimSpace(v), ""
+}
+
+// iniValue returns the value of key in section of an ini-style file ("" if absent).
+func iniValue(lines []string, section, key string) string {
+    in := false
+    for _, l := range lines {
+        t := strings.TrimSpace(l)
+        if strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") {
+            in = t == section
+            continue
+        }
+        if !in { continue }
+        if k, v, ok := strings.Cut(t, "="); ok && strings.TrimSpace(k) == key {
+            return strings.TrimSpace(v)
+        }
+    }
+    return ""
+}
+
+// removeInSection drops the lines of section starting with any of the prefixes.
+func removeInSection(lines []string, section string, prefixes ...string) []string {
+    var out []string
+    in := false
+    for _, l := range lines {
+        t := strings.TrimSpace(l)
+        if strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") { in = t == section }
+        drop := false
+        if in {
+            for _, p := range prefixes {
+                if strings.HasPrefix(t, p) { drop = true }
+            }
+        }
+        if !drop { out = append(out, l) }
+    }
+    return out
+}
+
+// runLogged runs a command, logging its output on failure.
+func runLogged(name string, args ...string) error {
+    out, err := exec.Command(name, args...).CombinedOutput()
+    if err != nil {
+        log.Printf("%s %s output: %s", name, strings.Join(args, " "), string(out))
+    }
+    return err
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil { return "", err }
+    b[6] = b[6]&0x0f | 0x40
+    b[8] = b[8]&0x3f | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// tempSettings points the backend files at a fresh directory for the duration of the test.
+func tempSettings(t *testing.T) string {
+    t.Helper()
+    dir := t.TempDir()
+    saved := settings
+    t.Cleanup(func() { settings = saved })
+    settings.NetDir = filepath.Join(dir, "networkd")
+    settings.NMDir = filepath.Join(dir, "nm")
+    settings.Interfaces = filepath.Join(dir, "interfaces")
+    settings.NetplanDir = filepath.Join(dir, "netplan")
+    settings.NetplanGen = false
+    for _, d := range []string{settings.NetDir, settings.NMDir, settings.NetplanDir} {
+        if err := os.MkdirAll(d, 0o755); err != nil { t.Fatal(err) }
+    }
+    return dir
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+    t.Helper()
+    if err := os.WriteFile(path, []byte(content), 0o644); err != nil { t.Fatal(err) }
+}
+
+func readTestFile(t *testing.T, path string) string {
+    t.Helper()
+    b, err := os.ReadFile(path)
+    if err != nil { t.Fatal(err) }
+    return string(b)
+}
+
+// sameConfig is reflect.DeepEqual that does not tell empty lists from nil ones.
+func sameConfig(a, b netConfig) bool {
+    for _, c := range []*netConfig{&a, &b} {
+        if len(c.DNS) == 0 { c.DNS = nil }
+        if len(c.Domains) == 0 { c.Domains = nil }
+        if len(c.NTP) == 0 { c.NTP = nil }
+        if len(c.Routes) == 0 { c.Routes = nil }
+    }
+    return reflect.DeepEqual(a, b)
+}
+
+// backendCase is an existing configuration of eth0 (with an unrelated part that must survive)
+// and what the backend supports.
+type backendCase struct {
+    backend networkBackend
+    file    func() string // the file holding eth0
+    initial string        // content of file before the test
+    keep    string        // text of initial that every write must keep
+    ntp     bool          // the backend stores NTP servers
+}
+
+func backendCases() []backendCase {
+    return []backendCase{
+        {
+            backend: networkdBackend{},
+            file:    func() string { return filepath.Join(settings.NetDir, "10-eth0.network") },
+            initial: "[Match]\nName=eth0\n\n[Network]\nDHCP=yes\nLLMNR=no\n",
+            keep:    "LLMNR=no",
+            ntp:     true,
+        },
+        {
+            backend: nmBackend{},
+            file:    func() string { return filepath.Join(settings.NMDir, "wired.nmconnection") },
+            initial: "[connection]\nid=wired\nuuid=0b9e4f3c-1111-4a2b-8c3d-123456789abc\ntype=ethernet\ninterface-name=eth0\n\n[ipv4]\nmethod=auto\n\n[ipv6]\nmethod=auto\naddr-gen-mode=stable-privacy\n",
+            keep:    "addr-gen-mode=stable-privacy",
+        },
+        {
+            backend: ifupdownBackend{},
+            file:    func() string { return settings.Interfaces },
+            initial: "auto lo\niface lo inet loopback\n\nauto eth0\niface eth0 inet dhcp\n    up echo eth0 up\n",
+            keep:    "up echo eth0 up",
+        },
+        {
+            backend: netplanBackend{},
+            file:    func() string { return filepath.Join(settings.NetplanDir, "50-cloud-init.yaml") },
+            initial: "# written by cloud-init\nnetwork:\n  version: 2\n  ethernets:\n    eth0:\n      dhcp4: true\n      optional: true\n",
+            keep:    "optional: true",
+        },
+    }
+}
+
+func TestBackendWriteStatic(t *testing.T) {
+    full := netConfig{
+        IP: "192.168.1.10", Mask: "255.255.255.0", GW: "192.168.1.1",
+        DNS: []string{"8.8.8.8", "1.1.1.1"}, IP6: "2001:db8::10/64", GW6: "2001:db8::1",
+        Domains: []string{"example.com", "lab.example.com"}, MTU: "1400", NTP: []string{"pool.ntp.org"},
+        Routes: []netRoute{{To: "10.20.0.0/16", Via: "192.168.1.254"}},
+    }
+    for _, bc := range backendCases() {
+        t.Run(bc.backend.Name(), func(t *testing.T) {
+            tempSettings(t)
+            path := bc.file()
+            writeTestFile(t, path, bc.initial)
+            if err := bc.backend.WriteStatic("eth0", full); err != nil { t.Fatal(err) }
+            want := full
+            if !bc.ntp { want.NTP = nil }
+            if got := bc.backend.Read("eth0"); !sameConfig(got, want) {
+                t.Errorf("after WriteStatic:\n got %+v\nwant %+v\n%s", got, want, readTestFile(t, path))
+            }
+            if f := bc.backend.File("eth0"); f != path { t.Errorf("File = %q, want %q", f, path) }
+
+            // empty fields are left alone; MTU=0 removes the MTU
+            if err := bc.backend.WriteStatic("eth0", netConfig{GW: "192.168.1.2", DNS: []string{"9.9.9.9"}, MTU: "0"}); err != nil { t.Fatal(err) }
+            want.GW, want.DNS, want.MTU = "192.168.1.2", []string{"9.9.9.9"}, ""
+            if got := bc.backend.Read("eth0"); !sameConfig(got, want) {
+                t.Errorf("after partial WriteStatic:\n got %+v\nwant %+v\n%s", got, want, readTestFile(t, path))
+            }
+
+            // empty (non-nil) lists clear the domains and routes
+            if err := bc.backend.WriteStatic("eth0", netConfig{Domains: []string{}, Routes: []netRoute{}}); err != nil { t.Fatal(err) }
+            want.Domains, want.Routes = nil, nil
+            if got := bc.backend.Read("eth0"); !sameConfig(got, want) {
+                t.Errorf("after clearing lists:\n got %+v\nwant %+v\n%s", got, want, readTestFile(t, path))
+            }
+            if content := readTestFile(t, path); !strings.Contains(content, bc.keep) {
+                t.Errorf("%q was dropped:\n%s", bc.keep, content)
+            }
+        })
+    }
+}
+
+func TestBackendWriteDHCP(t *testing.T) {
+    for _, bc := range backendCases() {
+        t.Run(bc.backend.Name(), func(t *testing.T) {
+            tempSettings(t)
+            path := bc.file()
+            writeTestFile(t, path, bc.initial)
+            static := netConfig{IP: "192.168.1.10", Mask: "255.255.255.0", GW: "192.168.1.1", DNS: []string{"8.8.8.8"}}
+            if err := bc.backend.WriteStatic("eth0", static); err != nil { t.Fatal(err) }
+            if err := bc.backend.WriteDHCP("eth0"); err != nil { t.Fatal(err) }
+            if got := bc.backend.Read("eth0"); got.IP != "" || got.Mask != "" || got.GW != "" || len(got.DNS) != 0 {
+                t.Errorf("after WriteDHCP: %+v\n%s", got, readTestFile(t, path))
+            }
+        })
+    }
+}
+
+func TestBackendNewFile(t *testing.T) {
+    for _, bc := range backendCases() {
+        t.Run(bc.backend.Name(), func(t *testing.T) {
+            tempSettings(t)
+            if f := bc.backend.File("eth1"); f != "" && fileExists(f) { t.Errorf("File(eth1) = %q before any write", f) }
+            c := netConfig{IP: "10.0.0.5", Mask: "255.0.0.0", GW: "10.0.0.1"}
+            if err := bc.backend.WriteStatic("eth1", c); err != nil { t.Fatal(err) }
+            if got := bc.backend.Read("eth1"); !sameConfig(got, c) { t.Errorf("Read = %+v, want %+v", got, c) }
+            if got := bc.backend.Read("eth0"); !sameConfig(got, netConfig{}) { t.Errorf("eth0 picked up eth1's settings: %+v", got) }
+        })
+    }
+}
+
+func TestBackendSetLinkLocal(t *testing.T) {
+    for _, bc := range backendCases() {
+        t.Run(bc.backend.Name(), func(t *testing.T) {
+            tempSettings(t)
+            path := bc.file()
+            writeTestFile(t, path, bc.initial)
+            if err := bc.backend.SetLinkLocal("eth0", "169.254.10.20/16"); err != nil { t.Fatal(err) }
+            content := readTestFile(t, path)
+            if got := bc.backend.Read("eth0"); got.IP != "169.254.10.20" || got.GW != "" {
+                t.Errorf("after SetLinkLocal: %+v\n%s", got, content)
+            }
+            // DHCP stays on and the rest of the file is kept
+            for _, s := range []string{"169.254.10.20", bc.keep} {
+                if !strings.Contains(content, s) { t.Errorf("%q missing:\n%s", s, content) }
+            }
+            if strings.Contains(content, "DHCP=no") || strings.Contains(content, "method=manual") || strings.Contains(content, "inet static") || strings.Contains(content, "dhcp4: false") {
+                t.Errorf("DHCP was turned off:\n%s", content)
+            }
+            if err := bc.backend.SetLinkLocal("eth0", "169.254.10.21/16"); err != nil { t.Fatal(err) }
+            if content := readTestFile(t, path); strings.Contains(content, "169.254.10.20") || strings.Count(content, "169.254.10.21") == 0 {
+                t.Errorf("address not replaced:\n%s", content)
+            }
+            if err := bc.backend.SetLinkLocal("eth0", ""); err != nil { t.Fatal(err) }
+            if got := readTestFile(t, path); got != bc.initial { t.Errorf("after removing:\n got %q\nwant %q", got, bc.initial) }
+
+            // nothing to remove for an interface without a configuration
+            if err := bc.backend.SetLinkLocal("eth1", ""); err != nil { t.Fatal(err) }
+            if f := bc.backend.File("eth1"); f != "" && fileExists(f) { t.Errorf("%s created for eth1", f) }
+        })
+    }
+}
+
+func TestIfupdownFiles(t *testing.T) {
+    dir := tempSettings(t)
+    writeTestFile(t, settings.Interfaces, "auto lo\niface lo inet loopback\n\nsource extra/*.cfg\nsource-directory interfaces.d\n")
+    for _, d := range []string{"interfaces.d", "extra"} {
+        if err := os.MkdirAll(filepath.Join(dir, d), 0o755); err != nil { t.Fatal(err) }
+    }
+    eth1 := "auto eth1\niface eth1 inet dhcp\n"
+    writeTestFile(t, filepath.Join(dir, "interfaces.d", "eth1"), eth1)
+    // run-parts skips names with dots, so the backup copy is not part of the configuration
+    writeTestFile(t, filepath.Join(dir, "interfaces.d", "eth1.bak"), eth1)
+    writeTestFile(t, filepath.Join(dir, "extra", "wlan0.cfg"), "iface wlan0 inet dhcp\n")
+    writeTestFile(t, filepath.Join(dir, "extra", "wlan0.txt"), "iface wlan0 inet static\n")
+
+    want := []string{settings.Interfaces, filepath.Join(dir, "extra", "wlan0.cfg"), filepath.Join(dir, "interfaces.d", "eth1")}
+    if got := ifupdownFiles(); !reflect.DeepEqual(got, want) { t.Errorf("ifupdownFiles = %q, want %q", got, want) }
+
+    b := ifupdownBackend{}
+    if f := b.File("eth1"); f != want[2] { t.Errorf("File(eth1) = %q, want %q", f, want[2]) }
+    main := readTestFile(t, settings.Interfaces)
+    if err := b.WriteStatic("eth1", netConfig{IP: "10.0.1.5", Mask: "255.255.255.0"}); err != nil { t.Fatal(err) }
+    if got := readTestFile(t, want[2]); got != "auto eth1\niface eth1 inet static\n    address 10.0.1.5\n    netmask 255.255.255.0\n" {
+        t.Errorf("interfaces.d/eth1 = %q", got)
+    }
+    if got := readTestFile(t, filepath.Join(dir, "interfaces.d", "eth1.bak")); got != eth1 { t.Errorf("eth1.bak was changed: %q", got) }
+    if got := readTestFile(t, settings.Interfaces); got != main { t.Errorf("interfaces was changed: %q", got) }
+    if got := readTestFile(t, want[1]); got != "iface wlan0 inet dhcp\n" { t.Errorf("wlan0.cfg was changed: %q", got) }
+    if got := b.Read("eth1"); got.IP != "10.0.1.5" { t.Errorf("Read(eth1) = %+v", got) }
+    if f := b.File("wlan0"); f != want[1] { t.Errorf("File(wlan0) = %q, want %q", f, want[1]) }
+}
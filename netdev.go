@@ -0,0 +1,166 @@
+package main
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// VLAN and bond interfaces (networkd backend).
+// CFG|IF=<parent>|VLAN=<id> creates the VLAN sub-interface <parent>.<id>, CFG|BOND=<name>|SLAVES=<a>,<b>
+// an active-backup bond; REMOVE=1 deletes them again (see cmd_net.go). The files are
+//   <net_dir>/eth0.100.netdev   [NetDev] Name=eth0.100, Kind=vlan; [VLAN] Id=100
+//   VLAN=eth0.100               in [Network] of the parent's .network file
+//   <net_dir>/bond0.netdev      [NetDev] Name=bond0, Kind=bond; [Bond] Mode=active-backup, MIIMonitorSec=100ms
+//   <net_dir>/eth0.network      [Network] Bond=bond0 (and PrimarySlave=yes), replacing the slave's addresses
+// and the addresses of the new interface go to its own .network file like those of any other
+// interface. Removing a bond puts its slaves back to DHCP; applying a removal deletes the
+// interface, which restarting systemd-networkd does not.
+
+var errNoLink = errors.New("NO_LINK")
+
+func (networkdBackend) AddVLAN(parent string, id int) (string, error) {
+    name := parent + "." + strconv.Itoa(id)
+    if err := writeNetdev(name, "vlan", "[VLAN]", "Id="+strconv.Itoa(id)); err != nil { return "", err }
+    path := networkdFile(parent)
+    lines := readNetworkLines(path, parent)
+    lines = upsertInSectionFunc(lines, "[Network]", "VLAN=", "VLAN="+name, func(v string) bool { return strings.TrimSpace(v) == name })
+    return name, writeNetworkLines(path, lines)
+}
+
+func (networkdBackend) RemoveVLAN(name string) error {
+    path, ok := netdevFile(name)
+    if !ok { return errNoLink }
+    if err := os.Remove(path); err != nil { return err }
+    if err := removeOwnNetworkFile(name); err != nil { return err }
+    // drop VLAN=<name> from the parent (or any other file referencing it)
+    return editNetworkFiles(func(lines []string) []string {
+        return removeInSectionFunc(lines, "[Network]", "VLAN=", func(v string) bool { return v == name })
+    })
+}
+
+func (networkdBackend) AddBond(name string, slaves []string, primary string) error {
+    if err := writeNetdev(name, "bond", "[Bond]", "Mode=active-backup", "MIIMonitorSec=100ms"); err != nil { return err }
+    for _, s := range slaves {
+        lines := []string{"[Match]", "Name=" + s, "", "[Network]", "Bond=" + name}
+        if s == primary { lines = append(lines, "PrimarySlave=yes") }
+        if err := writeNetworkLines(networkdOwnFile(s), lines); err != nil { return err }
+    }
+    return nil
+}
+
+func (networkdBackend) RemoveBond(name string) error {
+    path, ok := netdevFile(name)
+    if !ok { return errNoLink }
+    if err := os.Remove(path); err != nil { return err }
+    if err := removeOwnNetworkFile(name); err != nil { return err }
+    for _, s := range bondSlavesConfigured(name) {
+        if err := applySystemdNetworkDHCP(s); err != nil { return err }
+    }
+    return nil
+}
+
+func (networkdBackend) HasLink(name string) bool {
+    _, ok := netdevFile(name)
+    return ok
+}
+
+// applyNetworkd restarts systemd-networkd and deletes iface when it is a VLAN or bond whose
+// .netdev file is gone (removed by CFG or rolled back).
+func applyNetworkd(iface string) error {
+    if err := restartNetworkd(); err != nil { return err }
+    if k := linkKind(iface); k == "vlan" || k == "bond" {
+        if _, ok := netdevFile(iface); !ok { return runLogged("ip", "link", "delete", iface) }
+    }
+    return nil
+}
+
+// netdevFile returns the .netdev file in net_dir defining name, else <name>.netdev and false.
+func netdevFile(name string) (string, bool) {
+    matches, _ := filepath.Glob(filepath.Join(settings.NetDir, "*.netdev"))
+    for _, f := range matches {
+        b, err := os.ReadFile(f)
+        if err != nil { continue }
+        if iniValue(strings.Split(string(b), "\n"), "[NetDev]", "Name") == name { return f, true }
+    }
+    return filepath.Join(settings.NetDir, name+".netdev"), false
+}
+
+// writeNetdev writes the .netdev file of name: [NetDev] with Name= and Kind=, then section with opts.
+func writeNetdev(name, kind, section string, opts ...string) error {
+    path, _ := netdevFile(name)
+    lines := append([]string{"[NetDev]", "Name=" + name, "Kind=" + kind, "", section}, opts...)
+    return writeNetworkLines(path, lines)
+}
+
+// networkdOwnFile is networkdFile(iface) when that file is for iface alone, else <iface>.network,
+// so that rewriting it does not change other interfaces matched by the same pattern.
+func networkdOwnFile(iface string) string {
+    path := networkdFile(iface)
+    if b, err := os.ReadFile(path); err == nil && iniValue(strings.Split(string(b), "\n"), "[Match]", "Name") != iface {
+        return filepath.Join(settings.NetDir, iface+".network")
+    }
+    return path
+}
+
+// removeOwnNetworkFile deletes the .network file of iface if it is for iface alone.
+func removeOwnNetworkFile(iface string) error {
+    path := networkdOwnFile(iface)
+    if err := os.Remove(path); err != nil && !os.IsNotExist(err) { return err }
+    return nil
+}
+
+// bondSlavesConfigured returns the interfaces whose .network file has Bond=name.
+func bondSlavesConfigured(name string) []string {
+    var out []string
+    matches, _ := filepath.Glob(filepath.Join(settings.NetDir, "*.network"))
+    for _, f := range matches {
+        b, err := os.ReadFile(f)
+        if err != nil { continue }
+        lines := strings.Split(string(b), "\n")
+        if iniValue(lines, "[Network]", "Bond") == name { out = append(out, strings.Fields(iniValue(lines, "[Match]", "Name"))...) }
+    }
+    return out
+}
+
+// editNetworkFiles applies edit to every .network file in net_dir, writing those it changed.
+func editNetworkFiles(edit func([]string) []string) error {
+    matches, _ := filepath.Glob(filepath.Join(settings.NetDir, "*.network"))
+    for _, f := range matches {
+        b, err := os.ReadFile(f)
+        if err != nil { continue }
+        lines := strings.Split(string(b), "\n")
+        if out := edit(lines); len(out) != len(lines) {
+            if err := os.WriteFile(f, []byte(strings.Join(out, "\n")), 0o644); err != nil { return err }
+        }
+    }
+    return nil
+}
+
+// readNetworkLines reads a .network file, or returns a new one matching iface.
+func readNetworkLines(path, iface string) []string {
+    if b, err := os.ReadFile(path); err == nil {
+        return strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+    }
+    return []string{"[Match]", "Name=" + iface, "", "[Network]"}
+}
+
+func writeNetworkLines(path string, lines []string) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil { return err }
+    return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+}
+
+// removeInSectionFunc drops the lines of section starting with keyPrefix whose value satisfies match.
+func removeInSectionFunc(lines []string, section, keyPrefix string, match func(value string) bool) []string {
+    var out []string
+    in := false
+    for _, l := range lines {
+        t := strings.TrimSpace(l)
+        if strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") { in = t == section }
+        if in && strings.HasPrefix(t, keyPrefix) && match(strings.TrimSpace(strings.TrimPrefix(t, keyPrefix))) { continue }
+        out = append(out, l)
+    }
+    return out
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Wire formats.
+// v1 (text):  CMD|KEY=VALUE|KEY=VALUE...   e.g. CFG|IP=192.168.1.10|DNS=8.8.8.8,1.1.1.1
+// v2 (JSON):  {"v":2,"cmd":"cfg","req":"<id>","ts":<unix>,"args":{"ip":"192.168.1.10","dns":["8.8.8.8","1.1.1.1"]},"sig":"<hex>"}
+// A message starting with '{' is treated as v2 and answered in JSON:
+//             {"v":2,"cmd":"cfg_ack","req":"<id>","ts":<unix>,"ok":true,"data":{"id":"..."},"flags":["net_ack"]}
+// Both formats are parsed into a request and answered through a response, so command
+// handling does not depend on the wire format.
+
+const protoVersion = 2
+
+// request is a parsed client message.
+type request struct {
+    V      int                 // 1 = text, 2 = JSON envelope
+    Cmd    string              // upper-case command, e.g. "CFG"
+    Args   map[string][]string // upper-case keys; repeated keys or JSON arrays give several values
+    Req    string              // optional request ID (REQ / "req")
+    TS     string              // optional unix timestamp (TS / "ts")
+    Sig    string              // optional HMAC signature (SIG / "sig")
+    Signed string              // content covered by Sig
+    Via    string              // arrival path set by the server: multicast, broadcast or unicast
+    Dst    string              // address the datagram was sent to, "" when unknown
+}
+
+// arg returns the first value of key, or "".
+func (r *request) arg(key string) string {
+    if vs := r.Args[key]; len(vs) > 0 {
+        return vs[0]
+    }
+    return ""
+}
+
+// args returns all values of key; text values are also split on ',' (e.g. DNS=a,b).
+func (r *request) args(key string) []string {
+    var out []string
+    for _, v := range r.Args[key] {
+        for _, p := range strings.Split(v, ",") {
+            if p = strings.TrimSpace(p); p != "" {
+                out = append(out, p)
+            }
+        }
+    }
+    return out
+}
+
+// flag reports whether key is set to a true-ish value (1/yes/true/on).
+func (r *request) flag(key string) bool {
+    switch strings.ToLower(r.arg(key)) {
+    case "1", "yes", "true", "on":
+        return true
+    }
+    return false
+}
+
+// parseRequest parses a v1 text or v2 JSON message. It always returns a request
+// (with V set) so that errors can be answered in the client's format.
+func parseRequest(msg string) (*request, error) {
+    if strings.HasPrefix(msg, "{") {
+        return parseJSONRequest(msg)
+    }
+    return parseTextRequest(msg), nil
+}
+
+func parseTextRequest(msg string) *request {
+    r := &request{V: 1, Args: map[string][]string{}}
+    r.Signed, r.Sig = splitSig(msg)
+    parts := strings.Split(msg, "|")
+    r.Cmd = strings.ToUpper(strings.TrimSpace(parts[0]))
+    for _, p := range parts[1:] {
+        kv := strings.SplitN(p, "=", 2)
+        if len(kv) != 2 { continue }
+        k := strings.ToUpper(strings.TrimSpace(kv[0]))
+        v := strings.TrimSpace(kv[1])
+        switch k {
+        case "REQ":
+            r.Req = v
+        case "TS":
+            r.TS = v
+        case "SIG":
+            // already split off above
+        default:
+            r.Args[k] = append(r.Args[k], v)
+        }
+    }
+    return r
+}
+
+type jsonRequest struct {
+    V    int                    `json:"v"`
+    Cmd  string                 `json:"cmd"`
+    Req  string                 `json:"req,omitempty"`
+    TS   interface{}            `json:"ts,omitempty"`
+    Args map[string]interface{} `json:"args,omitempty"`
+    Sig  string                 `json:"sig,omitempty"`
+}
+
+func parseJSONRequest(msg string) (*request, error) {
+    r := &request{V: protoVersion, Args: map[string][]string{}}
+    var env jsonRequest
+    if err := json.Unmarshal([]byte(msg), &env); err != nil {
+        return r, errors.New("BAD_JSON")
+    }
+    if env.V != protoVersion {
+        return r, errors.New("BAD_VERSION")
+    }
+    r.Cmd = strings.ToUpper(strings.TrimSpace(env.Cmd))
+    r.Req = env.Req
+    r.TS = jsonScalar(env.TS)
+    r.Sig = env.Sig
+    for k, v := range env.Args {
+        key := strings.ToUpper(k)
+        switch vv := v.(type) {
+        case []interface{}:
+            for _, e := range vv {
+                r.Args[key] = append(r.Args[key], jsonScalar(e))
+            }
+        default:
+            r.Args[key] = append(r.Args[key], jsonScalar(vv))
+        }
+    }
+    if r.Cmd == "" {
+        return r, errors.New("NO_CMD")
+    }
+    r.Signed = r.canonical()
+    return r, nil
+}
+
+// canonical is the signed content of a v2 request: CMD, then args sorted by key as
+// KEY=v1,v2, then REQ and TS, joined by '|'. e.g. CFG|DNS=8.8.8.8,1.1.1.1|IP=10.0.0.5|REQ=ab|TS=1700000000
+// REQ and TS are always present (empty when absent) and '\', '|', ',' and '=' inside the command,
+// keys and values are escaped with '\', so no two different requests share a canonical form.
+func (r *request) canonical() string {
+    keys := make([]string, 0, len(r.Args))
+    for k := range r.Args {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    parts := []string{canonicalEscape(r.Cmd)}
+    for _, k := range keys {
+        vs := make([]string, len(r.Args[k]))
+        for i, v := range r.Args[k] {
+            vs[i] = canonicalEscape(v)
+        }
+        parts = append(parts, canonicalEscape(k)+"="+strings.Join(vs, ","))
+    }
+    parts = append(parts, "REQ="+canonicalEscape(r.Req), "TS="+canonicalEscape(r.TS))
+    return strings.Join(parts, "|")
+}
+
+var canonicalEscaper = strings.NewReplacer(`\`, `\\`, "|", `\|`, ",", `\,`, "=", `\=`)
+
+// canonicalEscape escapes the separators of the canonical form in s.
+func canonicalEscape(s string) string {
+    return canonicalEscaper.Replace(s)
+}
+
+// jsonScalar renders a decoded JSON scalar as text (numbers without exponent).
+func jsonScalar(v interface{}) string {
+    switch x := v.(type) {
+    case nil:
+        return ""
+    case string:
+        return strings.TrimSpace(x)
+    case float64:
+        return strconv.FormatFloat(x, 'f', -1, 64)
+    case bool:
+        return strconv.FormatBool(x)
+    default:
+        return fmt.Sprint(x)
+    }
+}
+
+// response is a reply in wire-format-neutral form. Fields keep insertion order for the text format.
+type response struct {
+    Status string // e.g. "TF", "NET", "CFG_ACK", "AUTH_NACK"; empty for bare-field replies like ID=<id>
+    Fields []respField
+}
+
+// respField is KEY=VALUE (Values), a list (List=true) or a bare token like NET_ACK (no Values).
+type respField struct {
+    Key    string
+    Values []string
+    List   bool
+}
+
+func newResponse(status string) *response {
+    return &response{Status: status}
+}
+
+// set adds KEY=value; empty values are skipped.
+func (r *response) set(key, value string) *response {
+    if value != "" {
+        r.Fields = append(r.Fields, respField{Key: key, Values: []string{value}})
+    }
+    return r
+}
+
+// list adds a multi-value field (text: KEY=a,b; JSON: array); empty lists are skipped.
+func (r *response) list(key string, values []string) *response {
+    if len(values) > 0 {
+        r.Fields = append(r.Fields, respField{Key: key, Values: values, List: true})
+    }
+    return r
+}
+
+// flag adds a bare status token such as NET_ACK.
+func (r *response) flag(name string) *response {
+    r.Fields = append(r.Fields, respField{Key: name})
+    return r
+}
+
+// ok reports whether the status denotes success.
+func (r *response) ok() bool {
+    return !strings.HasSuffix(r.Status, "_NACK") && r.Status != "UNKNOWN_CMD" && r.Status != "BAD_REQUEST"
+}
+
+// encode renders the response in the format of req, echoing REQ and TS.
+func (r *response) encode(req *request) string {
+    if req != nil && req.V == protoVersion {
+        return r.json(req)
+    }
+    var parts []string
+    if r.Status != "" {
+        parts = append(parts, r.Status)
+    }
+    for _, f := range r.Fields {
+        if len(f.Values) == 0 {
+            parts = append(parts, f.Key)
+            continue
+        }
+        // keep the text format parseable: '|' cannot appear inside values
+        parts = append(parts, f.Key+"="+strings.ReplaceAll(strings.Join(f.Values, ","), "|", ":"))
+    }
+    if req != nil && req.Req != "" { parts = append(parts, "REQ="+req.Req) }
+    if req != nil && req.TS != "" { parts = append(parts, "TS="+req.TS) }
+    return strings.Join(parts, "|")
+}
+
+type jsonResponse struct {
+    V     int                    `json:"v"`
+    Cmd   string                 `json:"cmd"`
+    Req   string                 `json:"req,omitempty"`
+    TS    json.Number            `json:"ts,omitempty"`
+    OK    bool                   `json:"ok"`
+    Data  map[string]interface{} `json:"data,omitempty"`
+    Flags []string               `json:"flags,omitempty"`
+}
+
+func (r *response) json(req *request) string {
+    cmd := r.Status
+    if cmd == "" {
+        cmd = req.Cmd
+    }
+    env := jsonResponse{V: protoVersion, Cmd: strings.ToLower(cmd), Req: req.Req, OK: r.ok(), Data: map[string]interface{}{}}
+    if _, err := strconv.ParseInt(req.TS, 10, 64); err == nil {
+        env.TS = json.Number(req.TS)
+    }
+    for _, f := range r.Fields {
+        k := strings.ToLower(f.Key)
+        switch {
+        case len(f.Values) == 0:
+            env.Flags = append(env.Flags, k)
+        case f.List:
+            env.Data[k] = f.Values
+        default:
+            env.Data[k] = f.Values[0]
+        }
+    }
+    b, err := json.Marshal(env)
+    if err != nil {
+        return `{"v":2,"cmd":"bad_request","ok":false}`
+    }
+    return string(b)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestParseRequest(t *testing.T) {
+    tests := []struct {
+        msg  string
+        want request
+        err  string
+    }{
+        {
+            msg:  "TF",
+            want: request{V: 1, Cmd: "TF", Args: map[string][]string{}, Signed: "TF"},
+        },
+        {
+            msg: " cfg |ip= 192.168.1.10 |dns=8.8.8.8,1.1.1.1|DNS=9.9.9.9|junk|REQ=ab|TS=1700000000|sig=CAFE",
+            want: request{V: 1, Cmd: "CFG", Req: "ab", TS: "1700000000", Sig: "CAFE",
+                Args:   map[string][]string{"IP": {"192.168.1.10"}, "DNS": {"8.8.8.8,1.1.1.1", "9.9.9.9"}},
+                Signed: " cfg |ip= 192.168.1.10 |dns=8.8.8.8,1.1.1.1|DNS=9.9.9.9|junk|REQ=ab|TS=1700000000"},
+        },
+        {
+            msg: "CFG|NAME=a=b",
+            want: request{V: 1, Cmd: "CFG", Args: map[string][]string{"NAME": {"a=b"}}, Signed: "CFG|NAME=a=b"},
+        },
+        {
+            msg: `{"v":2,"cmd":"cfg","req":"ab","ts":1700000000,"args":{"ip":"10.0.0.5","dns":["8.8.8.8","1.1.1.1"],"mtu":1400,"apply":true},"sig":"cafe"}`,
+            want: request{V: 2, Cmd: "CFG", Req: "ab", TS: "1700000000", Sig: "cafe",
+                Args: map[string][]string{"IP": {"10.0.0.5"}, "DNS": {"8.8.8.8", "1.1.1.1"}, "MTU": {"1400"}, "APPLY": {"true"}},
+                Signed: "CFG|APPLY=true|DNS=8.8.8.8,1.1.1.1|IP=10.0.0.5|MTU=1400|REQ=ab|TS=1700000000"},
+        },
+        {
+            msg: `{"v":2,"cmd":"wifi_set","args":{"ssid":"a|b,c"}}`,
+            want: request{V: 2, Cmd: "WIFI_SET", Args: map[string][]string{"SSID": {"a|b,c"}}, Signed: `WIFI_SET|SSID=a\|b\,c|REQ=|TS=`},
+        },
+        {msg: `{"v":2,"cmd":`, want: request{V: 2, Args: map[string][]string{}}, err: "BAD_JSON"},
+        {msg: `{"v":1,"cmd":"tf"}`, want: request{V: 2, Args: map[string][]string{}}, err: "BAD_VERSION"},
+        {msg: `{"v":2,"args":{"ip":"10.0.0.5"}}`, want: request{V: 2, Args: map[string][]string{"IP": {"10.0.0.5"}}}, err: "NO_CMD"},
+    }
+    for _, tt := range tests {
+        got, err := parseRequest(tt.msg)
+        if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+            t.Errorf("parseRequest(%q) err = %v, want %q", tt.msg, err, tt.err)
+        }
+        if got == nil {
+            t.Errorf("parseRequest(%q) returned no request", tt.msg)
+            continue
+        }
+        if !reflect.DeepEqual(*got, tt.want) {
+            t.Errorf("parseRequest(%q)\n got %+v\nwant %+v", tt.msg, *got, tt.want)
+        }
+    }
+}
+
+func TestRequestArgs(t *testing.T) {
+    r, _ := parseRequest("CFG|DNS=8.8.8.8, 1.1.1.1,|DNS=9.9.9.9|APPLY=Yes|HIDDEN=0")
+    if got, want := r.args("DNS"), []string{"8.8.8.8", "1.1.1.1", "9.9.9.9"}; !reflect.DeepEqual(got, want) {
+        t.Errorf("args(DNS) = %q, want %q", got, want)
+    }
+    if got := r.arg("DNS"); got != "8.8.8.8, 1.1.1.1," { t.Errorf("arg(DNS) = %q", got) }
+    if got := r.arg("IP"); got != "" { t.Errorf("arg(IP) = %q, want empty", got) }
+    if !r.flag("APPLY") || r.flag("HIDDEN") || r.flag("IP") { t.Errorf("flags: APPLY=%v HIDDEN=%v IP=%v", r.flag("APPLY"), r.flag("HIDDEN"), r.flag("IP")) }
+}
+
+func TestCanonical(t *testing.T) {
+    tests := []struct {
+        req  request
+        want string
+    }{
+        {request{Cmd: "TF"}, "TF|REQ=|TS="},
+        {request{Cmd: "RESTART", TS: "1700000000"}, "RESTART|REQ=|TS=1700000000"},
+        {request{Cmd: "CFG", Req: "ab", TS: "1700000000", Args: map[string][]string{"IP": {"10.0.0.5"}, "DNS": {"8.8.8.8", "1.1.1.1"}}},
+            "CFG|DNS=8.8.8.8,1.1.1.1|IP=10.0.0.5|REQ=ab|TS=1700000000"},
+        {request{Cmd: "CFG", Args: map[string][]string{"NTP": {}, "B": {"2"}, "A": {"1"}}}, "CFG|A=1|B=2|NTP=|REQ=|TS="},
+        // separators inside keys and values are escaped, so they cannot stand in for other fields
+        {request{Cmd: "CFG", TS: "1700000000", Args: map[string][]string{"ID": {"X|IP=10.0.0.5|REQ=ab"}}},
+            `CFG|ID=X\|IP\=10.0.0.5\|REQ\=ab|REQ=|TS=1700000000`},
+        {request{Cmd: "CFG", Args: map[string][]string{"DNS": {"8.8.8.8,1.1.1.1"}, `A\`: {"="}}}, `CFG|A\\=\=|DNS=8.8.8.8\,1.1.1.1|REQ=|TS=`},
+        {request{Cmd: "CFG", Req: "ab", Args: map[string][]string{"REQ": {"cd"}}}, "CFG|REQ=cd|REQ=ab|TS="},
+    }
+    for _, tt := range tests {
+        if got := tt.req.canonical(); got != tt.want { t.Errorf("canonical() = %q, want %q", got, tt.want) }
+    }
+}
+
+func TestResponseEncode(t *testing.T) {
+    r := newResponse("CFG_ACK").set("ID", "0190-A3F2").list("DNS", []string{"8.8.8.8", "1.1.1.1"}).flag("NET_ACK")
+    text, _ := parseRequest("CFG|REQ=ab|TS=1700000000")
+    if got, want := r.encode(text), "CFG_ACK|ID=0190-A3F2|DNS=8.8.8.8,1.1.1.1|NET_ACK|REQ=ab|TS=1700000000"; got != want {
+        t.Errorf("text reply = %q, want %q", got, want)
+    }
+    if !r.ok() || newResponse("CFG_NACK").ok() || newResponse("UNKNOWN_CMD").ok() { t.Error("ok() does not follow the status") }
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Request correlation and replay protection.
+// Clients may add REQ=<id> and TS=<unix seconds> to any request; the server echoes
+// both in its response (see response.encode). For mutating commands (CFG, RESTART)
+// a REQ seen within replayWindow is rejected with REPLAY_NACK|ERR=DUP_REQ, and a TS
+// further than half the window from local time is rejected with REPLAY_NACK|ERR=STALE_TS.
+
+// replayWindow covers the full auth skew range in both directions.
+const replayWindow = 2 * authMaxSkew
+
+// replayMaxEntries bounds memory; the oldest entry is evicted when full.
+const replayMaxEntries = 4096
+
+type replayCache struct {
+    mu     sync.Mutex
+    window time.Duration
+    seen   map[string]time.Time
+}
+
+func newReplayCache(window time.Duration) *replayCache {
+    return &replayCache{window: window, seen: map[string]time.Time{}}
+}
+
+// check records id and reports whether it is new (not seen within the window).
+func (c *replayCache) check(id string, now time.Time) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for k, t := range c.seen {
+        if now.Sub(t) > c.window { delete(c.seen, k) }
+    }
+    if t, ok := c.seen[id]; ok && now.Sub(t) <= c.window {
+        return false
+    }
+    if len(c.seen) >= replayMaxEntries {
+        var oldestK string
+        var oldestT time.Time
+        for k, t := range c.seen {
+            if oldestK == "" || t.Before(oldestT) { oldestK, oldestT = k, t }
+        }
+        delete(c.seen, oldestK)
+    }
+    c.seen[id] = now
+    return true
+}
+
+// checkReplay validates REQ/TS of a mutating request. It returns an empty string when
+// accepted, otherwise a reason for REPLAY_NACK|ERR=<reason>. Requests without REQ pass.
+func (c *replayCache) checkReplay(req *request, now time.Time) string {
+    if req.TS != "" {
+        if v, err := strconv.ParseInt(req.TS, 10, 64); err == nil {
+            skew := now.Sub(time.Unix(v, 0))
+            if skew < 0 { skew = -skew }
+            if skew > c.window/2 {
+                return "STALE_TS"
+            }
+        }
+    }
+    if req.Req == "" {
+        return ""
+    }
+    if !c.check(req.Req, now) {
+        return "DUP_REQ"
+    }
+    return ""
+}
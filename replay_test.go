@@ -0,0 +1,69 @@
+package main
+
+import (
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestReplayCacheCheck(t *testing.T) {
+    c := newReplayCache(10 * time.Minute)
+    t0 := time.Unix(1700000000, 0)
+    steps := []struct {
+        id    string
+        after time.Duration
+        want  bool
+    }{
+        {"a", 0, true},
+        {"a", time.Minute, false},
+        {"b", time.Minute, true},
+        {"a", 10 * time.Minute, false}, // still inside the window of the first use
+        {"a", 10*time.Minute + time.Second, true},
+        {"a", 11 * time.Minute, false},
+        {"b", 11*time.Minute + time.Second, true},
+    }
+    for i, s := range steps {
+        if got := c.check(s.id, t0.Add(s.after)); got != s.want {
+            t.Errorf("step %d: check(%q, +%v) = %v, want %v", i, s.id, s.after, got, s.want)
+        }
+    }
+}
+
+func TestReplayCacheBounded(t *testing.T) {
+    c := newReplayCache(time.Hour)
+    t0 := time.Unix(1700000000, 0)
+    for i := 0; i < replayMaxEntries+10; i++ {
+        c.check("id"+strconv.Itoa(i), t0.Add(time.Duration(i)*time.Millisecond))
+    }
+    if n := len(c.seen); n != replayMaxEntries { t.Errorf("%d entries, want %d", n, replayMaxEntries) }
+    now := t0.Add(time.Second * 10)
+    if !c.check("id0", now) { t.Error("oldest entry was not evicted") }
+    if c.check("id"+strconv.Itoa(replayMaxEntries+9), now) { t.Error("newest entry was evicted") }
+}
+
+func TestCheckReplay(t *testing.T) {
+    now := time.Unix(1700000000, 0)
+    ts := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).Unix(), 10) }
+    c := newReplayCache(replayWindow)
+    tests := []struct {
+        req  request
+        want string
+    }{
+        {request{Cmd: "CFG"}, ""},
+        {request{Cmd: "CFG"}, ""},
+        {request{Cmd: "CFG", Req: "r1", TS: ts(0)}, ""},
+        {request{Cmd: "CFG", Req: "r1", TS: ts(time.Second)}, "DUP_REQ"},
+        {request{Cmd: "CFG", Req: "r2"}, ""},
+        {request{Cmd: "CFG", Req: "r3", TS: ts(-replayWindow/2 - time.Second)}, "STALE_TS"},
+        {request{Cmd: "CFG", Req: "r3", TS: ts(replayWindow/2 + time.Second)}, "STALE_TS"},
+        {request{Cmd: "CFG", Req: "r3", TS: ts(replayWindow / 2)}, ""},
+        {request{Cmd: "CFG", TS: ts(-time.Hour)}, "STALE_TS"},
+        // a TS that is not a number is left to checkAuth
+        {request{Cmd: "CFG", Req: "r4", TS: "soon"}, ""},
+    }
+    for i, tt := range tests {
+        if got := c.checkReplay(&tt.req, now); got != tt.want {
+            t.Errorf("%d: checkReplay(REQ=%q TS=%q) = %q, want %q", i, tt.req.Req, tt.req.TS, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,23 @@
+//go:build linux
+
+package main
+
+import (
+    "syscall"
+
+    "golang.org/x/sys/unix"
+)
+
+// reuseAddrPort lets the mDNS socket share UDP 5353 with other responders (e.g. avahi-daemon).
+// Used as net.ListenConfig.Control.
+func reuseAddrPort(network, address string, c syscall.RawConn) error {
+    var serr error
+    err := c.Control(func(fd uintptr) {
+        if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); serr != nil { return }
+        serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+    })
+    if err != nil {
+        return err
+    }
+    return serr
+}
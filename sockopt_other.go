@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// reuseAddrPort is a no-op outside Linux; the mDNS socket then needs 5353 to itself.
+func reuseAddrPort(network, address string, c syscall.RawConn) error {
+    return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// systemd integration:
+// - sdNotify sends READY/STOPPING/WATCHDOG/STATUS messages to $NOTIFY_SOCKET (Type=notify units).
+//   Without NOTIFY_SOCKET it is a no-op, so any unixgram socket can stand in for systemd in tests.
+// - runWatchdog pings WATCHDOG=1 at half of $WATCHDOG_USEC when the unit sets WatchdogSec=.
+// - "udp-server install" writes a unit file for the running binary.
+
+// sdNotify sends state (e.g. "READY=1") to the socket named by $NOTIFY_SOCKET.
+// It reports whether a message was sent; an unset NOTIFY_SOCKET is not an error.
+func sdNotify(state string) (bool, error) {
+    name := os.Getenv("NOTIFY_SOCKET")
+    if name == "" {
+        return false, nil
+    }
+    // '@' denotes a Linux abstract socket
+    if strings.HasPrefix(name, "@") {
+        name = "\x00" + name[1:]
+    }
+    conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+    if err != nil {
+        return false, err
+    }
+    defer conn.Close()
+    if _, err := conn.Write([]byte(state)); err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// notify is sdNotify with errors logged instead of returned.
+func notify(state string) {
+    if _, err := sdNotify(state); err != nil {
+        log.Printf("sd_notify %q error: %v", state, err)
+    }
+}
+
+// watchdogInterval returns the watchdog timeout from $WATCHDOG_USEC, or 0 when disabled
+// or when $WATCHDOG_PID names another process.
+func watchdogInterval() time.Duration {
+    if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+        return 0
+    }
+    usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+    if err != nil || usec <= 0 {
+        return 0
+    }
+    return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog sends WATCHDOG=1 every timeout/2 until ctx is done.
+func runWatchdog(ctx context.Context, timeout time.Duration) {
+    t := time.NewTicker(timeout / 2)
+    defer t.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+            notify("WATCHDOG=1")
+        }
+    }
+}
+
+const unitTemplate = `[Unit]
+Description=Device discovery and configuration responder (UDP %s)
+After=network.target
+Wants=network.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart=%s
+Restart=always
+RestartSec=2
+WatchdogSec=%d
+TimeoutStopSec=10
+%s
+[Install]
+WantedBy=multi-user.target
+`
+
+// installUnit implements "udp-server install [-dir D] [-name N] [-port P] [-config F] [-watchdog S]":
+// it writes <dir>/<name>.service pointing ExecStart at this binary.
+func installUnit(args []string) error {
+    fs := flag.NewFlagSet("install", flag.ContinueOnError)
+    dir := fs.String("dir", "/etc/systemd/system", "unit directory")
+    name := fs.String("name", "udp-server", "unit name (without .service)")
+    port := fs.String("port", "", "UDP port written as Environment=UDP_PORT (empty: default)")
+    config := fs.String("config", "", "config file passed to ExecStart as -config (empty: default)")
+    watchdog := fs.Int("watchdog", 30, "WatchdogSec for the unit (seconds)")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+    exe, err := os.Executable()
+    if err != nil {
+        return err
+    }
+    if exe, err = filepath.Abs(exe); err != nil {
+        return err
+    }
+    if *config != "" {
+        abs, err := filepath.Abs(*config)
+        if err != nil {
+            return err
+        }
+        exe += " -config " + abs
+    }
+    env := ""
+    shownPort := "60000"
+    if *port != "" {
+        env = "Environment=UDP_PORT=" + *port + "\n"
+        shownPort = *port
+    }
+    unit := fmt.Sprintf(unitTemplate, shownPort, exe, *watchdog, env)
+    path := filepath.Join(*dir, *name+".service")
+    if err := os.WriteFile(path, []byte(unit), 0o644); err != nil {
+        return err
+    }
+    fmt.Printf("wrote %s\nenable with: systemctl daemon-reload && systemctl enable --now %s\n", path, *name)
+    return nil
+}
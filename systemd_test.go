@@ -0,0 +1,100 @@
+package main
+
+import (
+    "context"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "testing"
+    "time"
+)
+
+// listenNotify opens a unixgram socket standing in for systemd and points NOTIFY_SOCKET at it.
+func listenNotify(t *testing.T, name string) *net.UnixConn {
+    t.Helper()
+    addr := name
+    if addr[0] == '@' { addr = "\x00" + addr[1:] }
+    conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+    if err != nil { t.Fatal(err) }
+    t.Cleanup(func() { conn.Close() })
+    t.Setenv("NOTIFY_SOCKET", name)
+    return conn
+}
+
+// readNotify returns the next message on conn, failing the test after a second.
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+    t.Helper()
+    buf := make([]byte, 256)
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    n, err := conn.Read(buf)
+    if err != nil { t.Fatalf("no notification: %v", err) }
+    return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+    conn := listenNotify(t, filepath.Join(t.TempDir(), "notify"))
+    for _, state := range []string{"READY=1", "STATUS=listening on :5001", "STOPPING=1"} {
+        sent, err := sdNotify(state)
+        if !sent || err != nil { t.Fatalf("sdNotify(%q) = %v, %v", state, sent, err) }
+        if got := readNotify(t, conn); got != state { t.Errorf("got %q, want %q", got, state) }
+    }
+}
+
+func TestSdNotifyAbstract(t *testing.T) {
+    conn := listenNotify(t, "@config_m-test-"+strconv.Itoa(os.Getpid()))
+    if sent, err := sdNotify("READY=1"); !sent || err != nil { t.Fatalf("sdNotify = %v, %v", sent, err) }
+    if got := readNotify(t, conn); got != "READY=1" { t.Errorf("got %q", got) }
+}
+
+func TestSdNotifyUnset(t *testing.T) {
+    t.Setenv("NOTIFY_SOCKET", "")
+    if sent, err := sdNotify("READY=1"); sent || err != nil { t.Errorf("sdNotify without socket = %v, %v", sent, err) }
+}
+
+func TestSdNotifyNoListener(t *testing.T) {
+    t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+    if sent, err := sdNotify("READY=1"); sent || err == nil { t.Errorf("sdNotify to missing socket = %v, %v", sent, err) }
+}
+
+func TestWatchdogInterval(t *testing.T) {
+    self := strconv.Itoa(os.Getpid())
+    tests := []struct {
+        usec, pid string
+        want      time.Duration
+    }{
+        {"", "", 0},
+        {"20000000", "", 20 * time.Second},
+        {"20000000", self, 20 * time.Second},
+        {"20000000", "1", 0},
+        {"0", "", 0},
+        {"-5", "", 0},
+        {"soon", "", 0},
+    }
+    for _, tt := range tests {
+        t.Setenv("WATCHDOG_USEC", tt.usec)
+        t.Setenv("WATCHDOG_PID", tt.pid)
+        if got := watchdogInterval(); got != tt.want {
+            t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: %v, want %v", tt.usec, tt.pid, got, tt.want)
+        }
+    }
+}
+
+func TestRunWatchdog(t *testing.T) {
+    conn := listenNotify(t, filepath.Join(t.TempDir(), "notify"))
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan struct{})
+    go func() {
+        runWatchdog(ctx, 40*time.Millisecond)
+        close(done)
+    }()
+    for i := 0; i < 2; i++ {
+        if got := readNotify(t, conn); got != "WATCHDOG=1" { t.Errorf("got %q, want WATCHDOG=1", got) }
+    }
+    cancel()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("runWatchdog did not return after cancel")
+    }
+}
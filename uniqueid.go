@@ -0,0 +1,126 @@
+package main
+
+import (
+    "bufio"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Unique ID strategies.
+// The ID file (id_file) is created on first use by the rule id_strategy (ID_STRATEGY) selects:
+//   timestamp   current Unix time in milliseconds, e.g. 0190-A3F2-1C4B (default; boards first
+//               booted in the same millisecond, as on a flashing rig, get the same ID)
+//   machine-id  first 16 hex digits of /etc/machine-id (unique only if every image regenerates it)
+//   mac         MAC address of the primary interface, e.g. DCA6-32AB-CDEF
+//   cpu-serial  Serial of /proc/cpuinfo (Raspberry Pi and other ARM boards)
+// The hardware-derived ones yield the same ID again when the ID file is wiped. When the source is
+// missing the timestamp rule is used. IDs are upper-case hex in groups of four separated by '-'.
+// ID_REGEN (cmd_discovery.go) replaces the ID file explicitly.
+
+const (
+    idTimestamp = "timestamp"
+    idMachineID = "machine-id"
+    idMAC       = "mac"
+    idCPUSerial = "cpu-serial"
+)
+
+// idStrategies are the valid id_strategy values.
+var idStrategies = []string{idTimestamp, idMachineID, idMAC, idCPUSerial}
+
+// Sources of the hardware-derived IDs.
+var (
+    machineIDFile = "/etc/machine-id"
+    cpuInfoFile   = "/proc/cpuinfo"
+)
+
+var (
+    errBadStrategy = errors.New("BAD_STRATEGY")
+    errNoIDSource  = errors.New("NO_SOURCE")
+)
+
+// idFromStrategy derives an ID by strategy; errNoIDSource when its source is missing or unusable.
+func idFromStrategy(strategy string) (string, error) {
+    switch strategy {
+    case idTimestamp:
+        return timestampID(), nil
+    case idMachineID:
+        b, err := os.ReadFile(machineIDFile)
+        v := strings.TrimSpace(string(b))
+        if err != nil || len(v) < 16 || !isHex(v[:16]) { return "", errNoIDSource }
+        return formatID(v[:16]), nil
+    case idMAC:
+        mac := primaryMAC()
+        if mac == nil { return "", errNoIDSource }
+        return formatID(hex.EncodeToString(mac)), nil
+    case idCPUSerial:
+        s := cpuSerial()
+        if s == "" { return "", errNoIDSource }
+        return formatID(s), nil
+    }
+    return "", errBadStrategy
+}
+
+// timestampID is the original rule: current timestamp -> hex uppercase, prefixed with '0'.
+func timestampID() string {
+    return formatID("0" + strconv.FormatInt(time.Now().UnixMilli(), 16))
+}
+
+// formatID upper-cases hex digits and inserts '-' every 4 characters.
+func formatID(digits string) string {
+    digits = strings.ToUpper(digits)
+    var sb strings.Builder
+    for i := 0; i < len(digits); i += 4 {
+        end := i + 4
+        if end > len(digits) { end = len(digits) }
+        sb.WriteString(digits[i:end])
+        if end < len(digits) { sb.WriteByte('-') }
+    }
+    return sb.String()
+}
+
+// primaryMAC returns the MAC address of defaultIface, else of the first interface with a globally
+// unique one; locally administered (random or virtual) addresses are skipped.
+func primaryMAC() net.HardwareAddr {
+    usable := func(ifi *net.Interface) bool {
+        m := ifi.HardwareAddr
+        return ifi.Flags&net.FlagLoopback == 0 && len(m) == 6 && m[0]&0x02 == 0 && m.String() != "00:00:00:00:00:00"
+    }
+    if ifi, err := net.InterfaceByName(defaultIface()); err == nil && usable(ifi) { return ifi.HardwareAddr }
+    ifaces, _ := net.Interfaces()
+    for i := range ifaces {
+        if usable(&ifaces[i]) { return ifaces[i].HardwareAddr }
+    }
+    return nil
+}
+
+// cpuSerial returns the "Serial" line of /proc/cpuinfo, "" when absent or all zeros.
+func cpuSerial() string {
+    f, err := os.Open(cpuInfoFile)
+    if err != nil { return "" }
+    defer f.Close()
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        k, v, ok := strings.Cut(sc.Text(), ":")
+        if !ok || !strings.EqualFold(strings.TrimSpace(k), "Serial") { continue }
+        v = strings.TrimSpace(v)
+        if v == "" || strings.Trim(v, "0") == "" || !isHex(v) { return "" }
+        return v
+    }
+    return ""
+}
+
+// instanceID identifies this server process in discovery (INST=): a device answering a scan on
+// several addresses reports the same value, two devices that share an ID report different ones.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+    b := make([]byte, 4)
+    if _, err := rand.Read(b); err != nil { return strconv.FormatInt(time.Now().UnixNano(), 16) }
+    return hex.EncodeToString(b)
+}
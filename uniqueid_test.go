@@ -0,0 +1,101 @@
+package main
+
+import (
+    "path/filepath"
+    "regexp"
+    "testing"
+)
+
+func TestFormatID(t *testing.T) {
+    tests := map[string]string{
+        "0190a3f21c4b":     "0190-A3F2-1C4B",
+        "dca632abcdef":     "DCA6-32AB-CDEF",
+        "00000000abcdef12": "0000-0000-ABCD-EF12",
+        "12345":            "1234-5",
+        "":                 "",
+    }
+    for in, want := range tests {
+        if got := formatID(in); got != want { t.Errorf("formatID(%q) = %q, want %q", in, got, want) }
+    }
+    if id := timestampID(); !regexp.MustCompile(`^0[0-9A-F]{3}(-[0-9A-F]{4}){2}$`).MatchString(id) {
+        t.Errorf("timestampID() = %q", id)
+    }
+}
+
+// idSources points the machine-id and cpuinfo sources at files with the given content ("" for
+// a missing file).
+func idSources(t *testing.T, machineID, cpuInfo string) {
+    t.Helper()
+    dir := t.TempDir()
+    savedMachine, savedCPU := machineIDFile, cpuInfoFile
+    t.Cleanup(func() { machineIDFile, cpuInfoFile = savedMachine, savedCPU })
+    machineIDFile, cpuInfoFile = filepath.Join(dir, "machine-id"), filepath.Join(dir, "cpuinfo")
+    if machineID != "" { writeTestFile(t, machineIDFile, machineID) }
+    if cpuInfo != "" { writeTestFile(t, cpuInfoFile, cpuInfo) }
+}
+
+func TestIDFromStrategy(t *testing.T) {
+    tests := []struct {
+        name, machineID, cpuInfo, strategy, want string
+        err                                      error
+    }{
+        {"machine-id", "8f3a0c2d9e4b4f6a8c1d2e3f4a5b6c7d\n", "", idMachineID, "8F3A-0C2D-9E4B-4F6A", nil},
+        {"machine-id short", "8f3a0c2d\n", "", idMachineID, "", errNoIDSource},
+        {"machine-id not hex", "uninitialized\n", "", idMachineID, "", errNoIDSource},
+        {"machine-id missing", "", "", idMachineID, "", errNoIDSource},
+        {"cpu-serial", "", "processor\t: 0\nHardware\t: BCM2835\nSerial\t\t: 00000000abcdef12\nModel\t: Raspberry Pi 4\n", idCPUSerial, "0000-0000-ABCD-EF12", nil},
+        {"cpu-serial zero", "", "Serial\t\t: 0000000000000000\n", idCPUSerial, "", errNoIDSource},
+        {"cpu-serial absent", "", "processor\t: 0\nvendor_id\t: GenuineIntel\n", idCPUSerial, "", errNoIDSource},
+        {"unknown", "", "", "random", "", errBadStrategy},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            idSources(t, tt.machineID, tt.cpuInfo)
+            got, err := idFromStrategy(tt.strategy)
+            if got != tt.want || err != tt.err { t.Errorf("idFromStrategy(%s) = %q, %v, want %q, %v", tt.strategy, got, err, tt.want, tt.err) }
+        })
+    }
+}
+
+func TestGenerateUniqueIDFallback(t *testing.T) {
+    idSources(t, "", "")
+    saved := settings
+    t.Cleanup(func() { settings = saved })
+    settings.IDStrategy = idMachineID
+    if id, strategy := generateUniqueID(); strategy != idTimestamp || id == "" {
+        t.Errorf("generateUniqueID() = %q, %q, want a timestamp ID", id, strategy)
+    }
+}
+
+func TestUniqueIDFiles(t *testing.T) {
+    idSources(t, "8f3a0c2d9e4b4f6a8c1d2e3f4a5b6c7d\n", "Serial\t\t: 00000000abcdef12\n")
+    dir := t.TempDir()
+    saved := settings
+    t.Cleanup(func() { settings = saved })
+    settings.IDFile = filepath.Join(dir, "unique_ID")
+    settings.HostnameFile = filepath.Join(dir, "hostname")
+    settings.HostsFile = filepath.Join(dir, "hosts")
+    settings.IDStrategy = idMachineID
+
+    // first start: the ID is created and names the host
+    id, err := ensureUniqueID()
+    if id != "8F3A-0C2D-9E4B-4F6A" || err != nil { t.Fatalf("ensureUniqueID() = %q, %v", id, err) }
+    if got := readTestFile(t, settings.HostnameFile); got != "Kan-8F3A-0C2D-9E4B-4F6A\n" { t.Errorf("hostname = %q", got) }
+    if id, _ := ensureUniqueID(); id != "8F3A-0C2D-9E4B-4F6A" { t.Errorf("second ensureUniqueID() = %q", id) }
+
+    // a default hostname follows a new ID
+    old, id, err := regenerateUniqueID(idCPUSerial)
+    if old != "8F3A-0C2D-9E4B-4F6A" || id != "0000-0000-ABCD-EF12" || err != nil { t.Fatalf("regenerateUniqueID() = %q, %q, %v", old, id, err) }
+    if got := readTestFile(t, settings.IDFile); got != id { t.Errorf("ID file = %q", got) }
+    if got := readTestFile(t, settings.HostnameFile); got != "Kan-0000-0000-ABCD-EF12\n" { t.Errorf("hostname = %q", got) }
+
+    // a hostname set by hand is kept
+    if err := writeHostname("cam01"); err != nil { t.Fatal(err) }
+    if _, _, err := regenerateUniqueID(idMachineID); err != nil { t.Fatal(err) }
+    if got := readTestFile(t, settings.IDFile); got != "8F3A-0C2D-9E4B-4F6A" { t.Errorf("ID file = %q", got) }
+    if got := readTestFile(t, settings.HostnameFile); got != "cam01\n" { t.Errorf("hostname = %q, want cam01 kept", got) }
+
+    // an unusable strategy leaves the ID alone
+    if _, _, err := regenerateUniqueID("random"); err != errBadStrategy { t.Errorf("err = %v, want %v", err, errBadStrategy) }
+    if got := readTestFile(t, settings.IDFile); got != "8F3A-0C2D-9E4B-4F6A" { t.Errorf("ID file changed to %q", got) }
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+    "log"
+    "net"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Concurrent request processing.
+// The read loop only copies each datagram into a bounded queue; a fixed number of
+// workers parse, dispatch and reply. Commands that mutate state (Auth commands such
+// as CFG and RESTART) are serialized by dispatch, so a slow reboot or filesystem
+// write never delays discovery replies. When the queue is full, TF is dropped (the
+// client rescans) and every other request is answered with BUSY_NACK.
+
+const (
+    defaultWorkers   = 4
+    defaultQueueSize = 64
+)
+
+// packet is one received datagram awaiting processing.
+type packet struct {
+    data     []byte
+    conn     net.PacketConn // socket the datagram arrived on; the reply is sent through it
+    from     net.Addr
+    dst      net.IP // destination address, nil when control messages are unavailable
+    ifIndex  int    // receiving interface, 0 when unknown
+    received time.Time
+}
+
+type workerPool struct {
+    queue chan packet
+    wg    sync.WaitGroup
+}
+
+// newWorkerPool starts workers goroutines answering queued packets.
+func newWorkerPool(workers, queueSize int) *workerPool {
+    if workers < 1 { workers = 1 }
+    if queueSize < 1 { queueSize = 1 }
+    p := &workerPool{queue: make(chan packet, queueSize)}
+    for i := 0; i < workers; i++ {
+        p.wg.Add(1)
+        go func() {
+            defer p.wg.Done()
+            for pkt := range p.queue {
+                p.handle(pkt)
+            }
+        }()
+    }
+    return p
+}
+
+// stop closes the queue and waits up to timeout for queued and in-flight packets.
+// It reports whether all workers finished. submit must not be called afterwards.
+func (p *workerPool) stop(timeout time.Duration) bool {
+    close(p.queue)
+    done := make(chan struct{})
+    go func() {
+        p.wg.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return true
+    case <-time.After(timeout):
+        return false
+    }
+}
+
+// submit queues pkt without blocking; when the queue is full it drops or rejects it.
+func (p *workerPool) submit(pkt packet) {
+    select {
+    case p.queue <- pkt:
+    default:
+        p.reject(pkt)
+    }
+}
+
+// reject answers a packet that could not be queued: TF (and requests for other devices, see
+// forOtherDevice) is dropped silently, others get BUSY_NACK.
+func (p *workerPool) reject(pkt packet) {
+    req, _ := parseRequest(strings.TrimSpace(string(pkt.data)))
+    if req.Cmd == "TF" || forOtherDevice(req) {
+        warnf("queue full (%d), dropped %s from %s", cap(p.queue), req.Cmd, pkt.from)
+        return
+    }
+    warnf("queue full (%d), busy reply to %s", cap(p.queue), pkt.from)
+    out := newResponse("BUSY_NACK").encode(req)
+    if _, err := pkt.conn.WriteTo([]byte(out), pkt.from); err != nil {
+        log.Printf("write error to %s: %v", pkt.from, err)
+    }
+}
+
+// handle parses and dispatches one packet, writes the reply and logs the latency.
+func (p *workerPool) handle(pkt packet) {
+    msg := strings.TrimSpace(string(pkt.data))
+    debugf("received from %s: %q", pkt.from, msg)
+
+    // Accept both v1 text (CMD|K=V...) and v2 JSON ({"v":2,...}); see protocol.go
+    req, perr := parseRequest(msg)
+    req.Via = arrivalPath(pkt.dst)
+    if pkt.dst != nil { req.Dst = pkt.dst.String() }
+    var resp *response
+    if perr != nil {
+        resp = newResponse("BAD_REQUEST").set("ERR", perr.Error())
+    } else {
+        resp = dispatch(req)
+    }
+    if resp == nil {
+        debugf("ignored %s from %s: TARGET=%s is another device", req.Cmd, pkt.from, req.arg("TARGET"))
+        return
+    }
+    out := resp.encode(req)
+
+    // Clients on another subnet may not get the unicast reply (see bcastreply.go)
+    bcast := settings.BcastReply && offSubnet(pkt.from)
+    if bcast { sendBroadcastReply(pkt, resp, req) }
+    if _, err := pkt.conn.WriteTo([]byte(out), pkt.from); err != nil {
+        if !bcast { log.Printf("write error to %s: %v", pkt.from, err) }
+        return
+    }
+    infof("responded to %s: %q (%s in %v, queue %d/%d)", pkt.from, out, req.Cmd, time.Since(pkt.received).Round(time.Microsecond), len(p.queue), cap(p.queue))
+}
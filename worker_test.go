@@ -0,0 +1,65 @@
+package main
+
+import (
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+// TestWorkerPoolBusy fills a pool of one worker and a queue of one with a blocking command:
+// further requests are answered with BUSY_NACK at once, TF is dropped.
+func TestWorkerPoolBusy(t *testing.T) {
+    started, release := make(chan struct{}, 2), make(chan struct{})
+    savedCommands := commands
+    t.Cleanup(func() {
+        commands = savedCommands
+        delete(commandIndex, "TEST_BLOCK")
+    })
+    registerCommand(&command{Name: "TEST_BLOCK", Handle: func(req *request) *response {
+        started <- struct{}{}
+        <-release
+        return newResponse("TEST_BLOCK_ACK")
+    }})
+
+    server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    defer server.Close()
+    client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    defer client.Close()
+    submit := func(p *workerPool, msg string) {
+        p.submit(packet{data: []byte(msg), conn: server, from: client.LocalAddr(), received: time.Now()})
+    }
+    read := func() string {
+        t.Helper()
+        buf := make([]byte, 2048)
+        client.SetReadDeadline(time.Now().Add(time.Second))
+        n, _, err := client.ReadFrom(buf)
+        if err != nil { t.Fatalf("no reply: %v", err) }
+        return string(buf[:n])
+    }
+
+    p := newWorkerPool(1, 1)
+    submit(p, "TEST_BLOCK|REQ=r1")
+    <-started // the worker is busy with r1
+    submit(p, "TEST_BLOCK|REQ=r2")
+    // the queue holds r2: nothing else fits
+    submit(p, "TF|REQ=r3")
+    submit(p, "GET_ID|REQ=r4")
+    submit(p, `{"v":2,"cmd":"get_id","req":"r5"}`)
+    if got := read(); got != "BUSY_NACK|REQ=r4" { t.Errorf("reply = %q, want BUSY_NACK|REQ=r4", got) }
+    if got := read(); !strings.Contains(got, `"cmd":"busy_nack"`) || !strings.Contains(got, `"req":"r5"`) || !strings.Contains(got, `"ok":false`) {
+        t.Errorf("reply = %q, want a JSON busy_nack for r5", got)
+    }
+
+    close(release)
+    for _, want := range []string{"TEST_BLOCK_ACK|REQ=r1", "TEST_BLOCK_ACK|REQ=r2"} {
+        if got := read(); got != want { t.Errorf("reply = %q, want %q", got, want) }
+    }
+    if !p.stop(time.Second) { t.Error("workers did not stop") }
+    // TF was dropped without a reply
+    buf := make([]byte, 2048)
+    client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+    if n, _, err := client.ReadFrom(buf); err == nil { t.Errorf("unexpected reply %q", buf[:n]) }
+}